@@ -1,42 +1,116 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/hmac"
-	"encoding/base64"
-	"html/template"
+	"crypto/rand"
 	"crypto/sha256"
+	_ "embed"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
+	"maps"
+	"math"
+	mathrand "math/rand/v2"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"cloud.google.com/go/datastore"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/websocket"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// PlayerStatus is the state a player's app reports alongside, or instead of, a location.
+type PlayerStatus string
+
+// Statuses accepted from the player app.
+const (
+	PlayerStatusOK          PlayerStatus = "OK"          // A location fix is included
+	PlayerStatusUnavailable PlayerStatus = "UNAVAILABLE" // The device couldn't get a fix
+	PlayerStatusDenied      PlayerStatus = "DENIED"      // The player refused location access
+	PlayerStatusPaused      PlayerStatus = "PAUSED"      // The player is taking a break
+	PlayerStatusFinished    PlayerStatus = "FINISHED"    // The player is done with the game
+)
+
+// playerStatuses lists every valid PlayerStatus.
+var playerStatuses = []PlayerStatus{PlayerStatusOK, PlayerStatusUnavailable, PlayerStatusDenied, PlayerStatusPaused, PlayerStatusFinished}
+
+// valid reports whether s is one of the known statuses.
+func (s PlayerStatus) valid() bool {
+	return slices.Contains(playerStatuses, s)
+}
+
+// active reports whether a player with this status is still taking part in the game.
+func (s PlayerStatus) active() bool {
+	return s != PlayerStatusPaused && s != PlayerStatusFinished
+}
+
 // PlayerLocation represents the data we store for each player.
 type PlayerLocation struct {
-	Lat             float64   `json:"lat,omitempty"`
-	Lng             float64   `json:"lng,omitempty"`
-	Timestamp       time.Time `json:"timestamp"`       // Server-side timestamp of the update
-	ClientTimestamp time.Time `json:"clientTimestamp"` // Client-side timestamp of the location fix or status change
-	Status          string    `json:"status"`          // e.g., "OK", "UNAVAILABLE", "DENIED"
+	Lat             float64      `json:"lat,omitempty"`
+	Lng             float64      `json:"lng,omitempty"`
+	Timestamp       time.Time    `json:"timestamp"`       // Server-side timestamp of the update
+	ClientTimestamp time.Time    `json:"clientTimestamp"` // Client-side timestamp of the location fix or status change
+	Status          PlayerStatus `json:"status"`
+	Address         string       `json:"address,omitempty" datastore:",noindex"`
+	// AddressLat and AddressLng are where Address was looked up, to decide when to refresh it.
+	AddressLat float64 `json:"-" datastore:",noindex"`
+	AddressLng float64 `json:"-" datastore:",noindex"`
+	Stale      bool    `json:"stale,omitempty"` // Set by the sweeper once the player stops reporting
+	// ClockSkewSeconds is server time minus client time, only set when it exceeds the skew threshold.
+	ClockSkewSeconds int64 `json:"clockSkewSeconds,omitempty"`
+	// SpeedMps and HeadingDeg are the movement since the previous stored fix. The heading
+	// is in degrees clockwise from north and only means something while the speed isn't 0.
+	SpeedMps   float64 `json:"speedMps" datastore:",noindex"`
+	HeadingDeg float64 `json:"headingDeg" datastore:",noindex"`
+	// Suspicious is set when getting here from the previous fix took an implausible speed,
+	// which usually means a spoofed GPS. The update is stored anyway.
+	Suspicious bool `json:"suspicious,omitempty"`
+	// DisplayName is filled in from the Player by handleGetLocations, it isn't stored here.
+	DisplayName string `json:"displayName,omitempty" datastore:"-"`
 }
 
 // LocationHistoryEntry represents a single point in a player's location history.
 type LocationHistoryEntry struct {
-	PlayerID        string    `json:"playerID"`
-	Lat             float64   `json:"lat"`
-	Lng             float64   `json:"lng"`
-	Timestamp       time.Time `json:"timestamp"`
-	ClientTimestamp time.Time `json:"clientTimestamp"`
-	Status          string    `json:"status"`
+	PlayerID        string       `json:"playerID"`
+	Lat             float64      `json:"lat"`
+	Lng             float64      `json:"lng"`
+	Timestamp       time.Time    `json:"timestamp"`
+	ClientTimestamp time.Time    `json:"clientTimestamp"`
+	Status          PlayerStatus `json:"status"`
+	Suspicious      bool         `json:"suspicious,omitempty"` // Copied from the PlayerLocation, see flagImplausibleJump
 }
 
 // PlayerMessage represents a message sent from a player to the game leads.
@@ -52,8 +126,45 @@ type PlayerMessage struct {
 type DirectMessage struct {
 	ID        int64     `json:"id" datastore:"-"`
 	PlayerID  string    `json:"playerID"`
+	SenderID  string    `json:"senderID"` // Username of the lead who sent it
 	Content   string    `json:"content" datastore:",noindex"`
 	Timestamp time.Time `json:"timestamp"`
+	// DeliveredAt is when the player app first fetched the DM, ReadAt when it was displayed.
+	DeliveredAt time.Time `json:"deliveredAt,omitempty"`
+	ReadAt      time.Time `json:"readAt,omitempty"`
+}
+
+// ArchivedMessage is a PlayerMessage or DirectMessage moved out of the live inbox.
+// The key name is "{kind}-{id}" so archiving the same message twice is harmless.
+type ArchivedMessage struct {
+	Kind       string    `json:"kind"` // "PlayerMessage" or "DirectMessage"
+	ID         int64     `json:"id"`   // The key ID the message had before archiving
+	PlayerID   string    `json:"playerID"`
+	SenderID   string    `json:"senderID,omitempty"` // Only set for direct messages
+	Content    string    `json:"content" datastore:",noindex"`
+	Timestamp  time.Time `json:"timestamp"`
+	IsRead     bool      `json:"isRead"` // For direct messages, whether ReadAt is set
+	ArchivedAt time.Time `json:"archivedAt"`
+	// DeliveredAt and ReadAt are copied from a DirectMessage, zero for player messages.
+	DeliveredAt time.Time `json:"deliveredAt,omitempty"`
+	ReadAt      time.Time `json:"readAt,omitempty"`
+}
+
+// ReadCursor remembers how far a lead has read a conversation, so they can pick up
+// where they left off in a later session. The key name is "{leadID}:{playerID}".
+type ReadCursor struct {
+	LeadID   string    `json:"leadID"`
+	PlayerID string    `json:"playerID"`
+	ReadUpTo time.Time `json:"readUpTo" datastore:",noindex"` // Messages up to this time have been read
+	Updated  time.Time `json:"updated" datastore:",noindex"`
+}
+
+// IdempotencyRecord maps a client-supplied Idempotency-Key to the message it created.
+// The key name is "{playerID}:{idempotencyKey}" so keys are scoped per player.
+type IdempotencyRecord struct {
+	PlayerID  string    `json:"playerID"`
+	MessageID int64     `json:"messageID" datastore:",noindex"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
 // TestResult stores the outcome of a player's pre-game test.
@@ -67,54 +178,280 @@ type TestResult struct {
 
 // TargetLocation represents a target location sent from a game lead to a player.
 type TargetLocation struct {
-	Lat       float64   `json:"lat"`
-	Lng       float64   `json:"lng"`
-	Timestamp time.Time `json:"timestamp"`
-	FakeHash  string    `json:"fakeHash"`
+	Lat        float64   `json:"lat"`
+	Lng        float64   `json:"lng"`
+	Timestamp  time.Time `json:"timestamp"`
+	FakeHash   string    `json:"fakeHash"`
 	IsReleased bool      `json:"isReleased"`
+	ReleaseAt  time.Time `json:"releaseAt,omitempty"` // When a scheduled target becomes visible, zero for manual release
+	ArrivedAt  time.Time `json:"arrivedAt,omitempty"` // When the player first came within the arrival radius
+	ExpiresAt  time.Time `json:"expiresAt,omitempty"` // When an unreached target disappears, zero if it never does
+	// ArrivalRadiusMeters overrides the global arrival radius for this target, 0 keeps it.
+	ArrivalRadiusMeters float64 `json:"arrivalRadiusMeters,omitempty"`
+}
+
+// released reports whether the player may see the target at the given time.
+func (t TargetLocation) released(now time.Time) bool {
+	return t.IsReleased || (!t.ReleaseAt.IsZero() && !now.Before(t.ReleaseAt))
+}
+
+// expired reports whether the target ran out of time at the given time. Expired
+// targets are treated as if they weren't there.
+func (t TargetLocation) expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+// reachedAt reports whether a player at lat/lng is within the target's arrival radius.
+func (t TargetLocation) reachedAt(lat, lng float64) bool {
+	radius := arrivalRadiusMeters
+	if t.ArrivalRadiusMeters > 0 {
+		radius = t.ArrivalRadiusMeters
+	}
+	return haversineMeters(lat, lng, t.Lat, t.Lng) <= radius
+}
+
+// Webhook is an external URL notified of game events. Payloads are signed with Secret.
+type Webhook struct {
+	URL     string    `json:"url" datastore:",noindex"`
+	Events  []string  `json:"events"`
+	Secret  string    `json:"-" datastore:",noindex"`
+	Created time.Time `json:"created"`
 }
 
 // ChatMessage is a generic struct for sending combined chat history to the frontend.
 type ChatMessage struct {
-	From      string    `json:"from"` // "player" or "lead"
-	Content   string    `json:"content"`
+	Type      string    `json:"type,omitempty"`     // Empty for stored messages, or an ephemeral event like "typing"
+	PlayerID  string    `json:"playerID,omitempty"` // Only set when messages span several conversations
+	From      string    `json:"from"`               // "player" or "lead"
+	Sender    string    `json:"sender,omitempty"`   // For lead messages, the username of the lead who sent it
+	Content   string    `json:"content,omitempty"`
 	Timestamp time.Time `json:"timestamp"`
 	IsRead    bool      `json:"isRead,omitempty"`
+	ID        int64     `json:"id,omitempty"` // The datastore key ID of a stored message
+	// Receipts for lead messages, see DirectMessage.
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+	ReadAt      *time.Time `json:"readAt,omitempty"`
+	DisplayName string     `json:"displayName,omitempty"` // On player messages, the player's display name or else their ID
+}
+
+// Ephemeral chat event types. These are only relayed over WebSockets, never stored.
+const (
+	chatEventTyping        = "typing"
+	chatEventStoppedTyping = "stopped-typing"
+)
+
+// NotificationPrefs stores which notifications a player wants. The key name is the player ID.
+type NotificationPrefs struct {
+	TargetAlerts bool `json:"targetAlerts"`
+	DMAlerts     bool `json:"dmAlerts"`
+}
+
+// Player holds per-player settings. The key name is the player ID.
+type Player struct {
+	// DefaultLat and DefaultLng are where the player is shown while they deny location
+	// access and no earlier fix is known. They're taken from the player's first fix
+	// unless a lead sets them.
+	DefaultLat   float64   `json:"defaultLat" datastore:",noindex"`
+	DefaultLng   float64   `json:"defaultLng" datastore:",noindex"`
+	DefaultSetBy string    `json:"defaultSetBy,omitempty" datastore:",noindex"` // Username of the lead who set the default, empty for a first fix
+	DisplayName  string    `json:"displayName,omitempty" datastore:",noindex"`  // Shown to leads instead of the player ID, which stays the key
+	Updated      time.Time `json:"updated"`
+}
+
+// Lead is a game lead account. The key name is the lead's username.
+type Lead struct {
+	Username     string    `json:"username"`
+	PasswordHash []byte    `json:"-" datastore:",noindex"` // bcrypt hash, never the plain password
+	Namespace    string    `json:"namespace,omitempty"`    // Game the lead runs, empty for the default game
+	Created      time.Time `json:"created"`
+}
+
+// Game records a game namespace created by a lead of the default game.
+// Stored in the default namespace, keyed by the namespace name.
+type Game struct {
+	CreatedBy string    `json:"createdBy"`
+	Created   time.Time `json:"created"`
 }
 
 // A secret key for hashing. In a real production app, this should be loaded securely.
 const hmacSecret = "a-very-secret-key-for-the-game"
 
 // --- Player ID Obfuscation ---
-const idKey = "THIS_IS_A_STATIC_32_BYTE_SECRET_KEY" // 32 bytes for AES-256
 
-// obfuscatePlayerID takes a real player ID and returns a URL-safe obfuscated string.
-func obfuscatePlayerID(playerID string) string {
-	idBytes := []byte(playerID)
-	keyBytes := []byte(idKey)
-	obfuscated := make([]byte, len(idBytes))
-	for i := 0; i < len(idBytes); i++ {
-		// XOR the player ID byte with a byte from the key, repeating the key if necessary.
-		obfuscated[i] = idBytes[i] ^ keyBytes[i%len(keyBytes)]
+// defaultIDKey obfuscates player IDs when ID_KEY isn't set.
+const defaultIDKey = "THIS_IS_A_STATIC_32_BYTE_SECRET_KEY" // 32 bytes for AES-256
+
+// idKeys obfuscate player IDs, set at startup. The first one, ID_KEY, makes new player
+// URLs. The others, from the comma-separated PREVIOUS_ID_KEYS, are only tried to read
+// URLs, so the ones handed out before a key rotation keep working.
+var idKeys = []string{defaultIDKey}
+
+// loadIDKeys reads the primary key from ID_KEY, falling back to defaultIDKey, followed
+// by the previous keys from PREVIOUS_ID_KEYS.
+func loadIDKeys() []string {
+	primary := os.Getenv("ID_KEY")
+	if primary == "" {
+		log.Printf("ID_KEY not set. Player URLs use the built-in key.")
+		primary = defaultIDKey
+	}
+	keys := []string{primary}
+	for _, key := range strings.Split(os.Getenv("PREVIOUS_ID_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" && key != primary {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// defaultIDMACKey signs player IDs when ID_MAC_KEY isn't set.
+const defaultIDMACKey = "THIS_IS_A_STATIC_PLAYER_ID_MAC_KEY"
+
+// idMACKey signs obfuscated player IDs, set at startup from ID_MAC_KEY. It must differ
+// from the idKeys: those can be recovered from any player URL, as the XOR is undone by
+// knowing a single player's ID.
+var idMACKey = defaultIDMACKey
+
+// loadIDMACKey reads the player ID signing key from ID_MAC_KEY, falling back to defaultIDMACKey.
+func loadIDMACKey() string {
+	key := os.Getenv("ID_MAC_KEY")
+	if key == "" {
+		log.Printf("ID_MAC_KEY not set. Player URLs are signed with the built-in key.")
+		return defaultIDMACKey
+	}
+	return key
+}
+
+// idTagSize is the length of the HMAC tag appended to obfuscated IDs.
+const idTagSize = 8
+
+// playerIDTag authenticates a player ID with idMACKey, so tampered or forged obfuscated
+// IDs can be told apart.
+func playerIDTag(playerID string) []byte {
+	mac := hmac.New(sha256.New, []byte(idMACKey))
+	mac.Write([]byte(playerID))
+	return mac.Sum(nil)[:idTagSize]
+}
+
+// xorWithKey XORs every byte of data with a byte from key, repeating the key if necessary.
+func xorWithKey(data []byte, key string) []byte {
+	out := make([]byte, len(data))
+	for i := range data {
+		out[i] = data[i] ^ key[i%len(key)]
 	}
+	return out
+}
+
+// obfuscatePlayerID takes a real player ID and returns a URL-safe obfuscated string,
+// made with the primary key.
+func obfuscatePlayerID(playerID string) string {
+	obfuscated := xorWithKey([]byte(playerID), idKeys[0])
+	obfuscated = append(obfuscated, playerIDTag(playerID)...)
 
 	return base64.URLEncoding.EncodeToString(obfuscated)
 }
 
 // deobfuscatePlayerID takes an obfuscated string and returns the real player ID.
+// It tries the primary key first and then the previous ones, and fails for any
+// string that obfuscatePlayerID didn't produce with one of them.
 func deobfuscatePlayerID(obfuscatedID string) (string, error) {
 	decoded, err := base64.URLEncoding.DecodeString(obfuscatedID)
-	if err != nil {
+	if err != nil || len(decoded) <= idTagSize {
 		return "", fmt.Errorf("invalid obfuscated id format")
 	}
+	decoded, tag := decoded[:len(decoded)-idTagSize], decoded[len(decoded)-idTagSize:]
+
+	for _, key := range idKeys {
+		playerID := string(xorWithKey(decoded, key))
+		if !hmac.Equal(tag, playerIDTag(playerID)) {
+			continue
+		}
+		if err := validatePlayerID(playerID); err != nil {
+			return "", err
+		}
+		return playerID, nil
+	}
+	return "", fmt.Errorf("invalid obfuscated id signature")
+}
+
+// maxPlayerIDLength caps the length of a player ID in bytes.
+const maxPlayerIDLength = 64
+
+// validatePlayerID checks that a player ID is fit to be a datastore key: non-empty,
+// at most maxPlayerIDLength bytes and printable text. Names like "Chloé D." are fine,
+// control characters and invalid UTF-8 aren't.
+func validatePlayerID(playerID string) error {
+	if playerID == "" {
+		return fmt.Errorf("player id is empty")
+	}
+	if len(playerID) > maxPlayerIDLength {
+		return fmt.Errorf("player id is longer than %d bytes", maxPlayerIDLength)
+	}
+	if !utf8.ValidString(playerID) {
+		return fmt.Errorf("player id is not valid UTF-8")
+	}
+	for _, r := range playerID {
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("player id must be printable text")
+		}
+	}
+	return nil
+}
+
+// playerAllowlist, when PLAYER_ALLOWLIST is set, holds the only player names that
+// can get a player URL.
+var playerAllowlist map[string]bool
+
+// parsePlayerAllowlist parses a comma-separated list of player names, returning nil
+// when it names nobody so that every player is allowed.
+func parsePlayerAllowlist(list string) map[string]bool {
+	var allowed map[string]bool
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if allowed == nil {
+			allowed = make(map[string]bool)
+		}
+		allowed[name] = true
+	}
+	return allowed
+}
+
+// validatePlayerName checks a name before a player URL is made for it. It must be a
+// valid player ID, and on the allowlist if one is configured.
+func validatePlayerName(name string) error {
+	if err := validatePlayerID(name); err != nil {
+		return err
+	}
+	if playerAllowlist != nil && !playerAllowlist[name] {
+		return fmt.Errorf("player %q is not on the allowlist", name)
+	}
+	return nil
+}
 
-	keyBytes := []byte(idKey)
-	deobfuscated := make([]byte, len(decoded))
-	for i := 0; i < len(decoded); i++ {
-		deobfuscated[i] = decoded[i] ^ keyBytes[i%len(keyBytes)]
+// invalidPlayerIDMessage is the 400 response for an obfuscated player ID that is
+// missing or that resolvePlayerID or deobfuscatePlayerID reject.
+const invalidPlayerIDMessage = "Invalid or missing player ID"
+
+// resolvePlayerID returns the player ID from the obfuscated ID that follows prefix in
+// a URL path like /api/messages/{obfuscatedID}. Handlers call it before touching
+// datastore, so a malformed ID gets a 400 rather than a write under a bogus key.
+func resolvePlayerID(path, prefix string) (string, error) {
+	obfuscatedID, ok := strings.CutPrefix(path, prefix)
+	if !ok {
+		return "", fmt.Errorf("path doesn't start with %s", prefix)
 	}
+	return deobfuscatePlayerID(strings.TrimSuffix(obfuscatedID, "/"))
+}
 
-	return string(deobfuscated), nil
+// resolvePlayerSubpath is resolvePlayerID for paths where suffix follows the obfuscated
+// ID, like /api/messages/{obfuscatedID}/status.
+func resolvePlayerSubpath(path, prefix, suffix string) (string, error) {
+	path, ok := strings.CutSuffix(path, suffix)
+	if !ok {
+		return "", fmt.Errorf("path doesn't end with %s", suffix)
+	}
+	return resolvePlayerID(path, prefix)
 }
 
 type ObfuscatedURLResponse struct {
@@ -123,6 +460,18 @@ type ObfuscatedURLResponse struct {
 	ObfuscatedURL string `json:"obfuscatedURL"`
 }
 
+// Page size bounds for the paginated lead inbox.
+const (
+	defaultMessagesPageSize = 50
+	maxMessagesPageSize     = 500
+)
+
+// Result count bounds for message search.
+const (
+	defaultSearchResults = 50
+	maxSearchResults     = 500
+)
+
 // Global datastore client.
 var dsClient *datastore.Client
 
@@ -138,12 +487,158 @@ func main() {
 		log.Fatal("GOOGLE_CLOUD_PROJECT environment variable must be set when not using the datastore emulator.")
 	}
 
+	arrivalRadiusMeters = float64(envInt("ARRIVAL_RADIUS_METERS", defaultArrivalRadiusMeters))
+	coordinatePrecision = envInt("COORDINATE_PRECISION", defaultCoordinatePrecision)
+	if coordinatePrecision < 0 || coordinatePrecision > maxCoordinatePrecision {
+		log.Fatalf("COORDINATE_PRECISION must be between 0 and %d.", maxCoordinatePrecision)
+	}
+	if mode := os.Getenv("FAKE_HASH_MODE"); mode != "" {
+		fakeHashMode = strings.ToLower(mode)
+	}
+	if fakeHashMode != fakeHashTimestamped && fakeHashMode != fakeHashDeterministic {
+		log.Fatalf("FAKE_HASH_MODE must be %q or %q.", fakeHashTimestamped, fakeHashDeterministic)
+	}
+	fakeHashPrecision = envInt("FAKE_HASH_PRECISION", defaultFakeHashPrecision)
+	if fakeHashPrecision < 0 || fakeHashPrecision > maxFakeHashPrecision {
+		log.Fatalf("FAKE_HASH_PRECISION must be between 0 and %d.", maxFakeHashPrecision)
+	}
+	if source := os.Getenv("LOCATION_TIME_SOURCE"); source != "" {
+		locationTimeSource = strings.ToLower(source)
+	}
+	if locationTimeSource != locationTimeServer && locationTimeSource != locationTimeClient {
+		log.Fatalf("LOCATION_TIME_SOURCE must be %q or %q.", locationTimeServer, locationTimeClient)
+	}
+	clockSkewThreshold = time.Duration(envInt("CLOCK_SKEW_SECONDS", defaultClockSkewSeconds)) * time.Second
+	presenceOnlineWindow = time.Duration(envInt("PRESENCE_ONLINE_SECONDS", defaultPresenceOnlineSeconds)) * time.Second
+	presenceIdleWindow = time.Duration(envInt("PRESENCE_IDLE_SECONDS", defaultPresenceIdleSeconds)) * time.Second
+	targetsCacheTTL = time.Duration(envInt("TARGETS_CACHE_SECONDS", defaultTargetsCacheSeconds)) * time.Second
+	locationsCacheEnabled = envBool("LOCATIONS_CACHE", true)
+	locationsCacheTTL = time.Duration(envInt("LOCATIONS_CACHE_SECONDS", defaultLocationsCacheSeconds)) * time.Second
+	maxRosterEntries = envInt("MAX_ROSTER_ENTRIES", defaultMaxRosterEntries)
+	if maxChatHistory = envInt("MAX_CHAT_HISTORY", defaultMaxChatHistory); maxChatHistory < 1 {
+		log.Fatal("MAX_CHAT_HISTORY must be a positive integer.")
+	}
+	panicCooldown = time.Duration(envInt("PANIC_COOLDOWN_SECONDS", defaultPanicCooldownSeconds)) * time.Second
+	testResultCooldown = time.Duration(envInt("TEST_RESULT_COOLDOWN_SECONDS", defaultTestResultCooldownSeconds)) * time.Second
+	maxMessagesPerWindow = envInt("MAX_MESSAGES_PER_WINDOW", defaultMaxMessagesPerWindow)
+	if messageRateWindow = time.Duration(envInt("MESSAGE_RATE_WINDOW_SECONDS", defaultMessageRateWindowSeconds)) * time.Second; messageRateWindow <= 0 {
+		log.Fatal("MESSAGE_RATE_WINDOW_SECONDS must be a positive integer.")
+	}
+	requireJSONContentType = envBool("REQUIRE_JSON_CONTENT_TYPE", true)
+	maxPlayers = envInt("MAX_PLAYERS", 0)
+	playerAllowlist = parsePlayerAllowlist(os.Getenv("PLAYER_ALLOWLIST"))
+	idKeys = loadIDKeys()
+	idMACKey = loadIDMACKey()
+	targetTTL = time.Duration(envInt("TARGET_TTL_MINUTES", 0)) * time.Minute
 	var err error
-	dsClient, err = datastore.NewClient(ctx, projectID)
+	if mapConfig, err = loadMapConfig(); err != nil {
+		log.Fatal(err)
+	}
+	features = loadFeatures()
+	minMoveMeters = float64(envInt("MIN_MOVE_METERS", defaultMinMoveMeters))
+	maxPlausibleSpeedMps = float64(envInt("MAX_PLAUSIBLE_SPEED_MPS", defaultMaxPlausibleSpeedMps))
+	devReloadTemplates = envBool("DEV_RELOAD_TEMPLATES", false)
+	if csp := os.Getenv("CONTENT_SECURITY_POLICY"); csp != "" {
+		contentSecurityPolicy = csp
+	}
+	datastoreMaxAttempts = envInt("DATASTORE_MAX_ATTEMPTS", defaultDatastoreMaxAttempts)
+	if datastoreBatchSize = envInt("DATASTORE_BATCH_SIZE", maxDatastoreBatchSize); datastoreBatchSize < 1 {
+		log.Fatal("DATASTORE_BATCH_SIZE must be a positive integer.")
+	} else if datastoreBatchSize > maxDatastoreBatchSize {
+		log.Printf("WARNING: DATASTORE_BATCH_SIZE %d is over Datastore's limit, using %d.", datastoreBatchSize, maxDatastoreBatchSize)
+		datastoreBatchSize = maxDatastoreBatchSize
+	}
+	namespaceDomain = strings.ToLower(os.Getenv("NAMESPACE_DOMAIN"))
+
+	geocodeAPIKey = os.Getenv("GEOCODE_API_KEY")
+	if geocodeAPIKey == "" {
+		log.Printf("GEOCODE_API_KEY not set. Player addresses will not be looked up.")
+	}
+
+	// Lead sessions guard the dashboard, so never fall back to a built-in key. Without
+	// one, players can still play but lead login and lead-only endpoints are disabled.
+	leadSessionKey = []byte(os.Getenv("LEAD_SESSION_KEY"))
+	if len(leadSessionKey) == 0 {
+		log.Printf("WARNING: LEAD_SESSION_KEY not set. Lead login and lead-only endpoints are disabled.")
+	}
+
+	dsClient, err = datastore.NewClient(ctx, projectID, option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(countDatastoreErrors)))
 	if err != nil {
 		log.Fatalf("Failed to create datastore client: %v", err)
 	}
 
+	// Clean up test results left over from previous games.
+	if retentionHours := envInt("TEST_RESULT_RETENTION_HOURS", defaultTestResultRetentionHours); retentionHours > 0 {
+		go func() {
+			cutoff := time.Now().Add(-time.Duration(retentionHours) * time.Hour)
+			deleted, err := sumEachNamespace(ctx, func(ctx context.Context) (int, error) { return cleanupTestResults(ctx, cutoff) })
+			if err != nil {
+				log.Printf("ERROR: Startup cleanup of test results failed: %v", err)
+				return
+			}
+			log.Printf("Startup cleanup deleted %d test results older than %d hours", deleted, retentionHours)
+		}()
+	}
+
+	// Keep the live inbox small over multi-day events.
+	if retentionHours := envInt("MESSAGE_RETENTION_HOURS", defaultMessageRetentionHours); retentionHours > 0 {
+		go func() {
+			cutoff := time.Now().Add(-time.Duration(retentionHours) * time.Hour)
+			archived, err := sumEachNamespace(ctx, func(ctx context.Context) (int, error) { return archiveMessages(ctx, cutoff) })
+			if err != nil {
+				log.Printf("ERROR: Startup archiving of messages failed: %v", err)
+				return
+			}
+			log.Printf("Startup archiving moved %d messages older than %d hours", archived, retentionHours)
+		}()
+	}
+
+	// Composite indexes aren't deployed with the app, so point out any that are missing.
+	go checkIndexes(ctx)
+
+	// DMs from before delivery receipts need the property the receipts filter on.
+	go func() {
+		updated, err := sumEachNamespace(ctx, backfillDMDelivery)
+		if err != nil {
+			log.Printf("ERROR: Startup backfill of DM delivery failed: %v", err)
+			return
+		}
+		if updated > 0 {
+			log.Printf("Startup backfill marked %d older DMs as undelivered", updated)
+		}
+	}()
+
+	// Idempotency records are only useful for a few minutes, don't let them pile up.
+	go func() {
+		deleted, err := sumEachNamespace(ctx, cleanupIdempotencyRecords)
+		if err != nil {
+			log.Printf("ERROR: Startup cleanup of idempotency records failed: %v", err)
+			return
+		}
+		log.Printf("Startup cleanup deleted %d expired idempotency records", deleted)
+	}()
+
+	// Load the location caches up front, so the first dashboard polls don't all query datastore.
+	if locationsCacheEnabled {
+		go func() {
+			err := forEachNamespace(ctx, func(ctx context.Context) error {
+				_, err := cachedPlayerLocations(ctx, true)
+				return err
+			})
+			if err != nil {
+				log.Printf("ERROR: Startup loading of the location cache failed: %v", err)
+			}
+		}()
+	}
+
+	go runWebhookWorker()
+	go runReleaseSweeper(ctx)
+
+	// The stale sweeper is off unless STALE_LOCATION_MINUTES is set.
+	if staleMinutes := envInt("STALE_LOCATION_MINUTES", 0); staleMinutes > 0 {
+		go runStaleSweeper(ctx, time.Duration(staleMinutes)*time.Minute)
+	}
+
 	// App Engine automatically sets the PORT env variable.
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -152,41 +647,217 @@ func main() {
 	}
 
 	// API handlers
-	http.HandleFunc("/gamelead", serveTemplate("static/gamelead.html"))
-	http.HandleFunc("/player/", serveTemplate("static/player.html"))
-	http.HandleFunc("/test", serveTemplate("static/test.html"))
-	http.HandleFunc("/generator", serveTemplate("static/generator.html"))
-	http.HandleFunc("/testresults", serveTemplate("static/testresults.html"))
-	http.HandleFunc("/history", serveTemplate("static/history.html"))
-
-	http.HandleFunc("/api/locations/", handleUpdateLocation) // POST /api/locations/{playerID}
-	http.HandleFunc("/api/locations", handleGetLocations)   // GET /api/locations
+	http.HandleFunc("/gamelead", securityHeaders(serveTemplate("static/gamelead.html")))
+	http.HandleFunc("/login", securityHeaders(serveTemplate("static/login.html")))
+	http.HandleFunc("/player/", securityHeaders(serveTemplate("static/player.html")))
+	http.HandleFunc("/test", securityHeaders(serveTemplate("static/test.html")))
+	http.HandleFunc("/generator", securityHeaders(serveTemplate("static/generator.html")))
+	http.HandleFunc("/testresults", securityHeaders(serveTemplate("static/testresults.html")))
+	http.HandleFunc("/history", securityHeaders(serveTemplate("static/history.html")))
+	http.HandleFunc("/static/", handleStatic) // CSS, JS and other assets that aren't templates
+
+	http.HandleFunc("/api/locations/clusters", requireLeadOrSpectator(handleGetLocationClusters)) // GET /api/locations/clusters?radius=
+	http.HandleFunc("/api/locations/near", requireLeadOrSpectator(handleGetNearbyPlayers))        // GET /api/locations/near?lat=&lng=&radius=
+	http.HandleFunc("/api/locations/bbox", requireLeadOrSpectator(handleGetLocationsInBox))       // GET /api/locations/bbox?minLat=&minLng=&maxLat=&maxLng=
+	http.HandleFunc("/api/locations/", handleUpdateLocation)                                      // POST or PATCH /api/locations/{playerID}
+	http.HandleFunc("/api/locations", requireLeadOrSpectator(handleGetLocations))                 // GET /api/locations
+	http.HandleFunc("/api/presence", requireLead(handleGetPresence))                              // GET online/idle/offline per player
+	http.HandleFunc("/api/contact", requireLead(handleGetContact))                                // GET time since each player was last heard from
+
+	// Lead authentication
+	http.HandleFunc("/api/leads/login", handleLeadLogin)        // POST to get a session cookie
+	http.HandleFunc("/api/leads/me", requireLead(handleLeadMe)) // GET the logged-in lead
+	http.HandleFunc("/api/leads", handleCreateLead)             // POST to add a lead
 
 	// Message API handlers
-	http.HandleFunc("/api/messages/read/", handleMarkMessageRead) // POST for leads
-	http.HandleFunc("/api/messages/", handlePlayerMessages)       // POST and GET for players
-	http.HandleFunc("/api/messages", handleMessages)              // GET for leads
-	http.HandleFunc("/api/dm/", handleSendDirectMessage)          // POST for leads to send DM
-	http.HandleFunc("/api/chat/", handleChatHistory)              // GET for chat history
-	http.HandleFunc("/api/target/", handleSetTargetLocation)      // POST for leads to set a target
-	http.HandleFunc("/api/targets", handleGetTargets)             // GET for all targets
-	http.HandleFunc("/api/obfuscate-url", handleObfuscateURL)     // POST to get an obfuscated URL
-	http.HandleFunc("/api/test-result", handleTestResult)         // POST for test page results
-	http.HandleFunc("/api/test-results", handleGetTestResults)    // GET for all test results
-	http.HandleFunc("/api/history", handleGetHistory)             // GET location history for a player
-	http.HandleFunc("/api/admin/load-initial-targets", handleLoadInitialTargets) // POST to load targets from file
-	http.HandleFunc("/api/admin/clear-datastore", handleClearDatastore) // Temporary admin endpoint
+	http.HandleFunc("/api/messages/read/", requireLead(handleMarkMessageRead))                // POST for leads
+	http.HandleFunc("/api/messages/search", requireLead(handleSearchMessages))                // GET for leads to search all messages
+	http.HandleFunc("/api/messages/archived", requireLead(handleGetArchivedMessages))         // GET for leads to read archived messages
+	http.HandleFunc("/api/messages/", handlePlayerMessages)                                   // POST and GET for players, GET .../status for delivery status
+	http.HandleFunc("/api/messages", requireLead(handleMessages))                             // GET for leads
+	http.HandleFunc("/api/dm/read/", handleMarkDirectMessageRead)                             // POST for players to acknowledge a DM
+	http.HandleFunc("/api/dm/", requireLead(handleSendDirectMessage))                         // POST for leads to send DM, POST .../resend to send the last one again
+	http.HandleFunc("/api/dm-with-target/", requireLead(handleDMWithTarget))                  // POST for leads to send a DM and set a target at once
+	http.HandleFunc("/api/chat/", handleChatHistory)                                          // GET for chat history, GET/PUT .../cursor for a lead's read cursor
+	http.HandleFunc("/api/chat/batch", requireLead(handleChatBatch))                          // POST to get several chat histories at once
+	http.HandleFunc("/api/chat/ws/", handleChatWebSocket)                                     // WebSocket for real-time chat
+	http.HandleFunc("/api/target/", requireLead(handleSetTargetLocation))                     // POST for leads to set a target
+	http.HandleFunc("/api/target/verify", requireLead(handleVerifyTargetHash))                // POST to look up whose target a scanned hash is
+	http.HandleFunc("/api/player/", handlePlayerState)                                        // GET /api/player/{obfuscatedID}/state for the player app
+	http.HandleFunc("/api/prefs/", handleNotificationPrefs)                                   // GET and PUT notification preferences for players
+	http.HandleFunc("/api/targets/batch", requireLead(handleBatchSetTargets))                 // POST for leads to set many targets at once
+	http.HandleFunc("/api/targets/chain/", requireLead(handleTargetChain))                    // GET, POST and reorder a player's chain of targets
+	http.HandleFunc("/api/panic/", handlePanic)                                               // POST for players to raise an emergency alert
+	http.HandleFunc("/api/alerts", requireLead(handleGetAlerts))                              // GET unresolved emergency alerts
+	http.HandleFunc("/api/arrivals/stream", requireLead(handleArrivalStream))                 // WebSocket pushing arrivals as they happen
+	http.HandleFunc("/api/alerts/", requireLead(handleResolveAlert))                          // POST /api/alerts/{id}/resolve
+	http.HandleFunc("/api/targets", requireLeadOrSpectator(handleGetTargets))                 // GET for all targets
+	http.HandleFunc("/api/obfuscate-url/batch", handleObfuscateURLBatch)                      // POST to get many obfuscated URLs
+	http.HandleFunc("/api/obfuscate-url", handleObfuscateURL)                                 // POST to get an obfuscated URL
+	http.HandleFunc("/api/qr/", handlePlayerQRCode)                                           // GET a player URL as a PNG QR code
+	http.HandleFunc("/api/test-result", handleTestResult)                                     // POST for test page results
+	http.HandleFunc("/api/test-results/summary", requireLead(handleTestResultsSummary))       // GET readiness summary of test results
+	http.HandleFunc("/api/test-results", handleGetTestResults)                                // GET for all test results
+	http.HandleFunc("/api/history", handleGetHistory)                                         // GET location history for a player
+	http.HandleFunc("/api/stats", handleGetStats)                                             // GET game-wide tallies such as arrivals
+	http.HandleFunc("/api/stats/activity", requireLead(handleActivityStats))                  // GET location updates per time bucket
+	http.HandleFunc("/api/leaderboard", handleLeaderboard)                                    // GET players ranked by arrivals or distance
+	http.HandleFunc("/api/map-config", handleMapConfig)                                       // GET the initial center and zoom of the lead map
+	http.HandleFunc("/api/features", handleFeatures)                                          // GET which features are switched on for this event
+	http.HandleFunc("/api/game-state", requireLead(handleGameState))                          // GET or PUT whether the game is paused
+	http.HandleFunc("/api/admin/pause", requireLead(handlePauseGame(true)))                   // POST to pause the game
+	http.HandleFunc("/api/admin/resume", requireLead(handlePauseGame(false)))                 // POST to resume the game
+	http.HandleFunc("/api/admin/load-initial-targets", requireLead(handleLoadInitialTargets)) // POST to load targets from file
+	http.HandleFunc("/api/admin/load-targets", requireLead(handleLoadTargets))                // POST to load an uploaded target roster
+	http.HandleFunc("/api/admin/cleanup-test-results", requireLead(handleCleanupTestResults)) // POST to delete old test results
+	http.HandleFunc("/api/admin/archive-messages", requireLead(handleArchiveMessages))        // POST to archive old messages
+	http.HandleFunc("/api/admin/sweep-stale", requireLead(handleSweepStale))                  // POST to flag stale player locations
+	http.HandleFunc("/api/admin/rename-player", requireLead(handleRenamePlayer))              // POST to move a player's data to a new name
+	http.HandleFunc("/api/admin/display-name/", requireLead(handleDisplayName))               // GET or PUT the name a player is shown by
+	http.HandleFunc("/api/admin/default-location/", requireLead(handleDefaultLocation))       // GET or PUT where a denied player is shown
+	http.HandleFunc("/api/admin/clear-datastore", requireLead(handleClearDatastore))          // POST ?confirm=true to wipe game data
+	http.HandleFunc("/api/admin/counts", requireLead(handleCounts))                           // GET the number of entities per kind
+	http.HandleFunc("/api/admin/export", requireLead(handleExport))                           // GET a JSON backup of the game
+	http.HandleFunc("/api/admin/import", requireLead(handleImport))                           // POST a backup to restore it
+	http.HandleFunc("/api/admin/webhooks", requireLead(handleRegisterWebhook))                // POST to register a webhook
+	http.HandleFunc("/api/admin/spectator-token", requireLead(handleCreateSpectatorToken))    // POST to mint a read-only map token
+	http.HandleFunc("/api/admin/games", requireLead(handleCreateGame))                        // POST to create a game namespace and its first lead
+	http.HandleFunc("/api/openapi.json", handleOpenAPISpec)                                   // GET the OpenAPI description of this API
+
+	http.Handle("/metrics", promhttp.Handler()) // Prometheus scrape endpoint
+
+	requestTimeout := time.Duration(envInt("REQUEST_TIMEOUT_SECONDS", defaultRequestTimeoutSeconds)) * time.Second
+	handler := newHandler(http.DefaultServeMux, requestTimeout)
 
 	// Start the server
 	log.Printf("Listening on http://localhost:%s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := http.ListenAndServe(":"+port, handler); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// newHandler wraps mux in the middleware every request goes through.
+func newHandler(mux http.Handler, requestTimeout time.Duration) http.Handler {
+	// The timeout must be outermost: it hands a copy of the request down, and the metrics
+	// middleware reads the pattern the ServeMux stores on that copy.
+	// The namespace middleware likewise copies the request, so it sits outside metrics too.
+	// Panics are recovered inside metrics, so they're counted as 500s.
+	handler := gzipMiddleware(gunzipMiddleware(jsonContentTypeMiddleware(namespaceMiddleware(metricsMiddleware(recoverMiddleware(spectatorMiddleware(mux)))))))
+	return timeoutMiddleware(handler, requestTimeout)
+}
+
+// envInt reads an integer setting from the environment, falling back to def
+// when it's unset or invalid.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %d", value, name, def)
+		return def
+	}
+	return n
+}
+
+// envBool reads a boolean setting from the environment, falling back to def
+// when it's unset or invalid.
+func envBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %v", value, name, def)
+		return def
+	}
+	return b
+}
+
+// envFloat reads a decimal setting from the environment, falling back to def
+// when it's unset or invalid.
+func envFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %v", value, name, def)
+		return def
+	}
+	return f
+}
+
+// decodeJSONBody decodes a request body into dst, rejecting fields dst doesn't have
+// and anything after the JSON value. The error is meant for the client and names
+// the offending field where there is one.
+func decodeJSONBody(r *http.Request, dst interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err == io.EOF {
+		return errors.New("request body is empty")
+	} else if err != nil {
+		return jsonDecodeError(err)
+	}
+	if dec.More() {
+		return errors.New("request body must be a single JSON value")
+	}
+	return nil
+}
+
+// writeJSON responds with v as JSON. Adding ?pretty=true to a request indents the
+// output by two spaces, which is easier to read when debugging.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	var body []byte
+	var err error
+	if r.URL.Query().Get("pretty") == "true" {
+		body, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		body, err = json.Marshal(v)
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to encode response for %s: %v", r.URL.Path, err)
+		http.Error(w, "Internal server error when encoding the response.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
+
+// jsonDecodeError rewrites an error from a strict json.Decoder for the client.
+func jsonDecodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return fmt.Errorf("field %q must be of type %s", typeErr.Field, typeErr.Type)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return fmt.Errorf("unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	default:
+		return errors.New("invalid JSON body")
+	}
+}
+
+// errMissingField is the error for a required field that is missing or empty.
+func errMissingField(name string) error {
+	return fmt.Errorf("field %q is required", name)
+}
+
+// devReloadTemplates makes serveTemplate parse the HTML files on every request, so
+// edits show up without a restart. Set with DEV_RELOAD_TEMPLATES for local development.
+var devReloadTemplates = false
+
 // serveTemplate is a helper function that creates an HTTP handler for serving
 // a given HTML file as a template, injecting a cache-busting version string.
 func serveTemplate(filename string) http.HandlerFunc {
+	// The template is parsed on first use and kept, unless devReloadTemplates is set.
+	var (
+		parseOnce sync.Once
+		cached    *template.Template
+		parseErr  error
+	)
 	return func(w http.ResponseWriter, r *http.Request) {
 		// GAE_VERSION is a unique identifier for each deployed version.
 		appVersion := os.Getenv("GAE_VERSION")
@@ -196,7 +867,14 @@ func serveTemplate(filename string) http.HandlerFunc {
 		}
 
 		// Parse the HTML file as a template.
-		tmpl, err := template.ParseFiles(filename)
+		var tmpl *template.Template
+		var err error
+		if devReloadTemplates {
+			tmpl, err = template.ParseFiles(filename)
+		} else {
+			parseOnce.Do(func() { cached, parseErr = template.ParseFiles(filename) })
+			tmpl, err = cached, parseErr
+		}
 		if err != nil {
 			log.Printf("ERROR: could not parse template %s: %v", filename, err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -211,595 +889,7351 @@ func serveTemplate(filename string) http.HandlerFunc {
 	}
 }
 
-// handleUpdateLocation handles players posting their location.
-// It expects a POST request to /api/locations/{playerID}
-func handleUpdateLocation(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-		return
+// defaultContentSecurityPolicy allows the pages' own scripts and styles, Leaflet from
+// unpkg, and the map tiles. The pages use inline <style> blocks, so styles may be inline.
+const defaultContentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' https://unpkg.com; " +
+	"style-src 'self' 'unsafe-inline' https://unpkg.com; " +
+	"img-src 'self' data: https://unpkg.com https://*.tile.openstreetmap.org https://*.basemaps.cartocdn.com; " +
+	"connect-src 'self'; frame-ancestors 'none'; base-uri 'self'; form-action 'self'"
+
+// contentSecurityPolicy is sent with every page. Set with CONTENT_SECURITY_POLICY.
+var contentSecurityPolicy = defaultContentSecurityPolicy
+
+// securityHeaders adds the Content-Security-Policy and other hardening headers to the
+// HTML pages. The referrer policy keeps the secret player paths from leaking to the
+// CDN and tile servers.
+func securityHeaders(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		next(w, r)
 	}
+}
 
-	// Extract obfuscatedID from URL path: /api/locations/{obfuscatedID}
-	obfuscatedID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/locations/"), "/")
-	playerID, err := deobfuscatePlayerID(obfuscatedID)
-	if err != nil {
-		http.Error(w, "Player ID is missing in the URL", http.StatusBadRequest)
+// --- Static Assets ---
+
+// staticDir holds the assets served under /static/.
+var staticDir = "static"
+
+// staticMaxAge is how long browsers may use a cached asset before revalidating its ETag.
+const staticMaxAge = time.Hour
+
+// staticETags remembers each asset's ETag until its size or modification time changes.
+var staticETags = struct {
+	sync.Mutex
+	m map[string]staticETag
+}{m: make(map[string]staticETag)}
+
+type staticETag struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// handleStatic serves the files in staticDir with an ETag and Cache-Control header.
+// A pre-compressed name.gz next to a file is sent to clients that accept gzip; other
+// files are compressed on the fly by gzipMiddleware. The HTML pages are templates
+// served by serveTemplate, so they aren't served here, and neither is the roster of
+// initial targets, which holds the answers.
+func handleStatic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var reqBody struct {
-		Lat             *float64  `json:"lat,omitempty"`
-		Lng             *float64  `json:"lng,omitempty"`
-		ClientTimestamp time.Time `json:"clientTimestamp"`
-		Status          string    `json:"status"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/static/"))
+	if path.Ext(name) == ".html" || name == "/"+filepath.Base(initialTargetsFile) {
+		http.NotFound(w, r)
 		return
 	}
-
-	// Use the global client.
-	ctx := context.Background()
-
-	// The key is the player's unique ID. This acts as an "upsert".
-	key := datastore.NameKey("PlayerLocation", playerID, nil)
-
-	// Start with the new information.
-	loc := PlayerLocation{
-		Timestamp:       time.Now(), // Server receives it now
-		ClientTimestamp: reqBody.ClientTimestamp,
-		Status:          reqBody.Status,
+	filename := filepath.Join(staticDir, filepath.FromSlash(name))
+	info, err := os.Stat(filename)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
 	}
 
-	if reqBody.Status == "OK" && reqBody.Lat != nil && reqBody.Lng != nil { // A good update with coordinates
-		loc.Lat = *reqBody.Lat
-		loc.Lng = *reqBody.Lng
-	} else if reqBody.Status != "OK" { // A status-only update (e.g., "DENIED")
-		// Preserve the last known coordinates by fetching the existing entity.
-		var existingLoc PlayerLocation
-		if err := dsClient.Get(ctx, key, &existingLoc); err == nil && existingLoc.Lat != 0 {
-			// If we have a last known location, use it.
-			loc.Lat = existingLoc.Lat
-			loc.Lng = existingLoc.Lng
+	w.Header().Add("Vary", "Accept-Encoding")
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		if gzInfo, err := os.Stat(filename + ".gz"); err == nil && !gzInfo.IsDir() {
+			// Keep the type of the original file rather than application/gzip.
+			if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+				w.Header().Set("Content-Type", ctype)
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			filename, name, info = filename+".gz", name+".gz", gzInfo
 		} else {
-			// Otherwise, this is a new player with no location. Place them at the default location.
-			loc.Lat = 51.03528074190589
-			loc.Lng = 3.9737665526527852
+			// gzipMiddleware compresses whole responses, not byte ranges.
+			r.Header.Del("Range")
 		}
 	}
 
-	if _, err := dsClient.Put(ctx, key, &loc); err != nil { // Save the new struct
-		log.Printf("ERROR: Failed to save location for player %s: %v", playerID, err)
-		http.Error(w, "Internal server error when saving location.", http.StatusInternalServerError)
+	etag, err := staticFileETag(filename, info)
+	if err != nil {
+		log.Printf("ERROR: could not read static file %s: %v", filename, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(staticMaxAge.Seconds())))
 
-	// Also save to the LocationHistory kind to keep a full record.
-	historyEntry := &LocationHistoryEntry{
-		PlayerID:        playerID,
-		Lat:             loc.Lat,
-		Lng:             loc.Lng,
-		Timestamp:       loc.Timestamp,
-		ClientTimestamp: loc.ClientTimestamp,
-		Status:          loc.Status,
-	}
-	historyKey := datastore.IncompleteKey("LocationHistory", nil)
-	if _, err := dsClient.Put(ctx, historyKey, historyEntry); err != nil {
-		log.Printf("ERROR: Failed to save location history for player %s: %v", playerID, err)
-		// We don't fail the request here, as the main location update succeeded.
+	// The FileServer checks If-None-Match against the ETag set above.
+	fr := r.Clone(r.Context())
+	fr.URL.Path, fr.URL.RawPath = name, ""
+	http.FileServer(http.Dir(staticDir)).ServeHTTP(w, fr)
+}
+
+// staticFileETag returns the ETag for a file: a hash of its content, cached until the
+// file's size or modification time changes.
+func staticFileETag(filename string, info os.FileInfo) (string, error) {
+	staticETags.Lock()
+	defer staticETags.Unlock()
+	if cached, ok := staticETags.m[filename]; ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.etag, nil
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	etag := fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
+	staticETags.m[filename] = staticETag{size: info.Size(), modTime: info.ModTime(), etag: etag}
+	return etag, nil
 }
 
-// handleGetLocations handles requests from the game lead to get all locations.
-// It expects a GET request to /api/locations
-func handleGetLocations(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// gzipMinSize is the response size below which compression isn't worth the overhead.
+const gzipMinSize = 1024
+
+// gzipMiddleware compresses responses for clients that send Accept-Encoding: gzip.
+// Small responses, bodiless statuses, and responses that already set a
+// Content-Encoding are passed through untouched.
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Upgraded connections (e.g. WebSockets) need the raw writer.
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
 
-	// Use the global client.
-	ctx := context.Background()
+		gw := &gzipResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
 
-	query := datastore.NewQuery("PlayerLocation")
-	locations := make(map[string]PlayerLocation)
-	it := dsClient.Run(ctx, query)
-	for {
-		var loc PlayerLocation
-		key, err := it.Next(&loc)
-		if err == iterator.Done {
-			break
+// maxGunzippedBodyBytes caps how large a gzip-encoded request body may inflate to,
+// so a small upload can't expand into something that exhausts memory.
+const maxGunzippedBodyBytes = 32 << 20
+
+// gunzipMiddleware inflates request bodies sent with Content-Encoding: gzip, so
+// clients on poor connections can compress their uploads to any JSON handler.
+// Malformed gzip is rejected with a 400, and other encodings with a 415.
+func gunzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		switch encoding {
+		case "", "identity":
+			next.ServeHTTP(w, r)
+			return
+		case "gzip", "x-gzip":
+		default:
+			http.Error(w, fmt.Sprintf("Unsupported Content-Encoding %q", encoding), http.StatusUnsupportedMediaType)
+			return
 		}
+
+		gz, err := gzip.NewReader(r.Body)
 		if err != nil {
-			log.Printf("ERROR: Failed to iterate over locations: %v", err)
-			http.Error(w, "Internal server error when fetching locations.", http.StatusInternalServerError)
+			http.Error(w, "Malformed gzip request body", http.StatusBadRequest)
 			return
 		}
-		locations[key.Name] = loc
-	}
+		// Handlers see the inflated body, as if it had been sent uncompressed. Corruption
+		// further in surfaces as a decoding error, which handlers already answer with a 400.
+		r.Body = http.MaxBytesReader(w, gz, maxGunzippedBodyBytes)
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
+		next.ServeHTTP(w, r)
+	})
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	// It's safe to encode the error here as it's from the JSON marshaller.
-	if err := json.NewEncoder(w).Encode(locations); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// requireJSONContentType makes jsonContentTypeMiddleware reject API writes that aren't
+// sent as JSON. Turn it off with REQUIRE_JSON_CONTENT_TYPE=false for older clients.
+var requireJSONContentType = true
+
+// jsonContentTypeMiddleware answers POST, PUT and PATCH requests to /api/ that carry a
+// body without Content-Type: application/json with a 415, so a form post gets a clear
+// error instead of a confusing JSON decoding one. Parameters such as charset are allowed.
+func jsonContentTypeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !requireJSONContentType || !strings.HasPrefix(r.URL.Path, "/api/") || r.ContentLength == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gzipResponseWriter buffers the start of a response until it knows whether the
+// body is large enough to compress, then commits to either gzip or plain output.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz         *gzip.Writer
+	buf        []byte
+	statusCode int
+	decided    bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(statusCode int) {
+	if g.decided {
+		return
+	}
+	g.statusCode = statusCode
+	// These responses have no body, or the handler already encoded it.
+	if statusCode == http.StatusNoContent || statusCode == http.StatusNotModified || g.Header().Get("Content-Encoding") != "" {
+		g.startPlain()
+	}
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !g.decided {
+		if g.Header().Get("Content-Encoding") != "" {
+			g.startPlain()
+		} else {
+			g.buf = append(g.buf, p...)
+			if len(g.buf) >= gzipMinSize {
+				if err := g.startGzip(); err != nil {
+					return 0, err
+				}
+			}
+			return len(p), nil
+		}
+	}
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+// Flush commits to compression so streaming endpoints can push partial output.
+func (g *gzipResponseWriter) Flush() {
+	if !g.decided {
+		if g.Header().Get("Content-Encoding") != "" {
+			g.startPlain()
+		} else if err := g.startGzip(); err != nil {
+			return
+		}
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the response, writing out anything still buffered.
+func (g *gzipResponseWriter) Close() error {
+	if !g.decided {
+		g.startPlain()
+	}
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
+
+func (g *gzipResponseWriter) startGzip() error {
+	g.decided = true
+	// net/http won't sniff the content type once Content-Encoding is set, so do it here.
+	if g.Header().Get("Content-Type") == "" {
+		g.Header().Set("Content-Type", http.DetectContentType(g.buf))
+	}
+	g.Header().Del("Content-Length")
+	g.Header().Set("Content-Encoding", "gzip")
+	g.ResponseWriter.WriteHeader(g.statusCode)
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	_, err := g.gz.Write(g.buf)
+	g.buf = nil
+	return err
+}
+
+func (g *gzipResponseWriter) startPlain() {
+	g.decided = true
+	g.ResponseWriter.WriteHeader(g.statusCode)
+	if len(g.buf) > 0 {
+		g.ResponseWriter.Write(g.buf)
+		g.buf = nil
+	}
+}
+
+// --- Geo ---
+
+// earthRadiusMeters is the mean Earth radius used for distance calculations.
+const earthRadiusMeters = 6371000
+
+// haversineMeters returns the great-circle distance between two coordinates in meters.
+// It mirrors getDistanceAndBearing in the player app.
+func haversineMeters(lat1, lng1, lat2, lng2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLng := toRad(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Sin(dLng/2)*math.Sin(dLng/2)*math.Cos(toRad(lat1))*math.Cos(toRad(lat2))
+	return earthRadiusMeters * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// bearingDegrees returns the initial bearing from the first coordinate to the second,
+// in degrees clockwise from north. It also mirrors getDistanceAndBearing.
+func bearingDegrees(lat1, lng1, lat2, lng2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLng := toRad(lng2 - lng1)
+	y := math.Sin(dLng) * math.Cos(toRad(lat2))
+	x := math.Cos(toRad(lat1))*math.Sin(toRad(lat2)) - math.Sin(toRad(lat1))*math.Cos(toRad(lat2))*math.Cos(dLng)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// motion returns the speed in m/s and heading in degrees between two OK fixes. The
+// client timestamps are used when both fixes have one, since they tell when the fix
+// was taken; otherwise the server timestamps. It returns zeros when there's no
+// previous fix or no time passed between them.
+func motion(prev, loc PlayerLocation) (speedMps, headingDeg float64) {
+	if prev.Status != PlayerStatusOK || prev.Timestamp.IsZero() {
+		return 0, 0
+	}
+	elapsed := loc.Timestamp.Sub(prev.Timestamp)
+	if !prev.ClientTimestamp.IsZero() && !loc.ClientTimestamp.IsZero() {
+		elapsed = loc.ClientTimestamp.Sub(prev.ClientTimestamp)
+	}
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	distance := haversineMeters(prev.Lat, prev.Lng, loc.Lat, loc.Lng)
+	if distance == 0 {
+		return 0, 0
+	}
+	return distance / elapsed.Seconds(), bearingDegrees(prev.Lat, prev.Lng, loc.Lat, loc.Lng)
+}
+
+// defaultCoordinatePrecision is the number of decimal places kept for player
+// coordinates when COORDINATE_PRECISION isn't set. 5 places is about 1m, 4 about 10m.
+const defaultCoordinatePrecision = 5
+
+// maxCoordinatePrecision is beyond what any GPS fix can resolve.
+const maxCoordinatePrecision = 8
+
+// coordinatePrecision is the number of decimal places stored for player coordinates.
+var coordinatePrecision = defaultCoordinatePrecision
+
+// roundCoordinate rounds a latitude or longitude to the given number of decimal places.
+func roundCoordinate(v float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(v*scale) / scale
+}
+
+// --- Map Config ---
+
+// spawnLat and spawnLng are where players show up before their first location fix.
+const (
+	spawnLat = 51.03528074190589
+	spawnLng = 3.9737665526527852
+)
+
+// defaultMapZoom is the zoom level the lead map opens at.
+const defaultMapZoom = 9
+
+// maxMapZoom is the highest zoom level the map tiles support.
+const maxMapZoom = 19
+
+// MapConfig is the initial view of the lead map. Organizers can re-center it per
+// event with MAP_CENTER_LAT, MAP_CENTER_LNG and MAP_ZOOM.
+type MapConfig struct {
+	Lat  float64 `json:"lat"`
+	Lng  float64 `json:"lng"`
+	Zoom int     `json:"zoom"`
+}
+
+// mapConfig is the map view in effect, set at startup.
+var mapConfig = MapConfig{Lat: spawnLat, Lng: spawnLng, Zoom: defaultMapZoom}
+
+// loadMapConfig reads the map view from the environment, defaulting to the spawn location.
+func loadMapConfig() (MapConfig, error) {
+	config := MapConfig{
+		Lat:  envFloat("MAP_CENTER_LAT", spawnLat),
+		Lng:  envFloat("MAP_CENTER_LNG", spawnLng),
+		Zoom: envInt("MAP_ZOOM", defaultMapZoom),
+	}
+	if config.Lat < -90 || config.Lat > 90 || config.Lng < -180 || config.Lng > 180 {
+		return MapConfig{}, fmt.Errorf("MAP_CENTER_LAT and MAP_CENTER_LNG must be valid coordinates, got %v,%v", config.Lat, config.Lng)
+	}
+	if config.Zoom < 0 || config.Zoom > maxMapZoom {
+		return MapConfig{}, fmt.Errorf("MAP_ZOOM must be between 0 and %d, got %d", maxMapZoom, config.Zoom)
+	}
+	return config, nil
+}
+
+// handleMapConfig serves the initial view of the lead map.
+func handleMapConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, mapConfig)
+}
+
+// --- Feature Flags ---
+
+// Features organizers can switch off per event, FEATURE_CHAT=false and so on. While
+// one is off its write handlers respond with 403, and the pages hide it.
+const (
+	featureChat      = "chat"      // Player messages, direct messages and the chat WebSocket
+	featureTargets   = "targets"   // Setting, recalling and loading targets and chains
+	featureEmergency = "emergency" // The player's panic button
+)
+
+// features maps every feature to whether it's on, set at startup. All are on by default.
+var features = map[string]bool{featureChat: true, featureTargets: true, featureEmergency: true}
+
+// loadFeatures reads FEATURE_<NAME> for every feature from the environment.
+func loadFeatures() map[string]bool {
+	loaded := make(map[string]bool, len(features))
+	for name := range features {
+		loaded[name] = envBool("FEATURE_"+strings.ToUpper(name), true)
+	}
+	return loaded
+}
+
+// rejectIfDisabled responds with 403 Forbidden and returns true while the feature is off.
+func rejectIfDisabled(w http.ResponseWriter, feature string) bool {
+	if features[feature] {
+		return false
+	}
+	http.Error(w, fmt.Sprintf("The %s feature is switched off for this event.", feature), http.StatusForbidden)
+	return true
+}
+
+// handleFeatures serves which features are on, so the pages can hide the rest.
+func handleFeatures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, features)
+}
+
+// --- Reverse Geocoding ---
+
+// geocodeRefreshMeters is how far a player must move before their address is looked up again.
+const geocodeRefreshMeters = 100
+
+// geocodeURL is the Google Geocoding API endpoint used for reverse lookups.
+const geocodeURL = "https://maps.googleapis.com/maps/api/geocode/json"
+
+// geocodeAPIKey enables reverse geocoding when set from GEOCODE_API_KEY.
+var geocodeAPIKey string
+
+// geocodeClient sends reverse-geocoding requests.
+var geocodeClient = &http.Client{Timeout: 5 * time.Second}
+
+// reverseGeocode returns a human-readable address for a coordinate.
+func reverseGeocode(ctx context.Context, lat, lng float64) (string, error) {
+	params := url.Values{
+		"latlng": {fmt.Sprintf("%f,%f", lat, lng)},
+		"key":    {geocodeAPIKey},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, geocodeURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := geocodeClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("calling geocoder: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("geocoder returned %s", resp.Status)
+	}
+
+	var body struct {
+		Status  string `json:"status"`
+		Results []struct {
+			FormattedAddress string `json:"formatted_address"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decoding geocoder response: %w", err)
+	}
+	if body.Status != "OK" || len(body.Results) == 0 {
+		return "", fmt.Errorf("geocoder found no address (status %s)", body.Status)
+	}
+	return body.Results[0].FormattedAddress, nil
+}
+
+// setAddress fills in loc's address. The address cached on prev is reused unless the
+// player has moved more than geocodeRefreshMeters from where it was looked up.
+func setAddress(ctx context.Context, loc *PlayerLocation, prev PlayerLocation) error {
+	if prev.Address != "" && haversineMeters(prev.AddressLat, prev.AddressLng, loc.Lat, loc.Lng) <= geocodeRefreshMeters {
+		loc.Address, loc.AddressLat, loc.AddressLng = prev.Address, prev.AddressLat, prev.AddressLng
+		return nil
+	}
+	address, err := reverseGeocode(ctx, loc.Lat, loc.Lng)
+	if err != nil {
+		// Keep showing the old address rather than none at all.
+		loc.Address, loc.AddressLat, loc.AddressLng = prev.Address, prev.AddressLat, prev.AddressLng
+		return err
+	}
+	loc.Address, loc.AddressLat, loc.AddressLng = address, loc.Lat, loc.Lng
+	return nil
+}
+
+// --- Player Limit ---
+
+// maxPlayers caps the number of distinct players, to stay within the datastore quota.
+// Set with MAX_PLAYERS; 0 means no limit.
+var maxPlayers = 0
+
+// playerRegistryTTL is how long the set of known players is trusted before it's reloaded.
+const playerRegistryTTL = time.Minute
+
+// playerRegistry caches the IDs of the players that have a PlayerLocation, so the
+// player limit doesn't need a query on every location update.
+type playerRegistry struct {
+	mu     sync.Mutex
+	ids    map[string]bool
+	loaded time.Time
+}
+
+// Player registries, one per game namespace. players is the default game's.
+var (
+	playerRegistries = &namespaced[playerRegistry]{def: &playerRegistry{}}
+	players          = playerRegistries.def
+)
+
+// admit reports whether all of playerIDs may take part: those already known always
+// can, new ones only while there's room under maxPlayers. With add, admitted new
+// players count towards the limit right away, for callers that are about to store them.
+func (p *playerRegistry) admit(ctx context.Context, playerIDs []string, add bool) (bool, error) {
+	if maxPlayers <= 0 {
+		return true, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ids == nil || time.Since(p.loaded) > playerRegistryTTL {
+		keys, err := dsClient.GetAll(ctx, gameQuery(ctx, "PlayerLocation").KeysOnly(), nil)
+		if err != nil {
+			return false, fmt.Errorf("counting players: %w", err)
+		}
+		p.ids = make(map[string]bool, len(keys))
+		for _, key := range keys {
+			p.ids[key.Name] = true
+		}
+		p.loaded = time.Now()
+	}
+
+	newIDs := make(map[string]bool)
+	for _, id := range playerIDs {
+		if !p.ids[id] {
+			newIDs[id] = true
+		}
+	}
+	if len(p.ids)+len(newIDs) > maxPlayers {
+		return false, nil
+	}
+	if add {
+		for id := range newIDs {
+			p.ids[id] = true
+		}
+	}
+	return true, nil
+}
+
+// invalidate forgets the known players, e.g. after locations were deleted.
+func (p *playerRegistry) invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ids = nil
+}
+
+// playerLimitMessage is the error for a new player beyond maxPlayers.
+func playerLimitMessage() string {
+	return fmt.Sprintf("This game is full: it's limited to %d players", maxPlayers)
+}
+
+// --- Arrivals ---
+
+// defaultArrivalRadiusMeters is how close a player must get to their target to have arrived.
+// Override with ARRIVAL_RADIUS_METERS.
+const defaultArrivalRadiusMeters = 25
+
+// arrivalRadiusMeters is the radius in effect, set at startup. Targets can override it.
+var arrivalRadiusMeters float64 = defaultArrivalRadiusMeters
+
+// maxArrivalRadiusMeters bounds the radius a lead can set on a single target.
+const maxArrivalRadiusMeters = 5000
+
+// targetTTL is how long targets set by leads stay up before they expire, 0 for
+// never. Set with TARGET_TTL_MINUTES; leads can override it per target.
+var targetTTL time.Duration
+
+// targetTTLExpiry is when a target shown to its player from start expires under
+// targetTTL, or zero when targets don't expire.
+func targetTTLExpiry(start time.Time) time.Time {
+	if targetTTL <= 0 {
+		return time.Time{}
+	}
+	return start.Add(targetTTL)
+}
+
+// maxTargetTTLMinutes bounds the ttlMinutes a lead can set on a single target.
+const maxTargetTTLMinutes = 7 * 24 * 60
+
+// checkArrival marks the player's released target as reached when loc is within the
+// arrival radius. It reports whether this update was the arrival, so it fires only once.
+func checkArrival(ctx context.Context, playerID string, loc PlayerLocation) (bool, error) {
+	key := gameNameKey(ctx, "TargetLocation", playerID, nil)
+	var target TargetLocation
+	var next *TargetLocation
+	arrived := false
+	_, err := dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		arrived, next = false, nil // Reset in case the transaction is retried.
+		if err := tx.Get(key, &target); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		}
+		if !target.released(loc.Timestamp) || target.expired(loc.Timestamp) || !target.ArrivedAt.IsZero() {
+			return nil
+		}
+		if !target.reachedAt(loc.Lat, loc.Lng) {
+			return nil
+		}
+		target.ArrivedAt = loc.Timestamp
+		arrived = true
+		// If the target is a step of a chain, the player moves on to the next step.
+		var err error
+		if next, err = completeChainStep(ctx, tx, playerID, target); err != nil {
+			return err
+		}
+		if next != nil {
+			_, err = tx.Put(key, next)
+		} else {
+			_, err = tx.Put(key, &target)
+		}
+		if err != nil {
+			return err
+		}
+		arrival := &Arrival{PlayerID: playerID, Lat: target.Lat, Lng: target.Lng, FakeHash: target.FakeHash, ArrivedAt: target.ArrivedAt}
+		if _, err := tx.Put(gameIncompleteKey(ctx, "Arrival", nil), arrival); err != nil {
+			return err
+		}
+		return incrementArrivals(ctx, tx, loc.Timestamp)
+	}, datastore.MaxAttempts(gameStatsMaxAttempts))
+	if err != nil || !arrived {
+		return false, err
+	}
+	targetCaches.get(ctx).invalidate()
+	arrivalCaches.get(ctx).invalidate()
+	if next != nil {
+		emitWebhookEvent(ctx, webhookEventTargetReleased, map[string]interface{}{"playerID": playerID, "lat": next.Lat, "lng": next.Lng})
+	}
+
+	emitWebhookEvent(ctx, webhookEventArrival, map[string]interface{}{
+		"playerID":  playerID,
+		"lat":       loc.Lat,
+		"lng":       loc.Lng,
+		"arrivedAt": target.ArrivedAt,
+	})
+	arrivals.publish(gameNamespace(ctx), ArrivalEvent{
+		PlayerID:  playerID,
+		FakeHash:  target.FakeHash,
+		Lat:       loc.Lat,
+		Lng:       loc.Lng,
+		ArrivedAt: target.ArrivedAt,
+	})
+	return true, nil
+}
+
+// ArrivalEvent is pushed to leads watching the arrival stream the moment a player
+// reaches their target.
+type ArrivalEvent struct {
+	PlayerID  string    `json:"playerID"`
+	FakeHash  string    `json:"fakeHash"` // Code of the target that was reached
+	Lat       float64   `json:"lat"`
+	Lng       float64   `json:"lng"`
+	ArrivedAt time.Time `json:"arrivedAt"`
+}
+
+// arrivalHub fans out arrivals to every lead connected to the arrival stream of a game.
+// Subscribers are keyed by game namespace.
+type arrivalHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan ArrivalEvent]bool
+}
+
+// Global arrival hub.
+var arrivals = &arrivalHub{subscribers: make(map[string]map[chan ArrivalEvent]bool)}
+
+// subscribe registers a new listener for a game's arrivals.
+func (h *arrivalHub) subscribe(namespace string) chan ArrivalEvent {
+	ch := make(chan ArrivalEvent, 16)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[namespace] == nil {
+		h.subscribers[namespace] = make(map[chan ArrivalEvent]bool)
+	}
+	h.subscribers[namespace][ch] = true
+	return ch
+}
+
+// unsubscribe removes a listener and closes its channel. It's safe to call twice.
+func (h *arrivalHub) unsubscribe(namespace string, ch chan ArrivalEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[namespace][ch]; !ok {
+		return
+	}
+	delete(h.subscribers[namespace], ch)
+	if len(h.subscribers[namespace]) == 0 {
+		delete(h.subscribers, namespace)
+	}
+	close(ch)
+}
+
+// publish sends an arrival to all listeners of a game. Slow listeners whose buffer
+// is full miss it rather than holding up the location update.
+func (h *arrivalHub) publish(namespace string, ev ArrivalEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers[namespace] {
+		select {
+		case ch <- ev:
+		default:
+			log.Printf("Dropping arrival of player %s for slow subscriber", ev.PlayerID)
+		}
+	}
+}
+
+// handleArrivalStream upgrades to a WebSocket that carries an ArrivalEvent frame for
+// every arrival in the lead's game from then on. It expects GET /api/arrivals/stream.
+func handleArrivalStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	namespace := gameNamespace(r.Context())
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		ch := arrivals.subscribe(namespace)
+		defer arrivals.unsubscribe(namespace, ch)
+
+		// Leads never send anything, reading only notices when they go away. Unsubscribing
+		// then closes ch, which ends the writer below even if no arrival comes in.
+		go func() {
+			io.Copy(io.Discard, ws)
+			arrivals.unsubscribe(namespace, ch)
+		}()
+
+		for ev := range ch {
+			if err := websocket.JSON.Send(ws, ev); err != nil {
+				return
+			}
+		}
+	}).ServeHTTP(w, r)
+}
+
+// Arrival records a player reaching a target. Targets are overwritten by the next one,
+// so these records are what's left of the targets a player reached.
+type Arrival struct {
+	PlayerID  string    `json:"playerID"`
+	Lat       float64   `json:"lat" datastore:",noindex"` // The target, not where the player was
+	Lng       float64   `json:"lng" datastore:",noindex"`
+	FakeHash  string    `json:"fakeHash" datastore:",noindex"`
+	ArrivedAt time.Time `json:"arrivedAt"`
+}
+
+// GameStats holds game-wide tallies. There is a single entity per game, at gameStatsKey.
+type GameStats struct {
+	Arrivals  int64     `json:"arrivals"` // How many players reached their target
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+}
+
+// gameStatsKey returns the key of the GameStats entity of the game in ctx.
+func gameStatsKey(ctx context.Context) *datastore.Key {
+	return gameNameKey(ctx, "GameStats", "global", nil)
+}
+
+// gameStatsMaxAttempts is how often a transaction that updates GameStats is tried.
+// Every arrival writes the same entity, so players arriving together conflict.
+const gameStatsMaxAttempts = 10
+
+// incrementArrivals adds an arrival to GameStats as part of tx.
+func incrementArrivals(ctx context.Context, tx *datastore.Transaction, now time.Time) error {
+	var stats GameStats
+	if err := tx.Get(gameStatsKey(ctx), &stats); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	stats.Arrivals++
+	stats.UpdatedAt = now
+	_, err := tx.Put(gameStatsKey(ctx), &stats)
+	return err
+}
+
+// handleGetStats serves the game-wide tallies.
+func handleGetStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	var stats GameStats
+	if err := dsClient.Get(ctx, gameStatsKey(ctx), &stats); err != nil && err != datastore.ErrNoSuchEntity {
+		log.Printf("ERROR: Failed to get game stats: %v", err)
+		http.Error(w, "Internal server error when fetching game stats.", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, stats)
+}
+
+// maxActivityBucketMinutes caps ?bucketMinutes= on handleActivityStats at a day.
+const maxActivityBucketMinutes = 24 * 60
+
+// ActivityBucket counts the location updates received in one time bucket.
+type ActivityBucket struct {
+	Start   time.Time      `json:"start"`
+	Updates int            `json:"updates"`
+	Players map[string]int `json:"players,omitempty"` // Updates per player ID, with ?perPlayer=true
+}
+
+// activityBuckets counts history entries per bucket of the given size, by server
+// timestamp. Buckets run from the first update to the last, including empty ones so
+// the report shows quiet periods too.
+func activityBuckets(history []LocationHistoryEntry, size time.Duration, perPlayer bool) []ActivityBucket {
+	buckets := make([]ActivityBucket, 0)
+	if len(history) == 0 {
+		return buckets
+	}
+	first, last := history[0].Timestamp, history[0].Timestamp
+	for _, entry := range history {
+		if entry.Timestamp.Before(first) {
+			first = entry.Timestamp
+		}
+		if entry.Timestamp.After(last) {
+			last = entry.Timestamp
+		}
+	}
+	first = first.UTC().Truncate(size)
+	for start := first; !start.After(last); start = start.Add(size) {
+		bucket := ActivityBucket{Start: start}
+		if perPlayer {
+			bucket.Players = make(map[string]int)
+		}
+		buckets = append(buckets, bucket)
+	}
+	for _, entry := range history {
+		bucket := &buckets[entry.Timestamp.Sub(first)/size]
+		bucket.Updates++
+		if perPlayer {
+			bucket.Players[entry.PlayerID]++
+		}
+	}
+	return buckets
+}
+
+// handleActivityStats reports how many location updates came in over time, for a
+// post-game report. It expects GET /api/stats/activity?bucketMinutes= and counts the
+// LocationHistory entries per bucket; ?perPlayer=true also breaks each bucket down by player.
+func handleActivityStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bucketMinutes, err := strconv.Atoi(r.URL.Query().Get("bucketMinutes"))
+	if err != nil || bucketMinutes < 1 || bucketMinutes > maxActivityBucketMinutes {
+		http.Error(w, fmt.Sprintf("bucketMinutes must be between 1 and %d", maxActivityBucketMinutes), http.StatusBadRequest)
+		return
+	}
+	perPlayer := r.URL.Query().Get("perPlayer") == "true"
+
+	ctx := r.Context()
+	var history []LocationHistoryEntry
+	if _, err := dsClient.GetAll(ctx, gameQuery(ctx, "LocationHistory"), &history); err != nil {
+		log.Printf("ERROR: Failed to fetch location history for activity stats: %v", err)
+		http.Error(w, "Internal server error fetching history.", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, activityBuckets(history, time.Duration(bucketMinutes)*time.Minute, perPlayer))
+}
+
+// Metrics the leaderboard can rank players by.
+const (
+	leaderboardByArrivals = "arrivals"
+	leaderboardByDistance = "distance"
+)
+
+// LeaderboardEntry is one player's place on the leaderboard.
+type LeaderboardEntry struct {
+	Rank           int       `json:"rank"` // 1 for the leader
+	PlayerID       string    `json:"playerID"`
+	Arrivals       int       `json:"arrivals"`                // Targets reached
+	DistanceMeters float64   `json:"distanceMeters"`          // Distance between the player's location fixes, only with ?by=distance
+	LastArrivalAt  time.Time `json:"lastArrivalAt,omitempty"` // When the player reached their latest target
+}
+
+// historyDistances adds up how far each player moved between consecutive OK fixes in
+// their location history. Fixes without coordinates or flagged as suspicious are
+// skipped, as are segments faster than maxPlausibleSpeedMps, which catches jumps
+// recorded before history entries carried the flag.
+func historyDistances(history []LocationHistoryEntry) map[string]float64 {
+	byPlayer := make(map[string][]LocationHistoryEntry)
+	for _, entry := range history {
+		if entry.Status != PlayerStatusOK || (entry.Lat == 0 && entry.Lng == 0) || entry.Suspicious {
+			continue
+		}
+		byPlayer[entry.PlayerID] = append(byPlayer[entry.PlayerID], entry)
+	}
+	distances := make(map[string]float64, len(byPlayer))
+	for playerID, entries := range byPlayer {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Timestamp.Before(entries[j].Timestamp) })
+		total := 0.0
+		for i := 1; i < len(entries); i++ {
+			meters := haversineMeters(entries[i-1].Lat, entries[i-1].Lng, entries[i].Lat, entries[i].Lng)
+			seconds := entries[i].Timestamp.Sub(entries[i-1].Timestamp).Seconds()
+			if maxPlausibleSpeedMps > 0 && meters > 0 && (seconds <= 0 || meters/seconds > maxPlausibleSpeedMps) {
+				continue
+			}
+			total += meters
+		}
+		distances[playerID] = total
+	}
+	return distances
+}
+
+// rankLeaderboard orders players by the given metric, best first. Ranked by arrivals,
+// ties go to whoever reached their latest target first, then to the longer distance.
+// Ranked by distance, ties go to the player with more arrivals. Remaining ties are
+// broken by player ID, so every player gets their own rank.
+func rankLeaderboard(arrivals []Arrival, distances map[string]float64, by string) []LeaderboardEntry {
+	entries := make(map[string]*LeaderboardEntry)
+	entry := func(playerID string) *LeaderboardEntry {
+		if entries[playerID] == nil {
+			entries[playerID] = &LeaderboardEntry{PlayerID: playerID}
+		}
+		return entries[playerID]
+	}
+	for _, arrival := range arrivals {
+		e := entry(arrival.PlayerID)
+		e.Arrivals++
+		if arrival.ArrivedAt.After(e.LastArrivalAt) {
+			e.LastArrivalAt = arrival.ArrivedAt
+		}
+	}
+	for playerID, distance := range distances {
+		entry(playerID).DistanceMeters = distance
+	}
+
+	board := make([]LeaderboardEntry, 0, len(entries))
+	for _, e := range entries {
+		board = append(board, *e)
+	}
+	sort.Slice(board, func(i, j int) bool {
+		a, b := board[i], board[j]
+		if by == leaderboardByDistance && a.DistanceMeters != b.DistanceMeters {
+			return a.DistanceMeters > b.DistanceMeters
+		}
+		if a.Arrivals != b.Arrivals {
+			return a.Arrivals > b.Arrivals
+		}
+		if by == leaderboardByArrivals && !a.LastArrivalAt.Equal(b.LastArrivalAt) {
+			return a.LastArrivalAt.Before(b.LastArrivalAt)
+		}
+		if a.DistanceMeters != b.DistanceMeters {
+			return a.DistanceMeters > b.DistanceMeters
+		}
+		return a.PlayerID < b.PlayerID
+	})
+	for i := range board {
+		board[i].Rank = i + 1
+	}
+	return board
+}
+
+// leaderboardCacheTTL is how long the leaderboard's arrivals and distances are served
+// from memory. The leaderboard is public, so this bounds how often anyone can make it
+// read the whole Arrival and LocationHistory kinds, whatever LOCATIONS_CACHE says.
+const leaderboardCacheTTL = time.Minute
+
+// Leaderboard caches, one per game namespace: arrivals keyed by their datastore key
+// and travelled distances keyed by player ID. New arrivals invalidate the first;
+// distances may lag up to leaderboardCacheTTL behind the location history.
+var (
+	arrivalCaches  = &namespaced[snapshotCache[Arrival]]{def: &snapshotCache[Arrival]{}}
+	distanceCaches = &namespaced[snapshotCache[float64]]{def: &snapshotCache[float64]{}}
+)
+
+// invalidateLeaderboard drops the cached leaderboard data after bulk changes.
+func invalidateLeaderboard(ctx context.Context) {
+	arrivalCaches.get(ctx).invalidate()
+	distanceCaches.get(ctx).invalidate()
+}
+
+// cachedArrivals returns every Arrival record of the game, from arrivalCaches when loaded.
+func cachedArrivals(ctx context.Context) ([]Arrival, error) {
+	byKey, err := arrivalCaches.get(ctx).load(leaderboardCacheTTL, func() (map[string]Arrival, error) {
+		var records []Arrival
+		keys, err := dsClient.GetAll(ctx, gameQuery(ctx, "Arrival"), &records)
+		if err != nil {
+			return nil, err
+		}
+		byKey := make(map[string]Arrival, len(records))
+		for i, key := range keys {
+			byKey[key.String()] = records[i]
+		}
+		return byKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return slices.Collect(maps.Values(byKey)), nil
+}
+
+// cachedDistances returns historyDistances for the game, from distanceCaches when loaded.
+func cachedDistances(ctx context.Context) (map[string]float64, error) {
+	return distanceCaches.get(ctx).load(leaderboardCacheTTL, func() (map[string]float64, error) {
+		var history []LocationHistoryEntry
+		if _, err := dsClient.GetAll(ctx, gameQuery(ctx, "LocationHistory"), &history); err != nil {
+			return nil, err
+		}
+		return historyDistances(history), nil
+	})
+}
+
+// handleLeaderboard ranks the players for competitive games. It expects
+// GET /api/leaderboard with an optional ?by=arrivals (the default) or ?by=distance.
+// Arrivals come from the Arrival records. Only ?by=distance reads the location history
+// and fills in distanceMeters; ranked by arrivals, every player with a location is
+// listed with a distance of 0. Both are cached for leaderboardCacheTTL.
+func handleLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	by := r.URL.Query().Get("by")
+	if by == "" {
+		by = leaderboardByArrivals
+	}
+	if by != leaderboardByArrivals && by != leaderboardByDistance {
+		http.Error(w, fmt.Sprintf("by must be %s or %s", leaderboardByArrivals, leaderboardByDistance), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	arrivalRecords, err := cachedArrivals(ctx)
+	if err != nil {
+		log.Printf("ERROR: Failed to fetch arrivals for the leaderboard: %v", err)
+		http.Error(w, "Internal server error when building the leaderboard.", http.StatusInternalServerError)
+		return
+	}
+	var distances map[string]float64
+	if by == leaderboardByDistance {
+		if distances, err = cachedDistances(ctx); err != nil {
+			log.Printf("ERROR: Failed to fetch location history for the leaderboard: %v", err)
+			http.Error(w, "Internal server error when building the leaderboard.", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		// List players who haven't arrived anywhere yet too, from the cached locations.
+		locations, err := cachedPlayerLocations(ctx, false)
+		if err != nil {
+			log.Printf("ERROR: Failed to fetch players for the leaderboard: %v", err)
+			http.Error(w, "Internal server error when building the leaderboard.", http.StatusInternalServerError)
+			return
+		}
+		distances = make(map[string]float64, len(locations))
+		for playerID := range locations {
+			distances[playerID] = 0
+		}
+	}
+
+	writeJSON(w, r, rankLeaderboard(arrivalRecords, distances, by))
+}
+
+// --- Game State ---
+
+// How often the player app is advised to poll for messages, see GameState.pollInterval.
+const (
+	activePollInterval = 15 * time.Second
+	pausedPollInterval = 60 * time.Second
+)
+
+// GameState is what organizers control about the running game. There is a single
+// entity per game, at gameStateKey; without one the game is active. While the game
+// is paused, for example for safety, leads can't set targets and players don't see
+// theirs, but locations keep flowing so leads still see everyone move.
+type GameState struct {
+	Paused    bool      `json:"paused"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty" datastore:",noindex"`
+	UpdatedBy string    `json:"updatedBy,omitempty" datastore:",noindex"` // Username of the lead who last changed it
+}
+
+// gameStateKey returns the key of the GameState entity of the game in ctx.
+func gameStateKey(ctx context.Context) *datastore.Key {
+	return gameNameKey(ctx, "GameState", "global", nil)
+}
+
+// loadGameState returns the state of the game in ctx.
+func loadGameState(ctx context.Context) (GameState, error) {
+	var state GameState
+	if err := dsClient.Get(ctx, gameStateKey(ctx), &state); err != nil && err != datastore.ErrNoSuchEntity {
+		return GameState{}, err
+	}
+	return state, nil
+}
+
+// pollInterval is how often player apps should poll in this state. Nothing happens
+// while the game is paused, so they can back off and save battery.
+func (s GameState) pollInterval() time.Duration {
+	if s.Paused {
+		return pausedPollInterval
+	}
+	return activePollInterval
+}
+
+// handleGameState gets or changes the game state.
+// It expects GET or PUT /api/game-state, the latter with {"paused": true}.
+func handleGameState(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		state, err := loadGameState(ctx)
+		if err != nil {
+			log.Printf("ERROR: Failed to get game state: %v", err)
+			http.Error(w, "Internal server error when fetching game state.", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, r, state)
+
+	case http.MethodPut:
+		var reqBody struct {
+			Paused *bool `json:"paused"`
+		}
+		if err := decodeJSONBody(r, &reqBody); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if reqBody.Paused == nil {
+			http.Error(w, errMissingField("paused").Error(), http.StatusBadRequest)
+			return
+		}
+		writeGameState(w, r, *reqBody.Paused)
+
+	default:
+		http.Error(w, "Only GET or PUT method is allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handlePauseGame returns the handler for POST /api/admin/pause (paused true) or
+// POST /api/admin/resume (paused false).
+func handlePauseGame(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeGameState(w, r, paused)
+	}
+}
+
+// writeGameState pauses or resumes the game on behalf of the logged-in lead and
+// responds with the new state.
+func writeGameState(w http.ResponseWriter, r *http.Request, paused bool) {
+	ctx := r.Context()
+	leadID, _ := ctx.Value(leadIDContextKey).(string)
+	state := &GameState{Paused: paused, UpdatedAt: time.Now(), UpdatedBy: leadID}
+	if err := withRetry(ctx, func() error { _, err := dsClient.Put(ctx, gameStateKey(ctx), state); return err }); err != nil {
+		log.Printf("ERROR: Failed to save game state: %v", err)
+		http.Error(w, "Internal server error when saving game state.", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Lead %s set the game to paused=%t", leadID, state.Paused)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// rejectIfPaused responds with 409 Conflict and returns true while the game is paused.
+func rejectIfPaused(ctx context.Context, w http.ResponseWriter) bool {
+	state, err := loadGameState(ctx)
+	if err != nil {
+		log.Printf("ERROR: Failed to get game state: %v", err)
+		http.Error(w, "Internal server error when fetching game state.", http.StatusInternalServerError)
+		return true
+	}
+	if state.Paused {
+		http.Error(w, "The game is paused, resume it before setting targets.", http.StatusConflict)
+		return true
+	}
+	return false
+}
+
+// --- Webhooks ---
+
+// Game events that webhooks can subscribe to.
+const (
+	webhookEventArrival        = "arrival"
+	webhookEventNewMessage     = "new-message"
+	webhookEventTargetReleased = "target-released"
+	webhookEventEmergency      = "emergency"
+)
+
+var webhookEventTypes = []string{webhookEventArrival, webhookEventNewMessage, webhookEventTargetReleased, webhookEventEmergency}
+
+// webhookMaxAttempts is how many times a delivery is tried before giving up.
+const webhookMaxAttempts = 4
+
+// webhookBackoff is the wait before the first retry. It doubles on each further retry.
+var webhookBackoff = 2 * time.Second
+
+// webhookClient sends webhook deliveries.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookEvent is a game event waiting to be delivered.
+type webhookEvent struct {
+	Event     string      `json:"event"`
+	Namespace string      `json:"namespace,omitempty"` // Game namespace, omitted for the default game
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// webhookQueue decouples delivery from request handling. Events are dropped when it's full.
+var webhookQueue = make(chan webhookEvent, 256)
+
+// emitWebhookEvent queues an event of the game in ctx for delivery to subscribed
+// webhooks without blocking.
+func emitWebhookEvent(ctx context.Context, event string, data interface{}) {
+	select {
+	case webhookQueue <- webhookEvent{Event: event, Namespace: gameNamespace(ctx), Timestamp: time.Now(), Data: data}:
+	default:
+		log.Printf("ERROR: Webhook queue full, dropping %s event", event)
+	}
+}
+
+// runWebhookWorker delivers queued events until the queue is closed.
+func runWebhookWorker() {
+	for ev := range webhookQueue {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		var hooks []Webhook
+		_, err := dsClient.GetAll(ctx, datastore.NewQuery("Webhook").FilterField("Events", "=", ev.Event), &hooks)
+		cancel()
+		if err != nil {
+			log.Printf("ERROR: Failed to get webhooks for %s event: %v", ev.Event, err)
+			continue
+		}
+		if len(hooks) == 0 {
+			continue
+		}
+
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			log.Printf("ERROR: Failed to encode %s event: %v", ev.Event, err)
+			continue
+		}
+		// Each webhook retries on its own schedule, so a slow one doesn't hold up the rest.
+		for _, hook := range hooks {
+			go func(hook Webhook) {
+				if err := deliverWebhook(hook, payload); err != nil {
+					log.Printf("ERROR: Giving up on %s event for webhook %s: %v", ev.Event, hook.URL, err)
+				}
+			}(hook)
+		}
+	}
+}
+
+// signWebhookPayload returns the X-Signature value for a payload: "sha256=" and the hex HMAC.
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook POSTs a signed payload, retrying with exponential backoff until the
+// receiver answers with a 2xx status or the attempts run out.
+func deliverWebhook(hook Webhook, payload []byte) error {
+	backoff := webhookBackoff
+	var lastErr error
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Signature", signWebhookPayload(hook.Secret, payload))
+
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("receiver returned %s", resp.Status)
+	}
+	return fmt.Errorf("after %d attempts: %w", webhookMaxAttempts, lastErr)
+}
+
+// handleRegisterWebhook registers a URL to be notified of game events.
+// It expects POST /api/admin/webhooks with {"url": "...", "events": ["arrival", ...]}
+// and returns the secret used to sign deliveries. The secret is only shown once.
+func handleRegisterWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Webhooks receive events from every game, so only the default game's leads may add them.
+	if gameNamespace(r.Context()) != "" {
+		http.Error(w, "Only leads of the default game can register webhooks", http.StatusForbidden)
+		return
+	}
+
+	var reqBody struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reqBody.URL == "" {
+		http.Error(w, errMissingField("url").Error(), http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(reqBody.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "url must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+	if len(reqBody.Events) == 0 {
+		http.Error(w, fmt.Sprintf("events must list at least one of %s", strings.Join(webhookEventTypes, ", ")), http.StatusBadRequest)
+		return
+	}
+	for _, event := range reqBody.Events {
+		if !slices.Contains(webhookEventTypes, event) {
+			http.Error(w, fmt.Sprintf("Unknown event %q", event), http.StatusBadRequest)
+			return
+		}
+	}
+
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		log.Printf("ERROR: Failed to generate webhook secret: %v", err)
+		http.Error(w, "Internal server error when registering webhook.", http.StatusInternalServerError)
+		return
+	}
+	hook := &Webhook{
+		URL:     reqBody.URL,
+		Events:  reqBody.Events,
+		Secret:  hex.EncodeToString(secretBytes),
+		Created: time.Now(),
+	}
+
+	ctx := r.Context()
+	var key *datastore.Key
+	err := withRetry(ctx, func() (err error) {
+		key, err = dsClient.Put(ctx, datastore.IncompleteKey("Webhook", nil), hook)
+		return err
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to save webhook for %s: %v", reqBody.URL, err)
+		http.Error(w, "Internal server error when registering webhook.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": key.ID, "secret": hook.Secret})
+}
+
+// --- API Description ---
+
+// openAPISpec describes every /api endpoint. It is maintained by hand and checked
+// against the registered routes and the Go structs by the tests.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// handleOpenAPISpec serves the OpenAPI 3 document for integrators.
+func handleOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// --- Request Timeouts ---
+
+// defaultRequestTimeoutSeconds bounds how long a handler may wait on the datastore.
+// Override with REQUEST_TIMEOUT_SECONDS.
+const defaultRequestTimeoutSeconds = 10
+
+// requestTimeoutMessage is returned with a 503 when a request runs out of time.
+const requestTimeoutMessage = "The datastore took too long to respond. Please try again."
+
+// untimedPaths stream a whole game backup through the response or request body. That
+// can take longer than any fixed deadline, and http.TimeoutHandler would buffer the
+// whole response in memory, so they get no timeout.
+var untimedPaths = map[string]bool{
+	"/api/admin/export": true,
+	"/api/admin/import": true,
+}
+
+// timeoutMiddleware gives every request a context with a deadline. Handlers pass r.Context()
+// to the datastore, and if the deadline passes the client gets a 503 instead of hanging.
+func timeoutMiddleware(next http.Handler, timeout time.Duration) http.Handler {
+	timeoutHandler := http.TimeoutHandler(next, timeout, requestTimeoutMessage)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// WebSockets are long-lived and need the raw writer to hijack the connection.
+		if r.Header.Get("Upgrade") != "" || untimedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		timeoutHandler.ServeHTTP(w, r)
+	})
+}
+
+// --- Panic Recovery ---
+
+// requestID identifies a request in the logs. App Engine sends a trace ID with every
+// request; elsewhere a random one is made up so the log lines of a panic still match.
+func requestID(r *http.Request) string {
+	if trace, _, _ := strings.Cut(r.Header.Get("X-Cloud-Trace-Context"), "/"); trace != "" {
+		return trace
+	}
+	idBytes := make([]byte, 8)
+	rand.Read(idBytes)
+	return hex.EncodeToString(idBytes)
+}
+
+// recoverMiddleware turns a panicking handler into a 500 for that one request, instead of
+// letting it take down the whole instance. The stack trace is logged with the request ID.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// net/http uses this panic to abort a response on purpose.
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			log.Printf("ERROR: Panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, requestID(r), err, debug.Stack())
+			if rec.wroteHeader {
+				// Too late for a clean error; the client sees a truncated response.
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Internal server error"})
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// --- Game Namespaces ---
+
+// Each game can keep its data in its own datastore namespace, so one deployment can
+// run several games. Requests pick the game with a subdomain of namespaceDomain, or,
+// when that isn't set, with the X-Game-Namespace header. Without either they use the
+// default namespace, as before namespaces existed. Only the default game and games a
+// lead created with POST /api/admin/games are served. Lead accounts and webhooks live
+// in the default namespace; each lead belongs to one game and can only sign in to it.
+
+// namespaceHeader names the game namespace of a request.
+const namespaceHeader = "X-Game-Namespace"
+
+// namespaceDomain is the domain whose subdomains name game namespaces, so that
+// spring.games.example.com plays in the "spring" namespace. Set with NAMESPACE_DOMAIN.
+var namespaceDomain = ""
+
+// validNamespace matches the namespace names datastore accepts. Names starting
+// with "__" are reserved and rejected separately.
+var validNamespace = regexp.MustCompile(`^[0-9A-Za-z._-]{0,100}$`)
+
+// namespaceContextKey holds the game namespace in the request context.
+const namespaceContextKey contextKey = "namespace"
+
+// withNamespace returns a context for the game in namespace.
+func withNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, namespaceContextKey, namespace)
+}
+
+// gameNamespace returns the game namespace of ctx, "" for the default one.
+func gameNamespace(ctx context.Context) string {
+	namespace, _ := ctx.Value(namespaceContextKey).(string)
+	return namespace
+}
+
+// requestNamespace picks the game namespace of a request from its host or header.
+// With namespaceDomain set the header is ignored, so the site a client was given
+// decides the game.
+func requestNamespace(r *http.Request) (string, error) {
+	namespace := r.Header.Get(namespaceHeader)
+	if namespaceDomain != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		namespace, _ = strings.CutSuffix(strings.ToLower(host), "."+namespaceDomain)
+		if namespace == strings.ToLower(host) {
+			namespace = ""
+		}
+	}
+	if !validNamespace.MatchString(namespace) || strings.HasPrefix(namespace, "__") {
+		return "", fmt.Errorf("invalid game namespace %q", namespace)
+	}
+	return namespace, nil
+}
+
+// namespaceMiddleware puts the game namespace of each request in its context.
+// Requests for a game that doesn't exist are turned away with a 404.
+func namespaceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		namespace, err := requestNamespace(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		known, err := games.known(r.Context(), namespace)
+		if err != nil {
+			log.Printf("ERROR: Failed to look up game %s: %v", namespace, err)
+			http.Error(w, "Internal server error when looking up the game.", http.StatusInternalServerError)
+			return
+		}
+		if !known {
+			http.Error(w, fmt.Sprintf("Unknown game %q", namespace), http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withNamespace(r.Context(), namespace)))
+	})
+}
+
+// gameRegistryTTL is how long the set of known games is trusted before a request
+// for an unknown one reloads it.
+const gameRegistryTTL = time.Minute
+
+// gameRegistry caches the names of the games that have a Game entity, so
+// namespaceMiddleware doesn't need a query per request.
+type gameRegistry struct {
+	mu     sync.Mutex
+	names  map[string]bool
+	loaded time.Time
+}
+
+// games is the registry of created games.
+var games = &gameRegistry{}
+
+// gameKey returns the datastore key of the Game entity for namespace.
+func gameKey(namespace string) *datastore.Key {
+	return datastore.NameKey("Game", namespace, nil)
+}
+
+// known reports whether namespace is the default game or a created one. Unknown
+// names reload the registry at most once per gameRegistryTTL, so made-up namespaces
+// can't drive a datastore query per request, and per-game state such as
+// playerRegistries only ever grows with the games leads create.
+func (g *gameRegistry) known(ctx context.Context, namespace string) (bool, error) {
+	if namespace == "" {
+		return true, nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.names[namespace] || time.Since(g.loaded) < gameRegistryTTL {
+		return g.names[namespace], nil
+	}
+	keys, err := dsClient.GetAll(ctx, datastore.NewQuery("Game").KeysOnly(), nil)
+	if err != nil {
+		return false, fmt.Errorf("listing games: %w", err)
+	}
+	g.names = make(map[string]bool, len(keys))
+	for _, key := range keys {
+		g.names[key.Name] = true
+	}
+	g.loaded = time.Now()
+	return g.names[namespace], nil
+}
+
+// add records a game that was just created.
+func (g *gameRegistry) add(namespace string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.names == nil {
+		g.names = make(map[string]bool)
+	}
+	g.names[namespace] = true
+}
+
+// handleCreateGame creates a game namespace together with the account of its first lead.
+// It expects POST /api/admin/games with {"namespace", "username", "password"}, and only
+// leads of the default game may call it.
+func handleCreateGame(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	if gameNamespace(ctx) != "" {
+		http.Error(w, "Only leads of the default game can create games", http.StatusForbidden)
+		return
+	}
+
+	var reqBody struct {
+		Namespace string `json:"namespace"`
+		Username  string `json:"username"`
+		Password  string `json:"password"`
+	}
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reqBody.Namespace == "" {
+		http.Error(w, errMissingField("namespace").Error(), http.StatusBadRequest)
+		return
+	}
+	if !validNamespace.MatchString(reqBody.Namespace) || strings.HasPrefix(reqBody.Namespace, "__") {
+		http.Error(w, fmt.Sprintf("invalid game namespace %q", reqBody.Namespace), http.StatusBadRequest)
+		return
+	}
+	if reqBody.Username == "" {
+		http.Error(w, errMissingField("username").Error(), http.StatusBadRequest)
+		return
+	}
+	if len(reqBody.Password) < 8 {
+		http.Error(w, "password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(reqBody.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("ERROR: Failed to hash password for lead %s: %v", reqBody.Username, err)
+		http.Error(w, "Internal server error when creating game.", http.StatusInternalServerError)
+		return
+	}
+
+	leadID, _ := ctx.Value(leadIDContextKey).(string)
+	var conflict string
+	_, err = dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		conflict = ""
+		var game Game
+		if err := tx.Get(gameKey(reqBody.Namespace), &game); err == nil {
+			conflict = "Game already exists"
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		var lead Lead
+		if err := tx.Get(leadKey(reqBody.Username), &lead); err == nil {
+			conflict = "Username is already taken"
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		now := time.Now()
+		if _, err := tx.Put(gameKey(reqBody.Namespace), &Game{CreatedBy: leadID, Created: now}); err != nil {
+			return err
+		}
+		_, err := tx.Put(leadKey(reqBody.Username), &Lead{Username: reqBody.Username, PasswordHash: hash, Namespace: reqBody.Namespace, Created: now})
+		return err
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to create game %s: %v", reqBody.Namespace, err)
+		http.Error(w, "Internal server error when creating game.", http.StatusInternalServerError)
+		return
+	}
+	if conflict != "" {
+		http.Error(w, conflict, http.StatusConflict)
+		return
+	}
+	games.add(reqBody.Namespace)
+	log.Printf("Lead %s created game %s with lead %s", leadID, reqBody.Namespace, reqBody.Username)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "namespace": reqBody.Namespace})
+}
+
+// gameNameKey is datastore.NameKey in the game namespace of ctx.
+func gameNameKey(ctx context.Context, kind, name string, parent *datastore.Key) *datastore.Key {
+	key := datastore.NameKey(kind, name, parent)
+	key.Namespace = gameNamespace(ctx)
+	return key
+}
+
+// gameIDKey is datastore.IDKey in the game namespace of ctx.
+func gameIDKey(ctx context.Context, kind string, id int64, parent *datastore.Key) *datastore.Key {
+	key := datastore.IDKey(kind, id, parent)
+	key.Namespace = gameNamespace(ctx)
+	return key
+}
+
+// gameIncompleteKey is datastore.IncompleteKey in the game namespace of ctx.
+func gameIncompleteKey(ctx context.Context, kind string, parent *datastore.Key) *datastore.Key {
+	key := datastore.IncompleteKey(kind, parent)
+	key.Namespace = gameNamespace(ctx)
+	return key
+}
+
+// gameQuery is datastore.NewQuery in the game namespace of ctx.
+func gameQuery(ctx context.Context, kind string) *datastore.Query {
+	return datastore.NewQuery(kind).Namespace(gameNamespace(ctx))
+}
+
+// forEachNamespace calls fn with a context for every game namespace that has data,
+// for background jobs that aren't tied to a request. It stops at the first error.
+func forEachNamespace(ctx context.Context, fn func(ctx context.Context) error) error {
+	keys, err := dsClient.GetAll(ctx, datastore.NewQuery("__namespace__").KeysOnly(), nil)
+	if err != nil {
+		return fmt.Errorf("listing namespaces: %w", err)
+	}
+	namespaces := []string{""}
+	for _, key := range keys {
+		// The default namespace is listed with an ID rather than a name.
+		if key.Name != "" && !strings.HasPrefix(key.Name, "__") {
+			namespaces = append(namespaces, key.Name)
+		}
+	}
+	for _, namespace := range namespaces {
+		if err := fn(withNamespace(ctx, namespace)); err != nil {
+			if namespace != "" {
+				return fmt.Errorf("namespace %s: %w", namespace, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// sumEachNamespace runs a cleanup job like cleanupTestResults in every game
+// namespace and returns the total it reports.
+func sumEachNamespace(ctx context.Context, job func(ctx context.Context) (int, error)) (int, error) {
+	total := 0
+	err := forEachNamespace(ctx, func(ctx context.Context) error {
+		n, err := job(ctx)
+		total += n
+		return err
+	})
+	return total, err
+}
+
+// namespaced holds one value per game namespace, created on first use. Requests only
+// reach it for games namespaceMiddleware knows, so it holds at most one value per game.
+type namespaced[T any] struct {
+	mu     sync.Mutex
+	values map[string]*T
+	// def is the default namespace's value, which is created up front so tests and
+	// other code can reach it directly.
+	def *T
+}
+
+// get returns the value for the game namespace of ctx.
+func (n *namespaced[T]) get(ctx context.Context) *T {
+	namespace := gameNamespace(ctx)
+	if namespace == "" {
+		return n.def
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.values == nil {
+		n.values = make(map[string]*T)
+	}
+	if n.values[namespace] == nil {
+		n.values[namespace] = new(T)
+	}
+	return n.values[namespace]
+}
+
+// --- Datastore Retries ---
+
+// Datastore retry defaults. The attempt count can be changed with DATASTORE_MAX_ATTEMPTS.
+const (
+	defaultDatastoreMaxAttempts = 3
+	retryBaseDelay              = 100 * time.Millisecond
+	retryMaxDelay               = 2 * time.Second
+)
+
+// datastoreMaxAttempts is how often withRetry tries a call, including the first try.
+var datastoreMaxAttempts = defaultDatastoreMaxAttempts
+
+// retryable reports whether a datastore error is transient and worth another try.
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// withRetry calls fn until it succeeds, fails with an error that isn't transient, or
+// runs out of attempts. It waits with exponential backoff and jitter between tries,
+// and gives up early when ctx is done.
+func withRetry(ctx context.Context, fn func() error) error {
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !retryable(err) || attempt >= datastoreMaxAttempts {
+			return err
+		}
+		// Wait somewhere between half and all of the delay, so clients don't retry in lockstep.
+		wait := delay/2 + mathrand.N(delay/2+1)
+		log.Printf("WARNING: Datastore call failed (attempt %d of %d), retrying in %v: %v", attempt, datastoreMaxAttempts, wait, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		delay = min(2*delay, retryMaxDelay)
+	}
+}
+
+// --- Datastore Batches ---
+
+// maxDatastoreBatchSize is the most keys Datastore accepts in one PutMulti or DeleteMulti.
+const maxDatastoreBatchSize = 500
+
+// datastoreBatchSize is how many keys batchPut and batchDelete send per call. It can be
+// lowered with DATASTORE_BATCH_SIZE, which mostly helps to exercise batching in tests.
+var datastoreBatchSize = maxDatastoreBatchSize
+
+// forEachBatch calls fn with the bounds of consecutive batches covering n items, and
+// stops at the first error.
+func forEachBatch(n int, fn func(start, end int) error) error {
+	for start := 0; start < n; start += datastoreBatchSize {
+		if err := fn(start, min(start+datastoreBatchSize, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchPut saves src under keys in batches and returns how many were saved. Earlier
+// batches stay saved when a later one fails.
+func batchPut[T any](ctx context.Context, keys []*datastore.Key, src []T) (int, error) {
+	saved := 0
+	err := forEachBatch(len(keys), func(start, end int) error {
+		if _, err := dsClient.PutMulti(ctx, keys[start:end], src[start:end]); err != nil {
+			return err
+		}
+		saved = end
+		return nil
+	})
+	return saved, err
+}
+
+// batchDelete deletes keys in batches and returns how many were deleted. Earlier
+// batches stay deleted when a later one fails.
+func batchDelete(ctx context.Context, keys []*datastore.Key) (int, error) {
+	deleted := 0
+	err := forEachBatch(len(keys), func(start, end int) error {
+		if err := dsClient.DeleteMulti(ctx, keys[start:end]); err != nil {
+			return err
+		}
+		deleted = end
+		return nil
+	})
+	return deleted, err
+}
+
+// --- Datastore Indexes ---
+
+// indexCheck is a query that needs one of the composite indexes in index.yaml.
+type indexCheck struct {
+	name  string
+	query *datastore.Query
+}
+
+// indexChecks returns a query per composite index in index.yaml. Datastore rejects a
+// query without its index even when there are no entities, so the filter values don't matter.
+func indexChecks() []indexCheck {
+	return []indexCheck{
+		{"PlayerMessage (PlayerID, -Timestamp)", datastore.NewQuery("PlayerMessage").FilterField("PlayerID", "=", "").Order("-Timestamp")},
+		{"DirectMessage (PlayerID, -Timestamp)", datastore.NewQuery("DirectMessage").FilterField("PlayerID", "=", "").Order("-Timestamp")},
+		{"LocationHistory (PlayerID, Timestamp)", datastore.NewQuery("LocationHistory").FilterField("PlayerID", "=", "").Order("Timestamp")},
+		{"PlayerMessage (IsRead, -Timestamp)", datastore.NewQuery("PlayerMessage").FilterField("IsRead", "=", false).Order("-Timestamp")},
+		{"PlayerMessage (PlayerID, IsRead, -Timestamp)", datastore.NewQuery("PlayerMessage").FilterField("PlayerID", "=", "").FilterField("IsRead", "=", false).Order("-Timestamp")},
+		{"ArchivedMessage (PlayerID, -Timestamp)", datastore.NewQuery("ArchivedMessage").FilterField("PlayerID", "=", "").Order("-Timestamp")},
+		{"EmergencyAlert (Resolved, -Raised)", datastore.NewQuery("EmergencyAlert").FilterField("Resolved", "=", false).Order("-Raised")},
+	}
+}
+
+// missingIndex reports whether err is datastore refusing a query for lack of a
+// composite index.
+func missingIndex(err error) bool {
+	s, ok := status.FromError(err)
+	return ok && s.Code() == codes.FailedPrecondition && strings.Contains(strings.ToLower(s.Message()), "index")
+}
+
+// indexWarning turns a missing index error for the named index into a message that
+// says how to fix it, or returns "" for any other error.
+func indexWarning(name string, err error) string {
+	if !missingIndex(err) {
+		return ""
+	}
+	return fmt.Sprintf("Datastore index %s is missing, deploy index.yaml with \"gcloud datastore indexes create index.yaml\": %v", name, err)
+}
+
+// checkIndexes runs every indexCheck and logs a warning for each index that's missing,
+// so an undeployed index.yaml shows up at startup rather than as failing requests.
+func checkIndexes(ctx context.Context) {
+	for _, check := range indexChecks() {
+		_, err := dsClient.GetAll(ctx, check.query.KeysOnly().Limit(1), nil)
+		if warning := indexWarning(check.name, err); warning != "" {
+			log.Printf("WARNING: %s", warning)
+		} else if err != nil {
+			log.Printf("ERROR: Failed to check datastore index %s: %v", check.name, err)
+		}
+	}
+}
+
+// --- Metrics ---
+
+// activePlayerWindow is how recently a player must have sent a location to count as active.
+const activePlayerWindow = 5 * time.Minute
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "droppydrop_http_requests_total",
+		Help: "HTTP requests by handler pattern, method and status code.",
+	}, []string{"handler", "method", "code"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "droppydrop_http_request_duration_seconds",
+		Help:    "HTTP request durations by handler pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler"})
+
+	datastoreErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "droppydrop_datastore_errors_total",
+		Help: "Datastore calls that returned an error.",
+	})
+
+	activePlayers = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "droppydrop_active_players",
+		Help: "Players that sent a location within the active window.",
+	}, countActivePlayers)
+)
+
+// countActivePlayers counts distinct players with a recent PlayerLocation, across
+// all games.
+func countActivePlayers() float64 {
+	// Scrapes can arrive before main has created the client.
+	if dsClient == nil {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	active := 0
+	err := forEachNamespace(ctx, func(ctx context.Context) error {
+		q := gameQuery(ctx, "PlayerLocation").FilterField("Timestamp", ">", time.Now().Add(-activePlayerWindow))
+		var locs []PlayerLocation
+		if _, err := dsClient.GetAll(ctx, q, &locs); err != nil {
+			return err
+		}
+		// Paused and finished players still report in, but aren't playing.
+		for _, loc := range locs {
+			if loc.Status.active() {
+				active++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to count active players for metrics: %v", err)
+		return 0
+	}
+	return float64(active)
+}
+
+// countDatastoreErrors is a gRPC interceptor for the datastore client that counts failed calls.
+func countDatastoreErrors(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if err != nil {
+		datastoreErrorsTotal.Inc()
+	}
+	return err
+}
+
+// metricsMiddleware records request counts and durations per registered handler pattern.
+// It must wrap the ServeMux, which fills in r.Pattern once it has matched the request.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		// Label by pattern rather than path so obfuscated IDs don't blow up cardinality.
+		handler := r.Pattern
+		if handler == "" {
+			handler = "unmatched"
+		}
+		httpRequestsTotal.WithLabelValues(handler, r.Method, strconv.Itoa(rec.statusCode)).Inc()
+		httpRequestDuration.WithLabelValues(handler).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.statusCode = code
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *statusRecorder) Flush() {
+	s.wroteHeader = true
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets WebSocket upgrades through the recorder.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	s.statusCode = http.StatusSwitchingProtocols
+	s.wroteHeader = true
+	return http.NewResponseController(s.ResponseWriter).Hijack()
+}
+
+// --- Lead Authentication ---
+
+// leadSessionCookie is the name of the cookie holding a lead's signed session token.
+const leadSessionCookie = "lead_session"
+
+// leadSessionTTL is how long a lead stays logged in.
+const leadSessionTTL = 12 * time.Hour
+
+type contextKey string
+
+// leadIDContextKey holds the authenticated lead's username in the request context.
+const leadIDContextKey contextKey = "leadID"
+
+// leadsRoot is the common parent of all Lead entities. Keeping them in one entity group
+// lets handleCreateLead query for existing leads inside a transaction.
+var leadsRoot = datastore.NameKey("LeadRoot", "leads", nil)
+
+// leadKey returns the datastore key for a lead's username.
+func leadKey(username string) *datastore.Key {
+	return datastore.NameKey("Lead", username, leadsRoot)
+}
+
+// leadSessionKey signs lead session cookies. It is loaded from LEAD_SESSION_KEY at startup
+// and deliberately separate from hmacSecret, which ships in the source.
+var leadSessionKey []byte
+
+// errLeadSessionsDisabled is returned by the lead endpoints when LEAD_SESSION_KEY isn't set.
+const errLeadSessionsDisabled = "Lead sessions are not configured. Set LEAD_SESSION_KEY to enable them."
+
+// signLeadSession creates a token of the form "{username}|{namespace}|{expiryUnix}|{hmac}",
+// valid only for requests to the game in namespace.
+func signLeadSession(username, namespace string, expiry time.Time) string {
+	payload := fmt.Sprintf("%s|%s|%d", username, namespace, expiry.Unix())
+	mac := hmac.New(sha256.New, leadSessionKey)
+	mac.Write([]byte(payload))
+	token := payload + "|" + hex.EncodeToString(mac.Sum(nil))
+	return base64.URLEncoding.EncodeToString([]byte(token))
+}
+
+// verifyLeadSession checks a session token's signature, expiry and game and returns
+// the lead's username. namespace is the game of the request the token came with.
+func verifyLeadSession(token, namespace string) (string, error) {
+	if len(leadSessionKey) == 0 {
+		return "", fmt.Errorf("lead sessions are not configured")
+	}
+	decoded, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid session format")
+	}
+	// The username may itself contain "|", so split from the right.
+	parts := strings.Split(string(decoded), "|")
+	if len(parts) < 4 {
+		return "", fmt.Errorf("invalid session format")
+	}
+	sig := parts[len(parts)-1]
+	payload := strings.Join(parts[:len(parts)-1], "|")
+
+	mac := hmac.New(sha256.New, leadSessionKey)
+	mac.Write([]byte(payload))
+	if !hmac.Equal([]byte(sig), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return "", fmt.Errorf("invalid session signature")
+	}
+
+	expiryUnix, err := strconv.ParseInt(parts[len(parts)-2], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid session expiry")
+	}
+	if time.Now().After(time.Unix(expiryUnix, 0)) {
+		return "", fmt.Errorf("session expired")
+	}
+	if parts[len(parts)-3] != namespace {
+		return "", fmt.Errorf("session belongs to another game")
+	}
+	return strings.Join(parts[:len(parts)-3], "|"), nil
+}
+
+// requireLead wraps a handler so it's only reachable with a valid lead session cookie.
+// The lead's username is made available to the handler via the request context.
+func requireLead(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(leadSessionKey) == 0 {
+			http.Error(w, errLeadSessionsDisabled, http.StatusServiceUnavailable)
+			return
+		}
+		cookie, err := r.Cookie(leadSessionCookie)
+		if err != nil {
+			http.Error(w, "Login required", http.StatusUnauthorized)
+			return
+		}
+		leadID, err := verifyLeadSession(cookie.Value, gameNamespace(r.Context()))
+		if err != nil {
+			http.Error(w, "Invalid or expired session", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), leadIDContextKey, leadID)))
+	}
+}
+
+// requireLeadOrSpectator is requireLead for the routes a spectator token also opens.
+// spectatorMiddleware has already checked the token and the route by the time it runs.
+func requireLeadOrSpectator(next http.HandlerFunc) http.HandlerFunc {
+	withLead := requireLead(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := spectatorToken(r); token != "" && verifySpectatorToken(token, gameNamespace(r.Context())) == nil {
+			next(w, r)
+			return
+		}
+		withLead(w, r)
+	}
+}
+
+// --- Spectator Tokens ---
+
+// spectatorTokenParam is the query parameter carrying a spectator token in a shared map link.
+// Clients that can set headers may send "Authorization: Bearer {token}" instead.
+const spectatorTokenParam = "spectator"
+
+// Spectator token lifetime bounds in minutes.
+const (
+	defaultSpectatorTokenMinutes = 4 * 60
+	maxSpectatorTokenMinutes     = 7 * 24 * 60
+)
+
+// spectatorRoutes are the only requests a spectator token is good for.
+var spectatorRoutes = []string{
+	"GET /api/locations", "GET /api/locations/clusters", "GET /api/locations/near", "GET /api/locations/bbox",
+	"GET /api/targets",
+}
+
+// spectatorTokenKey derives the key for spectator tokens from the lead session key,
+// so a spectator token can never be passed off as a lead session.
+func spectatorTokenKey() []byte {
+	mac := hmac.New(sha256.New, leadSessionKey)
+	mac.Write([]byte("spectator-token"))
+	return mac.Sum(nil)
+}
+
+// signSpectatorToken creates a read-only token of the form "{namespace}|{expiryUnix}|{hmac}",
+// valid only for the game in namespace.
+func signSpectatorToken(namespace string, expiry time.Time) string {
+	payload := namespace + "|" + strconv.FormatInt(expiry.Unix(), 10)
+	mac := hmac.New(sha256.New, spectatorTokenKey())
+	mac.Write([]byte(payload))
+	return base64.URLEncoding.EncodeToString([]byte(payload + "|" + hex.EncodeToString(mac.Sum(nil))))
+}
+
+// verifySpectatorToken checks a spectator token's signature, expiry and game.
+func verifySpectatorToken(token, namespace string) error {
+	if len(leadSessionKey) == 0 {
+		return fmt.Errorf("spectator tokens are not configured")
+	}
+	decoded, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return fmt.Errorf("invalid token format")
+	}
+	i := strings.LastIndex(string(decoded), "|")
+	if i < 0 {
+		return fmt.Errorf("invalid token format")
+	}
+	payload, sig := string(decoded[:i]), string(decoded[i+1:])
+
+	mac := hmac.New(sha256.New, spectatorTokenKey())
+	mac.Write([]byte(payload))
+	if !hmac.Equal([]byte(sig), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return fmt.Errorf("invalid token signature")
+	}
+
+	tokenNamespace, expiryStr, ok := strings.Cut(payload, "|")
+	if !ok {
+		return fmt.Errorf("invalid token format")
+	}
+	expiryUnix, err := strconv.ParseInt(expiryStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid token expiry")
+	}
+	if time.Now().After(time.Unix(expiryUnix, 0)) {
+		return fmt.Errorf("token expired")
+	}
+	if tokenNamespace != namespace {
+		return fmt.Errorf("token belongs to another game")
+	}
+	return nil
+}
+
+// spectatorToken returns the spectator token a request carries, if any.
+func spectatorToken(r *http.Request) string {
+	if token := r.URL.Query().Get(spectatorTokenParam); token != "" {
+		return token
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return ""
+}
+
+// spectatorMiddleware confines requests carrying a spectator token to spectatorRoutes.
+// Requests without a token are passed through untouched; the spectator routes
+// themselves are wrapped in requireLeadOrSpectator.
+func spectatorMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := spectatorToken(r)
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := verifySpectatorToken(token, gameNamespace(r.Context())); err != nil {
+			http.Error(w, "Invalid or expired spectator token", http.StatusUnauthorized)
+			return
+		}
+		if !slices.Contains(spectatorRoutes, r.Method+" "+r.URL.Path) {
+			http.Error(w, "Spectators have read-only access to locations and targets", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleCreateSpectatorToken mints a read-only token for sharing the live map.
+// The lifetime can be set with ?ttlMinutes=.
+func handleCreateSpectatorToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ttlMinutes := defaultSpectatorTokenMinutes
+	if ttlStr := r.URL.Query().Get("ttlMinutes"); ttlStr != "" {
+		var err error
+		ttlMinutes, err = strconv.Atoi(ttlStr)
+		if err != nil || ttlMinutes <= 0 || ttlMinutes > maxSpectatorTokenMinutes {
+			http.Error(w, fmt.Sprintf("ttlMinutes must be between 1 and %d", maxSpectatorTokenMinutes), http.StatusBadRequest)
+			return
+		}
+	}
+
+	expiry := time.Now().Add(time.Duration(ttlMinutes) * time.Minute)
+	log.Printf("Lead %s minted a spectator token valid until %s", r.Context().Value(leadIDContextKey), expiry.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": signSpectatorToken(gameNamespace(r.Context()), expiry), "expiresAt": expiry})
+}
+
+// handleLeadLogin checks a lead's credentials and issues a signed session cookie.
+func handleLeadLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(leadSessionKey) == 0 {
+		http.Error(w, errLeadSessionsDisabled, http.StatusServiceUnavailable)
+		return
+	}
+
+	var reqBody struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reqBody.Username == "" {
+		http.Error(w, errMissingField("username").Error(), http.StatusBadRequest)
+		return
+	}
+	if reqBody.Password == "" {
+		http.Error(w, errMissingField("password").Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	var lead Lead
+	err := dsClient.Get(ctx, leadKey(reqBody.Username), &lead)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Printf("ERROR: Failed to get lead %s: %v", reqBody.Username, err)
+		http.Error(w, "Internal server error when logging in.", http.StatusInternalServerError)
+		return
+	}
+	// Use the same response for unknown users, leads of other games and wrong passwords.
+	if err == datastore.ErrNoSuchEntity || lead.Namespace != gameNamespace(ctx) || bcrypt.CompareHashAndPassword(lead.PasswordHash, []byte(reqBody.Password)) != nil {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	expiry := time.Now().Add(leadSessionTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     leadSessionCookie,
+		Value:    signLeadSession(lead.Username, lead.Namespace, expiry),
+		Path:     "/",
+		Expires:  expiry,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "username": lead.Username})
+}
+
+// handleLeadMe returns the username of the logged-in lead.
+func handleLeadMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, map[string]string{"username": r.Context().Value(leadIDContextKey).(string)})
+}
+
+// handleCreateLead adds a new lead account for the game of the request. Only an existing
+// lead of that game can do this, except when no leads exist yet, so the very first
+// account of the default game can be bootstrapped. The first lead of any other game is
+// made by handleCreateGame.
+func handleCreateLead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Without a session key the first lead couldn't log in anyway, and leaving the
+	// bootstrap open would let anyone claim it before the operator sets one.
+	if len(leadSessionKey) == 0 {
+		http.Error(w, errLeadSessionsDisabled, http.StatusServiceUnavailable)
+		return
+	}
+
+	// Anyone may attempt the bootstrap, but once a lead exists a session is required.
+	authenticated := false
+	if cookie, err := r.Cookie(leadSessionCookie); err == nil {
+		_, err := verifyLeadSession(cookie.Value, gameNamespace(r.Context()))
+		authenticated = err == nil
+	}
+
+	ctx := r.Context()
+	if !authenticated && gameNamespace(ctx) != "" {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+	if !authenticated {
+		existing, err := dsClient.GetAll(ctx, datastore.NewQuery("Lead").Ancestor(leadsRoot).KeysOnly().Limit(1), nil)
+		if err != nil {
+			log.Printf("ERROR: Failed to check for existing leads: %v", err)
+			http.Error(w, "Internal server error when creating lead.", http.StatusInternalServerError)
+			return
+		}
+		if len(existing) > 0 {
+			http.Error(w, "Login required", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var reqBody struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reqBody.Username == "" {
+		http.Error(w, errMissingField("username").Error(), http.StatusBadRequest)
+		return
+	}
+	if len(reqBody.Password) < 8 {
+		http.Error(w, "password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(reqBody.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("ERROR: Failed to hash password for lead %s: %v", reqBody.Username, err)
+		http.Error(w, "Internal server error when creating lead.", http.StatusInternalServerError)
+		return
+	}
+
+	// Re-check inside the transaction so two concurrent bootstraps, or two leads
+	// picking the same username, can't both succeed.
+	var loginRequired, taken bool
+	key := leadKey(reqBody.Username)
+	_, err = dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		loginRequired, taken = false, false
+		if !authenticated {
+			existing, err := dsClient.GetAll(ctx, datastore.NewQuery("Lead").Ancestor(leadsRoot).KeysOnly().Limit(1).Transaction(tx), nil)
+			if err != nil {
+				return err
+			}
+			if len(existing) > 0 {
+				loginRequired = true
+				return nil
+			}
+		}
+
+		var existing Lead
+		if err := tx.Get(key, &existing); err == nil {
+			taken = true
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		_, err := tx.Put(key, &Lead{Username: reqBody.Username, PasswordHash: hash, Namespace: gameNamespace(ctx), Created: time.Now()})
+		return err
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to save lead %s: %v", reqBody.Username, err)
+		http.Error(w, "Internal server error when creating lead.", http.StatusInternalServerError)
+		return
+	}
+	if loginRequired {
+		http.Error(w, "Login required", http.StatusUnauthorized)
+		return
+	}
+	if taken {
+		http.Error(w, "Username is already taken", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// handleUpdateLocation handles players posting their location.
+// It expects a POST request to /api/locations/{playerID}, which replaces the stored
+// location. A PATCH goes to handlePatchLocation.
+func handleUpdateLocation(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPatch {
+		handlePatchLocation(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST or PATCH method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract obfuscatedID from URL path: /api/locations/{obfuscatedID}
+	playerID, err := resolvePlayerID(r.URL.Path, "/api/locations/")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+
+	var reqBody struct {
+		Lat             *float64     `json:"lat,omitempty"`
+		Lng             *float64     `json:"lng,omitempty"`
+		ClientTimestamp time.Time    `json:"clientTimestamp"`
+		Status          PlayerStatus `json:"status"`
+	}
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reqBody.Status == "" {
+		http.Error(w, errMissingField("status").Error(), http.StatusBadRequest)
+		return
+	}
+	if !reqBody.Status.valid() {
+		http.Error(w, fmt.Sprintf("status must be one of %v", playerStatuses), http.StatusBadRequest)
+		return
+	}
+	if reqBody.Status == PlayerStatusOK && reqBody.Lat == nil {
+		http.Error(w, errMissingField("lat").Error()+" when status is OK", http.StatusBadRequest)
+		return
+	}
+	if reqBody.Status == PlayerStatusOK && reqBody.Lng == nil {
+		http.Error(w, errMissingField("lng").Error()+" when status is OK", http.StatusBadRequest)
+		return
+	}
+
+	// Use the global client.
+	ctx := r.Context()
+
+	// New players only get in while there's room under the player limit.
+	if ok, err := playerRegistries.get(ctx).admit(ctx, []string{playerID}, true); err != nil {
+		log.Printf("ERROR: Failed to check player limit for %s: %v", playerID, err)
+		http.Error(w, "Failed to update location", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, playerLimitMessage(), http.StatusForbidden)
+		return
+	}
+
+	// The key is the player's unique ID. This acts as an "upsert".
+	key := gameNameKey(ctx, "PlayerLocation", playerID, nil)
+
+	// Start with the new information.
+	firstFix := false
+	loc := PlayerLocation{
+		Timestamp:       time.Now(), // Server receives it now
+		ClientTimestamp: reqBody.ClientTimestamp,
+		Status:          reqBody.Status,
+	}
+	// Phones with a wrong clock still get their update stored, just annotated.
+	loc.ClockSkewSeconds = clockSkewSeconds(loc.Timestamp, loc.ClientTimestamp)
+	if loc.ClockSkewSeconds != 0 {
+		log.Printf("WARNING: Clock of player %s is off by %ds", playerID, loc.ClockSkewSeconds)
+	}
+
+	if reqBody.Status == PlayerStatusOK && reqBody.Lat != nil && reqBody.Lng != nil { // A good update with coordinates
+		// Don't store more precision than the leads need to see.
+		loc.Lat = roundCoordinate(*reqBody.Lat, coordinatePrecision)
+		loc.Lng = roundCoordinate(*reqBody.Lng, coordinatePrecision)
+
+		var prev PlayerLocation
+		if err := withRetry(ctx, func() error { return dsClient.Get(ctx, key, &prev) }); err != nil && err != datastore.ErrNoSuchEntity {
+			log.Printf("ERROR: Failed to get previous location for player %s: %v", playerID, err)
+		}
+
+		// GPS jitter of a player standing still isn't worth a write.
+		if jitter(prev, loc) {
+			if _, err := checkArrival(ctx, playerID, loc); err != nil {
+				log.Printf("ERROR: Failed to check arrival for player %s: %v", playerID, err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "skipped": true})
+			return
+		}
+		loc.SpeedMps, loc.HeadingDeg = motion(prev, loc)
+		flagImplausibleJump(playerID, prev, &loc)
+		// A player's first fix, or their first after denying access, may become their default.
+		firstFix = prev.Status != PlayerStatusOK
+
+		// Reverse geocoding is optional and only runs when an API key is configured.
+		if geocodeAPIKey != "" {
+			if err := setAddress(ctx, &loc, prev); err != nil {
+				log.Printf("ERROR: Failed to reverse geocode location for player %s: %v", playerID, err)
+			}
+		}
+	} else if reqBody.Status != PlayerStatusOK { // A status-only update (e.g., "DENIED")
+		// Preserve the last known coordinates by fetching the existing entity.
+		var existingLoc PlayerLocation
+		err := withRetry(ctx, func() error { return dsClient.Get(ctx, key, &existingLoc) })
+		if err == nil && existingLoc.Lat != 0 {
+			// If we have a last known location, use it.
+			loc.Lat = existingLoc.Lat
+			loc.Lng = existingLoc.Lng
+			loc.Address, loc.AddressLat, loc.AddressLng = existingLoc.Address, existingLoc.AddressLat, existingLoc.AddressLng
+		} else {
+			// Otherwise, this is a new player with no location. Place them at their own
+			// default location, so denied players don't all pile up on the spawn point.
+			player, err := loadPlayer(ctx, playerID)
+			if err != nil {
+				log.Printf("ERROR: Failed to get default location for player %s: %v", playerID, err)
+			}
+			loc.Lat, loc.Lng = player.defaultLocation()
+		}
+	}
+
+	if err := withRetry(ctx, func() error { _, err := dsClient.Put(ctx, key, &loc); return err }); err != nil { // Save the new struct
+		log.Printf("ERROR: Failed to save location for player %s: %v", playerID, err)
+		http.Error(w, "Internal server error when saving location.", http.StatusInternalServerError)
+		return
+	}
+	locationCaches.get(ctx).put(playerID, loc)
+	if firstFix {
+		if err := rememberFirstFix(ctx, playerID, loc); err != nil {
+			log.Printf("ERROR: Failed to save default location for player %s: %v", playerID, err)
+		}
+	}
+
+	// Also save to the LocationHistory kind to keep a full record.
+	if err := saveLocationHistory(ctx, playerID, loc); err != nil {
+		log.Printf("ERROR: Failed to save location history for player %s: %v", playerID, err)
+		// We don't fail the request here, as the main location update succeeded.
+	}
+
+	if loc.Status == PlayerStatusOK {
+		if _, err := checkArrival(ctx, playerID, loc); err != nil {
+			log.Printf("ERROR: Failed to check arrival for player %s: %v", playerID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// handlePatchLocation merges the fields of a PATCH /api/locations/{playerID} into the
+// stored location in a transaction, leaving the others as they are. lat and lng go
+// together. The timestamps, clock skew, speed, heading and the stale and suspicious
+// flags describe the update rather than the location, so they're set afresh.
+// Players without a stored location get a 404 and must POST one first.
+func handlePatchLocation(w http.ResponseWriter, r *http.Request) {
+	playerID, err := resolvePlayerID(r.URL.Path, "/api/locations/")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+
+	var reqBody struct {
+		Lat             *float64      `json:"lat"`
+		Lng             *float64      `json:"lng"`
+		ClientTimestamp *time.Time    `json:"clientTimestamp"`
+		Status          *PlayerStatus `json:"status"`
+	}
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reqBody.Lat == nil && reqBody.Lng == nil && reqBody.Status == nil {
+		http.Error(w, "request body must set status, or lat and lng", http.StatusBadRequest)
+		return
+	}
+	if reqBody.Lat != nil && reqBody.Lng == nil {
+		http.Error(w, errMissingField("lng").Error()+" along with lat", http.StatusBadRequest)
+		return
+	}
+	if reqBody.Lng != nil && reqBody.Lat == nil {
+		http.Error(w, errMissingField("lat").Error()+" along with lng", http.StatusBadRequest)
+		return
+	}
+	if reqBody.Status != nil && !reqBody.Status.valid() {
+		http.Error(w, fmt.Sprintf("status must be one of %v", playerStatuses), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	key := gameNameKey(ctx, "PlayerLocation", playerID, nil)
+	var prev, loc PlayerLocation
+	_, err = dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		prev = PlayerLocation{}
+		if err := tx.Get(key, &prev); err != nil {
+			return err
+		}
+		loc = prev
+		loc.Timestamp = time.Now()
+		loc.ClientTimestamp = time.Time{}
+		if reqBody.ClientTimestamp != nil {
+			loc.ClientTimestamp = *reqBody.ClientTimestamp
+		}
+		loc.ClockSkewSeconds = clockSkewSeconds(loc.Timestamp, loc.ClientTimestamp)
+		loc.Stale, loc.Suspicious, loc.SpeedMps, loc.HeadingDeg = false, false, 0, 0
+		if reqBody.Status != nil {
+			loc.Status = *reqBody.Status
+		}
+		if reqBody.Lat != nil {
+			loc.Lat = roundCoordinate(*reqBody.Lat, coordinatePrecision)
+			loc.Lng = roundCoordinate(*reqBody.Lng, coordinatePrecision)
+			loc.SpeedMps, loc.HeadingDeg = motion(prev, loc)
+			flagImplausibleJump(playerID, prev, &loc)
+			// Geocoding doesn't belong in a transaction, so an address that no longer
+			// applies is dropped and the next POST looks it up again.
+			if loc.Address != "" && haversineMeters(loc.AddressLat, loc.AddressLng, loc.Lat, loc.Lng) > geocodeRefreshMeters {
+				loc.Address, loc.AddressLat, loc.AddressLng = "", 0, 0
+			}
+		}
+		_, err := tx.Put(key, &loc)
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "The player has no location yet, POST one first", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to patch location for player %s: %v", playerID, err)
+		http.Error(w, "Internal server error when saving location.", http.StatusInternalServerError)
+		return
+	}
+	locationCaches.get(ctx).put(playerID, loc)
+	if reqBody.Lat != nil && loc.Status == PlayerStatusOK && prev.Status != PlayerStatusOK {
+		if err := rememberFirstFix(ctx, playerID, loc); err != nil {
+			log.Printf("ERROR: Failed to save default location for player %s: %v", playerID, err)
+		}
+	}
+
+	if err := saveLocationHistory(ctx, playerID, loc); err != nil {
+		log.Printf("ERROR: Failed to save location history for player %s: %v", playerID, err)
+	}
+
+	if loc.Status == PlayerStatusOK {
+		if _, err := checkArrival(ctx, playerID, loc); err != nil {
+			log.Printf("ERROR: Failed to check arrival for player %s: %v", playerID, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loc)
+}
+
+// saveLocationHistory adds an update to the LocationHistory kind, the full record of
+// where a player has been.
+func saveLocationHistory(ctx context.Context, playerID string, loc PlayerLocation) error {
+	historyEntry := &LocationHistoryEntry{
+		PlayerID:        playerID,
+		Lat:             loc.Lat,
+		Lng:             loc.Lng,
+		Timestamp:       loc.Timestamp,
+		ClientTimestamp: loc.ClientTimestamp,
+		Status:          loc.Status,
+		Suspicious:      loc.Suspicious,
+	}
+	historyKey := gameIncompleteKey(ctx, "LocationHistory", nil)
+	return withRetry(ctx, func() error { _, err := dsClient.Put(ctx, historyKey, historyEntry); return err })
+}
+
+// loadPlayer returns a player's settings, which are empty for players who have none.
+func loadPlayer(ctx context.Context, playerID string) (Player, error) {
+	var player Player
+	err := dsClient.Get(ctx, gameNameKey(ctx, "Player", playerID, nil), &player)
+	if err == datastore.ErrNoSuchEntity {
+		return Player{}, nil
+	}
+	return player, err
+}
+
+// defaultLocation is where to show the player when nothing better is known: their own
+// default if they have one, or else the global spawn point.
+func (p Player) defaultLocation() (lat, lng float64) {
+	if p.DefaultLat == 0 && p.DefaultLng == 0 {
+		return spawnLat, spawnLng
+	}
+	return p.DefaultLat, p.DefaultLng
+}
+
+// rememberFirstFix makes loc the player's default location, unless they already have one.
+func rememberFirstFix(ctx context.Context, playerID string, loc PlayerLocation) error {
+	key := gameNameKey(ctx, "Player", playerID, nil)
+	_, err := dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var player Player
+		if err := tx.Get(key, &player); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if player.DefaultLat != 0 || player.DefaultLng != 0 {
+			return nil
+		}
+		player.DefaultLat, player.DefaultLng, player.DefaultSetBy, player.Updated = loc.Lat, loc.Lng, "", loc.Timestamp
+		_, err := tx.Put(key, &player)
+		return err
+	})
+	return err
+}
+
+// handleDefaultLocation lets leads read (GET) and set (PUT) where a player is shown
+// while they deny location access. It expects /api/admin/default-location/{obfuscatedID},
+// a PUT with {"lat": ..., "lng": ...}. A lead's default replaces one taken from a first fix.
+func handleDefaultLocation(w http.ResponseWriter, r *http.Request) {
+	playerID, err := resolvePlayerID(r.URL.Path, "/api/admin/default-location/")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		player, err := loadPlayer(ctx, playerID)
+		if err != nil {
+			log.Printf("ERROR: Failed to get default location for player %s: %v", playerID, err)
+			http.Error(w, "Internal server error when fetching default location.", http.StatusInternalServerError)
+			return
+		}
+		if player.DefaultLat == 0 && player.DefaultLng == 0 {
+			http.Error(w, "The player has no default location", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, r, player)
+
+	case http.MethodPut:
+		var reqBody struct {
+			Lat *float64 `json:"lat"`
+			Lng *float64 `json:"lng"`
+		}
+		if err := decodeJSONBody(r, &reqBody); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if reqBody.Lat == nil || reqBody.Lng == nil {
+			http.Error(w, "fields \"lat\" and \"lng\" are required", http.StatusBadRequest)
+			return
+		}
+		lat, lng := *reqBody.Lat, *reqBody.Lng
+		if lat < -90 || lat > 90 || lng < -180 || lng > 180 || (lat == 0 && lng == 0) {
+			http.Error(w, "lat must be between -90 and 90 and lng between -180 and 180, and not both 0", http.StatusBadRequest)
+			return
+		}
+
+		leadID, _ := ctx.Value(leadIDContextKey).(string)
+		player, err := updatePlayer(ctx, playerID, func(player *Player) {
+			player.DefaultLat = roundCoordinate(lat, coordinatePrecision)
+			player.DefaultLng = roundCoordinate(lng, coordinatePrecision)
+			player.DefaultSetBy = leadID
+		})
+		if err != nil {
+			log.Printf("ERROR: Failed to save default location for player %s: %v", playerID, err)
+			http.Error(w, "Internal server error when saving default location.", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, r, player)
+
+	default:
+		http.Error(w, "Only GET or PUT method is allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// updatePlayer applies update to a player's settings in a transaction, creating them if
+// the player has none yet, and returns the result.
+func updatePlayer(ctx context.Context, playerID string, update func(*Player)) (Player, error) {
+	key := gameNameKey(ctx, "Player", playerID, nil)
+	var player Player
+	_, err := dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		player = Player{}
+		if err := tx.Get(key, &player); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		update(&player)
+		player.Updated = time.Now()
+		_, err := tx.Put(key, &player)
+		return err
+	})
+	return player, err
+}
+
+// maxDisplayNameLength caps the length of a display name in bytes.
+const maxDisplayNameLength = 64
+
+// validateDisplayName trims a display name and checks it's at most maxDisplayNameLength
+// bytes of printable text. The lead page renders names as HTML, so < and > aren't allowed.
+// An empty name is fine, it goes back to showing the player ID.
+func validateDisplayName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if len(name) > maxDisplayNameLength {
+		return "", fmt.Errorf("displayName is longer than %d bytes", maxDisplayNameLength)
+	}
+	if !utf8.ValidString(name) {
+		return "", errors.New("displayName is not valid UTF-8")
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) || r == '<' || r == '>' {
+			return "", errors.New("displayName must be printable text without < or >")
+		}
+	}
+	return name, nil
+}
+
+// setDisplayName stores a player's display name, or clears it when name is empty.
+func setDisplayName(ctx context.Context, playerID, name string) (Player, error) {
+	player, err := updatePlayer(ctx, playerID, func(player *Player) { player.DisplayName = name })
+	if err != nil {
+		return Player{}, err
+	}
+	displayNameCaches.get(ctx).put(playerID, name)
+	return player, nil
+}
+
+// Display name caches, one per game namespace. They hold the name of every player who
+// has a Player entity, empty for those without a display name. setDisplayName writes
+// through to them, other writes of a Player's name invalidate them.
+var displayNameCaches = &namespaced[snapshotCache[string]]{def: &snapshotCache[string]{}}
+
+// playerDisplayNames returns the display names of players keyed by player ID, from the
+// game's display name cache when it's loaded. Players without one may be missing or
+// have an empty name, displayNameOrID handles both.
+func playerDisplayNames(ctx context.Context) (map[string]string, error) {
+	cache := displayNameCaches.get(ctx)
+	names, generation, ok := cache.get()
+	if ok {
+		return names, nil
+	}
+	var players []Player
+	keys, err := dsClient.GetAll(ctx, gameQuery(ctx, "Player"), &players)
+	if err != nil {
+		return nil, err
+	}
+	names = make(map[string]string)
+	for i, player := range players {
+		if player.DisplayName != "" {
+			names[keys[i].Name] = player.DisplayName
+		}
+	}
+	cache.fill(names, generation)
+	return names, nil
+}
+
+// displayNameOrID returns name, or playerID for a player without a display name.
+func displayNameOrID(name, playerID string) string {
+	if name != "" {
+		return name
+	}
+	return playerID
+}
+
+// playerDisplayName returns one player's display name, falling back to the player ID,
+// also when the names can't be loaded: a missing name never fails a request.
+func playerDisplayName(ctx context.Context, playerID string) string {
+	names, err := playerDisplayNames(ctx)
+	if err != nil {
+		log.Printf("ERROR: Failed to get display names: %v", err)
+	}
+	return displayNameOrID(names[playerID], playerID)
+}
+
+// handleDisplayName lets leads read (GET) and set (PUT) the name a player is shown by.
+// It expects /api/admin/display-name/{obfuscatedID}, a PUT with {"displayName": "..."},
+// where an empty name goes back to the player ID. Both return the playerID and the
+// stored displayName, empty for a player shown by their ID.
+func handleDisplayName(w http.ResponseWriter, r *http.Request) {
+	playerID, err := resolvePlayerID(r.URL.Path, "/api/admin/display-name/")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		player, err := loadPlayer(ctx, playerID)
+		if err != nil {
+			log.Printf("ERROR: Failed to get display name for player %s: %v", playerID, err)
+			http.Error(w, "Internal server error when fetching display name.", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, r, map[string]string{"playerID": playerID, "displayName": player.DisplayName})
+
+	case http.MethodPut:
+		var reqBody struct {
+			DisplayName *string `json:"displayName"`
+		}
+		if err := decodeJSONBody(r, &reqBody); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if reqBody.DisplayName == nil {
+			http.Error(w, errMissingField("displayName").Error(), http.StatusBadRequest)
+			return
+		}
+		name, err := validateDisplayName(*reqBody.DisplayName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := setDisplayName(ctx, playerID, name); err != nil {
+			log.Printf("ERROR: Failed to save display name for player %s: %v", playerID, err)
+			http.Error(w, "Internal server error when saving display name.", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, r, map[string]string{"playerID": playerID, "displayName": name})
+
+	default:
+		http.Error(w, "Only GET or PUT method is allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// defaultMaxPlausibleSpeedMps is faster than any player can travel during a game.
+const defaultMaxPlausibleSpeedMps = 50
+
+// maxPlausibleSpeedMps can be overridden with MAX_PLAUSIBLE_SPEED_MPS; 0 turns the check off.
+var maxPlausibleSpeedMps float64 = defaultMaxPlausibleSpeedMps
+
+// flagImplausibleJump marks loc as suspicious when its speed since prev is beyond
+// maxPlausibleSpeedMps. The speed must already be set.
+func flagImplausibleJump(playerID string, prev PlayerLocation, loc *PlayerLocation) {
+	if maxPlausibleSpeedMps <= 0 || loc.SpeedMps <= maxPlausibleSpeedMps {
+		return
+	}
+	loc.Suspicious = true
+	log.Printf("WARNING: Player %s jumped %.0fm at %.0f m/s, possibly a spoofed GPS", playerID, haversineMeters(prev.Lat, prev.Lng, loc.Lat, loc.Lng), loc.SpeedMps)
+}
+
+// defaultMinMoveMeters is how far a player must move before an OK update is stored.
+const defaultMinMoveMeters = 5
+
+// minMoveMeters can be overridden with MIN_MOVE_METERS; 0 stores every update.
+var minMoveMeters float64 = defaultMinMoveMeters
+
+// locationRefreshInterval is how often an update is stored even if the player didn't
+// move, so the location's timestamp shows they're still around.
+const locationRefreshInterval = time.Minute
+
+// jitter reports whether loc is an OK update too close to the stored prev to be worth
+// storing: the status is unchanged, the player moved less than minMoveMeters, and the
+// stored location is recent and not flagged as stale.
+func jitter(prev, loc PlayerLocation) bool {
+	if minMoveMeters <= 0 || prev.Timestamp.IsZero() || prev.Status != loc.Status || prev.Stale {
+		return false
+	}
+	if loc.Timestamp.Sub(prev.Timestamp) >= locationRefreshInterval {
+		return false
+	}
+	return haversineMeters(prev.Lat, prev.Lng, loc.Lat, loc.Lng) < minMoveMeters
+}
+
+// defaultClockSkewSeconds is how far a client clock may drift before updates get flagged.
+const defaultClockSkewSeconds = 5 * 60
+
+// clockSkewThreshold can be overridden with CLOCK_SKEW_SECONDS.
+var clockSkewThreshold = defaultClockSkewSeconds * time.Second
+
+// clockSkewSeconds returns how far the client clock is behind the server (negative when
+// ahead), or 0 when the client sent no timestamp or the skew is within the threshold.
+func clockSkewSeconds(server, client time.Time) int64 {
+	if client.IsZero() {
+		return 0
+	}
+	skew := server.Sub(client)
+	if skew.Abs() <= clockSkewThreshold {
+		return 0
+	}
+	return int64(skew.Round(time.Second) / time.Second)
+}
+
+// locationsCacheEnabled can be turned off with LOCATIONS_CACHE=false, so every
+// handleGetLocations request queries datastore.
+var locationsCacheEnabled = true
+
+// defaultLocationsCacheSeconds is how long a loaded snapshot of locations or display
+// names is served before datastore is read again.
+const defaultLocationsCacheSeconds = 5
+
+// locationsCacheTTL can be overridden with LOCATIONS_CACHE_SECONDS. The caches live in
+// each instance, and writes handled by another instance only reach this one once the
+// snapshot expires, so this bounds how stale the lead map can get.
+var locationsCacheTTL = defaultLocationsCacheSeconds * time.Second
+
+// snapshotCache holds a value for every entity of a kind keyed by name, so lead
+// dashboards polling don't each query datastore for them. Writes that go through put
+// keep it current. Other writes invalidate it, and the next read loads it from
+// datastore again, as does the first read after its lifetime.
+type snapshotCache[V any] struct {
+	mu      sync.RWMutex
+	loadMu  sync.Mutex // Held by load while it reads datastore
+	entries map[string]V
+	expires time.Time
+	// generation is bumped on every write, so a snapshot loaded while an entity
+	// was being written isn't stored afterwards.
+	generation uint64
+}
+
+// Location caches, one per game namespace. locationCache is the default game's.
+// handleUpdateLocation writes through to them.
+var (
+	locationCaches = &namespaced[snapshotCache[PlayerLocation]]{def: &snapshotCache[PlayerLocation]{}}
+	locationCache  = locationCaches.def
+)
+
+// get returns a copy of the cached entries if they're loaded and haven't expired, and
+// the generation to pass to fill after loading them from datastore.
+func (c *snapshotCache[V]) get() (map[string]V, uint64, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.entries == nil || !time.Now().Before(c.expires) {
+		return nil, c.generation, false
+	}
+	return maps.Clone(c.entries), c.generation, true
+}
+
+// fill stores entries loaded at generation for locationsCacheTTL, unless a write
+// happened since or LOCATIONS_CACHE switched the location caches off.
+func (c *snapshotCache[V]) fill(entries map[string]V, generation uint64) {
+	if !locationsCacheEnabled {
+		return
+	}
+	c.fillFor(entries, generation, locationsCacheTTL)
+}
+
+// fillFor is fill with a lifetime of its own, for caches LOCATIONS_CACHE doesn't cover.
+func (c *snapshotCache[V]) fillFor(entries map[string]V, generation uint64, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	c.entries = maps.Clone(entries)
+	c.expires = time.Now().Add(ttl)
+}
+
+// load returns the cached entries, or reads them with loader and keeps them for ttl.
+// Concurrent misses wait for the first one's read rather than each querying datastore.
+func (c *snapshotCache[V]) load(ttl time.Duration, loader func() (map[string]V, error)) (map[string]V, error) {
+	if entries, _, ok := c.get(); ok {
+		return entries, nil
+	}
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
+	entries, generation, ok := c.get()
+	if ok {
+		return entries, nil
+	}
+	entries, err := loader()
+	if err != nil {
+		return nil, err
+	}
+	c.fillFor(entries, generation, ttl)
+	return entries, nil
+}
+
+// put writes through a value that was just stored in datastore.
+func (c *snapshotCache[V]) put(name string, v V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if c.entries != nil {
+		c.entries[name] = v
+	}
+}
+
+// invalidate drops the cached entries after a write that didn't go through put.
+func (c *snapshotCache[V]) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.generation++
+}
+
+// cachedPlayerLocations is loadPlayerLocations served from the game's location cache
+// when it's loaded. With fresh, datastore is always read and the cache refilled.
+// The returned map belongs to the caller.
+func cachedPlayerLocations(ctx context.Context, fresh bool) (map[string]PlayerLocation, error) {
+	cache := locationCaches.get(ctx)
+	locations, generation, ok := cache.get()
+	if ok && !fresh {
+		return locations, nil
+	}
+	locations, err := loadPlayerLocations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cache.fill(locations, generation)
+	return locations, nil
+}
+
+// loadPlayerLocations returns the current location of every player, keyed by player ID.
+func loadPlayerLocations(ctx context.Context) (map[string]PlayerLocation, error) {
+	locations := make(map[string]PlayerLocation)
+	it := dsClient.Run(ctx, gameQuery(ctx, "PlayerLocation"))
+	for {
+		var loc PlayerLocation
+		key, err := it.Next(&loc)
+		if err == iterator.Done {
+			return locations, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		locations[key.Name] = loc
+	}
+}
+
+// Values of LOCATION_TIME_SOURCE.
+const (
+	locationTimeServer = "server"
+	locationTimeClient = "client"
+)
+
+// locationTimeSource picks which timestamp of a location handleGetLocations trusts for
+// ?maxAgeSeconds. Both are always stored. With "client" a phone with a wrong clock can
+// look fresh or stale to the lead, so the default is "server". Presence, the stale
+// sweeper and arrival detection always go by server time, so with "client" a player
+// can be filtered out as too old while still showing as online, or the other way around.
+var locationTimeSource = locationTimeServer
+
+// locationTime returns when loc was reported according to locationTimeSource.
+// Updates without a client timestamp fall back to the server's.
+func locationTime(loc PlayerLocation) time.Time {
+	if locationTimeSource == locationTimeClient && !loc.ClientTimestamp.IsZero() {
+		return loc.ClientTimestamp
+	}
+	return loc.Timestamp
+}
+
+// handleGetLocations handles requests from the game lead to get all locations.
+// It expects a GET request to /api/locations
+// Optional filters: ?status=OK, ?maxAgeSeconds=300 and ?excludeStale=true. When
+// several are given, a location must match all of them to be returned. ?precision= rounds coordinates to
+// fewer decimal places than are stored. Locations come from the in-memory location cache
+// unless ?fresh=true forces a datastore read.
+// Passing ?since= switches to incremental mode: only players updated after that time are
+// returned, as {"locations": {...}, "serverTime": "..."}, and the client passes serverTime
+// as ?since= on its next poll.
+func handleGetLocations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statusFilter := PlayerStatus(r.URL.Query().Get("status"))
+	fresh := r.URL.Query().Get("fresh") == "true"
+	excludeStale := r.URL.Query().Get("excludeStale") == "true"
+	var maxAge time.Duration
+	if maxAgeStr := r.URL.Query().Get("maxAgeSeconds"); maxAgeStr != "" {
+		maxAgeSeconds, err := strconv.Atoi(maxAgeStr)
+		if err != nil || maxAgeSeconds <= 0 {
+			http.Error(w, "maxAgeSeconds must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		maxAge = time.Duration(maxAgeSeconds) * time.Second
+	}
+	precision := coordinatePrecision
+	if precisionStr := r.URL.Query().Get("precision"); precisionStr != "" {
+		var err error
+		precision, err = strconv.Atoi(precisionStr)
+		if err != nil || precision < 0 || precision > coordinatePrecision {
+			http.Error(w, fmt.Sprintf("precision must be between 0 and %d", coordinatePrecision), http.StatusBadRequest)
+			return
+		}
+	}
+	var since time.Time
+	sinceStr := r.URL.Query().Get("since")
+	if sinceStr != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, sinceStr); err != nil {
+			http.Error(w, "since must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Use the global client.
+	ctx := r.Context()
+	now := time.Now()
+
+	locations, err := cachedPlayerLocations(ctx, fresh)
+	if err != nil {
+		log.Printf("ERROR: Failed to iterate over locations: %v", err)
+		http.Error(w, "Internal server error when fetching locations.", http.StatusInternalServerError)
+		return
+	}
+	// Without the names the dashboard still works, it shows the player IDs.
+	names, err := playerDisplayNames(ctx)
+	if err != nil {
+		log.Printf("ERROR: Failed to get display names for locations: %v", err)
+	}
+	for playerID, loc := range locations {
+		if statusFilter != "" && loc.Status != statusFilter {
+			delete(locations, playerID)
+			continue
+		}
+		if excludeStale && loc.Stale {
+			delete(locations, playerID)
+			continue
+		}
+		// Staleness is based on the server timestamp unless LOCATION_TIME_SOURCE says otherwise.
+		if maxAge > 0 && now.Sub(locationTime(loc)) > maxAge {
+			delete(locations, playerID)
+			continue
+		}
+		// ?since= always compares server timestamps, since that's what serverTime is.
+		if sinceStr != "" && !loc.Timestamp.After(since) {
+			delete(locations, playerID)
+			continue
+		}
+		if precision < coordinatePrecision {
+			loc.Lat = roundCoordinate(loc.Lat, precision)
+			loc.Lng = roundCoordinate(loc.Lng, precision)
+		}
+		loc.DisplayName = displayNameOrID(names[playerID], playerID)
+		locations[playerID] = loc
+	}
+
+	// The dashboard polls this endpoint, so let clients revalidate cheaply.
+	etag := locationsETag(locations)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var body interface{} = locations
+	if sinceStr != "" {
+		// now was taken before reading, so echoing it as the next ?since= can't skip an update.
+		body = map[string]interface{}{"locations": locations, "serverTime": now.UTC().Format(time.RFC3339Nano)}
+	}
+	writeJSON(w, r, body)
+}
+
+// locationsETag computes a weak ETag from the player IDs, their server timestamps,
+// coordinates, display names and flags. Every location update bumps the timestamp, the
+// coordinates cover ?precision=, and a renamed player changes the display name. The
+// sweeper sets Stale without touching the timestamp, so the flags and status are hashed
+// too. This changes whenever the payload does.
+func locationsETag(locations map[string]PlayerLocation) string {
+	playerIDs := make([]string, 0, len(locations))
+	for playerID := range locations {
+		playerIDs = append(playerIDs, playerID)
+	}
+	sort.Strings(playerIDs)
+
+	h := sha256.New()
+	for _, playerID := range playerIDs {
+		loc := locations[playerID]
+		fmt.Fprintf(h, "%s:%d:%v:%v:%q:%s:%t:%t;", playerID, loc.Timestamp.UnixNano(), loc.Lat, loc.Lng, loc.DisplayName, loc.Status, loc.Stale, loc.Suspicious)
+	}
+	return fmt.Sprintf(`W/"%s"`, hex.EncodeToString(h.Sum(nil))[:16])
+}
+
+// Cluster radius bounds in meters.
+const (
+	defaultClusterRadiusMeters = 50
+	maxClusterRadiusMeters     = 50000
+)
+
+// LocationCluster is a group of players standing close together.
+type LocationCluster struct {
+	Lat       float64  `json:"lat"` // Centroid of the members
+	Lng       float64  `json:"lng"`
+	Count     int      `json:"count"`
+	PlayerIDs []string `json:"playerIDs"`
+}
+
+// clusterLocations greedily groups players: each player joins the first cluster whose
+// centroid is within radiusMeters, or starts a new one. Players are visited in ID
+// order so the result is stable between polls. Largest clusters come first.
+func clusterLocations(locations map[string]PlayerLocation, radiusMeters float64) []LocationCluster {
+	playerIDs := make([]string, 0, len(locations))
+	for playerID, loc := range locations {
+		// Players who never sent coordinates can't be placed.
+		if loc.Lat == 0 && loc.Lng == 0 {
+			continue
+		}
+		playerIDs = append(playerIDs, playerID)
+	}
+	sort.Strings(playerIDs)
+
+	clusters := make([]LocationCluster, 0)
+	for _, playerID := range playerIDs {
+		loc := locations[playerID]
+		joined := false
+		for i := range clusters {
+			c := &clusters[i]
+			if haversineMeters(c.Lat, c.Lng, loc.Lat, loc.Lng) <= radiusMeters {
+				// Move the centroid to the running mean of its members.
+				c.Lat = (c.Lat*float64(c.Count) + loc.Lat) / float64(c.Count+1)
+				c.Lng = (c.Lng*float64(c.Count) + loc.Lng) / float64(c.Count+1)
+				c.Count++
+				c.PlayerIDs = append(c.PlayerIDs, playerID)
+				joined = true
+				break
+			}
+		}
+		if !joined {
+			clusters = append(clusters, LocationCluster{Lat: loc.Lat, Lng: loc.Lng, Count: 1, PlayerIDs: []string{playerID}})
+		}
+	}
+
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return clusters[i].Count > clusters[j].Count
+	})
+	return clusters
+}
+
+// handleGetLocationClusters groups current player locations for the lead map.
+// It expects GET /api/locations/clusters with an optional ?radius= in meters.
+func handleGetLocationClusters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	radius := float64(defaultClusterRadiusMeters)
+	if radiusStr := r.URL.Query().Get("radius"); radiusStr != "" {
+		var err error
+		radius, err = strconv.ParseFloat(radiusStr, 64)
+		if err != nil || radius <= 0 || radius > maxClusterRadiusMeters {
+			http.Error(w, fmt.Sprintf("radius must be a number of meters between 0 and %d", maxClusterRadiusMeters), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	locations, err := cachedPlayerLocations(ctx, false)
+	if err != nil {
+		log.Printf("ERROR: Failed to fetch locations for clustering: %v", err)
+		http.Error(w, "Internal server error when fetching locations.", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, clusterLocations(locations, radius))
+}
+
+// NearbyPlayer is a player's location annotated with their distance from a point.
+type NearbyPlayer struct {
+	PlayerID       string  `json:"playerID"`
+	DistanceMeters float64 `json:"distanceMeters"`
+	PlayerLocation
+}
+
+// nearbyPlayers returns the players within radiusMeters of a point, closest first.
+func nearbyPlayers(locations map[string]PlayerLocation, lat, lng, radiusMeters float64) []NearbyPlayer {
+	nearby := make([]NearbyPlayer, 0)
+	for playerID, loc := range locations {
+		if loc.Lat == 0 && loc.Lng == 0 {
+			continue
+		}
+		if d := haversineMeters(lat, lng, loc.Lat, loc.Lng); d <= radiusMeters {
+			nearby = append(nearby, NearbyPlayer{PlayerID: playerID, DistanceMeters: d, PlayerLocation: loc})
+		}
+	}
+	sort.Slice(nearby, func(i, j int) bool {
+		if nearby[i].DistanceMeters != nearby[j].DistanceMeters {
+			return nearby[i].DistanceMeters < nearby[j].DistanceMeters
+		}
+		return nearby[i].PlayerID < nearby[j].PlayerID
+	})
+	return nearby
+}
+
+// handleGetNearbyPlayers lists the players near a point, e.g. a checkpoint.
+// It expects GET /api/locations/near?lat=&lng=&radius= with the radius in meters.
+func handleGetNearbyPlayers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	lat, latErr := strconv.ParseFloat(query.Get("lat"), 64)
+	lng, lngErr := strconv.ParseFloat(query.Get("lng"), 64)
+	if latErr != nil || lngErr != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		http.Error(w, "lat must be between -90 and 90 and lng between -180 and 180", http.StatusBadRequest)
+		return
+	}
+	radius, err := strconv.ParseFloat(query.Get("radius"), 64)
+	if err != nil || radius <= 0 || radius > maxClusterRadiusMeters {
+		http.Error(w, fmt.Sprintf("radius must be a number of meters between 0 and %d", maxClusterRadiusMeters), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	locations, err := cachedPlayerLocations(ctx, false)
+	if err != nil {
+		log.Printf("ERROR: Failed to fetch locations for nearby search: %v", err)
+		http.Error(w, "Internal server error when fetching locations.", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, nearbyPlayers(locations, lat, lng, radius))
+}
+
+// boundingBox is the part of the map a lead is looking at. A box whose minLng is
+// greater than its maxLng crosses the antimeridian.
+type boundingBox struct {
+	minLat, minLng, maxLat, maxLng float64
+}
+
+// parseBoundingBox reads a box from the minLat, minLng, maxLat and maxLng parameters.
+func parseBoundingBox(query url.Values) (boundingBox, error) {
+	var values [4]float64
+	for i, name := range []string{"minLat", "minLng", "maxLat", "maxLng"} {
+		v, err := strconv.ParseFloat(query.Get(name), 64)
+		if err != nil {
+			return boundingBox{}, fmt.Errorf("%s must be a number", name)
+		}
+		values[i] = v
+	}
+	box := boundingBox{minLat: values[0], minLng: values[1], maxLat: values[2], maxLng: values[3]}
+	if box.minLat < -90 || box.maxLat > 90 || box.minLat > box.maxLat {
+		return boundingBox{}, errors.New("minLat and maxLat must be between -90 and 90, with minLat at most maxLat")
+	}
+	if box.minLng < -180 || box.minLng > 180 || box.maxLng < -180 || box.maxLng > 180 {
+		return boundingBox{}, errors.New("minLng and maxLng must be between -180 and 180")
+	}
+	return box, nil
+}
+
+// contains reports whether a point lies in the box, edges included.
+func (b boundingBox) contains(lat, lng float64) bool {
+	if lat < b.minLat || lat > b.maxLat {
+		return false
+	}
+	if b.minLng <= b.maxLng {
+		return lng >= b.minLng && lng <= b.maxLng
+	}
+	// Crossing the antimeridian, the box is everything east of minLng plus everything west of maxLng.
+	return lng >= b.minLng || lng <= b.maxLng
+}
+
+// handleGetLocationsInBox returns the locations of the players in view on a lead's map.
+// It expects GET /api/locations/bbox?minLat=&minLng=&maxLat=&maxLng=; a minLng greater
+// than maxLng selects a box across the antimeridian. Players without coordinates are left out.
+func handleGetLocationsInBox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	box, err := parseBoundingBox(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	locations, err := cachedPlayerLocations(ctx, false)
+	if err != nil {
+		log.Printf("ERROR: Failed to fetch locations for bounding box: %v", err)
+		http.Error(w, "Internal server error when fetching locations.", http.StatusInternalServerError)
+		return
+	}
+	for playerID, loc := range locations {
+		if (loc.Lat == 0 && loc.Lng == 0) || !box.contains(loc.Lat, loc.Lng) {
+			delete(locations, playerID)
+		}
+	}
+
+	writeJSON(w, r, locations)
+}
+
+// staleSweepInterval is how often the background sweeper looks for stale locations.
+const staleSweepInterval = time.Minute
+
+// sweepStaleLocations flags locations whose server timestamp is older than cutoff as stale.
+// Locations are flagged rather than deleted so the lead can still see where a player was.
+// It returns how many locations were newly flagged.
+func sweepStaleLocations(ctx context.Context, cutoff time.Time) (int, error) {
+	q := gameQuery(ctx, "PlayerLocation").FilterField("Timestamp", "<", cutoff).KeysOnly()
+	keys, err := dsClient.GetAll(ctx, q, nil)
+	if err != nil {
+		return 0, fmt.Errorf("getting stale location keys: %w", err)
+	}
+
+	flagged := 0
+	err = forEachBatch(len(keys), func(i, end int) error {
+		batchFlagged := 0
+		// Re-check inside a transaction, a player may have reported in since the query ran.
+		_, err := dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			batchFlagged = 0
+			locs := make([]PlayerLocation, end-i)
+			if err := tx.GetMulti(keys[i:end], locs); err != nil {
+				return err
+			}
+			var staleKeys []*datastore.Key
+			var staleLocs []*PlayerLocation
+			for j := range locs {
+				if locs[j].Stale || !locs[j].Timestamp.Before(cutoff) {
+					continue
+				}
+				locs[j].Stale = true
+				staleKeys = append(staleKeys, keys[i+j])
+				staleLocs = append(staleLocs, &locs[j])
+			}
+			if len(staleKeys) == 0 {
+				return nil
+			}
+			batchFlagged = len(staleKeys)
+			_, err := tx.PutMulti(staleKeys, staleLocs)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("flagging stale locations: %w", err)
+		}
+		flagged += batchFlagged
+		return nil
+	})
+	if err != nil {
+		return flagged, err
+	}
+	if flagged > 0 {
+		locationCaches.get(ctx).invalidate()
+	}
+	return flagged, nil
+}
+
+// runStaleSweeper periodically flags locations that haven't been updated for threshold.
+func runStaleSweeper(ctx context.Context, threshold time.Duration) {
+	ticker := time.NewTicker(staleSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		cutoff := time.Now().Add(-threshold)
+		flagged, err := sumEachNamespace(ctx, func(ctx context.Context) (int, error) { return sweepStaleLocations(ctx, cutoff) })
+		if err != nil {
+			log.Printf("ERROR: Stale location sweep failed: %v", err)
+			continue
+		}
+		if flagged > 0 {
+			log.Printf("Flagged %d player locations as stale", flagged)
+		}
+	}
+}
+
+// handleSweepStale flags locations older than ?olderThanMinutes= as stale.
+func handleSweepStale(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	olderThanMinutes, err := strconv.Atoi(r.URL.Query().Get("olderThanMinutes"))
+	if err != nil || olderThanMinutes <= 0 {
+		http.Error(w, "olderThanMinutes must be a positive integer", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	flagged, err := sweepStaleLocations(ctx, time.Now().Add(-time.Duration(olderThanMinutes)*time.Minute))
+	if err != nil {
+		log.Printf("ERROR: Failed to sweep stale locations: %v", err)
+		http.Error(w, "Internal server error when sweeping stale locations.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"flagged": flagged})
+}
+
+// Presence states reported by /api/presence.
+const (
+	presenceOnline  = "online"
+	presenceIdle    = "idle"
+	presenceOffline = "offline"
+)
+
+// Default presence thresholds in seconds since the last location update.
+const (
+	defaultPresenceOnlineSeconds = 60
+	defaultPresenceIdleSeconds   = 5 * 60
+)
+
+// presenceOnlineWindow and presenceIdleWindow can be overridden with PRESENCE_ONLINE_SECONDS
+// and PRESENCE_IDLE_SECONDS.
+var (
+	presenceOnlineWindow = defaultPresenceOnlineSeconds * time.Second
+	presenceIdleWindow   = defaultPresenceIdleSeconds * time.Second
+)
+
+// presenceState classifies a player by how long ago the server last heard from them.
+func presenceState(lastSeen, now time.Time) string {
+	age := now.Sub(lastSeen)
+	switch {
+	case age <= presenceOnlineWindow:
+		return presenceOnline
+	case age <= presenceIdleWindow:
+		return presenceIdle
+	default:
+		return presenceOffline
+	}
+}
+
+// playerPresence returns the presence state of every player, keyed by player ID.
+func playerPresence(locations map[string]PlayerLocation, now time.Time) map[string]string {
+	presence := make(map[string]string, len(locations))
+	for playerID, loc := range locations {
+		presence[playerID] = presenceState(loc.Timestamp, now)
+	}
+	return presence
+}
+
+// handleGetPresence reports whether each player is online, idle or offline.
+// It expects a GET request to /api/presence
+func handleGetPresence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	locations, err := loadPlayerLocations(ctx)
+	if err != nil {
+		log.Printf("ERROR: Failed to fetch locations for presence: %v", err)
+		http.Error(w, "Internal server error when fetching locations.", http.StatusInternalServerError)
+		return
+	}
+
+	// Classify on server timestamps only, client clocks can't be trusted.
+	writeJSON(w, r, playerPresence(locations, time.Now()))
+}
+
+// PlayerContact tells how long ago the server last heard from a player. An age is nil
+// if the player never reported a location or never sent a message.
+type PlayerContact struct {
+	PlayerID                 string `json:"playerID"`
+	SecondsSinceLastLocation *int64 `json:"secondsSinceLastLocation"`
+	SecondsSinceLastMessage  *int64 `json:"secondsSinceLastMessage"`
+	SecondsSinceLastContact  int64  `json:"secondsSinceLastContact"` // The younger of the two
+}
+
+// contactAges works out how long ago each player was last heard from, by location
+// update or message, and sorts them by their last contact of either kind, longest ago
+// first, then by player ID.
+func contactAges(locations map[string]PlayerLocation, lastMessages map[string]time.Time, now time.Time) []PlayerContact {
+	byPlayer := make(map[string]*PlayerContact)
+	entry := func(playerID string) *PlayerContact {
+		if byPlayer[playerID] == nil {
+			byPlayer[playerID] = &PlayerContact{PlayerID: playerID}
+		}
+		return byPlayer[playerID]
+	}
+	for playerID, loc := range locations {
+		age := int64(now.Sub(loc.Timestamp) / time.Second)
+		entry(playerID).SecondsSinceLastLocation = &age
+	}
+	for playerID, at := range lastMessages {
+		age := int64(now.Sub(at) / time.Second)
+		entry(playerID).SecondsSinceLastMessage = &age
+	}
+
+	contacts := make([]PlayerContact, 0, len(byPlayer))
+	for _, c := range byPlayer {
+		switch {
+		case c.SecondsSinceLastLocation == nil:
+			c.SecondsSinceLastContact = *c.SecondsSinceLastMessage
+		case c.SecondsSinceLastMessage == nil:
+			c.SecondsSinceLastContact = *c.SecondsSinceLastLocation
+		default:
+			c.SecondsSinceLastContact = min(*c.SecondsSinceLastLocation, *c.SecondsSinceLastMessage)
+		}
+		contacts = append(contacts, *c)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		if contacts[i].SecondsSinceLastContact != contacts[j].SecondsSinceLastContact {
+			return contacts[i].SecondsSinceLastContact > contacts[j].SecondsSinceLastContact
+		}
+		return contacts[i].PlayerID < contacts[j].PlayerID
+	})
+	return contacts
+}
+
+// handleGetContact helps leads triage who to check on. It expects GET /api/contact and
+// returns a PlayerContact for every player who reported a location or sent a message,
+// the one not heard from the longest first. Ages go by server timestamps.
+func handleGetContact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	locations, err := loadPlayerLocations(ctx)
+	if err != nil {
+		log.Printf("ERROR: Failed to fetch locations for contact ages: %v", err)
+		http.Error(w, "Internal server error when fetching locations.", http.StatusInternalServerError)
+		return
+	}
+	var messages []PlayerMessage
+	if _, err := dsClient.GetAll(ctx, gameQuery(ctx, "PlayerMessage"), &messages); err != nil {
+		log.Printf("ERROR: Failed to fetch messages for contact ages: %v", err)
+		http.Error(w, "Internal server error when fetching messages.", http.StatusInternalServerError)
+		return
+	}
+	lastMessages := make(map[string]time.Time)
+	for _, msg := range messages {
+		if msg.Timestamp.After(lastMessages[msg.PlayerID]) {
+			lastMessages[msg.PlayerID] = msg.Timestamp
+		}
+	}
+
+	writeJSON(w, r, contactAges(locations, lastMessages, time.Now()))
+}
+
+// sanitizeMessage cleans up chat message content before it's stored: control
+// characters other than newlines and tabs are dropped, surrounding whitespace is
+// trimmed. Anything else is kept as sent; pages escape it when they render it.
+// Messages with nothing left are rejected.
+func sanitizeMessage(content string) (string, error) {
+	content = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, content)
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return "", errors.New("message must not be blank")
+	}
+	return content, nil
+}
+
+// Default flood protection for player chat: at most this many messages per window.
+const (
+	defaultMaxMessagesPerWindow     = 5
+	defaultMessageRateWindowSeconds = 10
+)
+
+// maxMessagesPerWindow and messageRateWindow limit how fast a player can send messages,
+// set with MAX_MESSAGES_PER_WINDOW (0 disables the limit) and MESSAGE_RATE_WINDOW_SECONDS.
+// Location updates aren't affected.
+var (
+	maxMessagesPerWindow = defaultMaxMessagesPerWindow
+	messageRateWindow    = defaultMessageRateWindowSeconds * time.Second
+)
+
+// rateWindows remembers when each player recently did something that's limited to a
+// number of times per window.
+type rateWindows struct {
+	mu   sync.Mutex
+	sent map[string][]time.Time // Oldest first, only those within the last window
+}
+
+// Message rates of players, one per game namespace.
+var messageRates = &namespaced[rateWindows]{def: &rateWindows{}}
+
+// take records an action of playerID at now and returns 0 if the player did fewer than
+// limit within window before it. Otherwise nothing is recorded, and it returns how long
+// until the oldest of those actions leaves the window.
+func (rw *rateWindows) take(playerID string, now time.Time, limit int, window time.Duration) time.Duration {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	// Forget what left the window, so the map doesn't grow with every player.
+	for id, times := range rw.sent {
+		for len(times) > 0 && now.Sub(times[0]) >= window {
+			times = times[1:]
+		}
+		if len(times) == 0 {
+			delete(rw.sent, id)
+		} else {
+			rw.sent[id] = times
+		}
+	}
+	times := rw.sent[playerID]
+	if len(times) >= limit {
+		return times[len(times)-limit].Add(window).Sub(now)
+	}
+	if rw.sent == nil {
+		rw.sent = make(map[string][]time.Time)
+	}
+	rw.sent[playerID] = append(times, now)
+	return 0
+}
+
+// handlePlayerMessages handles players sending messages (POST) and checking their last message status (GET).
+// GET /api/messages/{obfuscatedID}/status goes to handleMessageStatus. A player sending
+// more than maxMessagesPerWindow messages per messageRateWindow gets a 429 with Retry-After.
+func handlePlayerMessages(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/status") {
+		handleMessageStatus(w, r)
+		return
+	}
+	playerID, err := resolvePlayerID(r.URL.Path, "/api/messages/")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	switch r.Method {
+	case http.MethodPost:
+		if rejectIfDisabled(w, featureChat) {
+			return
+		}
+		// Player sends a new message
+		var reqBody struct {
+			Message string `json:"message"`
+		}
+		if err := decodeJSONBody(r, &reqBody); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if reqBody.Message == "" {
+			http.Error(w, errMissingField("message").Error(), http.StatusBadRequest)
+			return
+		}
+		content, err := sanitizeMessage(reqBody.Message)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		if maxMessagesPerWindow > 0 {
+			if wait := messageRates.get(ctx).take(playerID, now, maxMessagesPerWindow, messageRateWindow); wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Too many messages, slow down.", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		msg := &PlayerMessage{
+			PlayerID:  playerID,
+			Content:   content,
+			Timestamp: now,
+			IsRead:    false,
+		}
+
+		var newKey *datastore.Key
+		if k := r.Header.Get("Idempotency-Key"); k != "" {
+			// Clients retry on flaky networks. If they send an Idempotency-Key we've
+			// already seen for this player, return the original message instead of a duplicate.
+			var existingID int64
+			newKey, existingID, err = putMessageIdempotent(ctx, playerID, k, msg)
+			if err != nil {
+				log.Printf("ERROR: Failed to save message for player %s: %v", playerID, err)
+				http.Error(w, "Internal server error when saving message.", http.StatusInternalServerError)
+				return
+			}
+			if existingID != 0 {
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": existingID})
+				return
+			}
+		} else {
+			err = withRetry(ctx, func() (err error) {
+				newKey, err = dsClient.Put(ctx, gameIncompleteKey(ctx, "PlayerMessage", nil), msg)
+				return err
+			})
+			if err != nil {
+				log.Printf("ERROR: Failed to save message for player %s: %v", playerID, err)
+				http.Error(w, "Internal server error when saving message.", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		chat.broadcast(chatTopic(ctx, playerID), ChatMessage{From: "player", DisplayName: playerDisplayName(ctx, playerID), Content: msg.Content, Timestamp: msg.Timestamp})
+		emitWebhookEvent(ctx, webhookEventNewMessage, map[string]interface{}{"playerID": playerID, "from": "player", "content": msg.Content})
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": newKey.ID})
+
+	case http.MethodGet:
+		// Player checks the status of their last message
+		query := gameQuery(ctx, "PlayerMessage").
+			FilterField("PlayerID", "=", playerID).
+			Order("-Timestamp").
+			Limit(1)
+
+		var messages []PlayerMessage
+		keys, err := dsClient.GetAll(ctx, query, &messages)
+		if err != nil {
+			if warning := indexWarning("PlayerMessage (PlayerID, -Timestamp)", err); warning != "" {
+				err = errors.New(warning)
+			}
+			log.Printf("ERROR: Failed to get last message for player %s: %v", playerID, err)
+			http.Error(w, "Internal server error retrieving message status.", http.StatusInternalServerError)
+			return
+		}
+
+		// Also get the latest DM for this player
+		dmQuery := gameQuery(ctx, "DirectMessage").
+			FilterField("PlayerID", "=", playerID).
+			Order("-Timestamp").
+			Limit(1)
+
+		var dms []DirectMessage
+		dmKeys, err := dsClient.GetAll(ctx, dmQuery, &dms)
+		if err != nil {
+			log.Printf("ERROR: Failed to get last DM for player %s: %v", playerID, err)
+			http.Error(w, "Internal server error retrieving direct message.", http.StatusInternalServerError)
+			return
+		}
+		if len(dms) > 0 {
+			dms[0].ID = dmKeys[0].ID
+		}
+		// The player app has now received every DM sent so far.
+		if err := markDMsDelivered(ctx, playerID); err != nil {
+			log.Printf("ERROR: Failed to mark DMs delivered for player %s: %v", playerID, err)
+		}
+
+		// The game state decides how soon the app polls again and whether it may see its target.
+		// Without it, fall back to an active game.
+		state, err := loadGameState(ctx)
+		if err != nil {
+			log.Printf("Failed to get game state for player %s: %v", playerID, err)
+		}
+
+		// Also get the target location for this player
+		var targetLoc TargetLocation
+		targetKey := gameNameKey(ctx, "TargetLocation", playerID, nil)
+		err = dsClient.Get(ctx, targetKey, &targetLoc)
+		// It's okay if it's not found, so we only handle other errors.
+		// Scheduled targets stay hidden until their release time, and all of them while paused.
+		now := time.Now()
+		hasTarget := err == nil && targetLoc.released(now) && !targetLoc.expired(now) && !state.Paused
+		if err != nil && err != datastore.ErrNoSuchEntity { // Don't log "not found" as an error
+			log.Printf("Failed to get target location for player %s: %v", playerID, err)
+			// Don't fail the whole request, just log the error.
+		}
+
+		// The player app uses these to decide whether to show notifications.
+		prefs, err := loadNotificationPrefs(ctx, playerID)
+		if err != nil {
+			log.Printf("Failed to get notification preferences for player %s: %v", playerID, err)
+			// Don't fail the whole request, the defaults are already filled in.
+		}
+
+		// We don't handle the 404 case here, if there are no messages, the slices will be empty.
+		// The frontend will handle this.
+
+		response := make(map[string]interface{})
+		if len(messages) > 0 {
+			messages[0].ID = keys[0].ID // Add the ID to the struct
+			response["playerMessage"] = messages[0]
+		}
+		if len(dms) > 0 {
+			response["dm"] = dms[0]
+		}
+		if hasTarget {
+			response["target"] = targetLoc
+		}
+		response["prefs"] = prefs
+		if state.Paused {
+			response["paused"] = true
+		}
+		response["pollIntervalSeconds"] = int(state.pollInterval().Seconds())
+		writeJSON(w, r, response)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+const (
+	defaultMessageStatusLimit = 20
+	maxMessageStatusLimit     = 200
+)
+
+// handleMessageStatus lists the messages a player has sent with whether a lead has
+// read them, newest first, so a player can check their message got through.
+// It expects GET /api/messages/{obfuscatedID}/status with an optional ?limit=.
+// Only the player's own messages are returned.
+func handleMessageStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	playerID, err := resolvePlayerSubpath(r.URL.Path, "/api/messages/", "/status")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+	limit := defaultMessageStatusLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxMessageStatusLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxMessageStatusLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	query := gameQuery(ctx, "PlayerMessage").
+		FilterField("PlayerID", "=", playerID).
+		Order("-Timestamp").
+		Limit(limit)
+
+	// Initialize as an empty slice to ensure we return [] instead of null in JSON.
+	messages := make([]PlayerMessage, 0)
+	keys, err := dsClient.GetAll(ctx, query, &messages)
+	if err != nil {
+		log.Printf("ERROR: Failed to get message status for player %s: %v", playerID, err)
+		http.Error(w, "Internal server error retrieving message status.", http.StatusInternalServerError)
+		return
+	}
+	for i := range messages {
+		messages[i].ID = keys[i].ID
+	}
+
+	writeJSON(w, r, messages)
+}
+
+// loadNotificationPrefs returns a player's notification preferences.
+// Everything is enabled for players who haven't saved any preferences.
+func loadNotificationPrefs(ctx context.Context, playerID string) (NotificationPrefs, error) {
+	prefs := NotificationPrefs{TargetAlerts: true, DMAlerts: true}
+	err := dsClient.Get(ctx, gameNameKey(ctx, "NotificationPrefs", playerID, nil), &prefs)
+	if err == datastore.ErrNoSuchEntity {
+		return prefs, nil
+	}
+	return prefs, err
+}
+
+// handleNotificationPrefs lets players read (GET) and update (PUT) their notification preferences.
+// It expects requests to /api/prefs/{obfuscatedID}. A PUT only changes the fields it includes.
+func handleNotificationPrefs(w http.ResponseWriter, r *http.Request) {
+	playerID, err := resolvePlayerID(r.URL.Path, "/api/prefs/")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	prefs, err := loadNotificationPrefs(ctx, playerID)
+	if err != nil {
+		log.Printf("ERROR: Failed to get notification preferences for player %s: %v", playerID, err)
+		http.Error(w, "Internal server error when fetching preferences.", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		// Nothing to change, just return the current preferences below.
+
+	case http.MethodPut:
+		var reqBody struct {
+			TargetAlerts *bool `json:"targetAlerts"`
+			DMAlerts     *bool `json:"dmAlerts"`
+		}
+		if err := decodeJSONBody(r, &reqBody); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if reqBody.TargetAlerts != nil {
+			prefs.TargetAlerts = *reqBody.TargetAlerts
+		}
+		if reqBody.DMAlerts != nil {
+			prefs.DMAlerts = *reqBody.DMAlerts
+		}
+
+		if err := withRetry(ctx, func() error {
+			_, err := dsClient.Put(ctx, gameNameKey(ctx, "NotificationPrefs", playerID, nil), &prefs)
+			return err
+		}); err != nil {
+			log.Printf("ERROR: Failed to save notification preferences for player %s: %v", playerID, err)
+			http.Error(w, "Internal server error when saving preferences.", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		http.Error(w, "Only GET or PUT method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, r, prefs)
+}
+
+// idempotencyTTL is how long a repeated Idempotency-Key returns the original message.
+const idempotencyTTL = 10 * time.Minute
+
+// putMessageIdempotent saves msg unless the player already used idempotencyKey within
+// the TTL, in which case it returns the ID of the original message instead. The record
+// and the message are written in one transaction, so concurrent retries can't both
+// miss the record and create duplicates.
+func putMessageIdempotent(ctx context.Context, playerID, idempotencyKey string, msg *PlayerMessage) (*datastore.Key, int64, error) {
+	// Allocate the message ID up front so the record can point at it inside the transaction.
+	keys, err := dsClient.AllocateIDs(ctx, []*datastore.Key{gameIncompleteKey(ctx, "PlayerMessage", nil)})
+	if err != nil {
+		return nil, 0, fmt.Errorf("allocating message ID: %w", err)
+	}
+	msgKey := keys[0]
+	recordKey := gameNameKey(ctx, "IdempotencyRecord", playerID+":"+idempotencyKey, nil)
+
+	var existingID int64
+	_, err = dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		existingID = 0
+		var record IdempotencyRecord
+		err := tx.Get(recordKey, &record)
+		if err == nil && time.Since(record.Timestamp) < idempotencyTTL {
+			existingID = record.MessageID
+			return nil
+		}
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		record = IdempotencyRecord{PlayerID: playerID, MessageID: msgKey.ID, Timestamp: msg.Timestamp}
+		if _, err := tx.Put(recordKey, &record); err != nil {
+			return err
+		}
+		_, err = tx.Put(msgKey, msg)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return msgKey, existingID, nil
+}
+
+// cleanupIdempotencyRecords deletes records whose TTL has passed and returns how many were deleted.
+func cleanupIdempotencyRecords(ctx context.Context) (int, error) {
+	q := gameQuery(ctx, "IdempotencyRecord").FilterField("Timestamp", "<", time.Now().Add(-idempotencyTTL)).KeysOnly()
+	keys, err := dsClient.GetAll(ctx, q, nil)
+	if err != nil {
+		return 0, fmt.Errorf("getting expired idempotency record keys: %w", err)
+	}
+
+	if deleted, err := batchDelete(ctx, keys); err != nil {
+		return deleted, fmt.Errorf("deleting expired idempotency records: %w", err)
+	}
+	return len(keys), nil
+}
+
+// handleMessages handles game leads fetching all messages.
+// It can be narrowed to one player and/or to unread messages only.
+// Passing ?limit= and/or ?cursor= switches to paginated mode, which returns
+// {"messages": [...], "nextCursor": "..."} instead of a bare array.
+func handleMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	query := gameQuery(ctx, "PlayerMessage").Order("-Timestamp")
+
+	// Optional filters: ?playerID={obfuscatedID} and ?unread=true.
+	if obfuscatedID := r.URL.Query().Get("playerID"); obfuscatedID != "" {
+		playerID, err := deobfuscatePlayerID(obfuscatedID)
+		if err != nil {
+			http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+			return
+		}
+		query = query.FilterField("PlayerID", "=", playerID)
+	}
+	if r.URL.Query().Get("unread") == "true" {
+		query = query.FilterField("IsRead", "=", false)
+	}
+
+	limitStr := r.URL.Query().Get("limit")
+	cursorStr := r.URL.Query().Get("cursor")
+	if limitStr == "" && cursorStr == "" {
+		var messages []PlayerMessage
+		keys, err := dsClient.GetAll(ctx, query, &messages)
+		if err != nil {
+			log.Printf("ERROR: Error fetching all messages: %v", err)
+			http.Error(w, "Internal server error when fetching messages.", http.StatusInternalServerError)
+			return
+		}
+
+		// Populate the ID field for each message from its key
+		for i := 0; i < len(messages); i++ {
+			messages[i].ID = keys[i].ID
+		}
+
+		writeJSON(w, r, messages)
+		return
+	}
+
+	limit := defaultMessagesPageSize
+	if limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxMessagesPageSize {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxMessagesPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+	query = query.Limit(limit)
+	if cursorStr != "" {
+		cursor, err := datastore.DecodeCursor(cursorStr)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		query = query.Start(cursor)
+	}
+
+	// Initialize as an empty slice to ensure we return [] instead of null in JSON.
+	messages := make([]PlayerMessage, 0, limit)
+	it := dsClient.Run(ctx, query)
+	for {
+		var msg PlayerMessage
+		key, err := it.Next(&msg)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("ERROR: Error fetching page of messages: %v", err)
+			http.Error(w, "Internal server error when fetching messages.", http.StatusInternalServerError)
+			return
+		}
+		msg.ID = key.ID
+		messages = append(messages, msg)
+	}
+
+	// A short page means we've reached the end, so there's nothing more to fetch.
+	nextCursor := ""
+	if len(messages) == limit {
+		cursor, err := it.Cursor()
+		if err != nil {
+			log.Printf("ERROR: Failed to get cursor for messages: %v", err)
+			http.Error(w, "Internal server error when fetching messages.", http.StatusInternalServerError)
+			return
+		}
+		nextCursor = cursor.String()
+	}
+
+	writeJSON(w, r, map[string]interface{}{"messages": messages, "nextCursor": nextCursor})
+}
+
+// handleSearchMessages lets game leads search all player messages and DMs for a keyword.
+// It expects GET /api/messages/search?q={keyword}&limit={n}. Datastore has no
+// full-text search, so this scans both kinds and matches case-insensitively in Go.
+func handleSearchMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	if q == "" {
+		http.Error(w, "Search query is required", http.StatusBadRequest)
+		return
+	}
+	limit := defaultSearchResults
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxSearchResults {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxSearchResults), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	// Initialize as an empty slice to ensure we return [] instead of null in JSON.
+	results := make([]ChatMessage, 0)
+
+	var playerMessages []PlayerMessage
+	if _, err := dsClient.GetAll(ctx, gameQuery(ctx, "PlayerMessage"), &playerMessages); err != nil {
+		log.Printf("ERROR: Failed to retrieve player messages for search: %v", err)
+		http.Error(w, "Internal server error when searching messages.", http.StatusInternalServerError)
+		return
+	}
+	names, err := playerDisplayNames(ctx)
+	if err != nil {
+		log.Printf("ERROR: Failed to get display names for search: %v", err)
+	}
+	for _, msg := range playerMessages {
+		if strings.Contains(strings.ToLower(msg.Content), q) {
+			results = append(results, ChatMessage{
+				PlayerID:    msg.PlayerID,
+				From:        "player",
+				DisplayName: displayNameOrID(names[msg.PlayerID], msg.PlayerID),
+				Content:     msg.Content,
+				Timestamp:   msg.Timestamp,
+				IsRead:      msg.IsRead,
+			})
+		}
+	}
+
+	var dms []DirectMessage
+	if _, err := dsClient.GetAll(ctx, gameQuery(ctx, "DirectMessage"), &dms); err != nil {
+		log.Printf("ERROR: Failed to retrieve direct messages for search: %v", err)
+		http.Error(w, "Internal server error when searching messages.", http.StatusInternalServerError)
+		return
+	}
+	for _, msg := range dms {
+		if strings.Contains(strings.ToLower(msg.Content), q) {
+			results = append(results, ChatMessage{
+				PlayerID:  msg.PlayerID,
+				From:      "lead",
+				Sender:    dmSender(msg),
+				Content:   msg.Content,
+				Timestamp: msg.Timestamp,
+			})
+		}
+	}
+
+	// Newest matches first, capped to the limit.
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Timestamp.After(results[j].Timestamp)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	writeJSON(w, r, results)
+}
+
+// handleMarkMessageRead handles game leads marking a message as read.
+func handleMarkMessageRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+
+	// Extract messageID from URL path: /api/messages/read/{messageID}
+	idStr := strings.TrimPrefix(r.URL.Path, "/api/messages/read/")
+	var messageID int64
+	if _, err := fmt.Sscan(idStr, &messageID); err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	key := gameIDKey(ctx, "PlayerMessage", messageID, nil)
+	var msg PlayerMessage
+	if err := dsClient.Get(ctx, key, &msg); err != nil {
+		// This could be a client error (bad ID) or a server error.
+		log.Printf("ERROR: Failed to get message %d to mark as read: %v", messageID, err)
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	msg.IsRead = true
+	if _, err := dsClient.Put(ctx, key, &msg); err != nil {
+		http.Error(w, "Internal server error when updating message.", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleSendDirectMessage handles a game lead sending a message to a player.
+// POST /api/dm/{obfuscatedID}/resend goes to handleResendDirectMessage.
+func handleSendDirectMessage(w http.ResponseWriter, r *http.Request) {
+	if rejectIfDisabled(w, featureChat) {
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/resend") {
+		handleResendDirectMessage(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	playerID, err := resolvePlayerID(r.URL.Path, "/api/dm/")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+
+	var reqBody struct {
+		Message string `json:"message"`
+	}
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reqBody.Message == "" {
+		http.Error(w, errMissingField("message").Error(), http.StatusBadRequest)
+		return
+	}
+	content, err := sanitizeMessage(reqBody.Message)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	senderID, _ := r.Context().Value(leadIDContextKey).(string)
+	dm := &DirectMessage{
+		PlayerID:  playerID,
+		SenderID:  senderID,
+		Content:   content,
+		Timestamp: time.Now(),
+	}
+
+	ctx := r.Context()
+	key := gameIncompleteKey(ctx, "DirectMessage", nil)
+	if err := withRetry(ctx, func() error { _, err := dsClient.Put(ctx, key, dm); return err }); err != nil {
+		log.Printf("ERROR: Failed to save DM for player %s: %v", playerID, err)
+		http.Error(w, "Internal server error when saving direct message.", http.StatusInternalServerError)
+		return
+	}
+
+	chat.broadcast(chatTopic(ctx, playerID), ChatMessage{From: "lead", Sender: dmSender(*dm), Content: dm.Content, Timestamp: dm.Timestamp})
+	emitWebhookEvent(ctx, webhookEventNewMessage, map[string]interface{}{"playerID": playerID, "from": "lead", "sender": dmSender(*dm), "content": dm.Content})
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleResendDirectMessage nudges a player by sending their most recent DM again, as a
+// new message from the requesting lead. It expects POST /api/dm/{obfuscatedID}/resend and
+// returns the new DirectMessage, or a 404 if the player was never sent a DM.
+func handleResendDirectMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	playerID, err := resolvePlayerSubpath(r.URL.Path, "/api/dm/", "/resend")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	var last []DirectMessage
+	query := gameQuery(ctx, "DirectMessage").FilterField("PlayerID", "=", playerID).Order("-Timestamp").Limit(1)
+	if _, err := dsClient.GetAll(ctx, query, &last); err != nil {
+		if warning := indexWarning("DirectMessage (PlayerID, -Timestamp)", err); warning != "" {
+			err = errors.New(warning)
+		}
+		log.Printf("ERROR: Failed to get last DM for player %s: %v", playerID, err)
+		http.Error(w, "Internal server error when fetching the last direct message.", http.StatusInternalServerError)
+		return
+	}
+	if len(last) == 0 {
+		http.Error(w, "No direct message to resend", http.StatusNotFound)
+		return
+	}
+
+	// The copy starts out undelivered and unread, like any new DM.
+	senderID, _ := ctx.Value(leadIDContextKey).(string)
+	dm := &DirectMessage{
+		PlayerID:  playerID,
+		SenderID:  senderID,
+		Content:   last[0].Content,
+		Timestamp: time.Now(),
+	}
+	var key *datastore.Key
+	if err := withRetry(ctx, func() error {
+		var err error
+		key, err = dsClient.Put(ctx, gameIncompleteKey(ctx, "DirectMessage", nil), dm)
+		return err
+	}); err != nil {
+		log.Printf("ERROR: Failed to resend DM to player %s: %v", playerID, err)
+		http.Error(w, "Internal server error when saving direct message.", http.StatusInternalServerError)
+		return
+	}
+	dm.ID = key.ID
+
+	chat.broadcast(chatTopic(ctx, playerID), leadChatMessage(*dm, key))
+	emitWebhookEvent(ctx, webhookEventNewMessage, map[string]interface{}{"playerID": playerID, "from": "lead", "sender": dmSender(*dm), "content": dm.Content})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(dm)
+}
+
+// markDMsDelivered stamps DeliveredAt on the player's DMs that don't have it yet.
+// It's called whenever the player app fetches its DMs. DMs stored before DeliveredAt
+// existed only match the filter once backfillDMDelivery has run.
+func markDMsDelivered(ctx context.Context, playerID string) error {
+	q := gameQuery(ctx, "DirectMessage").
+		FilterField("PlayerID", "=", playerID).
+		FilterField("DeliveredAt", "=", time.Time{})
+	var dms []*DirectMessage
+	keys, err := dsClient.GetAll(ctx, q, &dms)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	now := time.Now()
+	for _, dm := range dms {
+		dm.DeliveredAt = now
+	}
+	_, err = batchPut(ctx, keys, dms)
+	return err
+}
+
+// backfillDMDelivery gives DMs stored before DeliveredAt existed a zero DeliveredAt,
+// so markDMsDelivered's filter finds them. A missing property never matches a filter,
+// so they'd otherwise stay undelivered for good. It returns how many DMs it updated.
+func backfillDMDelivery(ctx context.Context) (int, error) {
+	var dms []datastore.PropertyList
+	keys, err := dsClient.GetAll(ctx, gameQuery(ctx, "DirectMessage"), &dms)
+	if err != nil {
+		return 0, fmt.Errorf("getting direct messages: %w", err)
+	}
+	var legacyKeys []*datastore.Key
+	var legacy []datastore.PropertyList
+	for i, props := range dms {
+		if !slices.ContainsFunc(props, func(p datastore.Property) bool { return p.Name == "DeliveredAt" }) {
+			legacyKeys = append(legacyKeys, keys[i])
+			legacy = append(legacy, append(props, datastore.Property{Name: "DeliveredAt", Value: time.Time{}}))
+		}
+	}
+	updated, err := batchPut(ctx, legacyKeys, legacy)
+	if err != nil {
+		return updated, fmt.Errorf("backfilling DeliveredAt: %w", err)
+	}
+	return updated, nil
+}
+
+// handleMarkDirectMessageRead lets the player app acknowledge that it displayed a DM.
+// It expects POST /api/dm/read/{obfuscatedID}/{messageID}. Only the DM's recipient
+// can mark it read.
+func handleMarkDirectMessageRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	messageIDStr := path.Base(r.URL.Path)
+	playerID, err := resolvePlayerSubpath(r.URL.Path, "/api/dm/read/", "/"+messageIDStr)
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+	messageID, err := strconv.ParseInt(messageIDStr, 10, 64)
+	if err != nil || messageID <= 0 {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	key := gameIDKey(ctx, "DirectMessage", messageID, nil)
+	errNotRecipient := fmt.Errorf("not the recipient")
+	var dm DirectMessage
+	_, err = dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(key, &dm); err != nil {
+			return err
+		}
+		if dm.PlayerID != playerID {
+			return errNotRecipient
+		}
+		if !dm.ReadAt.IsZero() {
+			return nil // Keep the first receipt.
+		}
+		now := time.Now()
+		dm.ReadAt = now
+		if dm.DeliveredAt.IsZero() {
+			dm.DeliveredAt = now
+		}
+		_, err := tx.Put(key, &dm)
+		return err
+	})
+	switch {
+	case err == datastore.ErrNoSuchEntity:
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	case err == errNotRecipient:
+		http.Error(w, "This message was sent to another player", http.StatusForbidden)
+		return
+	case err != nil:
+		log.Printf("ERROR: Failed to mark DM %d read for player %s: %v", messageID, playerID, err)
+		http.Error(w, "Internal server error when marking message as read.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "readAt": dm.ReadAt})
+}
+
+// defaultTargetsCacheSeconds is how long handleGetTargets serves the same snapshot.
+const defaultTargetsCacheSeconds = 5
+
+// targetsCacheTTL can be overridden with TARGETS_CACHE_SECONDS; 0 disables the cache.
+var targetsCacheTTL = defaultTargetsCacheSeconds * time.Second
+
+// Targets caches, one per game namespace, holding the snapshot of all targets served
+// by handleGetTargets for targetsCacheTTL. Everything that writes a TargetLocation
+// invalidates them. targetCache is the default game's.
+var (
+	targetCaches = &namespaced[snapshotCache[TargetLocation]]{def: &snapshotCache[TargetLocation]{}}
+	targetCache  = targetCaches.def
+)
+
+// TargetListEntry is a target together with the player it belongs to, as listed by
+// handleGetTargets with ?sort=time.
+type TargetListEntry struct {
+	PlayerID string `json:"playerID"`
+	TargetLocation
+}
+
+// handleGetTargets handles requests from the game lead to get all target locations.
+// By default it returns a map keyed by player ID. ?released=true only returns targets
+// players can see, ?released=false only those still hidden or scheduled. ?sort=time
+// returns a TargetListEntry array sorted by the time each target was set instead.
+func handleGetTargets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	releasedFilter := r.URL.Query().Get("released")
+	if releasedFilter != "" && releasedFilter != "true" && releasedFilter != "false" {
+		http.Error(w, "released must be true or false", http.StatusBadRequest)
+		return
+	}
+	sortOrder := r.URL.Query().Get("sort")
+	if sortOrder != "" && sortOrder != "time" {
+		http.Error(w, "sort must be time", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	targets, err := targetCaches.get(ctx).load(targetsCacheTTL, func() (map[string]TargetLocation, error) {
+		targets := make(map[string]TargetLocation)
+		it := dsClient.Run(ctx, gameQuery(ctx, "TargetLocation"))
+		for {
+			var loc TargetLocation
+			key, err := it.Next(&loc)
+			if err == iterator.Done {
+				return targets, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			targets[key.Name] = loc
+		}
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to iterate over targets: %v", err)
+		http.Error(w, "Internal server error when fetching targets.", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	targets = withoutExpired(targets, now)
+	if releasedFilter != "" {
+		wantReleased := releasedFilter == "true"
+		filtered := make(map[string]TargetLocation, len(targets))
+		for playerID, target := range targets {
+			if target.released(now) == wantReleased {
+				filtered[playerID] = target
+			}
+		}
+		targets = filtered
+	}
+
+	var response interface{} = targets
+	if sortOrder == "time" {
+		response = targetsByTime(targets)
+	}
+	writeJSON(w, r, response)
+}
+
+// targetsByTime lists targets by the time they were set, oldest first. Targets set
+// at the same time are ordered by player ID, so the order is always the same.
+func targetsByTime(targets map[string]TargetLocation) []TargetListEntry {
+	entries := make([]TargetListEntry, 0, len(targets))
+	for playerID, target := range targets {
+		entries = append(entries, TargetListEntry{PlayerID: playerID, TargetLocation: target})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Timestamp.Equal(entries[j].Timestamp) {
+			return entries[i].Timestamp.Before(entries[j].Timestamp)
+		}
+		return entries[i].PlayerID < entries[j].PlayerID
+	})
+	return entries
+}
+
+// withoutExpired returns the targets that haven't expired at now. The cached
+// snapshot is shared, so expired targets are dropped from a copy.
+func withoutExpired(targets map[string]TargetLocation, now time.Time) map[string]TargetLocation {
+	var live map[string]TargetLocation
+	for playerID, target := range targets {
+		if !target.expired(now) {
+			continue
+		}
+		if live == nil {
+			live = maps.Clone(targets)
+		}
+		delete(live, playerID)
+	}
+	if live == nil {
+		return targets
+	}
+	return live
+}
+
+// defaultMaxChatHistory is how many messages of a conversation are returned at most.
+const defaultMaxChatHistory = 1000
+
+// maxChatHistory caps every chat history the server builds, keeping the most recent
+// messages, and the ?limit= accepted by handleChatHistory. Override with MAX_CHAT_HISTORY.
+var maxChatHistory = defaultMaxChatHistory
+
+// chatTruncatedHeader is set to "true" on chat responses that left out older messages
+// because a conversation was longer than maxChatHistory.
+const chatTruncatedHeader = "X-Chat-Truncated"
+
+// ChatHistory is a conversation together with where the requesting lead stopped reading.
+type ChatHistory struct {
+	Messages   []ChatMessage `json:"messages"`             // Oldest first
+	UnreadFrom int64         `json:"unreadFrom,omitempty"` // ID of the first message the lead hasn't read
+	Truncated  bool          `json:"truncated,omitempty"`  // Older messages were left out to stay within maxChatHistory
+}
+
+// handleChatHistory serves the conversation history for a given player. The optional
+// ?since= (RFC3339) only returns messages sent after that time, and ?limit= only the
+// most recent N of them. Either way the messages are sorted oldest first. Leads can
+// add ?withCursor=true to get a ChatHistory marking the first message they haven't read.
+// Conversations longer than maxChatHistory are cut to the most recent messages.
+// GET and PUT /api/chat/{obfuscatedID}/cursor go to handleChatCursor.
+func handleChatHistory(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/cursor") {
+		requireLead(handleChatCursor)(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	playerID, err := resolvePlayerID(r.URL.Path, "/api/chat/")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+
+	// Only a logged-in lead has a read cursor.
+	leadID := ""
+	withCursor := r.URL.Query().Get("withCursor") == "true"
+	if withCursor {
+		cookie, err := r.Cookie(leadSessionCookie)
+		if err != nil {
+			http.Error(w, "Login required", http.StatusUnauthorized)
+			return
+		}
+		if leadID, err = verifyLeadSession(cookie.Value, gameNamespace(r.Context())); err != nil {
+			http.Error(w, "Invalid or expired session", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var since time.Time
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		since, err = time.Parse(time.RFC3339, sinceStr)
+		if err != nil {
+			http.Error(w, "since must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 0
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxChatHistory {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxChatHistory), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	allMessages, truncated, err := loadChatHistory(ctx, playerID, since, limit)
+	if err != nil {
+		log.Printf("ERROR: Failed to retrieve chat history (%s): %v", playerID, err)
+		http.Error(w, "Internal server error retrieving chat history.", http.StatusInternalServerError)
+		return
+	}
+
+	if truncated {
+		w.Header().Set(chatTruncatedHeader, "true")
+	}
+	if !withCursor {
+		writeJSON(w, r, allMessages)
+		return
+	}
+
+	// Without a cursor the lead hasn't read anything yet.
+	var cursor ReadCursor
+	if err := dsClient.Get(ctx, readCursorKey(ctx, leadID, playerID), &cursor); err != nil && err != datastore.ErrNoSuchEntity {
+		log.Printf("ERROR: Failed to get read cursor of lead %s for player %s: %v", leadID, playerID, err)
+		http.Error(w, "Internal server error retrieving chat history.", http.StatusInternalServerError)
+		return
+	}
+	history := ChatHistory{Messages: allMessages, UnreadFrom: firstUnread(allMessages, cursor.ReadUpTo, leadID), Truncated: truncated}
+	writeJSON(w, r, history)
+}
+
+// readCursorKey returns the key of a lead's read cursor for a player's conversation.
+func readCursorKey(ctx context.Context, leadID, playerID string) *datastore.Key {
+	return gameNameKey(ctx, "ReadCursor", leadID+":"+playerID, nil)
+}
+
+// firstUnread returns the ID of the first message sent after readUpTo, or 0 when the
+// lead has read everything. The lead's own messages never count as unread.
+func firstUnread(messages []ChatMessage, readUpTo time.Time, leadID string) int64 {
+	for _, msg := range messages {
+		if msg.From == "lead" && msg.Sender == leadID {
+			continue
+		}
+		if msg.Timestamp.After(readUpTo) {
+			return msg.ID
+		}
+	}
+	return 0
+}
+
+// handleChatCursor gets or moves the logged-in lead's read cursor for a conversation.
+// It expects GET or PUT /api/chat/{obfuscatedID}/cursor, the latter with
+// {"readUpTo": "2024-05-01T12:00:00Z"}.
+func handleChatCursor(w http.ResponseWriter, r *http.Request) {
+	playerID, err := resolvePlayerSubpath(r.URL.Path, "/api/chat/", "/cursor")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	leadID, _ := ctx.Value(leadIDContextKey).(string)
+	key := readCursorKey(ctx, leadID, playerID)
+	switch r.Method {
+	case http.MethodGet:
+		var cursor ReadCursor
+		if err := dsClient.Get(ctx, key, &cursor); err == datastore.ErrNoSuchEntity {
+			http.Error(w, "No read cursor for this conversation", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("ERROR: Failed to get read cursor of lead %s for player %s: %v", leadID, playerID, err)
+			http.Error(w, "Internal server error retrieving read cursor.", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, r, cursor)
+
+	case http.MethodPut:
+		var reqBody struct {
+			ReadUpTo time.Time `json:"readUpTo"`
+		}
+		if err := decodeJSONBody(r, &reqBody); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		if reqBody.ReadUpTo.IsZero() {
+			http.Error(w, errMissingField("readUpTo").Error(), http.StatusBadRequest)
+			return
+		}
+		if reqBody.ReadUpTo.After(now.Add(clockSkewThreshold)) {
+			http.Error(w, "readUpTo must not be in the future", http.StatusBadRequest)
+			return
+		}
+		cursor := &ReadCursor{LeadID: leadID, PlayerID: playerID, ReadUpTo: reqBody.ReadUpTo, Updated: now}
+		if err := withRetry(ctx, func() error { _, err := dsClient.Put(ctx, key, cursor); return err }); err != nil {
+			log.Printf("ERROR: Failed to save read cursor of lead %s for player %s: %v", leadID, playerID, err)
+			http.Error(w, "Internal server error saving read cursor.", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, r, cursor)
+
+	default:
+		http.Error(w, "Only GET or PUT method is allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// chatQuery builds the query for one side of a conversation, newest first. A non-zero
+// since only matches messages sent after it and a positive limit caps the results.
+func chatQuery(ctx context.Context, kind, playerID string, since time.Time, limit int) *datastore.Query {
+	q := gameQuery(ctx, kind).FilterField("PlayerID", "=", playerID).Order("-Timestamp")
+	if !since.IsZero() {
+		q = q.FilterField("Timestamp", ">", since)
+	}
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	return q
+}
+
+// loadChatHistory merges a player's messages and the DMs sent to them into a
+// single conversation, sorted by timestamp ascending. A non-zero since skips the
+// messages sent up to then, and a positive limit keeps only the most recent ones.
+// Without a limit the history is capped at maxChatHistory, and truncated reports
+// whether that cap left older messages out.
+func loadChatHistory(ctx context.Context, playerID string, since time.Time, limit int) (messages []ChatMessage, truncated bool, err error) {
+	// Initialize as an empty slice to ensure we return [] instead of null in JSON.
+	allMessages := make([]ChatMessage, 0)
+
+	// Fetch one more than the cap, so a longer conversation shows up as truncated.
+	capped := limit <= 0 || limit > maxChatHistory
+	if capped {
+		limit = maxChatHistory + 1
+	}
+
+	// Get messages from the player
+	playerQuery := chatQuery(ctx, "PlayerMessage", playerID, since, limit)
+	var playerMessages []PlayerMessage
+	playerKeys, err := dsClient.GetAll(ctx, playerQuery, &playerMessages)
+	if err != nil {
+		return nil, false, fmt.Errorf("retrieving player messages: %w", err)
+	}
+	if len(playerMessages) > 0 {
+		displayName := playerDisplayName(ctx, playerID)
+		for i, msg := range playerMessages {
+			chatMsg := playerChatMessage(msg, playerKeys[i])
+			chatMsg.DisplayName = displayName
+			allMessages = append(allMessages, chatMsg)
+		}
+	}
+
+	// Get messages from the game leads (DMs)
+	dmQuery := chatQuery(ctx, "DirectMessage", playerID, since, limit)
+	var dms []DirectMessage
+	dmKeys, err := dsClient.GetAll(ctx, dmQuery, &dms)
+	if err != nil {
+		return nil, false, fmt.Errorf("retrieving direct messages: %w", err)
+	}
+	for i, msg := range dms {
+		allMessages = append(allMessages, leadChatMessage(msg, dmKeys[i]))
+	}
+
+	// Sort all messages by timestamp ascending
+	sortChatMessages(allMessages)
+	if capped {
+		allMessages, truncated = truncateChat(allMessages)
+		return allMessages, truncated, nil
+	}
+	// Each side returned up to limit messages; keep the most recent of the merged set.
+	if len(allMessages) > limit {
+		allMessages = allMessages[len(allMessages)-limit:]
+	}
+	return allMessages, false, nil
+}
+
+// truncateChat keeps the most recent maxChatHistory messages of a conversation sorted
+// oldest first, and reports whether any were dropped.
+func truncateChat(messages []ChatMessage) ([]ChatMessage, bool) {
+	if len(messages) <= maxChatHistory {
+		return messages, false
+	}
+	return messages[len(messages)-maxChatHistory:], true
+}
+
+// playerChatMessage converts a stored player message to its chat form.
+func playerChatMessage(msg PlayerMessage, key *datastore.Key) ChatMessage {
+	return ChatMessage{
+		From:      "player",
+		Content:   msg.Content,
+		Timestamp: msg.Timestamp,
+		IsRead:    msg.IsRead,
+		ID:        key.ID,
+	}
+}
+
+// leadChatMessage converts a stored DM to its chat form.
+func leadChatMessage(dm DirectMessage, key *datastore.Key) ChatMessage {
+	chatMsg := ChatMessage{
+		From:      "lead",
+		Sender:    dmSender(dm),
+		Content:   dm.Content,
+		Timestamp: dm.Timestamp,
+		ID:        key.ID,
+	}
+	if !dm.DeliveredAt.IsZero() {
+		chatMsg.DeliveredAt = &dm.DeliveredAt
+	}
+	if !dm.ReadAt.IsZero() {
+		chatMsg.ReadAt = &dm.ReadAt
+	}
+	return chatMsg
+}
+
+// sortChatMessages sorts a conversation oldest first.
+func sortChatMessages(messages []ChatMessage) {
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Timestamp.Before(messages[j].Timestamp)
+	})
+}
+
+// maxChatBatchPlayers caps the conversations one batch request can load. Datastore
+// allows at most 30 values in an "in" filter.
+const maxChatBatchPlayers = 30
+
+// batchChatQuery loads the newest messages of kind for all of playerIDs with one "in"
+// query, keeping at most maxChatHistory+1 per player, one more than the cap like
+// loadChatHistory. The query reads no more than that many per player in total. When
+// it hits that limit a busy player may have crowded out older messages of the others,
+// so only the players left with fewer than the cap are queried on their own, in parallel.
+func batchChatQuery[T any](ctx context.Context, kind string, playerIDs []string, playerOf func(T) string) ([]T, []*datastore.Key, error) {
+	perPlayer := maxChatHistory + 1
+	limit := perPlayer * len(playerIDs)
+	inIDs := make([]interface{}, len(playerIDs))
+	for i, playerID := range playerIDs {
+		inIDs[i] = playerID
+	}
+
+	var batch []T
+	batchKeys, err := dsClient.GetAll(ctx, gameQuery(ctx, kind).FilterField("PlayerID", "in", inIDs).Order("-Timestamp").Limit(limit), &batch)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Group the results by player, newest first, up to the cap.
+	type playerResults struct {
+		entities []T
+		keys     []*datastore.Key
+	}
+	byPlayer := make(map[string]*playerResults, len(playerIDs))
+	for _, playerID := range playerIDs {
+		byPlayer[playerID] = &playerResults{}
+	}
+	for i, entity := range batch {
+		if results := byPlayer[playerOf(entity)]; results != nil && len(results.entities) < perPlayer {
+			results.entities = append(results.entities, entity)
+			results.keys = append(results.keys, batchKeys[i])
+		}
+	}
+
+	if len(batch) == limit {
+		var (
+			wg       sync.WaitGroup
+			mu       sync.Mutex
+			firstErr error
+		)
+		for _, playerID := range playerIDs {
+			results := byPlayer[playerID]
+			if len(results.entities) >= perPlayer {
+				continue
+			}
+			wg.Add(1)
+			go func(playerID string, results *playerResults) {
+				defer wg.Done()
+				var own []T
+				ownKeys, err := dsClient.GetAll(ctx, chatQuery(ctx, kind, playerID, time.Time{}, perPlayer), &own)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+				results.entities, results.keys = own, ownKeys
+			}(playerID, results)
+		}
+		wg.Wait()
+		if firstErr != nil {
+			return nil, nil, firstErr
+		}
+	}
+
+	var entities []T
+	var keys []*datastore.Key
+	for _, playerID := range playerIDs {
+		entities = append(entities, byPlayer[playerID].entities...)
+		keys = append(keys, byPlayer[playerID].keys...)
+	}
+	return entities, keys, nil
+}
+
+// handleChatBatch loads the conversations of several players in one round trip, for
+// the lead dashboard opening many chats at once. It expects POST /api/chat/batch with
+// {"obfuscatedIDs": [...]} and returns a map of player ID to their history, sorted
+// oldest first, using one query per message kind for the whole batch. Each history is
+// capped at maxChatHistory like a single one, and batchChatQuery bounds what is read.
+func handleChatBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody struct {
+		ObfuscatedIDs []string `json:"obfuscatedIDs"`
+	}
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(reqBody.ObfuscatedIDs) == 0 {
+		http.Error(w, errMissingField("obfuscatedIDs").Error(), http.StatusBadRequest)
+		return
+	}
+	if len(reqBody.ObfuscatedIDs) > maxChatBatchPlayers {
+		http.Error(w, fmt.Sprintf("obfuscatedIDs must list between 1 and %d players", maxChatBatchPlayers), http.StatusBadRequest)
+		return
+	}
+
+	// Initialize every list so players without messages get [] rather than nothing.
+	histories := make(map[string][]ChatMessage, len(reqBody.ObfuscatedIDs))
+	var playerIDs []string
+	for _, obfuscatedID := range reqBody.ObfuscatedIDs {
+		playerID, err := deobfuscatePlayerID(obfuscatedID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: %q", invalidPlayerIDMessage, obfuscatedID), http.StatusBadRequest)
+			return
+		}
+		if _, ok := histories[playerID]; !ok {
+			histories[playerID] = make([]ChatMessage, 0)
+			playerIDs = append(playerIDs, playerID)
+		}
+	}
+
+	ctx := r.Context()
+	playerMessages, playerKeys, err := batchChatQuery(ctx, "PlayerMessage", playerIDs, func(msg PlayerMessage) string { return msg.PlayerID })
+	if err != nil {
+		log.Printf("ERROR: Failed to retrieve player messages for chat batch: %v", err)
+		http.Error(w, "Internal server error retrieving chat history.", http.StatusInternalServerError)
+		return
+	}
+	if len(playerMessages) > 0 {
+		// Player messages carry the sender's display name, like a single history.
+		names, err := playerDisplayNames(ctx)
+		if err != nil {
+			log.Printf("ERROR: Failed to get display names for chat batch: %v", err)
+		}
+		for i, msg := range playerMessages {
+			chatMsg := playerChatMessage(msg, playerKeys[i])
+			chatMsg.DisplayName = displayNameOrID(names[msg.PlayerID], msg.PlayerID)
+			histories[msg.PlayerID] = append(histories[msg.PlayerID], chatMsg)
+		}
+	}
+
+	dms, dmKeys, err := batchChatQuery(ctx, "DirectMessage", playerIDs, func(dm DirectMessage) string { return dm.PlayerID })
+	if err != nil {
+		log.Printf("ERROR: Failed to retrieve direct messages for chat batch: %v", err)
+		http.Error(w, "Internal server error retrieving chat history.", http.StatusInternalServerError)
+		return
+	}
+	for i, dm := range dms {
+		histories[dm.PlayerID] = append(histories[dm.PlayerID], leadChatMessage(dm, dmKeys[i]))
+	}
+
+	truncated := false
+	for playerID, messages := range histories {
+		sortChatMessages(messages)
+		var cut bool
+		if histories[playerID], cut = truncateChat(messages); cut {
+			truncated = true
+		}
+	}
+
+	if truncated {
+		w.Header().Set(chatTruncatedHeader, "true")
+	}
+	writeJSON(w, r, histories)
+}
+
+// Bounds for the number of chat messages included in a player's state.
+const (
+	defaultStateChatMessages = 20
+	maxStateChatMessages     = 200
+)
+
+// PlayerState is everything the player app needs to render, in one response.
+type PlayerState struct {
+	Location  *PlayerLocation   `json:"location,omitempty"` // The last location the server stored
+	UnreadDMs int               `json:"unreadDMs"`
+	Chat      []ChatMessage     `json:"chat"`             // The most recent messages, oldest first
+	Target    *TargetLocation   `json:"target,omitempty"` // Hidden while the game is paused
+	Prefs     NotificationPrefs `json:"prefs"`
+	Paused    bool              `json:"paused,omitempty"`
+}
+
+// unreadDMCount counts the lead messages at the end of a conversation that came after
+// the player's last reply or read receipt.
+func unreadDMCount(chatHistory []ChatMessage) int {
+	unread := 0
+	for i := len(chatHistory) - 1; i >= 0 && chatHistory[i].From == "lead" && chatHistory[i].ReadAt == nil; i-- {
+		unread++
+	}
+	return unread
+}
+
+// handlePlayerState returns a player's location, recent chat, target and preferences.
+// It expects GET /api/player/{obfuscatedID}/state with an optional ?chatLimit=.
+func handlePlayerState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, "/state") {
+		http.NotFound(w, r)
+		return
+	}
+	playerID, err := resolvePlayerSubpath(r.URL.Path, "/api/player/", "/state")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+	chatLimit := defaultStateChatMessages
+	if limitStr := r.URL.Query().Get("chatLimit"); limitStr != "" {
+		chatLimit, err = strconv.Atoi(limitStr)
+		if err != nil || chatLimit < 0 || chatLimit > maxStateChatMessages {
+			http.Error(w, fmt.Sprintf("chatLimit must be between 0 and %d", maxStateChatMessages), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	var state PlayerState
+
+	var loc PlayerLocation
+	if err := dsClient.Get(ctx, gameNameKey(ctx, "PlayerLocation", playerID, nil), &loc); err == nil {
+		state.Location = &loc
+	} else if err != datastore.ErrNoSuchEntity {
+		log.Printf("ERROR: Failed to get location for player %s: %v", playerID, err)
+		http.Error(w, "Internal server error retrieving player state.", http.StatusInternalServerError)
+		return
+	}
+
+	if err := markDMsDelivered(ctx, playerID); err != nil {
+		log.Printf("ERROR: Failed to mark DMs delivered for player %s: %v", playerID, err)
+	}
+	state.Chat = []ChatMessage{}
+	if chatLimit > 0 {
+		state.Chat, _, err = loadChatHistory(ctx, playerID, time.Time{}, chatLimit)
+		if err != nil {
+			log.Printf("ERROR: Failed to retrieve chat history (%s): %v", playerID, err)
+			http.Error(w, "Internal server error retrieving player state.", http.StatusInternalServerError)
+			return
+		}
+	}
+	state.UnreadDMs = unreadDMCount(state.Chat)
+	// When every returned message is an unread DM the run may start further back, so
+	// count it over a longer window, capped at maxStateChatMessages.
+	if state.UnreadDMs == len(state.Chat) && chatLimit < maxStateChatMessages {
+		window, _, err := loadChatHistory(ctx, playerID, time.Time{}, maxStateChatMessages)
+		if err != nil {
+			log.Printf("ERROR: Failed to retrieve chat history (%s): %v", playerID, err)
+			http.Error(w, "Internal server error retrieving player state.", http.StatusInternalServerError)
+			return
+		}
+		state.UnreadDMs = unreadDMCount(window)
+	}
+
+	gameState, err := loadGameState(ctx)
+	if err != nil {
+		log.Printf("ERROR: Failed to get game state for player %s: %v", playerID, err)
+		http.Error(w, "Internal server error retrieving player state.", http.StatusInternalServerError)
+		return
+	}
+	state.Paused = gameState.Paused
+
+	var target TargetLocation
+	if err := dsClient.Get(ctx, gameNameKey(ctx, "TargetLocation", playerID, nil), &target); err == nil {
+		// Scheduled, recalled and expired targets stay hidden, as in handlePlayerMessages.
+		if now := time.Now(); target.released(now) && !target.expired(now) && !state.Paused {
+			state.Target = &target
+		}
+	} else if err != datastore.ErrNoSuchEntity {
+		log.Printf("ERROR: Failed to get target for player %s: %v", playerID, err)
+		http.Error(w, "Internal server error retrieving player state.", http.StatusInternalServerError)
+		return
+	}
+
+	state.Prefs, err = loadNotificationPrefs(ctx, playerID)
+	if err != nil {
+		log.Printf("Failed to get notification preferences for player %s: %v", playerID, err)
+		// Don't fail the whole request, the defaults are already filled in.
+	}
+
+	writeJSON(w, r, state)
+}
+
+// dmSender returns who sent a DM, falling back to "lead" for DMs sent before
+// leads had accounts.
+func dmSender(dm DirectMessage) string {
+	if dm.SenderID == "" {
+		return "lead"
+	}
+	return dm.SenderID
+}
+
+// --- Real-time Chat ---
+
+// chatHistoryOnConnect is how many recent messages a WebSocket client receives
+// when it (re)connects, so it can catch up on anything it missed.
+const chatHistoryOnConnect = 50
+
+// typingExpiry is how long a typing indicator lasts without a follow-up event.
+const typingExpiry = 5 * time.Second
+
+// chatHub fans out chat messages to every WebSocket connection subscribed to a
+// conversation. Conversations are keyed by chatTopic.
+type chatHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan ChatMessage]bool
+}
+
+// Global chat hub.
+var chat = &chatHub{subscribers: make(map[string]map[chan ChatMessage]bool)}
+
+// chatTopic names the conversation with a (deobfuscated) player ID in the game of
+// ctx, so games that happen to share player IDs don't see each other's messages.
+func chatTopic(ctx context.Context, playerID string) string {
+	if namespace := gameNamespace(ctx); namespace != "" {
+		return namespace + "/" + playerID
+	}
+	return playerID
+}
+
+// subscribe registers a new listener for a player's conversation.
+func (h *chatHub) subscribe(playerID string) chan ChatMessage {
+	ch := make(chan ChatMessage, 16)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[playerID] == nil {
+		h.subscribers[playerID] = make(map[chan ChatMessage]bool)
+	}
+	h.subscribers[playerID][ch] = true
+	return ch
+}
+
+// unsubscribe removes a listener and closes its channel.
+func (h *chatHub) unsubscribe(playerID string, ch chan ChatMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[playerID][ch]; !ok {
+		return
+	}
+	delete(h.subscribers[playerID], ch)
+	if len(h.subscribers[playerID]) == 0 {
+		delete(h.subscribers, playerID)
+	}
+	close(ch)
+}
+
+// broadcast sends a message to all listeners of a player's conversation.
+// Slow listeners whose buffer is full miss the message rather than blocking the sender.
+func (h *chatHub) broadcast(playerID string, msg ChatMessage) {
+	h.broadcastExcept(playerID, msg, nil)
+}
+
+// broadcastExcept is like broadcast but skips the given listener, typically the sender.
+func (h *chatHub) broadcastExcept(playerID string, msg ChatMessage, skip chan ChatMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers[playerID] {
+		if ch == skip {
+			continue
+		}
+		select {
+		case ch <- msg:
+		default:
+			log.Printf("Dropping chat message for slow subscriber of player %s", playerID)
+		}
+	}
+}
+
+// handleChatWebSocket upgrades to a WebSocket for real-time chat with a player.
+// It expects GET /api/chat/ws/{obfuscatedID}; the lead dashboard adds ?as=lead.
+func handleChatWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// The socket is for sending messages, chat history stays readable through GET /api/chat/.
+	if rejectIfDisabled(w, featureChat) {
+		return
+	}
+
+	playerID, err := resolvePlayerID(r.URL.Path, "/api/chat/ws/")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+
+	// Leads must be logged in, like for the DM endpoint, so their messages can be attributed.
+	from, senderID := "player", ""
+	if r.URL.Query().Get("as") == "lead" {
+		cookie, err := r.Cookie(leadSessionCookie)
+		if err != nil {
+			http.Error(w, "Login required", http.StatusUnauthorized)
+			return
+		}
+		if senderID, err = verifyLeadSession(cookie.Value, gameNamespace(r.Context())); err != nil {
+			http.Error(w, "Invalid or expired session", http.StatusUnauthorized)
+			return
+		}
+		from = "lead"
+	}
+
+	// The connection outlives request timeouts but stays in the request's game.
+	ctx := context.WithoutCancel(r.Context())
+	websocket.Handler(func(ws *websocket.Conn) {
+		serveChatConn(ctx, ws, playerID, from, senderID)
+	}).ServeHTTP(w, r)
+}
+
+// serveChatConn runs a single chat WebSocket connection until the client disconnects.
+// senderID is the lead's username for lead connections, empty for players.
+func serveChatConn(ctx context.Context, ws *websocket.Conn, playerID, from, senderID string) {
+	defer ws.Close()
+	topic := chatTopic(ctx, playerID)
+
+	// Subscribe before loading history so nothing sent in between is lost.
+	ch := chat.subscribe(topic)
+	defer chat.unsubscribe(topic, ch)
+
+	history, _, err := loadChatHistory(ctx, playerID, time.Time{}, chatHistoryOnConnect)
+	if err != nil {
+		log.Printf("ERROR: Failed to retrieve chat history for WebSocket (%s): %v", playerID, err)
+		return
+	}
+	for _, msg := range history {
+		if err := websocket.JSON.Send(ws, msg); err != nil {
+			return
+		}
+	}
+
+	// Writer: forward broadcasts for this conversation to the client.
+	go func() {
+		for msg := range ch {
+			if err := websocket.JSON.Send(ws, msg); err != nil {
+				ws.Close()
+				return
+			}
+		}
+	}()
+
+	// A typing indicator expires on its own if no follow-up arrives in time.
+	var typingTimer *time.Timer
+	stopTyping := func() {
+		if typingTimer != nil && typingTimer.Stop() {
+			chat.broadcastExcept(topic, ChatMessage{Type: chatEventStoppedTyping, From: from, Timestamp: time.Now()}, ch)
+		}
+	}
+	defer stopTyping()
+
+	// Reader: persist incoming messages and fan them out.
+	for {
+		var in struct {
+			Type    string `json:"type"`
+			Content string `json:"content"`
+		}
+		if err := websocket.JSON.Receive(ws, &in); err != nil {
+			return
+		}
+
+		if in.Type == chatEventTyping {
+			// Typing events are relayed to the other side only and never persisted.
+			if typingTimer == nil || !typingTimer.Stop() {
+				chat.broadcastExcept(topic, ChatMessage{Type: chatEventTyping, From: from, Timestamp: time.Now()}, ch)
+			}
+			typingTimer = time.AfterFunc(typingExpiry, func() {
+				chat.broadcastExcept(topic, ChatMessage{Type: chatEventStoppedTyping, From: from, Timestamp: time.Now()}, ch)
+			})
+			continue
+		}
+		content, err := sanitizeMessage(in.Content)
+		if err != nil {
+			continue
+		}
+		// A real message implicitly ends the typing indicator.
+		if typingTimer != nil {
+			typingTimer.Stop()
+		}
+
+		now := time.Now()
+		// Players can't get around the message rate limit over the WebSocket. A flood
+		// is dropped like a blank message, the connection stays up.
+		if from != "lead" && maxMessagesPerWindow > 0 && messageRates.get(ctx).take(playerID, now, maxMessagesPerWindow, messageRateWindow) > 0 {
+			continue
+		}
+		out := ChatMessage{From: from, Content: content, Timestamp: now}
+		var saveErr error
+		if from == "lead" {
+			dm := &DirectMessage{PlayerID: playerID, SenderID: senderID, Content: content, Timestamp: now}
+			_, saveErr = dsClient.Put(ctx, gameIncompleteKey(ctx, "DirectMessage", nil), dm)
+			out.Sender = dmSender(*dm)
+		} else {
+			msg := &PlayerMessage{PlayerID: playerID, Content: content, Timestamp: now}
+			_, saveErr = dsClient.Put(ctx, gameIncompleteKey(ctx, "PlayerMessage", nil), msg)
+			out.DisplayName = playerDisplayName(ctx, playerID)
+		}
+		if saveErr != nil {
+			log.Printf("ERROR: Failed to save WebSocket chat message for player %s: %v", playerID, saveErr)
+			continue
+		}
+
+		chat.broadcast(topic, out)
+		emitWebhookEvent(ctx, webhookEventNewMessage, map[string]interface{}{"playerID": playerID, "from": out.From, "sender": out.Sender, "content": out.Content})
+	}
+}
+
+// handleSetTargetLocation handles a game lead setting a target location for a player.
+// POST /api/target/{obfuscatedID}/recall hides a released target again, and
+// POST /api/target/{obfuscatedID}/rotate-hash gives it a new fake hash.
+func handleSetTargetLocation(w http.ResponseWriter, r *http.Request) {
+	if rejectIfDisabled(w, featureTargets) {
+		return
+	}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/recall"):
+		handleRecallTarget(w, r)
+		return
+	case strings.HasSuffix(r.URL.Path, "/rotate-hash"):
+		handleRotateTargetHash(w, r)
+		return
+	}
+	playerID, err := resolvePlayerID(r.URL.Path, "/api/target/")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	key := gameNameKey(ctx, "TargetLocation", playerID, nil)
+
+	if r.Method == http.MethodDelete {
+		if err := dsClient.Delete(ctx, key); err != nil {
+			log.Printf("ERROR: Failed to delete target for player %s: %v", playerID, err)
+			http.Error(w, "Internal server error when deleting target location.", http.StatusInternalServerError)
+			return
+		}
+		targetCaches.get(ctx).invalidate()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST or DELETE method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody targetRequest
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	target, err := reqBody.target(time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rejectIfPaused(ctx, w) {
+		return
+	}
+
+	if err := withRetry(ctx, func() error { _, err := dsClient.Put(ctx, key, target); return err }); err != nil {
+		log.Printf("ERROR: Failed to save target for player %s: %v", playerID, err)
+		http.Error(w, "Internal server error when saving target location.", http.StatusInternalServerError)
+		return
+	}
+	targetCaches.get(ctx).invalidate()
+	emitWebhookEvent(ctx, webhookEventTargetReleased, map[string]interface{}{"playerID": playerID, "lat": target.Lat, "lng": target.Lng})
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// targetRequest is the body lead requests use to set a player's target.
+type targetRequest struct {
+	Lat                 *float64 `json:"lat"`
+	Lng                 *float64 `json:"lng"`
+	ArrivalRadiusMeters float64  `json:"arrivalRadiusMeters"` // Optional, 0 uses the global radius
+	TTLMinutes          *int     `json:"ttlMinutes"`          // Optional, 0 never expires and nil uses targetTTL
+}
+
+// target validates the request and returns the target it sets at now.
+func (req targetRequest) target(now time.Time) (*TargetLocation, error) {
+	if err := requireCoordinates(req.Lat, req.Lng); err != nil {
+		return nil, err
+	}
+	if err := validateArrivalRadius(req.ArrivalRadiusMeters); err != nil {
+		return nil, err
+	}
+	ttl := targetTTL
+	if req.TTLMinutes != nil {
+		if *req.TTLMinutes < 0 || *req.TTLMinutes > maxTargetTTLMinutes {
+			return nil, fmt.Errorf("ttlMinutes must be between 0 and %d", maxTargetTTLMinutes)
+		}
+		ttl = time.Duration(*req.TTLMinutes) * time.Minute
+	}
+
+	target := &TargetLocation{
+		Lat:                 *req.Lat,
+		Lng:                 *req.Lng,
+		Timestamp:           now,
+		FakeHash:            targetFakeHash(*req.Lat, *req.Lng, now),
+		IsReleased:          true, // Targets set during the game are always released immediately.
+		ArrivalRadiusMeters: req.ArrivalRadiusMeters,
+	}
+	if ttl > 0 {
+		target.ExpiresAt = now.Add(ttl)
+	}
+	return target, nil
+}
+
+// handleDMWithTarget sends a player a DM and sets their target in one go, for the
+// usual "go here" message. It expects POST /api/dm-with-target/{obfuscatedID} with
+// the message next to the fields handleSetTargetLocation takes. Both are written in
+// one transaction, so either the player gets both or neither.
+func handleDMWithTarget(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rejectIfDisabled(w, featureChat) || rejectIfDisabled(w, featureTargets) {
+		return
+	}
+
+	playerID, err := resolvePlayerID(r.URL.Path, "/api/dm-with-target/")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+
+	var reqBody struct {
+		Message string `json:"message"`
+		targetRequest
+	}
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reqBody.Message == "" {
+		http.Error(w, errMissingField("message").Error(), http.StatusBadRequest)
+		return
+	}
+	content, err := sanitizeMessage(reqBody.Message)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	target, err := reqBody.target(now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if rejectIfPaused(ctx, w) {
+		return
+	}
+
+	senderID, _ := ctx.Value(leadIDContextKey).(string)
+	dm := &DirectMessage{
+		PlayerID:  playerID,
+		SenderID:  senderID,
+		Content:   content,
+		Timestamp: now,
+	}
+	dmKey, err := saveDMWithTarget(ctx, gameIncompleteKey(ctx, "DirectMessage", nil), dm, gameNameKey(ctx, "TargetLocation", playerID, nil), target)
+	if err != nil {
+		log.Printf("ERROR: Failed to save DM with target for player %s: %v", playerID, err)
+		http.Error(w, "Internal server error when saving direct message and target.", http.StatusInternalServerError)
+		return
+	}
+	targetCaches.get(ctx).invalidate()
+
+	chat.broadcast(chatTopic(ctx, playerID), ChatMessage{From: "lead", Sender: dmSender(*dm), Content: dm.Content, Timestamp: dm.Timestamp})
+	emitWebhookEvent(ctx, webhookEventNewMessage, map[string]interface{}{"playerID": playerID, "from": "lead", "sender": dmSender(*dm), "content": dm.Content})
+	emitWebhookEvent(ctx, webhookEventTargetReleased, map[string]interface{}{"playerID": playerID, "lat": target.Lat, "lng": target.Lng})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": dmKey.ID, "target": target})
+}
+
+// saveDMWithTarget stores a DM and a target in a single transaction and returns the
+// DM's key. If either write fails, neither is stored.
+func saveDMWithTarget(ctx context.Context, dmKey *datastore.Key, dm *DirectMessage, targetKey *datastore.Key, target *TargetLocation) (*datastore.Key, error) {
+	var pending *datastore.PendingKey
+	commit, err := dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var err error
+		if pending, err = tx.Put(dmKey, dm); err != nil {
+			return err
+		}
+		_, err = tx.Put(targetKey, target)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return commit.Key(pending), nil
+}
+
+// handleRecallTarget un-releases a player's target, e.g. one released by mistake,
+// so the player no longer sees it. It expects POST /api/target/{obfuscatedID}/recall.
+func handleRecallTarget(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	playerID, err := resolvePlayerSubpath(r.URL.Path, "/api/target/", "/recall")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	key := gameNameKey(ctx, "TargetLocation", playerID, nil)
+	_, err = dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var target TargetLocation
+		if err := tx.Get(key, &target); err != nil {
+			return err
+		}
+		// Clear the schedule too, or the target would come back on its own.
+		target.IsReleased = false
+		target.ReleaseAt = time.Time{}
+		_, err := tx.Put(key, &target)
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "Player has no target", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to recall target for player %s: %v", playerID, err)
+		http.Error(w, "Internal server error when recalling target.", http.StatusInternalServerError)
+		return
+	}
+	targetCaches.get(ctx).invalidate()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "recalled"})
+}
+
+// handleRotateTargetHash replaces a target's fake hash, e.g. after it leaked, keeping
+// its coordinates. It expects POST /api/target/{obfuscatedID}/rotate-hash.
+func handleRotateTargetHash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	playerID, err := resolvePlayerSubpath(r.URL.Path, "/api/target/", "/rotate-hash")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+	// A hash derived from the coordinates alone would come out the same.
+	if fakeHashMode == fakeHashDeterministic {
+		http.Error(w, "Fake hashes are derived from the coordinates and can't be rotated", http.StatusConflict)
+		return
+	}
+
+	ctx := r.Context()
+	key := gameNameKey(ctx, "TargetLocation", playerID, nil)
+	var target TargetLocation
+	_, err = dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(key, &target); err != nil {
+			return err
+		}
+		// The hash mixes in the current time, so it changes even though the coordinates don't.
+		target.FakeHash = targetFakeHash(target.Lat, target.Lng, time.Now())
+		_, err := tx.Put(key, &target)
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "Player has no target", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to rotate target hash for player %s: %v", playerID, err)
+		http.Error(w, "Internal server error when rotating target hash.", http.StatusInternalServerError)
+		return
+	}
+	targetCaches.get(ctx).invalidate()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"fakeHash": target.FakeHash})
+}
+
+// TargetHashMatch is the target a scanned fake hash belongs to.
+type TargetHashMatch struct {
+	PlayerID   string    `json:"playerID"`
+	Lat        float64   `json:"lat"`
+	Lng        float64   `json:"lng"`
+	IsReleased bool      `json:"isReleased"`
+	ArrivedAt  time.Time `json:"arrivedAt,omitempty"`
+	// SharedWith lists other players whose target has the same hash, which happens in
+	// deterministic mode when they were sent to the same coordinates.
+	SharedWith []string `json:"sharedWith,omitempty"`
+}
+
+// handleVerifyTargetHash looks up whose target a hash printed on a clue card belongs
+// to. It expects POST /api/target/verify with {"hash": "ABCD1234"}, ignoring case, and
+// returns a TargetHashMatch, or 404 if no current target has the hash.
+func handleVerifyTargetHash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var reqBody struct {
+		Hash string `json:"hash"`
+	}
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Hashes are shown in upper case, but a card may well be typed in lower case.
+	hash := strings.ToUpper(strings.TrimSpace(reqBody.Hash))
+	if hash == "" {
+		http.Error(w, errMissingField("hash").Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	var targets []TargetLocation
+	keys, err := dsClient.GetAll(ctx, gameQuery(ctx, "TargetLocation").FilterField("FakeHash", "=", hash), &targets)
+	if err != nil {
+		log.Printf("ERROR: Failed to look up target hash %s: %v", hash, err)
+		http.Error(w, "Internal server error when verifying target hash.", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	var match *TargetHashMatch
+	for i, target := range targets {
+		if target.expired(now) {
+			continue
+		}
+		if match != nil {
+			match.SharedWith = append(match.SharedWith, keys[i].Name)
+			continue
+		}
+		match = &TargetHashMatch{PlayerID: keys[i].Name, Lat: target.Lat, Lng: target.Lng, IsReleased: target.released(now), ArrivedAt: target.ArrivedAt}
+	}
+	if match == nil {
+		http.Error(w, "No target has this hash", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(match)
+}
+
+// validateTargetCoordinates rejects coordinates that can't be a real target. An exact
+// (0,0) is what the lead page sends when it failed to pick a point.
+func validateTargetCoordinates(lat, lng float64) error {
+	if lat < -90 || lat > 90 {
+		return fmt.Errorf("lat must be between -90 and 90, got %v", lat)
+	}
+	if lng < -180 || lng > 180 {
+		return fmt.Errorf("lng must be between -180 and 180, got %v", lng)
+	}
+	if lat == 0 && lng == 0 {
+		return fmt.Errorf("target coordinates are (0,0), pick a location on the map")
+	}
+	return nil
+}
+
+// requireCoordinates checks that a request gave both coordinates of a target, and
+// that they're valid.
+func requireCoordinates(lat, lng *float64) error {
+	if lat == nil {
+		return errMissingField("lat")
+	}
+	if lng == nil {
+		return errMissingField("lng")
+	}
+	return validateTargetCoordinates(*lat, *lng)
+}
+
+// validateArrivalRadius rejects a per-target arrival radius out of bounds. 0 means the global radius.
+func validateArrivalRadius(radius float64) error {
+	if radius < 0 || radius > maxArrivalRadiusMeters {
+		return fmt.Errorf("arrivalRadiusMeters must be between 0 and %d", maxArrivalRadiusMeters)
+	}
+	return nil
+}
+
+// Values of FAKE_HASH_MODE.
+const (
+	fakeHashTimestamped   = "timestamped"
+	fakeHashDeterministic = "deterministic"
+)
+
+// fakeHashMode picks how targetFakeHash derives a target's fake hash. "timestamped"
+// mixes in the time the target is set, so setting the same coordinates again gives a
+// new hash. "deterministic" only uses the coordinates, so a target always gets the
+// same hash, e.g. to match it against printed clue cards.
+var fakeHashMode = fakeHashTimestamped
+
+// Bounds for the number of decimals of the coordinates hashed by targetFakeHash.
+const (
+	defaultFakeHashPrecision = 6
+	maxFakeHashPrecision     = 12
+)
+
+// fakeHashPrecision is how many decimals of each coordinate go into a fake hash, set
+// with FAKE_HASH_PRECISION. Coordinates that only differ beyond it hash the same, which
+// in deterministic mode means two targets that close share a hash. 6 decimals is about
+// 10cm. Fewer lets a clue card match a target set a few meters off, more tells apart
+// targets that should never have been that close anyway.
+var fakeHashPrecision = defaultFakeHashPrecision
+
+// targetFakeHash returns the short hash players are shown for a target at lat/lng set at
+// now. Every way of setting a target uses it, so they all hash at fakeHashPrecision.
+func targetFakeHash(lat, lng float64, now time.Time) string {
+	mac := hmac.New(sha256.New, []byte(hmacSecret))
+	data := strconv.FormatFloat(lat, 'f', fakeHashPrecision, 64) + "," + strconv.FormatFloat(lng, 'f', fakeHashPrecision, 64)
+	if fakeHashMode != fakeHashDeterministic {
+		data += fmt.Sprintf(",%d", now.UnixNano())
+	}
+	mac.Write([]byte(data))
+	return strings.ToUpper(hex.EncodeToString(mac.Sum(nil))[:8])
+}
+
+// BatchTargetResult reports the outcome of one entry of a batch target assignment.
+type BatchTargetResult struct {
+	PlayerID string `json:"playerID"` // As given in the request
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+}
+
+// handleBatchSetTargets lets game leads assign many targets in one request.
+// It expects POST /api/targets/batch with a JSON array of
+// {"playerID": obfuscatedID, "lat", "lng", "releaseAt"?}. Targets without a
+// releaseAt are released immediately. Like other targets set by leads, they expire
+// targetTTL after they're released. Entries are validated and saved
+// independently, and the response lists a result per entry in request order.
+func handleBatchSetTargets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rejectIfDisabled(w, featureTargets) {
+		return
+	}
+
+	var entries []struct {
+		PlayerID  string    `json:"playerID"`
+		Lat       float64   `json:"lat"`
+		Lng       float64   `json:"lng"`
+		ReleaseAt time.Time `json:"releaseAt"`
+	}
+	if err := decodeJSONBody(r, &entries); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(entries) == 0 {
+		http.Error(w, "At least one target is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if rejectIfPaused(ctx, w) {
+		return
+	}
+	now := time.Now()
+	results := make([]BatchTargetResult, len(entries))
+	var keys []*datastore.Key
+	var targets []*TargetLocation
+	var indexes []int // Position in results of each entry in keys
+	seen := make(map[string]bool)
+	for i, entry := range entries {
+		results[i].PlayerID = entry.PlayerID
+		playerID, err := deobfuscatePlayerID(entry.PlayerID)
+		switch {
+		case err != nil:
+			results[i].Error = "invalid player ID"
+		case seen[playerID]:
+			results[i].Error = "duplicate player ID"
+		default:
+			if err := validateTargetCoordinates(entry.Lat, entry.Lng); err != nil {
+				results[i].Error = err.Error()
+			}
+		}
+		if results[i].Error != "" {
+			continue
+		}
+		seen[playerID] = true
+
+		target := &TargetLocation{
+			Lat:       entry.Lat,
+			Lng:       entry.Lng,
+			Timestamp: now,
+			FakeHash:  targetFakeHash(entry.Lat, entry.Lng, now),
+		}
+		if entry.ReleaseAt.After(now) {
+			target.ReleaseAt = entry.ReleaseAt
+			target.ExpiresAt = targetTTLExpiry(entry.ReleaseAt)
+		} else {
+			target.IsReleased = true
+			target.ExpiresAt = targetTTLExpiry(now)
+		}
+		keys = append(keys, gameNameKey(ctx, "TargetLocation", playerID, nil))
+		targets = append(targets, target)
+		indexes = append(indexes, i)
+	}
+
+	// A failed batch only fails its own entries, so keep going with the next one.
+	forEachBatch(len(keys), func(i, end int) error {
+		err := withRetry(ctx, func() error { _, err := dsClient.PutMulti(ctx, keys[i:end], targets[i:end]); return err })
+		for j := i; j < end; j++ {
+			if err != nil {
+				results[indexes[j]].Error = "failed to save target"
+				continue
+			}
+			results[indexes[j]].OK = true
+			if targets[j].IsReleased {
+				emitWebhookEvent(ctx, webhookEventTargetReleased, map[string]interface{}{"playerID": keys[j].Name, "lat": targets[j].Lat, "lng": targets[j].Lng})
+			}
+		}
+		if err != nil {
+			log.Printf("ERROR: Failed to save batch of %d targets: %v", end-i, err)
+		}
+		return nil
+	})
+	targetCaches.get(ctx).invalidate()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+// releaseSweepInterval is how often runReleaseSweeper looks for scheduled targets that
+// became visible, so their target-released webhooks are at most this late.
+const releaseSweepInterval = time.Minute
+
+// releaseScheduledTargets marks scheduled targets whose release time has passed as
+// released and emits a target-released event for each. Players see them from ReleaseAt
+// on regardless; this is what tells the webhooks, once per target. Expired targets are
+// left alone. It returns how many targets were released.
+func releaseScheduledTargets(ctx context.Context, now time.Time) (int, error) {
+	q := gameQuery(ctx, "TargetLocation").FilterField("ReleaseAt", ">", time.Time{}).FilterField("ReleaseAt", "<=", now).KeysOnly()
+	keys, err := dsClient.GetAll(ctx, q, nil)
+	if err != nil {
+		return 0, fmt.Errorf("getting scheduled target keys: %w", err)
+	}
+
+	released := 0
+	err = forEachBatch(len(keys), func(i, end int) error {
+		var releasedKeys []*datastore.Key
+		var releasedTargets []*TargetLocation
+		// Re-check inside a transaction, a lead may have released or recalled the target since the query ran.
+		_, err := dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			releasedKeys, releasedTargets = nil, nil
+			targets := make([]TargetLocation, end-i)
+			// Targets deleted since the query stay zero and are skipped below.
+			if err := tx.GetMulti(keys[i:end], targets); err != nil {
+				multiErr, ok := err.(datastore.MultiError)
+				if !ok {
+					return err
+				}
+				for _, err := range multiErr {
+					if err != nil && err != datastore.ErrNoSuchEntity {
+						return err
+					}
+				}
+			}
+			for j := range targets {
+				target := &targets[j]
+				if target.IsReleased || target.ReleaseAt.IsZero() || !target.released(now) || target.expired(now) {
+					continue
+				}
+				target.IsReleased = true
+				releasedKeys = append(releasedKeys, keys[i+j])
+				releasedTargets = append(releasedTargets, target)
+			}
+			if len(releasedKeys) == 0 {
+				return nil
+			}
+			_, err := tx.PutMulti(releasedKeys, releasedTargets)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("releasing scheduled targets: %w", err)
+		}
+		for j, key := range releasedKeys {
+			emitWebhookEvent(ctx, webhookEventTargetReleased, map[string]interface{}{"playerID": key.Name, "lat": releasedTargets[j].Lat, "lng": releasedTargets[j].Lng})
+		}
+		released += len(releasedKeys)
+		return nil
+	})
+	if released > 0 {
+		targetCaches.get(ctx).invalidate()
+	}
+	return released, err
+}
+
+// runReleaseSweeper periodically releases scheduled targets whose time has come.
+func runReleaseSweeper(ctx context.Context) {
+	ticker := time.NewTicker(releaseSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		released, err := sumEachNamespace(ctx, func(ctx context.Context) (int, error) { return releaseScheduledTargets(ctx, time.Now()) })
+		if err != nil {
+			log.Printf("ERROR: Scheduled target release failed: %v", err)
+			continue
+		}
+		if released > 0 {
+			log.Printf("Released %d scheduled targets", released)
+		}
+	}
+}
+
+// --- Emergency Alerts ---
+
+// EmergencyAlert is raised by a player who needs help. Alerts are kept apart from
+// messages so they can't get lost in the inbox, and stay listed until a lead resolves them.
+type EmergencyAlert struct {
+	ID       int64     `json:"id" datastore:"-"`
+	PlayerID string    `json:"playerID"`
+	Raised   time.Time `json:"raised"`
+	// Lat, Lng and LocatedAt are the player's last known location when the alert was raised.
+	Lat        float64   `json:"lat,omitempty" datastore:",noindex"`
+	Lng        float64   `json:"lng,omitempty" datastore:",noindex"`
+	LocatedAt  time.Time `json:"locatedAt,omitempty" datastore:",noindex"`
+	Resolved   bool      `json:"resolved"`
+	ResolvedAt time.Time `json:"resolvedAt,omitempty"`
+	ResolvedBy string    `json:"resolvedBy,omitempty"` // Username of the lead who resolved it
+}
+
+// defaultPanicCooldownSeconds is how long a player has to wait between emergency alerts.
+const defaultPanicCooldownSeconds = 30
+
+// panicCooldown can be overridden with PANIC_COOLDOWN_SECONDS; 0 disables it.
+var panicCooldown = defaultPanicCooldownSeconds * time.Second
+
+// cooldowns remembers when each player last did something that's rate limited.
+type cooldowns struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// Panic cooldowns, one per game namespace. Each instance keeps its own.
+var panicCooldowns = &namespaced[cooldowns]{def: &cooldowns{}}
+
+// take starts a new cooldown of window for playerID and returns 0, or returns how much
+// longer the player must wait if the previous one hasn't ended yet.
+func (c *cooldowns) take(playerID string, now time.Time, window time.Duration) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if wait := c.last[playerID].Add(window).Sub(now); wait > 0 {
+		return wait
+	}
+	// Forget the players whose cooldown ended, so the map doesn't grow with every player.
+	for id, last := range c.last {
+		if now.Sub(last) >= window {
+			delete(c.last, id)
+		}
+	}
+	if c.last == nil {
+		c.last = make(map[string]time.Time)
+	}
+	c.last[playerID] = now
+	return 0
+}
+
+// forget ends playerID's cooldown, for when the action it guarded didn't happen after all.
+func (c *cooldowns) forget(playerID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.last, playerID)
+}
+
+// handlePanic records an emergency alert for a player.
+// It expects POST /api/panic/{obfuscatedID} without a body, so it works with one tap.
+// A player can raise one alert per panicCooldown; pressing again sooner gets a 429 with
+// Retry-After, and leaves the earlier alert as it is.
+func handlePanic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rejectIfDisabled(w, featureEmergency) {
+		return
+	}
+
+	playerID, err := resolvePlayerID(r.URL.Path, "/api/panic/")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	now := time.Now()
+	cooldown := panicCooldowns.get(ctx)
+	if panicCooldown > 0 {
+		if wait := cooldown.take(playerID, now, panicCooldown); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "An alert was raised moments ago. Help is on the way.", http.StatusTooManyRequests)
+			return
+		}
+	}
+	alert := &EmergencyAlert{PlayerID: playerID, Raised: now}
+	// Raise the alert even when the location can't be read: it's better than no alert.
+	var loc PlayerLocation
+	if err := withRetry(ctx, func() error { return dsClient.Get(ctx, gameNameKey(ctx, "PlayerLocation", playerID, nil), &loc) }); err == nil {
+		alert.Lat, alert.Lng, alert.LocatedAt = loc.Lat, loc.Lng, loc.Timestamp
+	} else if err != datastore.ErrNoSuchEntity {
+		log.Printf("ERROR: Failed to get location for emergency alert of player %s: %v", playerID, err)
+	}
+
+	var key *datastore.Key
+	err = withRetry(ctx, func() (err error) {
+		key, err = dsClient.Put(ctx, gameIncompleteKey(ctx, "EmergencyAlert", nil), alert)
+		return err
+	})
+	if err != nil {
+		// Let the player try again right away.
+		cooldown.forget(playerID)
+		log.Printf("ERROR: Failed to save emergency alert for player %s: %v", playerID, err)
+		http.Error(w, "Internal server error when raising alert.", http.StatusInternalServerError)
+		return
 	}
+	alert.ID = key.ID
+	log.Printf("EMERGENCY: Player %s raised an alert at %v,%v", playerID, alert.Lat, alert.Lng)
+	emitWebhookEvent(ctx, webhookEventEmergency, alert)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(alert)
 }
 
-// handlePlayerMessages handles players sending messages (POST) and checking their last message status (GET).
-func handlePlayerMessages(w http.ResponseWriter, r *http.Request) {
-	obfuscatedID := strings.TrimPrefix(r.URL.Path, "/api/messages/")
-	playerID, err := deobfuscatePlayerID(obfuscatedID)
+// handleGetAlerts lists the unresolved emergency alerts, newest first.
+func handleGetAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	q := gameQuery(ctx, "EmergencyAlert").FilterField("Resolved", "=", false).Order("-Raised")
+	alerts := []EmergencyAlert{}
+	keys, err := dsClient.GetAll(ctx, q, &alerts)
 	if err != nil {
-		http.Error(w, "Player ID is missing", http.StatusBadRequest)
+		log.Printf("ERROR: Failed to get emergency alerts: %v", err)
+		http.Error(w, "Internal server error fetching alerts.", http.StatusInternalServerError)
 		return
 	}
+	for i, key := range keys {
+		alerts[i].ID = key.ID
+	}
 
-	ctx := context.Background()
+	writeJSON(w, r, alerts)
+}
 
-	switch r.Method {
-	case http.MethodPost:
-		// Player sends a new message
-		var reqBody struct {
-			Message string `json:"message"`
+// handleResolveAlert marks an emergency alert as handled by the calling lead.
+// It expects POST /api/alerts/{id}/resolve and returns the alert. Resolving an alert
+// twice keeps the first resolution.
+func handleResolveAlert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	idStr, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/alerts/"), "/resolve")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	alertID, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || alertID <= 0 {
+		http.Error(w, "Invalid alert ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	leadID, _ := ctx.Value(leadIDContextKey).(string)
+	key := gameIDKey(ctx, "EmergencyAlert", alertID, nil)
+	var alert EmergencyAlert
+	_, err = dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(key, &alert); err != nil {
+			return err
 		}
-		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
-			return
+		if alert.Resolved {
+			return nil
 		}
+		alert.Resolved, alert.ResolvedAt, alert.ResolvedBy = true, time.Now(), leadID
+		_, err := tx.Put(key, &alert)
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "Alert not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to resolve emergency alert %d: %v", alertID, err)
+		http.Error(w, "Internal server error when resolving alert.", http.StatusInternalServerError)
+		return
+	}
+	alert.ID = alertID
+	log.Printf("Lead %s resolved the emergency alert of player %s", alert.ResolvedBy, alert.PlayerID)
 
-		msg := &PlayerMessage{
-			PlayerID:  playerID,
-			Content:   reqBody.Message,
-			Timestamp: time.Now(),
-			IsRead:    false,
-		}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alert)
+}
 
-		key := datastore.IncompleteKey("PlayerMessage", nil)
-		newKey, err := dsClient.Put(ctx, key, msg)
-		if err != nil {
-			log.Printf("ERROR: Failed to save message for player %s: %v", playerID, err)
-			http.Error(w, "Internal server error when saving message.", http.StatusInternalServerError)
-			return
-		}
+// --- Target Chains ---
+
+// maxChainSteps bounds the number of targets in a single player's chain.
+const maxChainSteps = 100
+
+// PlayerTarget is one step of a player's target chain, a scavenger hunt of targets
+// visited in order. Steps are keyed by their 1-based position under the player's
+// targetChainKey. The first step that isn't completed is mirrored into the player's
+// TargetLocation, so the player app and arrival detection only ever see that one.
+type PlayerTarget struct {
+	Seq                 int64     `json:"seq" datastore:"-"` // Position in the chain, from the key
+	Lat                 float64   `json:"lat"`
+	Lng                 float64   `json:"lng"`
+	FakeHash            string    `json:"fakeHash"`
+	ArrivalRadiusMeters float64   `json:"arrivalRadiusMeters,omitempty"`
+	Created             time.Time `json:"created"`
+	CompletedAt         time.Time `json:"completedAt,omitempty"` // When the player arrived at this step
+}
 
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "id": newKey.ID})
+// targetChainKey is the parent key of all the steps of a player's chain.
+func targetChainKey(ctx context.Context, playerID string) *datastore.Key {
+	return gameNameKey(ctx, "TargetChain", playerID, nil)
+}
 
-	case http.MethodGet:
-		// Player checks the status of their last message
-		query := datastore.NewQuery("PlayerMessage").
-			FilterField("PlayerID", "=", playerID).
-			Order("-Timestamp").
-			Limit(1)
+// playerTargetKey is the key of step seq of a player's chain.
+func playerTargetKey(ctx context.Context, playerID string, seq int64) *datastore.Key {
+	return gameIDKey(ctx, "PlayerTarget", seq, targetChainKey(ctx, playerID))
+}
 
-		var messages []PlayerMessage
-		keys, err := dsClient.GetAll(ctx, query, &messages)
-		if err != nil {
-			log.Printf("ERROR: Failed to get last message for player %s: %v", playerID, err)
-			http.Error(w, "Internal server error retrieving message status.", http.StatusInternalServerError)
-			return
+// loadTargetChain returns a player's chain in order, reading within tx if it's not nil.
+func loadTargetChain(ctx context.Context, tx *datastore.Transaction, playerID string) ([]PlayerTarget, error) {
+	q := gameQuery(ctx, "PlayerTarget").Ancestor(targetChainKey(ctx, playerID))
+	if tx != nil {
+		q = q.Transaction(tx)
+	}
+	var chain []PlayerTarget
+	keys, err := dsClient.GetAll(ctx, q, &chain)
+	if err != nil {
+		return nil, err
+	}
+	for i := range chain {
+		chain[i].Seq = keys[i].ID
+	}
+	sort.Slice(chain, func(i, j int) bool { return chain[i].Seq < chain[j].Seq })
+	return chain, nil
+}
+
+// currentChainStep returns the index of the first step that isn't completed, or -1.
+func currentChainStep(chain []PlayerTarget) int {
+	for i, step := range chain {
+		if step.CompletedAt.IsZero() {
+			return i
 		}
+	}
+	return -1
+}
 
-		// Also get the latest DM for this player
-		dmQuery := datastore.NewQuery("DirectMessage").
-			FilterField("PlayerID", "=", playerID).
-			Order("-Timestamp").
-			Limit(1)
+// targetForStep is the released TargetLocation shown to the player for a chain step.
+// Each step gets the full targetTTL from the moment it's shown.
+func targetForStep(step PlayerTarget, now time.Time) *TargetLocation {
+	return &TargetLocation{
+		Lat:                 step.Lat,
+		Lng:                 step.Lng,
+		Timestamp:           now,
+		FakeHash:            step.FakeHash,
+		IsReleased:          true,
+		ExpiresAt:           targetTTLExpiry(now),
+		ArrivalRadiusMeters: step.ArrivalRadiusMeters,
+	}
+}
 
-		var dms []DirectMessage
-		_, err = dsClient.GetAll(ctx, dmQuery, &dms)
+// completeChainStep marks the player's current chain step as completed when target,
+// which the player just reached, is that step. It returns the target for the next
+// step, or nil when the chain is done or target isn't part of it.
+func completeChainStep(ctx context.Context, tx *datastore.Transaction, playerID string, target TargetLocation) (*TargetLocation, error) {
+	chain, err := loadTargetChain(ctx, tx, playerID)
+	if err != nil {
+		return nil, err
+	}
+	i := currentChainStep(chain)
+	// A target set by hand in the middle of a chain doesn't complete a step.
+	if i < 0 || chain[i].Lat != target.Lat || chain[i].Lng != target.Lng {
+		return nil, nil
+	}
+	chain[i].CompletedAt = target.ArrivedAt
+	if _, err := tx.Put(playerTargetKey(ctx, playerID, chain[i].Seq), &chain[i]); err != nil {
+		return nil, err
+	}
+	if i+1 == len(chain) {
+		return nil, nil
+	}
+	return targetForStep(chain[i+1], target.ArrivedAt), nil
+}
+
+// syncChainTarget points the player's TargetLocation at the current step of chain,
+// unless it already is. It returns the target it saved, or nil.
+func syncChainTarget(ctx context.Context, tx *datastore.Transaction, playerID string, chain []PlayerTarget, now time.Time) (*TargetLocation, error) {
+	i := currentChainStep(chain)
+	if i < 0 {
+		return nil, nil
+	}
+	key := gameNameKey(ctx, "TargetLocation", playerID, nil)
+	var existing TargetLocation
+	err := tx.Get(key, &existing)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	if err == nil && existing.Lat == chain[i].Lat && existing.Lng == chain[i].Lng && existing.ArrivedAt.IsZero() {
+		return nil, nil
+	}
+	target := targetForStep(chain[i], now)
+	if _, err := tx.Put(key, target); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// handleTargetChain manages a player's target chain:
+//   - GET /api/targets/chain/{obfuscatedID} lists the steps in order.
+//   - POST /api/targets/chain/{obfuscatedID} appends a step, {lat, lng, arrivalRadiusMeters}.
+//   - POST /api/targets/chain/{obfuscatedID}/reorder takes {"order": [3, 1, 2]}, the
+//     current step numbers in their new order.
+func handleTargetChain(w http.ResponseWriter, r *http.Request) {
+	reorder := strings.HasSuffix(r.URL.Path, "/reorder")
+	playerID, err := resolvePlayerID(strings.TrimSuffix(r.URL.Path, "/reorder"), "/api/targets/chain/")
+	if err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+		return
+	}
+
+	if r.Method != http.MethodGet && rejectIfDisabled(w, featureTargets) {
+		return
+	}
+	switch {
+	case reorder && r.Method == http.MethodPost:
+		handleReorderTargetChain(w, r, playerID)
+	case !reorder && r.Method == http.MethodPost:
+		handleAddChainStep(w, r, playerID)
+	case !reorder && r.Method == http.MethodGet:
+		chain, err := loadTargetChain(r.Context(), nil, playerID)
 		if err != nil {
-			log.Printf("ERROR: Failed to get last DM for player %s: %v", playerID, err)
-			http.Error(w, "Internal server error retrieving direct message.", http.StatusInternalServerError)
+			log.Printf("ERROR: Failed to get target chain for player %s: %v", playerID, err)
+			http.Error(w, "Internal server error when fetching target chain.", http.StatusInternalServerError)
 			return
 		}
-
-		// Also get the target location for this player
-		var targetLoc TargetLocation
-		targetKey := datastore.NameKey("TargetLocation", playerID, nil)
-		err = dsClient.Get(ctx, targetKey, &targetLoc)
-		// It's okay if it's not found, so we only handle other errors.
-		hasTarget := (err == nil)
-		if err != nil && err != datastore.ErrNoSuchEntity { // Don't log "not found" as an error
-			log.Printf("Failed to get target location for player %s: %v", playerID, err)
-			// Don't fail the whole request, just log the error.
+		if chain == nil {
+			chain = make([]PlayerTarget, 0)
 		}
+		writeJSON(w, r, chain)
+	default:
+		http.Error(w, "Only GET or POST method is allowed", http.StatusMethodNotAllowed)
+	}
+}
 
-		// We don't handle the 404 case here, if there are no messages, the slices will be empty.
-		// The frontend will handle this.
+// handleAddChainStep appends a step to the end of a player's chain. If the player has
+// completed every earlier step, it becomes their target right away.
+func handleAddChainStep(w http.ResponseWriter, r *http.Request, playerID string) {
+	var reqBody struct {
+		Lat                 *float64 `json:"lat"`
+		Lng                 *float64 `json:"lng"`
+		ArrivalRadiusMeters float64  `json:"arrivalRadiusMeters"`
+	}
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := requireCoordinates(reqBody.Lat, reqBody.Lng); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateArrivalRadius(reqBody.ArrivalRadiusMeters); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		response := make(map[string]interface{})
-		if len(messages) > 0 {
-			messages[0].ID = keys[0].ID // Add the ID to the struct
-			response["playerMessage"] = messages[0]
+	ctx := r.Context()
+	now := time.Now()
+	errChainFull := fmt.Errorf("the chain already has %d steps", maxChainSteps)
+	var step PlayerTarget
+	var released *TargetLocation
+	_, err := dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		chain, err := loadTargetChain(ctx, tx, playerID)
+		if err != nil {
+			return err
 		}
-		if len(dms) > 0 {
-			response["dm"] = dms[0]
+		if len(chain) >= maxChainSteps {
+			return errChainFull
 		}
-		if hasTarget {
-			response["target"] = targetLoc
+		step = PlayerTarget{
+			Seq:                 int64(len(chain)) + 1,
+			Lat:                 *reqBody.Lat,
+			Lng:                 *reqBody.Lng,
+			FakeHash:            targetFakeHash(*reqBody.Lat, *reqBody.Lng, now),
+			ArrivalRadiusMeters: reqBody.ArrivalRadiusMeters,
+			Created:             now,
 		}
-		json.NewEncoder(w).Encode(response)
-
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		if _, err := tx.Put(playerTargetKey(ctx, playerID, step.Seq), &step); err != nil {
+			return err
+		}
+		released, err = syncChainTarget(ctx, tx, playerID, append(chain, step), now)
+		return err
+	})
+	if err == errChainFull {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to add chain step for player %s: %v", playerID, err)
+		http.Error(w, "Internal server error when saving target chain.", http.StatusInternalServerError)
+		return
 	}
+	if released != nil {
+		targetCaches.get(ctx).invalidate()
+		emitWebhookEvent(ctx, webhookEventTargetReleased, map[string]interface{}{"playerID": playerID, "lat": released.Lat, "lng": released.Lng})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(step)
 }
 
-// handleMessages handles game leads fetching all messages.
-func handleMessages(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+// handleReorderTargetChain puts a player's chain steps in a new order. Completed steps
+// stay completed; the player's target becomes the first step in the new order that
+// isn't.
+func handleReorderTargetChain(w http.ResponseWriter, r *http.Request, playerID string) {
+	var reqBody struct {
+		Order []int64 `json:"order"`
+	}
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	ctx := context.Background()
-	query := datastore.NewQuery("PlayerMessage").Order("-Timestamp")
+	if len(reqBody.Order) == 0 {
+		http.Error(w, errMissingField("order").Error(), http.StatusBadRequest)
+		return
+	}
+	seen := make(map[int64]bool)
+	for _, seq := range reqBody.Order {
+		if seq < 1 || seen[seq] {
+			http.Error(w, "order must list every step number exactly once", http.StatusBadRequest)
+			return
+		}
+		seen[seq] = true
+	}
 
-	var messages []PlayerMessage
-	keys, err := dsClient.GetAll(ctx, query, &messages)
+	ctx := r.Context()
+	errBadOrder := fmt.Errorf("order must list every step number exactly once")
+	var chain []PlayerTarget
+	var released *TargetLocation
+	_, err := dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		current, err := loadTargetChain(ctx, tx, playerID)
+		if err != nil {
+			return err
+		}
+		if len(current) != len(reqBody.Order) {
+			return errBadOrder
+		}
+		chain = make([]PlayerTarget, len(current))
+		keys := make([]*datastore.Key, len(current))
+		for i, seq := range reqBody.Order {
+			if seq > int64(len(current)) {
+				return errBadOrder
+			}
+			chain[i] = current[seq-1]
+			chain[i].Seq = int64(i) + 1
+			keys[i] = playerTargetKey(ctx, playerID, chain[i].Seq)
+		}
+		if _, err := tx.PutMulti(keys, chain); err != nil {
+			return err
+		}
+		released, err = syncChainTarget(ctx, tx, playerID, chain, time.Now())
+		return err
+	})
+	if err == errBadOrder {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		log.Printf("ERROR: Error fetching all messages: %v", err)
-		http.Error(w, "Internal server error when fetching messages.", http.StatusInternalServerError)
+		log.Printf("ERROR: Failed to reorder target chain for player %s: %v", playerID, err)
+		http.Error(w, "Internal server error when saving target chain.", http.StatusInternalServerError)
 		return
 	}
-
-	// Populate the ID field for each message from its key
-	for i := 0; i < len(messages); i++ {
-		messages[i].ID = keys[i].ID
+	if released != nil {
+		targetCaches.get(ctx).invalidate()
+		emitWebhookEvent(ctx, webhookEventTargetReleased, map[string]interface{}{"playerID": playerID, "lat": released.Lat, "lng": released.Lng})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(messages); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(chain)
+}
+
+// handleObfuscateURL creates a new obfuscated URL for a given player name. Anyone can
+// call it, so display names are only set by leads, through handleDisplayName.
+func handleObfuscateURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody struct {
+		PlayerID string    `json:"playerID"`
+		Target   *struct { // Make target optional
+			Lat float64 `json:"lat"`
+			Lng float64 `json:"lng"`
+		} `json:"target"`
+	}
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(reqBody.PlayerID) == "" {
+		http.Error(w, errMissingField("playerID").Error(), http.StatusBadRequest)
+		return
 	}
+	if err := validatePlayerName(reqBody.PlayerID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ok, err := playerRegistries.get(r.Context()).admit(r.Context(), []string{reqBody.PlayerID}, false); err != nil {
+		log.Printf("ERROR: Failed to check player limit for %s: %v", reqBody.PlayerID, err)
+		http.Error(w, "Failed to create player URL", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, playerLimitMessage(), http.StatusForbidden)
+		return
+	}
+	obfuscatedID := obfuscatePlayerID(reqBody.PlayerID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ObfuscatedURLResponse{PlayerID: reqBody.PlayerID, ObfuscatedID: obfuscatedID, ObfuscatedURL: playerURL(r, obfuscatedID)})
 }
 
-// handleMarkMessageRead handles game leads marking a message as read.
-func handleMarkMessageRead(w http.ResponseWriter, r *http.Request) {
+// maxObfuscateBatch caps how many player URLs one batch request can generate.
+const maxObfuscateBatch = 1000
+
+// handleObfuscateURLBatch creates obfuscated URLs for many players in one round trip.
+// It expects POST /api/obfuscate-url/batch with {"playerIDs": ["alice", "bob"]} and
+// returns the URLs in the same order.
+func handleObfuscateURLBatch(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	ctx := context.Background()
 
-	// Extract messageID from URL path: /api/messages/read/{messageID}
-	idStr := strings.TrimPrefix(r.URL.Path, "/api/messages/read/")
-	var messageID int64
-	if _, err := fmt.Sscan(idStr, &messageID); err != nil {
-		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+	var reqBody struct {
+		PlayerIDs []string `json:"playerIDs"`
+	}
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(reqBody.PlayerIDs) == 0 {
+		http.Error(w, errMissingField("playerIDs").Error(), http.StatusBadRequest)
+		return
+	}
+	if len(reqBody.PlayerIDs) > maxObfuscateBatch {
+		http.Error(w, fmt.Sprintf("playerIDs must list between 1 and %d players", maxObfuscateBatch), http.StatusBadRequest)
 		return
 	}
 
-	key := datastore.IDKey("PlayerMessage", messageID, nil)
-	var msg PlayerMessage
-	if err := dsClient.Get(ctx, key, &msg); err != nil {
-		// This could be a client error (bad ID) or a server error.
-		log.Printf("ERROR: Failed to get message %d to mark as read: %v", messageID, err)
-		http.Error(w, "Message not found", http.StatusNotFound)
+	for i, playerID := range reqBody.PlayerIDs {
+		if strings.TrimSpace(playerID) == "" {
+			http.Error(w, "playerIDs must not contain empty names", http.StatusBadRequest)
+			return
+		}
+		if err := validatePlayerName(playerID); err != nil {
+			http.Error(w, fmt.Sprintf("playerIDs[%d]: %v", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+	// The whole batch has to fit under the player limit.
+	if ok, err := playerRegistries.get(r.Context()).admit(r.Context(), reqBody.PlayerIDs, false); err != nil {
+		log.Printf("ERROR: Failed to check player limit for batch: %v", err)
+		http.Error(w, "Failed to create player URLs", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, playerLimitMessage(), http.StatusForbidden)
+		return
+	}
+
+	urls := make([]ObfuscatedURLResponse, 0, len(reqBody.PlayerIDs))
+	for _, playerID := range reqBody.PlayerIDs {
+		obfuscatedID := obfuscatePlayerID(playerID)
+		urls = append(urls, ObfuscatedURLResponse{PlayerID: playerID, ObfuscatedID: obfuscatedID, ObfuscatedURL: playerURL(r, obfuscatedID)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(urls)
+}
+
+// playerURL builds the link a player opens to join the game.
+func playerURL(r *http.Request, obfuscatedID string) string {
+	baseURL := "https://" + r.Host // In production, this will be your appspot domain.
+	if r.Host == "" || strings.HasPrefix(r.Host, "localhost") {
+		baseURL = "http://" + r.Host
+	}
+	return fmt.Sprintf("%s/player/%s", baseURL, obfuscatedID)
+}
+
+// QR code size bounds in pixels.
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 1024
+)
+
+// handlePlayerQRCode renders a player's URL as a PNG QR code for printing or sharing.
+// It expects GET /api/qr/{obfuscatedID}, or GET /api/qr/?player={name}, with an
+// optional ?size= in pixels.
+func handlePlayerQRCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	obfuscatedID := strings.TrimPrefix(r.URL.Path, "/api/qr/")
+	if obfuscatedID == "" {
+		playerName := strings.TrimSpace(r.URL.Query().Get("player"))
+		if playerName == "" {
+			http.Error(w, "Player ID or ?player= name is required", http.StatusBadRequest)
+			return
+		}
+		if err := validatePlayerName(playerName); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		obfuscatedID = obfuscatePlayerID(playerName)
+	} else if _, err := deobfuscatePlayerID(obfuscatedID); err != nil {
+		http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
 		return
 	}
 
-	msg.IsRead = true
-	if _, err := dsClient.Put(ctx, key, &msg); err != nil {
-		http.Error(w, "Internal server error when updating message.", http.StatusInternalServerError)
+	size := defaultQRSize
+	if sizeStr := r.URL.Query().Get("size"); sizeStr != "" {
+		var err error
+		size, err = strconv.Atoi(sizeStr)
+		if err != nil || size < minQRSize || size > maxQRSize {
+			http.Error(w, fmt.Sprintf("size must be between %d and %d pixels", minQRSize, maxQRSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	png, err := qrcode.Encode(playerURL(r, obfuscatedID), qrcode.Medium, size)
+	if err != nil {
+		log.Printf("ERROR: Failed to render QR code: %v", err)
+		http.Error(w, "Internal server error when rendering QR code.", http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
 }
 
-// handleSendDirectMessage handles a game lead sending a message to a player.
-func handleSendDirectMessage(w http.ResponseWriter, r *http.Request) {
+// testStatuses are the statuses a pre-game test result may report, in upper case. Next
+// to the generic ones, they're what the test page in player.js sends.
+var testStatuses = map[string]bool{
+	"OK": true, "FAIL": true, "DENIED": true, "PENDING": true,
+	"SUCCESS": true, "FAILED": true, "UNAVAILABLE": true, "PERMISSION DENIED": true, "NOT SUPPORTED": true,
+	"GRANTED": true, "REFUSED": true, "SKIPPED": true, "UNSUPPORTED": true, "ERROR": true,
+}
+
+// validateTestStatus rejects a status of a test result field that isn't one of
+// testStatuses, ignoring case. An empty status means the check wasn't reported.
+func validateTestStatus(field, status string) error {
+	if status != "" && !testStatuses[strings.ToUpper(status)] {
+		return fmt.Errorf("field %q has unknown status %q", field, status)
+	}
+	return nil
+}
+
+// defaultTestResultCooldownSeconds is how long a test page has to wait between submissions
+// for the same player name.
+const defaultTestResultCooldownSeconds = 5
+
+// testResultCooldown can be overridden with TEST_RESULT_COOLDOWN_SECONDS; 0 disables it.
+var testResultCooldown = defaultTestResultCooldownSeconds * time.Second
+
+// Test result cooldowns by player name, one per game namespace.
+var testResultCooldowns = &namespaced[cooldowns]{def: &cooldowns{}}
+
+// testResultRefreshInterval is how old a stored test result may get before an unchanged
+// submission is written anyway, so the summary shows when a device last tested and
+// cleanupTestResults doesn't delete results of devices that keep testing.
+const testResultRefreshInterval = time.Hour
+
+// handleTestResult handles submissions of pre-game test results. A test page stuck in
+// a loop gets a 429 with Retry-After when it submits more than once per
+// testResultCooldown, and a submission with the same statuses as a stored result younger
+// than testResultRefreshInterval is answered with {"unchanged": true} without writing it again.
+func handleTestResult(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	obfuscatedID := strings.TrimPrefix(r.URL.Path, "/api/dm/")
-	playerID, err := deobfuscatePlayerID(obfuscatedID)
-	if err != nil {
-		http.Error(w, "Player ID is missing", http.StatusBadRequest)
+	var reqBody struct {
+		PlayerName         string `json:"playerName"`
+		LocationStatus     string `json:"locationStatus"`
+		NotificationStatus string `json:"notificationStatus"`
+		ServerStatus       string `json:"serverStatus"`
+	}
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var reqBody struct {
-		Message string `json:"message"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+	if reqBody.PlayerName == "" {
+		http.Error(w, errMissingField("playerName").Error(), http.StatusBadRequest)
 		return
 	}
+	for _, field := range []struct{ name, status string }{
+		{"locationStatus", reqBody.LocationStatus},
+		{"notificationStatus", reqBody.NotificationStatus},
+		{"serverStatus", reqBody.ServerStatus},
+	} {
+		if err := validateTestStatus(field.name, field.status); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	dm := &DirectMessage{
-		PlayerID:  playerID,
-		Content:   reqBody.Message,
-		Timestamp: time.Now(),
+	ctx := r.Context()
+	now := time.Now()
+	cooldown := testResultCooldowns.get(ctx)
+	if testResultCooldown > 0 {
+		if wait := cooldown.take(reqBody.PlayerName, now, testResultCooldown); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Test results were submitted moments ago.", http.StatusTooManyRequests)
+			return
+		}
 	}
+	// Use the player's name as the key to "upsert" their latest test result.
+	key := gameNameKey(ctx, "TestResult", reqBody.PlayerName, nil)
 
-	ctx := context.Background()
-	key := datastore.IncompleteKey("DirectMessage", nil)
-	if _, err := dsClient.Put(ctx, key, dm); err != nil {
-		log.Printf("ERROR: Failed to save DM for player %s: %v", playerID, err)
-		http.Error(w, "Internal server error when saving direct message.", http.StatusInternalServerError)
+	result := &TestResult{
+		PlayerName:         reqBody.PlayerName,
+		LocationStatus:     reqBody.LocationStatus,
+		NotificationStatus: reqBody.NotificationStatus,
+		ServerStatus:       reqBody.ServerStatus,
+		Timestamp:          now,
+	}
+
+	// Failing to read the stored result only costs a redundant write.
+	var stored TestResult
+	if err := withRetry(ctx, func() error { return dsClient.Get(ctx, key, &stored) }); err == nil {
+		unchanged := stored.LocationStatus == result.LocationStatus && stored.NotificationStatus == result.NotificationStatus && stored.ServerStatus == result.ServerStatus
+		if unchanged && now.Sub(stored.Timestamp) < testResultRefreshInterval {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]bool{"unchanged": true})
+			return
+		}
+	} else if err != datastore.ErrNoSuchEntity {
+		log.Printf("ERROR: Failed to get stored test result for player %s: %v", reqBody.PlayerName, err)
+	}
+
+	if err := withRetry(ctx, func() error { _, err := dsClient.Put(ctx, key, result); return err }); err != nil {
+		// Let the test page try again right away.
+		cooldown.forget(reqBody.PlayerName)
+		log.Printf("ERROR: Failed to save test result for player %s: %v", reqBody.PlayerName, err)
+		http.Error(w, "Internal server error when saving test result.", http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
-// handleGetTargets handles requests from the game lead to get all target locations.
-func handleGetTargets(w http.ResponseWriter, r *http.Request) {
+// handleGetTestResults serves all stored pre-game test results.
+func handleGetTestResults(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	ctx := context.Background()
+	ctx := r.Context()
+	// Query for all test results, ordered by the most recent timestamp first.
+	query := gameQuery(ctx, "TestResult").Order("-Timestamp")
 
-	query := datastore.NewQuery("TargetLocation")
-	targets := make(map[string]TargetLocation)
-	it := dsClient.Run(ctx, query)
-	for {
-		var loc TargetLocation
-		key, err := it.Next(&loc)
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			log.Printf("ERROR: Failed to iterate over targets: %v", err)
-			http.Error(w, "Internal server error when fetching targets.", http.StatusInternalServerError)
-			return
-		}
-		targets[key.Name] = loc
+	var results []TestResult
+	// Using GetAll is fine for a moderate number of players.
+	// For a very large number, we would implement pagination.
+	if _, err := dsClient.GetAll(ctx, query, &results); err != nil {
+		log.Printf("ERROR: Failed to fetch test results: %v", err)
+		http.Error(w, "Internal server error when fetching test results.", http.StatusInternalServerError)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(targets); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// If no results are found, return an empty array instead of null.
+	if results == nil {
+		results = make([]TestResult, 0)
 	}
+
+	writeJSON(w, r, results)
 }
 
-// handleChatHistory serves the full conversation history for a given player.
-func handleChatHistory(w http.ResponseWriter, r *http.Request) {
+// testStatusPassed reports whether a pre-game test status counts as a pass.
+// The test page reports "Success" for location and "Granted" for notifications.
+// Like validateTestStatus, it ignores case.
+func testStatusPassed(status string) bool {
+	switch strings.ToUpper(status) {
+	case "OK", "SUCCESS", "GRANTED":
+		return true
+	}
+	return false
+}
+
+// handleTestResultsSummary gives organizers a readiness overview before the game:
+// how many players passed every check, how many failed any, and who hasn't tested yet.
+// Players still to test are those with a Player record or a current target, plus the
+// initial_targets.json roster if there is one.
+func handleTestResultsSummary(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	obfuscatedID := strings.TrimPrefix(r.URL.Path, "/api/chat/")
-	playerID, err := deobfuscatePlayerID(obfuscatedID)
-	if err != nil {
-		http.Error(w, "Player ID is missing", http.StatusBadRequest)
+	ctx := r.Context()
+	var results []TestResult
+	if _, err := dsClient.GetAll(ctx, gameQuery(ctx, "TestResult"), &results); err != nil {
+		log.Printf("ERROR: Failed to fetch test results for summary: %v", err)
+		http.Error(w, "Internal server error when fetching test results.", http.StatusInternalServerError)
 		return
 	}
 
-	ctx := context.Background()
-	// Initialize as an empty slice to ensure we return [] instead of null in JSON.
-	allMessages := make([]ChatMessage, 0)
-
-	// Get messages from the player
-	playerQuery := datastore.NewQuery("PlayerMessage").FilterField("PlayerID", "=", playerID)
-	var playerMessages []PlayerMessage
-	if _, err := dsClient.GetAll(ctx, playerQuery, &playerMessages); err != nil {
-		log.Printf("ERROR: Failed to retrieve player messages for chat history (%s): %v", playerID, err)
-		http.Error(w, "Internal server error retrieving player messages.", http.StatusInternalServerError)
-		return
-	}
-	for _, msg := range playerMessages {
-		allMessages = append(allMessages, ChatMessage{
-			From:      "player",
-			Content:   msg.Content,
-			Timestamp: msg.Timestamp,
-			IsRead:    msg.IsRead,
-		})
+	summary := struct {
+		Passed   int      `json:"passed"`
+		Failed   int      `json:"failed"`
+		Untested []string `json:"untested"`
+	}{Untested: make([]string, 0)}
+
+	tested := make(map[string]bool)
+	for _, result := range results {
+		tested[result.PlayerName] = true
+		// The test page submits its results before it knows the server check passed,
+		// so a "Pending" server status still proves the server was reachable.
+		serverOK := testStatusPassed(result.ServerStatus) || strings.EqualFold(result.ServerStatus, "Pending")
+		if testStatusPassed(result.LocationStatus) && testStatusPassed(result.NotificationStatus) && serverOK {
+			summary.Passed++
+		} else {
+			summary.Failed++
+		}
 	}
 
-	// Get messages from the game leads (DMs)
-	dmQuery := datastore.NewQuery("DirectMessage").FilterField("PlayerID", "=", playerID)
-	var dms []DirectMessage
-	if _, err := dsClient.GetAll(ctx, dmQuery, &dms); err != nil {
-		log.Printf("ERROR: Failed to retrieve direct messages for chat history (%s): %v", playerID, err)
-		http.Error(w, "Internal server error retrieving direct messages.", http.StatusInternalServerError)
-		return
+	roster := make(map[string]bool)
+	for _, kind := range []string{"Player", "TargetLocation"} {
+		keys, err := dsClient.GetAll(ctx, gameQuery(ctx, kind).KeysOnly(), nil)
+		if err != nil {
+			log.Printf("ERROR: Failed to fetch %s keys for test summary: %v", kind, err)
+			http.Error(w, "Internal server error when fetching players.", http.StatusInternalServerError)
+			return
+		}
+		for _, key := range keys {
+			roster[key.Name] = true
+		}
 	}
-	for _, msg := range dms {
-		allMessages = append(allMessages, ChatMessage{
-			From:      "lead",
-			Content:   msg.Content,
-			Timestamp: msg.Timestamp,
-		})
+	if jsonFile, err := os.Open(initialTargetsFile); err == nil {
+		defer jsonFile.Close()
+		var initial []struct {
+			PlayerName string `json:"playerName"`
+		}
+		if err := json.NewDecoder(jsonFile).Decode(&initial); err != nil {
+			log.Printf("Failed to parse initial_targets.json for test summary: %v", err)
+		}
+		for _, player := range initial {
+			roster[player.PlayerName] = true
+		}
 	}
-
-	// Sort all messages by timestamp ascending
-	sort.Slice(allMessages, func(i, j int) bool {
-		return allMessages[i].Timestamp.Before(allMessages[j].Timestamp)
-	})
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(allMessages); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	for playerName := range roster {
+		if playerName != "" && !tested[playerName] {
+			summary.Untested = append(summary.Untested, playerName)
+		}
 	}
+	sort.Strings(summary.Untested)
+
+	writeJSON(w, r, summary)
 }
 
-// handleSetTargetLocation handles a game lead setting a target location for a player.
-func handleSetTargetLocation(w http.ResponseWriter, r *http.Request) {
-	obfuscatedID := strings.TrimPrefix(r.URL.Path, "/api/target/")
-	playerID, err := deobfuscatePlayerID(obfuscatedID)
+// defaultTestResultRetentionHours is how old test results must be before the
+// startup cleanup removes them. Set TEST_RESULT_RETENTION_HOURS=0 to disable it.
+const defaultTestResultRetentionHours = 7 * 24
+
+// cleanupTestResults deletes all test results submitted before the cutoff and
+// returns how many were deleted.
+func cleanupTestResults(ctx context.Context, cutoff time.Time) (int, error) {
+	q := gameQuery(ctx, "TestResult").FilterField("Timestamp", "<", cutoff).KeysOnly()
+	keys, err := dsClient.GetAll(ctx, q, nil)
 	if err != nil {
-		http.Error(w, "Player ID is missing", http.StatusBadRequest)
-		return
+		return 0, fmt.Errorf("getting old test result keys: %w", err)
 	}
 
-	ctx := context.Background()
-	key := datastore.NameKey("TargetLocation", playerID, nil)
-
-	if r.Method == http.MethodDelete {
-		if err := dsClient.Delete(ctx, key); err != nil {
-			log.Printf("ERROR: Failed to delete target for player %s: %v", playerID, err)
-			http.Error(w, "Internal server error when deleting target location.", http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
-		return
+	if deleted, err := batchDelete(ctx, keys); err != nil {
+		return deleted, fmt.Errorf("deleting old test results: %w", err)
 	}
+	return len(keys), nil
+}
 
+// handleCleanupTestResults deletes test results older than ?olderThanHours=.
+func handleCleanupTestResults(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST or DELETE method is allowed", http.StatusMethodNotAllowed)
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var reqBody struct {
-		Lat float64 `json:"lat"`
-		Lng float64 `json:"lng"`
+	olderThanHours, err := strconv.Atoi(r.URL.Query().Get("olderThanHours"))
+	if err != nil || olderThanHours < 0 {
+		http.Error(w, "olderThanHours must be a non-negative integer", http.StatusBadRequest)
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+
+	ctx := r.Context()
+	deleted, err := cleanupTestResults(ctx, time.Now().Add(-time.Duration(olderThanHours)*time.Hour))
+	if err != nil {
+		log.Printf("ERROR: Failed to clean up test results: %v", err)
+		http.Error(w, "Internal server error when cleaning up test results.", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"deleted": deleted})
+}
+
+// defaultMessageRetentionHours is how long messages stay in the live inbox when
+// MESSAGE_RETENTION_HOURS isn't set.
+const defaultMessageRetentionHours = 3 * 24
+
+// archiveMessages moves player messages and DMs older than cutoff to the ArchivedMessage
+// kind and deletes the originals. It returns how many messages were moved.
+func archiveMessages(ctx context.Context, cutoff time.Time) (int, error) {
 	now := time.Now()
-	// Generate a non-reversible hash from the coordinates and timestamp.
-	mac := hmac.New(sha256.New, []byte(hmacSecret))
-	data := fmt.Sprintf("%.6f,%.6f,%d", reqBody.Lat, reqBody.Lng, now.UnixNano())
-	mac.Write([]byte(data))
-	fakeHash := strings.ToUpper(hex.EncodeToString(mac.Sum(nil))[:8])
+	var keys []*datastore.Key
+	var archived []*ArchivedMessage
 
-	target := &TargetLocation{
-		Lat:       reqBody.Lat,
-		Lng:       reqBody.Lng,
-		Timestamp: now,
-		FakeHash:  fakeHash,
-		IsReleased: true, // Targets set during the game are always released immediately.
+	var msgs []PlayerMessage
+	msgKeys, err := dsClient.GetAll(ctx, gameQuery(ctx, "PlayerMessage").FilterField("Timestamp", "<", cutoff), &msgs)
+	if err != nil {
+		return 0, fmt.Errorf("getting old player messages: %w", err)
+	}
+	for i, msg := range msgs {
+		keys = append(keys, msgKeys[i])
+		archived = append(archived, &ArchivedMessage{Kind: "PlayerMessage", ID: msgKeys[i].ID, PlayerID: msg.PlayerID,
+			Content: msg.Content, Timestamp: msg.Timestamp, IsRead: msg.IsRead, ArchivedAt: now})
 	}
 
-	if _, err := dsClient.Put(ctx, key, target); err != nil {
-		log.Printf("ERROR: Failed to save target for player %s: %v", playerID, err)
-		http.Error(w, "Internal server error when saving target location.", http.StatusInternalServerError)
-		return
+	var dms []DirectMessage
+	dmKeys, err := dsClient.GetAll(ctx, gameQuery(ctx, "DirectMessage").FilterField("Timestamp", "<", cutoff), &dms)
+	if err != nil {
+		return 0, fmt.Errorf("getting old direct messages: %w", err)
+	}
+	for i, dm := range dms {
+		keys = append(keys, dmKeys[i])
+		archived = append(archived, &ArchivedMessage{Kind: "DirectMessage", ID: dmKeys[i].ID, PlayerID: dm.PlayerID,
+			SenderID: dm.SenderID, Content: dm.Content, Timestamp: dm.Timestamp, IsRead: !dm.ReadAt.IsZero(), ArchivedAt: now,
+			DeliveredAt: dm.DeliveredAt, ReadAt: dm.ReadAt})
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	// Write each batch to the archive before deleting it, so a failure never loses messages.
+	done := 0
+	err = forEachBatch(len(keys), func(i, end int) error {
+		archiveKeys := make([]*datastore.Key, 0, end-i)
+		for j := i; j < end; j++ {
+			archiveKeys = append(archiveKeys, gameNameKey(ctx, "ArchivedMessage", fmt.Sprintf("%s-%d", archived[j].Kind, archived[j].ID), nil))
+		}
+		if _, err := dsClient.PutMulti(ctx, archiveKeys, archived[i:end]); err != nil {
+			return fmt.Errorf("archiving messages: %w", err)
+		}
+		if err := dsClient.DeleteMulti(ctx, keys[i:end]); err != nil {
+			return fmt.Errorf("deleting archived messages: %w", err)
+		}
+		done = end
+		return nil
+	})
+	return done, err
 }
 
-// handleObfuscateURL creates a new obfuscated URL for a given player name.
-func handleObfuscateURL(w http.ResponseWriter, r *http.Request) {
+// handleArchiveMessages archives messages older than ?olderThanHours=.
+func handleArchiveMessages(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var reqBody struct {
-		PlayerID   string   `json:"playerID"`
-		Target     *struct { // Make target optional
-			Lat float64 `json:"lat"`
-			Lng float64 `json:"lng"`
-		} `json:"target"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+	olderThanHours, err := strconv.Atoi(r.URL.Query().Get("olderThanHours"))
+	if err != nil || olderThanHours < 0 {
+		http.Error(w, "olderThanHours must be a non-negative integer", http.StatusBadRequest)
 		return
 	}
 
-	obfuscatedID := obfuscatePlayerID(reqBody.PlayerID)
-
-	baseURL := "https://" + r.Host // In production, this will be your appspot domain.
-	if r.Host == "" || strings.HasPrefix(r.Host, "localhost") {
-		baseURL = "http://" + r.Host
+	ctx := r.Context()
+	archived, err := archiveMessages(ctx, time.Now().Add(-time.Duration(olderThanHours)*time.Hour))
+	if err != nil {
+		log.Printf("ERROR: Failed to archive messages: %v", err)
+		http.Error(w, "Internal server error when archiving messages.", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(ObfuscatedURLResponse{PlayerID: reqBody.PlayerID, ObfuscatedID: obfuscatedID, ObfuscatedURL: fmt.Sprintf("%s/player/%s", baseURL, obfuscatedID)})
+	json.NewEncoder(w).Encode(map[string]int{"archived": archived})
 }
 
-// handleTestResult handles submissions of pre-game test results.
-func handleTestResult(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+// handleGetArchivedMessages lets game leads read archived messages, newest first.
+// It can be narrowed to one player with ?playerID={obfuscatedID}.
+func handleGetArchivedMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var reqBody struct {
-		PlayerName         string `json:"playerName"`
-		LocationStatus     string `json:"locationStatus"`
-		NotificationStatus string `json:"notificationStatus"`
-		ServerStatus       string `json:"serverStatus"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
-		return
+	ctx := r.Context()
+	query := gameQuery(ctx, "ArchivedMessage").Order("-Timestamp")
+	if obfuscatedID := r.URL.Query().Get("playerID"); obfuscatedID != "" {
+		playerID, err := deobfuscatePlayerID(obfuscatedID)
+		if err != nil {
+			http.Error(w, invalidPlayerIDMessage, http.StatusBadRequest)
+			return
+		}
+		query = query.FilterField("PlayerID", "=", playerID)
 	}
 
-	if reqBody.PlayerName == "" {
-		http.Error(w, "PlayerName is required", http.StatusBadRequest)
+	// Initialize as an empty slice to ensure we return [] instead of null in JSON.
+	messages := make([]ArchivedMessage, 0)
+	if _, err := dsClient.GetAll(ctx, query, &messages); err != nil {
+		log.Printf("ERROR: Error fetching archived messages: %v", err)
+		http.Error(w, "Internal server error when fetching archived messages.", http.StatusInternalServerError)
 		return
 	}
 
-	ctx := context.Background()
-	// Use the player's name as the key to "upsert" their latest test result.
-	key := datastore.NameKey("TestResult", reqBody.PlayerName, nil)
+	writeJSON(w, r, messages)
+}
 
-	result := &TestResult{
-		PlayerName:         reqBody.PlayerName,
-		LocationStatus:     reqBody.LocationStatus,
-		NotificationStatus: reqBody.NotificationStatus,
-		ServerStatus:       reqBody.ServerStatus,
-		Timestamp:          time.Now(),
+// initialTargetsFile is the roster loaded by handleLoadInitialTargets.
+var initialTargetsFile = "static/initial_targets.json"
+
+// defaultMaxRosterEntries bounds how many players a target roster may list.
+const defaultMaxRosterEntries = 5000
+
+// maxRosterEntries can be overridden with MAX_ROSTER_ENTRIES.
+var maxRosterEntries = defaultMaxRosterEntries
+
+// errRosterTooLarge is returned by decodeRoster when a roster lists more than maxRosterEntries players.
+var errRosterTooLarge = errors.New("roster has too many entries")
+
+// InitialTarget is one entry of a target roster, as in static/initial_targets.json.
+type InitialTarget struct {
+	PlayerName    string `json:"playerName"`
+	ObfuscatedURL string `json:"obfuscatedURL,omitempty"` // Written by the URL generator, not used when loading
+	Target        struct {
+		Lat float64 `json:"lat"`
+		Lng float64 `json:"lng"`
+	} `json:"target"`
+}
+
+// rosterLoadResult summarizes loading a target roster.
+type rosterLoadResult struct {
+	Loaded  int      `json:"loaded"`
+	Skipped int      `json:"skipped"` // Players who already had a target, with skipExisting
+	Invalid []string `json:"errors"`  // Why each invalid entry was left out
+}
+
+// decodeRoster reads a JSON array of roster entries one at a time, so an oversized
+// roster is rejected with errRosterTooLarge without reading the rest of it.
+func decodeRoster(r io.Reader) ([]InitialTarget, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, fmt.Errorf("roster must be a JSON array")
+	}
+	roster := make([]InitialTarget, 0)
+	for dec.More() {
+		if len(roster) == maxRosterEntries {
+			return nil, errRosterTooLarge
+		}
+		var entry InitialTarget
+		if err := dec.Decode(&entry); err != nil {
+			return nil, fmt.Errorf("entry %d: %w", len(roster), jsonDecodeError(err))
+		}
+		roster = append(roster, entry)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("roster must be a JSON array: %w", err)
 	}
+	return roster, nil
+}
 
-	if _, err := dsClient.Put(ctx, key, result); err != nil {
-		log.Printf("ERROR: Failed to save test result for player %s: %v", reqBody.PlayerName, err)
-		http.Error(w, "Internal server error when saving test result.", http.StatusInternalServerError)
-		return
+// saveInitialTargets saves a released target for every valid roster entry. With
+// skipExisting, players who already have a target keep it.
+func saveInitialTargets(ctx context.Context, roster []InitialTarget, skipExisting bool) (rosterLoadResult, error) {
+	result := rosterLoadResult{Invalid: make([]string, 0)}
+	existing := make(map[string]bool)
+	if skipExisting {
+		keys, err := dsClient.GetAll(ctx, gameQuery(ctx, "TargetLocation").KeysOnly(), nil)
+		if err != nil {
+			return result, fmt.Errorf("getting existing target keys: %w", err)
+		}
+		for _, key := range keys {
+			existing[key.Name] = true
+		}
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	var keys []*datastore.Key
+	var targets []*TargetLocation
+	for i, it := range roster {
+		if strings.TrimSpace(it.PlayerName) == "" {
+			result.Invalid = append(result.Invalid, fmt.Sprintf("entry %d: playerName is required", i))
+			continue
+		}
+		if err := validateTargetCoordinates(it.Target.Lat, it.Target.Lng); err != nil {
+			result.Invalid = append(result.Invalid, fmt.Sprintf("entry %d (%s): %v", i, it.PlayerName, err))
+			continue
+		}
+		if existing[it.PlayerName] {
+			result.Skipped++
+			continue
+		}
+		now := time.Now()
+		keys = append(keys, gameNameKey(ctx, "TargetLocation", it.PlayerName, nil))
+		targets = append(targets, &TargetLocation{
+			Lat:        it.Target.Lat,
+			Lng:        it.Target.Lng,
+			Timestamp:  now,
+			FakeHash:   targetFakeHash(it.Target.Lat, it.Target.Lng, now),
+			IsReleased: true, // These targets are immediately released.
+			ExpiresAt:  targetTTLExpiry(now),
+		})
+	}
+
+	// Earlier batches may have been saved even if a later one fails.
+	defer targetCaches.get(ctx).invalidate()
+	if saved, err := batchPut(ctx, keys, targets); err != nil {
+		result.Loaded = saved
+		return result, fmt.Errorf("saving targets: %w", err)
+	}
+	for i, key := range keys {
+		emitWebhookEvent(ctx, webhookEventTargetReleased, map[string]interface{}{"playerID": key.Name, "lat": targets[i].Lat, "lng": targets[i].Lng})
+	}
+	result.Loaded = len(keys)
+	return result, nil
 }
 
-// handleGetTestResults serves all stored pre-game test results.
-func handleGetTestResults(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+// handleLoadTargets loads a target roster uploaded in the request body, with the same
+// schema as static/initial_targets.json, so a roster can change without a redeploy.
+// Pass ?skipExisting=true to keep targets already set during the game. Large rosters
+// can be uploaded gzip-compressed with Content-Encoding: gzip, like any request body.
+func handleLoadTargets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rejectIfDisabled(w, featureTargets) {
 		return
 	}
 
-	ctx := context.Background()
-	// Query for all test results, ordered by the most recent timestamp first.
-	query := datastore.NewQuery("TestResult").Order("-Timestamp")
-
-	var results []TestResult
-	// Using GetAll is fine for a moderate number of players.
-	// For a very large number, we would implement pagination.
-	if _, err := dsClient.GetAll(ctx, query, &results); err != nil {
-		log.Printf("ERROR: Failed to fetch test results: %v", err)
-		http.Error(w, "Internal server error when fetching test results.", http.StatusInternalServerError)
+	// gunzipMiddleware has already inflated a gzip-compressed upload.
+	roster, err := decodeRoster(r.Body)
+	if err == errRosterTooLarge {
+		http.Error(w, fmt.Sprintf("The roster may list at most %d players", maxRosterEntries), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(roster) == 0 {
+		http.Error(w, "The roster is empty", http.StatusBadRequest)
 		return
 	}
 
-	// If no results are found, return an empty array instead of null.
-	if results == nil {
-		results = make([]TestResult, 0)
+	ctx := r.Context()
+	result, err := saveInitialTargets(ctx, roster, r.URL.Query().Get("skipExisting") == "true")
+	if err != nil {
+		log.Printf("ERROR: Failed to save uploaded targets: %v", err)
+		http.Error(w, "Internal server error when saving targets.", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(results); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	json.NewEncoder(w).Encode(result)
 }
 
 // handleLoadInitialTargets reads a static JSON file and creates released targets for all players listed.
+// Pass ?skipExisting=true to keep targets already set during the game.
 func handleLoadInitialTargets(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if rejectIfDisabled(w, featureTargets) {
+		return
+	}
 
 	// Read the static JSON file
-	jsonFile, err := os.Open("static/initial_targets.json")
+	jsonFile, err := os.Open(initialTargetsFile)
 	if err != nil {
 		log.Printf("ERROR: Failed to open initial_targets.json: %v", err)
 		http.Error(w, "Could not find initial_targets.json on the server.", http.StatusInternalServerError)
@@ -807,49 +8241,41 @@ func handleLoadInitialTargets(w http.ResponseWriter, r *http.Request) {
 	}
 	defer jsonFile.Close()
 
-	var initialTargets []struct {
-		PlayerName string `json:"playerName"`
-		Target     struct {
-			Lat float64 `json:"lat"`
-			Lng float64 `json:"lng"`
-		} `json:"target"`
+	roster, err := decodeRoster(jsonFile)
+	if err == errRosterTooLarge {
+		log.Printf("ERROR: initial_targets.json lists more than %d players", maxRosterEntries)
+		http.Error(w, fmt.Sprintf("initial_targets.json may list at most %d players.", maxRosterEntries), http.StatusRequestEntityTooLarge)
+		return
 	}
-
-	if err := json.NewDecoder(jsonFile).Decode(&initialTargets); err != nil {
+	if err != nil {
 		log.Printf("ERROR: Failed to parse initial_targets.json: %v", err)
 		http.Error(w, "Failed to parse initial_targets.json.", http.StatusInternalServerError)
 		return
 	}
 
-	ctx := context.Background()
-	var keys []*datastore.Key
-	var targets []*TargetLocation
-
-	for _, it := range initialTargets {
-		now := time.Now()
-		mac := hmac.New(sha256.New, []byte(hmacSecret))
-		data := fmt.Sprintf("%.6f,%.6f,%d", it.Target.Lat, it.Target.Lng, now.UnixNano())
-		mac.Write([]byte(data))
-		fakeHash := strings.ToUpper(hex.EncodeToString(mac.Sum(nil))[:8])
-
-		keys = append(keys, datastore.NameKey("TargetLocation", it.PlayerName, nil))
-		targets = append(targets, &TargetLocation{
-			Lat:        it.Target.Lat,
-			Lng:        it.Target.Lng,
-			Timestamp:  now,
-			FakeHash:   fakeHash,
-			IsReleased: true, // These targets are immediately released.
-		})
-	}
-
-	if _, err := dsClient.PutMulti(ctx, keys, targets); err != nil {
+	ctx := r.Context()
+	result, err := saveInitialTargets(ctx, roster, r.URL.Query().Get("skipExisting") == "true")
+	if err != nil {
 		log.Printf("ERROR: Failed to save initial targets: %v", err)
 		http.Error(w, "Internal server error when saving initial targets.", http.StatusInternalServerError)
 		return
 	}
+	for _, reason := range result.Invalid {
+		log.Printf("Skipped invalid entry in initial_targets.json: %s", reason)
+	}
 
+	message := fmt.Sprintf("Successfully loaded and set %d initial targets.", result.Loaded)
+	if result.Skipped > 0 {
+		message += fmt.Sprintf(" Skipped %d players who already have a target.", result.Skipped)
+	}
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{"message": fmt.Sprintf("Successfully loaded and set %d initial targets.", len(targets))})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": message,
+		"loaded":  result.Loaded,
+		"skipped": result.Skipped,
+		"invalid": len(result.Invalid),
+		"errors":  result.Invalid,
+	})
 }
 
 // handleGetHistory retrieves the location history for a specific player.
@@ -865,8 +8291,8 @@ func handleGetHistory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
-	query := datastore.NewQuery("LocationHistory").FilterField("PlayerID", "=", playerID).Order("Timestamp")
+	ctx := r.Context()
+	query := gameQuery(ctx, "LocationHistory").FilterField("PlayerID", "=", playerID).Order("Timestamp")
 
 	var history []LocationHistoryEntry
 	if _, err := dsClient.GetAll(ctx, query, &history); err != nil {
@@ -875,26 +8301,63 @@ func handleGetHistory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(history)
+	writeJSON(w, r, history)
+}
+
+// knownKinds lists the game data kinds that handleClearDatastore may wipe.
+var knownKinds = []string{"PlayerLocation", "PlayerMessage", "DirectMessage", "TargetLocation", "TestResult", "LocationHistory", "IdempotencyRecord", "NotificationPrefs", "ArchivedMessage", "GameStats", "PlayerTarget", "EmergencyAlert", "ReadCursor", "GameState", "Player", "Arrival"}
+
+// handleCounts reports how many entities of each known kind exist.
+// It expects GET /api/admin/counts and only fetches keys.
+func handleCounts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	counts := make(map[string]int, len(knownKinds))
+	for _, kind := range knownKinds {
+		keys, err := dsClient.GetAll(ctx, gameQuery(ctx, kind).KeysOnly(), nil)
+		if err != nil {
+			log.Printf("ERROR: Failed to count entities of kind %s: %v", kind, err)
+			http.Error(w, "Internal server error when counting entities.", http.StatusInternalServerError)
+			return
+		}
+		counts[kind] = len(keys)
+	}
+
+	writeJSON(w, r, counts)
 }
 
-// handleClearDatastore is a temporary admin function to wipe all known kinds from the datastore.
+// handleClearDatastore lets leads wipe all known kinds from the datastore.
+// Pass ?kinds=PlayerMessage,DirectMessage to only wipe some of them.
 // WARNING: This deletes all data. Use with caution.
 func handleClearDatastore(w http.ResponseWriter, r *http.Request) {
-	// Simple protection to prevent accidental calls.
-	// In a real app, this should be behind proper admin authentication.
+	// Leads are logged in, this only protects against accidental calls.
 	if r.URL.Query().Get("confirm") != "true" {
 		http.Error(w, "This is a destructive operation. Add `?confirm=true` to the URL to proceed.", http.StatusForbidden)
 		return
 	}
 
-	ctx := context.Background()
-	kinds := []string{"PlayerLocation", "PlayerMessage", "DirectMessage", "TargetLocation", "TestResult", "LocationHistory"}
+	kinds := knownKinds
+	if kindsParam := r.URL.Query().Get("kinds"); kindsParam != "" {
+		kinds = nil
+		for _, kind := range strings.Split(kindsParam, ",") {
+			kind = strings.TrimSpace(kind)
+			if !slices.Contains(knownKinds, kind) {
+				http.Error(w, fmt.Sprintf("Unknown kind %q", kind), http.StatusBadRequest)
+				return
+			}
+			kinds = append(kinds, kind)
+		}
+	}
+
+	ctx := r.Context()
 	totalDeleted := 0
 
 	for _, kind := range kinds {
-		q := datastore.NewQuery(kind).KeysOnly()
+		q := gameQuery(ctx, kind).KeysOnly()
 		keys, err := dsClient.GetAll(ctx, q, nil)
 		if err != nil {
 			log.Printf("Failed to get keys for kind %s: %v", kind, err)
@@ -906,22 +8369,600 @@ func handleClearDatastore(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		// Datastore allows deleting up to 500 keys at a time. Batch the deletes.
-		for i := 0; i < len(keys); i += 500 {
-			end := i + 500
-			if end > len(keys) {
-				end = len(keys)
+		if _, err := batchDelete(ctx, keys); err != nil {
+			log.Printf("Failed to delete batch of keys for kind %s: %v", kind, err)
+			http.Error(w, fmt.Sprintf("Failed to delete keys for kind %s", kind), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Deleted %d entities of kind %s", len(keys), kind)
+		totalDeleted += len(keys)
+		switch kind {
+		case "TargetLocation":
+			targetCaches.get(ctx).invalidate()
+		case "PlayerLocation":
+			playerRegistries.get(ctx).invalidate()
+			locationCaches.get(ctx).invalidate()
+		case "Player":
+			displayNameCaches.get(ctx).invalidate()
+		case "Arrival", "LocationHistory":
+			invalidateLeaderboard(ctx)
+		}
+	}
+
+	fmt.Fprintf(w, "Successfully deleted %d entities across %d kinds.", totalDeleted, len(kinds))
+}
+
+// --- Renaming Players ---
+
+// renameKeyedKinds are the kinds keyed by player ID, which are re-keyed on a rename.
+var renameKeyedKinds = []string{"PlayerLocation", "TargetLocation", "TestResult", "NotificationPrefs", "Player"}
+
+// renameFieldKinds are the kinds that refer to a player in their PlayerID property.
+var renameFieldKinds = []string{"PlayerMessage", "DirectMessage", "LocationHistory", "ArchivedMessage", "EmergencyAlert", "Arrival"}
+
+// errRenameTargetExists is returned when the new name already has entities of its own.
+var errRenameTargetExists = errors.New("player already exists")
+
+// RenameSummary reports how many entities of each kind a rename moved.
+type RenameSummary struct {
+	OldName string         `json:"oldName"`
+	NewName string         `json:"newName"`
+	Moved   map[string]int `json:"moved"`
+}
+
+// setPlayerProperties points the player properties of an entity loaded as a
+// PropertyList at playerID. TestResult calls it PlayerName, the rest PlayerID.
+func setPlayerProperties(props datastore.PropertyList, playerID string) {
+	for i := range props {
+		if props[i].Name == "PlayerID" || props[i].Name == "PlayerName" {
+			props[i].Value = playerID
+		}
+	}
+}
+
+// entitiesExist interprets the error of a GetMulti of n keys, reporting which of the
+// entities exist. Errors other than missing entities are returned as they are.
+func entitiesExist(err error, n int) ([]bool, error) {
+	exist := make([]bool, n)
+	if err == nil {
+		for i := range exist {
+			exist[i] = true
+		}
+		return exist, nil
+	}
+	multi, ok := err.(datastore.MultiError)
+	if !ok {
+		return nil, err
+	}
+	for i, err := range multi {
+		switch err {
+		case nil:
+			exist[i] = true
+		case datastore.ErrNoSuchEntity:
+		default:
+			return nil, err
+		}
+	}
+	return exist, nil
+}
+
+// renamePlayer moves everything stored for oldName to newName. The entities keyed by
+// player ID and the target chain move in one transaction, which fails with
+// errRenameTargetExists if newName already has any of them or chain steps. The messages,
+// history and alerts referring to the player are then updated in batches of their own
+// transactions, and the leads' read cursors are re-keyed. Entities are loaded as
+// PropertyLists, so every property survives the move.
+func renamePlayer(ctx context.Context, oldName, newName string) (RenameSummary, error) {
+	summary := RenameSummary{OldName: oldName, NewName: newName, Moved: make(map[string]int)}
+
+	_, err := dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		clear(summary.Moved)
+		var oldKeys, newKeys []*datastore.Key
+		for _, kind := range renameKeyedKinds {
+			oldKeys = append(oldKeys, gameNameKey(ctx, kind, oldName, nil))
+			newKeys = append(newKeys, gameNameKey(ctx, kind, newName, nil))
+		}
+		taken, err := entitiesExist(tx.GetMulti(newKeys, make([]datastore.PropertyList, len(newKeys))), len(newKeys))
+		if err != nil {
+			return err
+		}
+		if slices.Contains(taken, true) {
+			return errRenameTargetExists
+		}
+		// Moving a chain onto an existing one would interleave their steps.
+		newSteps, err := dsClient.GetAll(ctx, gameQuery(ctx, "PlayerTarget").Ancestor(targetChainKey(ctx, newName)).KeysOnly().Limit(1).Transaction(tx), nil)
+		if err != nil {
+			return err
+		}
+		if len(newSteps) > 0 {
+			return errRenameTargetExists
+		}
+
+		entities := make([]datastore.PropertyList, len(oldKeys))
+		found, err := entitiesExist(tx.GetMulti(oldKeys, entities), len(oldKeys))
+		if err != nil {
+			return err
+		}
+		var putKeys, deleteKeys []*datastore.Key
+		var puts []datastore.PropertyList
+		for i := range oldKeys {
+			if !found[i] {
+				continue
 			}
+			setPlayerProperties(entities[i], newName)
+			putKeys = append(putKeys, newKeys[i])
+			deleteKeys = append(deleteKeys, oldKeys[i])
+			puts = append(puts, entities[i])
+			summary.Moved[renameKeyedKinds[i]]++
+		}
+
+		// Chain steps are keyed under the player's chain, so they move with it.
+		var steps []datastore.PropertyList
+		stepKeys, err := dsClient.GetAll(ctx, gameQuery(ctx, "PlayerTarget").Ancestor(targetChainKey(ctx, oldName)).Transaction(tx), &steps)
+		if err != nil {
+			return err
+		}
+		for i, key := range stepKeys {
+			putKeys = append(putKeys, playerTargetKey(ctx, newName, key.ID))
+			deleteKeys = append(deleteKeys, key)
+			puts = append(puts, steps[i])
+			summary.Moved["PlayerTarget"]++
+		}
+
+		if len(putKeys) == 0 {
+			return nil
+		}
+		if _, err := tx.PutMulti(putKeys, puts); err != nil {
+			return err
+		}
+		return tx.DeleteMulti(deleteKeys)
+	})
+	if err != nil {
+		return summary, err
+	}
+
+	for _, kind := range renameFieldKinds {
+		keys, err := dsClient.GetAll(ctx, gameQuery(ctx, kind).FilterField("PlayerID", "=", oldName).KeysOnly(), nil)
+		if err != nil {
+			return summary, fmt.Errorf("finding %s of %s: %w", kind, oldName, err)
+		}
+		err = forEachBatch(len(keys), func(i, end int) error {
 			batch := keys[i:end]
-			if err := dsClient.DeleteMulti(ctx, batch); err != nil {
-				log.Printf("Failed to delete batch of keys for kind %s: %v", kind, err)
-				http.Error(w, fmt.Sprintf("Failed to delete keys for kind %s", kind), http.StatusInternalServerError)
+			_, err := dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+				entities := make([]datastore.PropertyList, len(batch))
+				if err := tx.GetMulti(batch, entities); err != nil {
+					return err
+				}
+				for _, props := range entities {
+					setPlayerProperties(props, newName)
+				}
+				_, err := tx.PutMulti(batch, entities)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("updating %s of %s: %w", kind, oldName, err)
+			}
+			summary.Moved[kind] += len(batch)
+			return nil
+		})
+		if err != nil {
+			return summary, err
+		}
+	}
+
+	moved, err := renameReadCursors(ctx, oldName, newName)
+	if moved > 0 {
+		summary.Moved["ReadCursor"] = moved
+	}
+	if err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
+
+// renameReadCursors re-keys the leads' read cursors of oldName to newName and returns
+// how many moved. A lead who already has a cursor for newName keeps whichever of the
+// two has read further.
+func renameReadCursors(ctx context.Context, oldName, newName string) (int, error) {
+	keys, err := dsClient.GetAll(ctx, gameQuery(ctx, "ReadCursor").FilterField("PlayerID", "=", oldName).KeysOnly(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("finding read cursors of %s: %w", oldName, err)
+	}
+	moved := 0
+	err = forEachBatch(len(keys), func(i, end int) error {
+		batch := keys[i:end]
+		batchMoved := 0
+		_, err := dsClient.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			batchMoved = 0
+			cursors := make([]ReadCursor, len(batch))
+			found, err := entitiesExist(tx.GetMulti(batch, cursors), len(batch))
+			if err != nil {
+				return err
+			}
+			var oldKeys, newKeys []*datastore.Key
+			var moving []*ReadCursor
+			for j := range batch {
+				if found[j] {
+					oldKeys = append(oldKeys, batch[j])
+					newKeys = append(newKeys, readCursorKey(ctx, cursors[j].LeadID, newName))
+					moving = append(moving, &cursors[j])
+				}
+			}
+			if len(moving) == 0 {
+				return nil
+			}
+			batchMoved = len(moving)
+			existing := make([]ReadCursor, len(newKeys))
+			exists, err := entitiesExist(tx.GetMulti(newKeys, existing), len(newKeys))
+			if err != nil {
+				return err
+			}
+			for j, cursor := range moving {
+				cursor.PlayerID = newName
+				if exists[j] && existing[j].ReadUpTo.After(cursor.ReadUpTo) {
+					*cursor = existing[j]
+				}
+			}
+			if _, err := tx.PutMulti(newKeys, moving); err != nil {
+				return err
+			}
+			return tx.DeleteMulti(oldKeys)
+		})
+		if err != nil {
+			return fmt.Errorf("moving read cursors of %s: %w", oldName, err)
+		}
+		moved += batchMoved
+		return nil
+	})
+	return moved, err
+}
+
+// handleRenamePlayer moves all data of a player whose name was entered wrong to the
+// right name. It expects POST /api/admin/rename-player with {"oldName", "newName"}
+// and returns a RenameSummary. The player needs a new URL afterwards, since the
+// obfuscated ID is derived from the name.
+func handleRenamePlayer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody struct {
+		OldName string `json:"oldName"`
+		NewName string `json:"newName"`
+	}
+	if err := decodeJSONBody(r, &reqBody); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reqBody.OldName == "" {
+		http.Error(w, errMissingField("oldName").Error(), http.StatusBadRequest)
+		return
+	}
+	if reqBody.NewName == "" {
+		http.Error(w, errMissingField("newName").Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validatePlayerName(reqBody.NewName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reqBody.OldName == reqBody.NewName {
+		http.Error(w, "oldName and newName must differ", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	summary, err := renamePlayer(ctx, reqBody.OldName, reqBody.NewName)
+	// Whatever moved before a failure changed the targets and players.
+	targetCaches.get(ctx).invalidate()
+	playerRegistries.get(ctx).invalidate()
+	locationCaches.get(ctx).invalidate()
+	displayNameCaches.get(ctx).invalidate()
+	invalidateLeaderboard(ctx)
+	if err == errRenameTargetExists {
+		http.Error(w, fmt.Sprintf("Player %q already has data, rename them first", reqBody.NewName), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to rename player %s to %s: %v", reqBody.OldName, reqBody.NewName, err)
+		http.Error(w, "Internal server error when renaming player.", http.StatusInternalServerError)
+		return
+	}
+	if len(summary.Moved) == 0 {
+		http.Error(w, fmt.Sprintf("No data found for player %q", reqBody.OldName), http.StatusNotFound)
+		return
+	}
+	log.Printf("Renamed player %s to %s: %v", reqBody.OldName, reqBody.NewName, summary.Moved)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// --- Export and Import ---
+
+// backupKind is a kind in a game backup, with a constructor for the struct its entities load into.
+type backupKind struct {
+	kind      string
+	newEntity func() interface{}
+}
+
+// backupEntities gives the struct each of knownKinds loads into for a backup.
+var backupEntities = map[string]func() interface{}{
+	"PlayerLocation":    func() interface{} { return new(PlayerLocation) },
+	"PlayerMessage":     func() interface{} { return new(PlayerMessage) },
+	"DirectMessage":     func() interface{} { return new(DirectMessage) },
+	"TargetLocation":    func() interface{} { return new(TargetLocation) },
+	"TestResult":        func() interface{} { return new(TestResult) },
+	"LocationHistory":   func() interface{} { return new(LocationHistoryEntry) },
+	"IdempotencyRecord": func() interface{} { return new(IdempotencyRecord) },
+	"NotificationPrefs": func() interface{} { return new(NotificationPrefs) },
+	"ArchivedMessage":   func() interface{} { return new(ArchivedMessage) },
+	"GameStats":         func() interface{} { return new(GameStats) },
+	"PlayerTarget":      func() interface{} { return new(PlayerTarget) },
+	"EmergencyAlert":    func() interface{} { return new(EmergencyAlert) },
+	"ReadCursor":        func() interface{} { return new(ReadCursor) },
+	"GameState":         func() interface{} { return new(GameState) },
+	"Player":            func() interface{} { return new(Player) },
+	"Arrival":           func() interface{} { return new(Arrival) },
+}
+
+// backupKinds are the kinds in a game backup, in export order. They're every kind
+// handleClearDatastore can wipe, so a backup taken before clearing restores all of it.
+var backupKinds = func() []backupKind {
+	kinds := make([]backupKind, len(knownKinds))
+	for i, kind := range knownKinds {
+		newEntity, ok := backupEntities[kind]
+		if !ok {
+			panic(fmt.Sprintf("no backup entity for kind %s", kind))
+		}
+		kinds[i] = backupKind{kind, newEntity}
+	}
+	return kinds
+}()
+
+// backupRecord is one entity in a backup. Named keys keep their name, the others their ID.
+// Entities with a parent, like the steps of a target chain, also keep the parent's key.
+type backupRecord struct {
+	Name   string          `json:"name,omitempty"`
+	ID     int64           `json:"id,omitempty"`
+	Parent *backupKey      `json:"parent,omitempty"`
+	Entity json.RawMessage `json:"entity"`
+}
+
+// backupKey is the key of a parent entity in a backup.
+type backupKey struct {
+	Kind string `json:"kind"`
+	Name string `json:"name,omitempty"`
+	ID   int64  `json:"id,omitempty"`
+}
+
+// importBatchSize is how many entities handleImport writes per PutMulti.
+const importBatchSize = 500
+
+// handleExport streams a backup of the game as one JSON document:
+// {"exportedAt": "...", "kinds": {"PlayerLocation": [{"name": "alice", "entity": {...}}], ...}}.
+// Entities are written as they're read, so the backup never has to fit in memory.
+// Fields that aren't part of the JSON API, like where an address was looked up, aren't kept.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="droppydrop-%s.json"`, time.Now().UTC().Format("20060102-150405")))
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	exportedAt, _ := json.Marshal(time.Now())
+	fmt.Fprintf(bw, `{"exportedAt":%s,"kinds":{`, exportedAt)
+	for i, bk := range backupKinds {
+		if i > 0 {
+			bw.WriteString(",")
+		}
+		fmt.Fprintf(bw, "%q:[", bk.kind)
+		it := dsClient.Run(ctx, gameQuery(ctx, bk.kind))
+		for n := 0; ; n++ {
+			entity := bk.newEntity()
+			key, err := it.Next(entity)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				// The status is already sent, so leave the document unfinished: it won't import.
+				log.Printf("ERROR: Failed to export %s: %v", bk.kind, err)
 				return
 			}
+			data, err := json.Marshal(entity)
+			if err != nil {
+				log.Printf("ERROR: Failed to encode %s %v for export: %v", bk.kind, key, err)
+				return
+			}
+			entry := backupRecord{Name: key.Name, ID: key.ID, Entity: data}
+			if key.Parent != nil {
+				entry.Parent = &backupKey{Kind: key.Parent.Kind, Name: key.Parent.Name, ID: key.Parent.ID}
+			}
+			record, _ := json.Marshal(entry)
+			if n > 0 {
+				bw.WriteString(",")
+			}
+			bw.Write(record)
 		}
-		log.Printf("Deleted %d entities of kind %s", len(keys), kind)
-		totalDeleted += len(keys)
+		bw.WriteString("]")
 	}
+	bw.WriteString("}}\n")
+}
 
-	fmt.Fprintf(w, "Successfully deleted %d entities across %d kinds.", totalDeleted, len(kinds))
+// handleImport restores a backup written by handleExport. Entities overwrite those with
+// the same key and are written in batches as the body is read. It responds with the
+// number of entities imported per kind.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	imported, err := importBackup(ctx, r.Body)
+	// Whatever was written before a failure changed the targets and players.
+	targetCaches.get(ctx).invalidate()
+	playerRegistries.get(ctx).invalidate()
+	locationCaches.get(ctx).invalidate()
+	displayNameCaches.get(ctx).invalidate()
+	invalidateLeaderboard(ctx)
+	if err != nil {
+		var saveErr *backupSaveError
+		if errors.As(err, &saveErr) {
+			log.Printf("ERROR: Failed to import backup: %v", err)
+			http.Error(w, "Internal server error when importing backup.", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, fmt.Sprintf("invalid backup: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"imported": imported})
+}
+
+// backupSaveError is a datastore failure while importing, as opposed to a bad backup.
+type backupSaveError struct {
+	kind string
+	err  error
+}
+
+func (e *backupSaveError) Error() string {
+	return fmt.Sprintf("saving %s: %v", e.kind, e.err)
+}
+
+// importBackup reads a backup from body and saves its entities, returning how many
+// were saved per kind.
+func importBackup(ctx context.Context, body io.Reader) (map[string]int, error) {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	imported := make(map[string]int)
+	if err := expectDelim(dec, '{'); err != nil {
+		return imported, err
+	}
+	for dec.More() {
+		field, err := dec.Token()
+		if err != nil {
+			return imported, err
+		}
+		switch field {
+		case "exportedAt":
+			var exportedAt time.Time
+			if err := dec.Decode(&exportedAt); err != nil {
+				return imported, fmt.Errorf("exportedAt: %w", err)
+			}
+		case "kinds":
+			if err := expectDelim(dec, '{'); err != nil {
+				return imported, err
+			}
+			for dec.More() {
+				kind, err := dec.Token()
+				if err != nil {
+					return imported, err
+				}
+				name, _ := kind.(string)
+				if err := importKind(ctx, dec, name, imported); err != nil {
+					return imported, err
+				}
+			}
+			if err := expectDelim(dec, '}'); err != nil {
+				return imported, err
+			}
+		default:
+			return imported, fmt.Errorf("unknown field %v", field)
+		}
+	}
+	return imported, expectDelim(dec, '}')
+}
+
+// importKind reads the array of records for one kind and saves them in batches.
+func importKind(ctx context.Context, dec *json.Decoder, kind string, imported map[string]int) error {
+	i := slices.IndexFunc(backupKinds, func(bk backupKind) bool { return bk.kind == kind })
+	if i < 0 {
+		return fmt.Errorf("unknown kind %q", kind)
+	}
+	newEntity := backupKinds[i].newEntity
+	if err := expectDelim(dec, '['); err != nil {
+		return fmt.Errorf("%s: %w", kind, err)
+	}
+
+	var keys []*datastore.Key
+	var entities []interface{}
+	save := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		if err := withRetry(ctx, func() error { _, err := dsClient.PutMulti(ctx, keys, entities); return err }); err != nil {
+			return &backupSaveError{kind: kind, err: err}
+		}
+		imported[kind] += len(keys)
+		keys, entities = keys[:0], entities[:0]
+		return nil
+	}
+	for dec.More() {
+		var record backupRecord
+		if err := dec.Decode(&record); err != nil {
+			return fmt.Errorf("%s: %w", kind, err)
+		}
+		var parent *datastore.Key
+		if p := record.Parent; p != nil {
+			switch {
+			case p.Kind == "":
+				return fmt.Errorf("%s: parent needs a kind", kind)
+			case p.Name != "" && p.ID == 0:
+				parent = gameNameKey(ctx, p.Kind, p.Name, nil)
+			case p.ID != 0 && p.Name == "":
+				parent = gameIDKey(ctx, p.Kind, p.ID, nil)
+			default:
+				return fmt.Errorf("%s: parent needs either a name or an id", kind)
+			}
+		}
+		var key *datastore.Key
+		switch {
+		case record.Name != "" && record.ID == 0:
+			key = gameNameKey(ctx, kind, record.Name, parent)
+		case record.ID != 0 && record.Name == "":
+			key = gameIDKey(ctx, kind, record.ID, parent)
+		default:
+			return fmt.Errorf("%s: each entity needs either a name or an id", kind)
+		}
+		entity := newEntity()
+		entityDec := json.NewDecoder(bytes.NewReader(record.Entity))
+		entityDec.DisallowUnknownFields()
+		if err := entityDec.Decode(entity); err != nil {
+			return fmt.Errorf("%s %v: %w", kind, key, err)
+		}
+		keys = append(keys, key)
+		entities = append(entities, entity)
+		if len(keys) == importBatchSize {
+			if err := save(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := save(); err != nil {
+		return err
+	}
+	return expectDelim(dec, ']')
+}
+
+// expectDelim reads the next token and checks that it's the delimiter want.
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return errors.New("backup ends too early")
+	}
+	if err != nil {
+		return err
+	}
+	if tok != want {
+		return fmt.Errorf("expected %v, got %v", want, tok)
+	}
+	return nil
 }
@@ -0,0 +1,7429 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"image/png"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestMain connects to the datastore emulator when DATASTORE_EMULATOR_HOST is set.
+// Without it, tests that need the datastore are skipped.
+func TestMain(m *testing.M) {
+	// Tests write targets straight to datastore, so only the cache tests enable it.
+	targetsCacheTTL = 0
+	// Tests write locations straight to datastore, so only the cache tests enable it.
+	locationsCacheEnabled = false
+	// Tests repeat updates from the same spot, so only the jitter tests filter them.
+	minMoveMeters = 0
+	// Tests raise alerts for the same players, so only the cooldown tests enable it.
+	panicCooldown = 0
+	// Tests submit test results for the same players, so only the cooldown test enables it.
+	testResultCooldown = 0
+	// Tests send many messages for the same players, so only the rate limit tests enable it.
+	maxMessagesPerWindow = 0
+	if os.Getenv("DATASTORE_EMULATOR_HOST") != "" {
+		var err error
+		dsClient, err = datastore.NewClient(context.Background(), "droppydrop-test")
+		if err != nil {
+			log.Fatalf("Failed to create datastore client: %v", err)
+		}
+	}
+	os.Exit(m.Run())
+}
+
+// requireEmulator skips the test when there's no datastore emulator, and otherwise
+// empties the given kinds so the test starts from a clean slate.
+func requireEmulator(t *testing.T, kinds ...string) {
+	t.Helper()
+	if dsClient == nil {
+		t.Skip("DATASTORE_EMULATOR_HOST not set, skipping datastore test")
+	}
+	ctx := context.Background()
+	for _, kind := range kinds {
+		keys, err := dsClient.GetAll(ctx, datastore.NewQuery(kind).KeysOnly(), nil)
+		if err != nil {
+			t.Fatalf("listing %s keys: %v", kind, err)
+		}
+		if err := dsClient.DeleteMulti(ctx, keys); err != nil {
+			t.Fatalf("clearing %s: %v", kind, err)
+		}
+	}
+}
+
+// putEntity stores src under key, failing the test on error.
+func putEntity(t *testing.T, key *datastore.Key, src interface{}) *datastore.Key {
+	t.Helper()
+	k, err := dsClient.Put(context.Background(), key, src)
+	if err != nil {
+		t.Fatalf("putting %v: %v", key, err)
+	}
+	return k
+}
+
+// countEntities returns how many entities of a kind are stored.
+func countEntities(t *testing.T, kind string) int {
+	t.Helper()
+	keys, err := dsClient.GetAll(context.Background(), datastore.NewQuery(kind).KeysOnly(), nil)
+	if err != nil {
+		t.Fatalf("counting %s: %v", kind, err)
+	}
+	return len(keys)
+}
+
+func getLocations(t *testing.T, url string) map[string]PlayerLocation {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleGetLocations(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d, body %q", url, rec.Code, rec.Body.String())
+	}
+	var locations map[string]PlayerLocation
+	if err := json.NewDecoder(rec.Body).Decode(&locations); err != nil {
+		t.Fatalf("decoding locations: %v", err)
+	}
+	return locations
+}
+
+func TestGetLocationsFilters(t *testing.T) {
+	requireEmulator(t, "PlayerLocation")
+	now := time.Now()
+	putEntity(t, datastore.NameKey("PlayerLocation", "fresh-ok", nil), &PlayerLocation{Lat: 51, Lng: 4, Status: "OK", Timestamp: now})
+	putEntity(t, datastore.NameKey("PlayerLocation", "fresh-denied", nil), &PlayerLocation{Lat: 51, Lng: 4, Status: "DENIED", Timestamp: now})
+	putEntity(t, datastore.NameKey("PlayerLocation", "stale-ok", nil), &PlayerLocation{Lat: 51, Lng: 4, Status: "OK", Timestamp: now.Add(-time.Hour)})
+
+	tests := []struct {
+		url  string
+		want []string
+	}{
+		{"/api/locations", []string{"fresh-ok", "fresh-denied", "stale-ok"}},
+		{"/api/locations?status=OK", []string{"fresh-ok", "stale-ok"}},
+		{"/api/locations?maxAgeSeconds=300", []string{"fresh-ok", "fresh-denied"}},
+		{"/api/locations?status=OK&maxAgeSeconds=300", []string{"fresh-ok"}},
+	}
+	for _, tt := range tests {
+		locations := getLocations(t, tt.url)
+		if len(locations) != len(tt.want) {
+			t.Errorf("GET %s returned %d players, want %v", tt.url, len(locations), tt.want)
+		}
+		for _, playerID := range tt.want {
+			if _, ok := locations[playerID]; !ok {
+				t.Errorf("GET %s is missing %s", tt.url, playerID)
+			}
+		}
+	}
+}
+
+func TestGetLocationsRejectsInvalidMaxAge(t *testing.T) {
+	for _, value := range []string{"abc", "0", "-5"} {
+		rec := httptest.NewRecorder()
+		handleGetLocations(rec, httptest.NewRequest(http.MethodGet, "/api/locations?maxAgeSeconds="+value, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("maxAgeSeconds=%s: status %d, want %d", value, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestLocationsETagTracksTimestamps(t *testing.T) {
+	now := time.Now()
+	a := map[string]PlayerLocation{"alice": {Timestamp: now}, "bob": {Timestamp: now}}
+	b := map[string]PlayerLocation{"bob": {Timestamp: now}, "alice": {Timestamp: now}}
+	if locationsETag(a) != locationsETag(b) {
+		t.Error("ETag depends on map order")
+	}
+	b["bob"] = PlayerLocation{Timestamp: now.Add(time.Second)}
+	if locationsETag(a) == locationsETag(b) {
+		t.Error("ETag didn't change after a location update")
+	}
+
+	// These change without a new timestamp.
+	for name, loc := range map[string]PlayerLocation{
+		"stale":      {Timestamp: now, Stale: true},
+		"status":     {Timestamp: now, Status: "DENIED"},
+		"suspicious": {Timestamp: now, Suspicious: true},
+	} {
+		b = map[string]PlayerLocation{"alice": {Timestamp: now}, "bob": loc}
+		if locationsETag(a) == locationsETag(b) {
+			t.Errorf("ETag didn't change for a %s location", name)
+		}
+	}
+}
+
+func TestGetLocationsNotModified(t *testing.T) {
+	requireEmulator(t, "PlayerLocation")
+	putEntity(t, datastore.NameKey("PlayerLocation", "alice", nil), &PlayerLocation{Lat: 51, Lng: 4, Status: "OK", Timestamp: time.Now()})
+
+	rec := httptest.NewRecorder()
+	handleGetLocations(rec, httptest.NewRequest(http.MethodGet, "/api/locations", nil))
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("first response has no ETag")
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("Cache-Control = %q, want no-cache", got)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/locations", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handleGetLocations(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusNotModified)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("304 response has a body: %q", rec.Body.String())
+	}
+}
+
+func TestGetLocationsModifiedAfterSweep(t *testing.T) {
+	requireEmulator(t, "PlayerLocation")
+	now := time.Now()
+	putEntity(t, datastore.NameKey("PlayerLocation", "alice", nil), &PlayerLocation{Lat: 51, Lng: 4, Status: "OK", Timestamp: now.Add(-time.Hour)})
+
+	rec := httptest.NewRecorder()
+	handleGetLocations(rec, httptest.NewRequest(http.MethodGet, "/api/locations", nil))
+	etag := rec.Header().Get("ETag")
+
+	// Flagging alice as stale leaves her timestamp alone, but changes the payload.
+	if n, err := sweepStaleLocations(context.Background(), now.Add(-30*time.Minute)); err != nil || n != 1 {
+		t.Fatalf("sweep: got %d, %v", n, err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/locations", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handleGetLocations(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"stale":true`) {
+		t.Errorf("after the sweep: got %d %q, want %d with the stale flag", rec.Code, rec.Body.String(), http.StatusOK)
+	}
+}
+
+func TestLocationTimeSource(t *testing.T) {
+	withLocationsCache(t)
+	t.Cleanup(func() { locationTimeSource = locationTimeServer })
+	now := time.Now()
+	_, generation, _ := locationCache.get()
+	locationCache.fill(map[string]PlayerLocation{
+		// The server just heard from slow-clock, but its phone says it's 10 minutes ago.
+		"slow-clock": {Status: PlayerStatusOK, Timestamp: now, ClientTimestamp: now.Add(-10 * time.Minute)},
+		// The server last heard from replayed 10 minutes ago, with a current client time.
+		"replayed": {Status: PlayerStatusOK, Timestamp: now.Add(-10 * time.Minute), ClientTimestamp: now},
+		// Without a client timestamp both policies go by the server's.
+		"no-client": {Status: PlayerStatusOK, Timestamp: now},
+	}, generation)
+
+	tests := []struct {
+		source string
+		want   []string
+	}{
+		{locationTimeServer, []string{"no-client", "slow-clock"}},
+		{locationTimeClient, []string{"no-client", "replayed"}},
+	}
+	for _, tt := range tests {
+		locationTimeSource = tt.source
+		rec := httptest.NewRecorder()
+		handleGetLocations(rec, httptest.NewRequest(http.MethodGet, "/api/locations?maxAgeSeconds=300", nil))
+		var locations map[string]PlayerLocation
+		if err := json.NewDecoder(rec.Body).Decode(&locations); err != nil {
+			t.Fatalf("%s: decoding: %v", tt.source, err)
+		}
+		var got []string
+		for playerID := range locations {
+			got = append(got, playerID)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: fresh players %v, want %v", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestGzipMiddlewareCompressesLargeJSON(t *testing.T) {
+	payload := make(map[string]PlayerLocation)
+	for i := 0; i < 100; i++ {
+		payload[fmt.Sprintf("player-%d", i)] = PlayerLocation{Lat: 51.03, Lng: 3.97, Status: "OK"}
+	}
+	want, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(want)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/locations", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("response isn't gzip: %v", err)
+	}
+	got, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("decompressing: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("decompressed body doesn't match the original JSON")
+	}
+}
+
+func TestGzipMiddlewareDetectsContentType(t *testing.T) {
+	page := "<!DOCTYPE html><html><body>" + strings.Repeat("<p>droppydrop</p>", 200) + "</body></html>"
+	handler := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, page)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/gamelead", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+		t.Errorf("Content-Type = %q, want text/html", got)
+	}
+}
+
+func TestGzipMiddlewareSkipsSmallAndEncodedResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"small", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, `{"status":"ok"}`)
+		}},
+		{"already encoded", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "br")
+			w.Write(bytes.Repeat([]byte("x"), 2*gzipMinSize))
+		}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/test", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		gzipMiddleware(tt.handler).ServeHTTP(rec, req)
+		if rec.Header().Get("Content-Encoding") == "gzip" {
+			t.Errorf("%s: response was gzipped", tt.name)
+		}
+	}
+}
+
+func gzipBody(t *testing.T, body string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := io.WriteString(gz, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestGunzipMiddlewareInflatesRequestBody(t *testing.T) {
+	const want = `{"lat":51.03,"lng":3.97,"status":"OK"}`
+	var got string
+	handler := gunzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if enc := r.Header.Get("Content-Encoding"); enc != "" {
+			t.Errorf("Content-Encoding = %q after inflating, want none", enc)
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading body: %v", err)
+		}
+		got = string(b)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/locations/x", gzipBody(t, want))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	if got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+func TestGunzipMiddlewareRejectsBadEncodings(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     string
+		want     int
+	}{
+		{"malformed gzip", "gzip", `{"status":"OK"}`, http.StatusBadRequest},
+		{"unsupported encoding", "br", `{"status":"OK"}`, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		handler := gunzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("%s: handler reached", tt.name)
+		}))
+		req := httptest.NewRequest(http.MethodPost, "/api/locations/x", strings.NewReader(tt.body))
+		req.Header.Set("Content-Encoding", tt.encoding)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestJSONContentTypeMiddleware(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"JSON", http.MethodPost, "/api/dm/x", "application/json", `{"message":"hi"}`, http.StatusOK},
+		{"JSON with charset", http.MethodPut, "/api/chat/x/cursor", "application/json; charset=utf-8", `{}`, http.StatusOK},
+		{"form", http.MethodPost, "/api/dm/x", "application/x-www-form-urlencoded", "message=hi", http.StatusUnsupportedMediaType},
+		{"text", http.MethodPut, "/api/chat/x/cursor", "text/plain", `{}`, http.StatusUnsupportedMediaType},
+		{"missing", http.MethodPost, "/api/dm/x", "", `{"message":"hi"}`, http.StatusUnsupportedMediaType},
+		{"no body", http.MethodPost, "/api/panic/x", "", "", http.StatusOK},
+		{"GET", http.MethodGet, "/api/locations", "text/plain", "ignored", http.StatusOK},
+		{"outside the API", http.MethodPost, "/login", "application/x-www-form-urlencoded", "user=ann", http.StatusOK},
+	}
+	for _, tt := range tests {
+		handler := jsonContentTypeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	requireJSONContentType = false
+	defer func() { requireJSONContentType = true }()
+	handler := jsonContentTypeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/dm/x", strings.NewReader("message=hi")))
+	if rec.Code != http.StatusOK {
+		t.Errorf("with enforcement off: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestGzipLocationUpdate(t *testing.T) {
+	requireEmulator(t, "PlayerLocation")
+	ctx := context.Background()
+
+	body := gzipBody(t, `{"lat":51.03,"lng":3.97,"status":"OK","clientTimestamp":"`+time.Now().Format(time.RFC3339)+`"}`)
+	req := httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID("zipped"), body)
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	gunzipMiddleware(http.HandlerFunc(handleUpdateLocation)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+
+	var loc PlayerLocation
+	if err := dsClient.Get(ctx, gameNameKey(ctx, "PlayerLocation", "zipped", nil), &loc); err != nil {
+		t.Fatalf("location wasn't stored: %v", err)
+	}
+	if loc.Lat != 51.03 || loc.Lng != 3.97 {
+		t.Errorf("stored location = %v,%v, want 51.03,3.97", loc.Lat, loc.Lng)
+	}
+}
+
+func TestGzipMiddlewareFlushStartsCompression(t *testing.T) {
+	handler := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "data: hello\n\n")
+		w.(http.Flusher).Flush()
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/stream", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if !rec.Flushed {
+		t.Error("underlying writer was not flushed")
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("flushed response isn't gzip: %v", err)
+	}
+	if got, _ := io.ReadAll(gz); string(got) != "data: hello\n\n" {
+		t.Errorf("body = %q", got)
+	}
+}
+
+type messagesPage struct {
+	Messages   []PlayerMessage `json:"messages"`
+	NextCursor string          `json:"nextCursor"`
+}
+
+func getMessagesPage(t *testing.T, url string) messagesPage {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleMessages(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d, body %q", url, rec.Code, rec.Body.String())
+	}
+	var page messagesPage
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatalf("decoding page: %v", err)
+	}
+	return page
+}
+
+func TestMessagesPagination(t *testing.T) {
+	requireEmulator(t, "PlayerMessage")
+	start := time.Now().Add(-time.Hour)
+	const total = 23
+	for i := 0; i < total; i++ {
+		putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{
+			PlayerID:  "alice",
+			Content:   fmt.Sprintf("message %d", i),
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+		})
+	}
+
+	var all []PlayerMessage
+	url := "/api/messages?limit=10"
+	for pages := 0; ; pages++ {
+		if pages > total {
+			t.Fatal("pagination didn't terminate")
+		}
+		page := getMessagesPage(t, url)
+		all = append(all, page.Messages...)
+		if page.NextCursor == "" {
+			break
+		}
+		url = "/api/messages?limit=10&cursor=" + page.NextCursor
+	}
+
+	if len(all) != total {
+		t.Fatalf("paged through %d messages, want %d", len(all), total)
+	}
+	for i, msg := range all {
+		if msg.ID == 0 {
+			t.Errorf("message %d has no ID", i)
+		}
+		if i > 0 && msg.Timestamp.After(all[i-1].Timestamp) {
+			t.Errorf("message %d is out of -Timestamp order", i)
+		}
+	}
+}
+
+func TestMessagesPaginationRejectsBadParams(t *testing.T) {
+	for _, url := range []string{"/api/messages?limit=0", "/api/messages?limit=abc", "/api/messages?cursor=!!!"} {
+		rec := httptest.NewRecorder()
+		handleMessages(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d, want %d", url, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestMessagesFilters(t *testing.T) {
+	requireEmulator(t, "PlayerMessage")
+	now := time.Now()
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "alice", Content: "read", Timestamp: now, IsRead: true})
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "alice", Content: "unread", Timestamp: now})
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "bob", Content: "unread", Timestamp: now})
+
+	alice := obfuscatePlayerID("alice")
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{"/api/messages", 3},
+		{"/api/messages?playerID=" + alice, 2},
+		{"/api/messages?unread=true", 2},
+		{"/api/messages?playerID=" + alice + "&unread=true", 1},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleMessages(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+		var messages []PlayerMessage
+		if err := json.NewDecoder(rec.Body).Decode(&messages); err != nil {
+			t.Fatalf("GET %s: decoding: %v", tt.url, err)
+		}
+		if len(messages) != tt.want {
+			t.Errorf("GET %s returned %d messages, want %d", tt.url, len(messages), tt.want)
+		}
+	}
+}
+
+func TestMessagesRejectsInvalidPlayerID(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleMessages(rec, httptest.NewRequest(http.MethodGet, "/api/messages?playerID=!!!", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMessageStatus(t *testing.T) {
+	requireEmulator(t, "PlayerMessage")
+	now := time.Now()
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "alice", Content: "oldest", Timestamp: now.Add(-2 * time.Minute), IsRead: true})
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "alice", Content: "newest", Timestamp: now})
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "alice", Content: "middle", Timestamp: now.Add(-time.Minute)})
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "bob", Content: "bob's", Timestamp: now.Add(time.Minute)})
+
+	status := func(url string) []PlayerMessage {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handlePlayerMessages(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d: %s", url, rec.Code, rec.Body.String())
+		}
+		var messages []PlayerMessage
+		if err := json.NewDecoder(rec.Body).Decode(&messages); err != nil {
+			t.Fatalf("GET %s: decoding: %v", url, err)
+		}
+		return messages
+	}
+
+	url := "/api/messages/" + obfuscatePlayerID("alice") + "/status"
+	var got []string
+	for _, msg := range status(url) {
+		if msg.PlayerID != "alice" {
+			t.Errorf("got a message of %s", msg.PlayerID)
+		}
+		if msg.ID == 0 {
+			t.Errorf("message %q has no ID", msg.Content)
+		}
+		got = append(got, msg.Content)
+	}
+	if want := []string{"newest", "middle", "oldest"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if messages := status(url + "?limit=1"); len(messages) != 1 || messages[0].Content != "newest" || messages[0].IsRead {
+		t.Errorf("limit=1 returned %+v, want only the unread newest message", messages)
+	}
+	if messages := status("/api/messages/" + obfuscatePlayerID("carol") + "/status"); len(messages) != 0 {
+		t.Errorf("player without messages got %d", len(messages))
+	}
+}
+
+func TestMessageStatusRejectsBadRequests(t *testing.T) {
+	url := "/api/messages/" + obfuscatePlayerID("alice") + "/status"
+	tests := []struct {
+		method, url string
+		want        int
+	}{
+		{http.MethodGet, url + "?limit=0", http.StatusBadRequest},
+		{http.MethodGet, url + "?limit=abc", http.StatusBadRequest},
+		{http.MethodGet, fmt.Sprintf("%s?limit=%d", url, maxMessageStatusLimit+1), http.StatusBadRequest},
+		{http.MethodGet, "/api/messages/!!!/status", http.StatusBadRequest},
+		{http.MethodPost, url, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handlePlayerMessages(rec, httptest.NewRequest(tt.method, tt.url, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.url, rec.Code, tt.want)
+		}
+	}
+}
+
+func postPlayerMessage(t *testing.T, playerID, idempotencyKey string) (int, int64) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/messages/"+obfuscatePlayerID(playerID), strings.NewReader(`{"message":"hello"}`))
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	rec := httptest.NewRecorder()
+	handlePlayerMessages(rec, req)
+	var body struct {
+		ID int64 `json:"id"`
+	}
+	json.NewDecoder(rec.Body).Decode(&body)
+	return rec.Code, body.ID
+}
+
+func TestPlayerMessageIdempotencyKey(t *testing.T) {
+	requireEmulator(t, "PlayerMessage", "IdempotencyRecord")
+
+	code, firstID := postPlayerMessage(t, "p1", "retry-1")
+	if code != http.StatusCreated {
+		t.Fatalf("first post: got %d, want %d", code, http.StatusCreated)
+	}
+	code, secondID := postPlayerMessage(t, "p1", "retry-1")
+	if code != http.StatusOK || secondID != firstID {
+		t.Fatalf("retry: got %d id %d, want %d id %d", code, secondID, http.StatusOK, firstID)
+	}
+	if n := countEntities(t, "PlayerMessage"); n != 1 {
+		t.Fatalf("got %d messages after retry, want 1", n)
+	}
+
+	// The same key from another player is a different message.
+	if code, _ := postPlayerMessage(t, "p2", "retry-1"); code != http.StatusCreated {
+		t.Fatalf("other player: got %d, want %d", code, http.StatusCreated)
+	}
+	if n := countEntities(t, "PlayerMessage"); n != 2 {
+		t.Fatalf("got %d messages, want 2", n)
+	}
+}
+
+// withMessageRateLimit enables the message rate limit for the duration of a test.
+func withMessageRateLimit(t *testing.T, limit int, window time.Duration) {
+	t.Helper()
+	maxMessagesPerWindow, messageRateWindow = limit, window
+	messageRates.def.sent = nil
+	t.Cleanup(func() {
+		maxMessagesPerWindow, messageRateWindow = 0, defaultMessageRateWindowSeconds*time.Second
+		messageRates.def.sent = nil
+	})
+}
+
+func TestRateWindows(t *testing.T) {
+	var rw rateWindows
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if wait := rw.take("alice", now.Add(time.Duration(i)*time.Second), 3, 10*time.Second); wait != 0 {
+			t.Fatalf("message %d: wait %v, want none", i+1, wait)
+		}
+	}
+	if wait := rw.take("alice", now.Add(4*time.Second), 3, 10*time.Second); wait != 6*time.Second {
+		t.Errorf("over the limit: wait %v, want 6s", wait)
+	}
+	if wait := rw.take("bob", now.Add(4*time.Second), 3, 10*time.Second); wait != 0 {
+		t.Errorf("another player: wait %v, want none", wait)
+	}
+	// The first message left the window, the throttled one was never counted.
+	if wait := rw.take("alice", now.Add(10*time.Second), 3, 10*time.Second); wait != 0 {
+		t.Errorf("after the first left the window: wait %v, want none", wait)
+	}
+	if wait := rw.take("alice", now.Add(10*time.Second), 3, 10*time.Second); wait != time.Second {
+		t.Errorf("full again: wait %v, want 1s", wait)
+	}
+	// Players without messages in the window are dropped; bob's left at 14s.
+	rw.take("carol", now.Add(15*time.Second), 3, 10*time.Second)
+	if _, ok := rw.sent["bob"]; ok {
+		t.Error("bob's old messages are still remembered")
+	}
+}
+
+func TestPlayerMessageRateLimit(t *testing.T) {
+	withMessageRateLimit(t, 5, 10*time.Second)
+	// Five messages moments ago, without needing the datastore to send them.
+	for i := 0; i < 5; i++ {
+		messageRates.def.take("p1", time.Now().Add(-2*time.Second), 5, 10*time.Second)
+	}
+	rec := httptest.NewRecorder()
+	handlePlayerMessages(rec, httptest.NewRequest(http.MethodPost, "/api/messages/"+obfuscatePlayerID("p1"), strings.NewReader(`{"message":"hello"}`)))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "8" {
+		t.Errorf("Retry-After: got %q, want 8", got)
+	}
+
+	requireEmulator(t, "PlayerMessage")
+	messageRates.def.sent = nil
+	for i := 0; i < 5; i++ {
+		if code, _ := postPlayerMessage(t, "p2", ""); code != http.StatusCreated {
+			t.Fatalf("message %d: got %d, want %d", i+1, code, http.StatusCreated)
+		}
+	}
+	if code, _ := postPlayerMessage(t, "p2", ""); code != http.StatusTooManyRequests {
+		t.Errorf("sixth message: got %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code, _ := postPlayerMessage(t, "p3", ""); code != http.StatusCreated {
+		t.Errorf("another player: got %d, want %d", code, http.StatusCreated)
+	}
+	if n := countEntities(t, "PlayerMessage"); n != 6 {
+		t.Errorf("got %d messages, want 6", n)
+	}
+}
+
+func TestCleanupIdempotencyRecords(t *testing.T) {
+	requireEmulator(t, "IdempotencyRecord")
+
+	putEntity(t, datastore.NameKey("IdempotencyRecord", "p1:old", nil), &IdempotencyRecord{PlayerID: "p1", MessageID: 1, Timestamp: time.Now().Add(-2 * idempotencyTTL)})
+	putEntity(t, datastore.NameKey("IdempotencyRecord", "p1:new", nil), &IdempotencyRecord{PlayerID: "p1", MessageID: 2, Timestamp: time.Now()})
+
+	deleted, err := cleanupIdempotencyRecords(context.Background())
+	if err != nil {
+		t.Fatalf("cleanupIdempotencyRecords: %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("deleted %d records, want 1", deleted)
+	}
+	if n := countEntities(t, "IdempotencyRecord"); n != 1 {
+		t.Errorf("got %d records left, want 1", n)
+	}
+}
+
+func TestChatWebSocketRejectsMissingPlayerID(t *testing.T) {
+	for _, path := range []string{"/api/chat/ws/", "/api/chat/ws/!!!"} {
+		rec := httptest.NewRecorder()
+		handleChatWebSocket(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: got %d, want %d", path, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// receiveChat waits briefly for a message on ch, reporting whether one arrived.
+func receiveChat(ch chan ChatMessage) (ChatMessage, bool) {
+	select {
+	case msg := <-ch:
+		return msg, true
+	case <-time.After(100 * time.Millisecond):
+		return ChatMessage{}, false
+	}
+}
+
+func TestChatHubFansOutPerConversation(t *testing.T) {
+	hub := &chatHub{subscribers: make(map[string]map[chan ChatMessage]bool)}
+	a1 := hub.subscribe("alice")
+	a2 := hub.subscribe("alice")
+	b := hub.subscribe("bob")
+	defer hub.unsubscribe("alice", a1)
+	defer hub.unsubscribe("alice", a2)
+	defer hub.unsubscribe("bob", b)
+
+	hub.broadcast("alice", ChatMessage{From: "player", Content: "hi"})
+	for i, ch := range []chan ChatMessage{a1, a2} {
+		if msg, ok := receiveChat(ch); !ok || msg.Content != "hi" {
+			t.Errorf("alice subscriber %d: got %+v, %v", i, msg, ok)
+		}
+	}
+	if msg, ok := receiveChat(b); ok {
+		t.Errorf("bob received alice's message: %+v", msg)
+	}
+}
+
+func TestChatHubUnsubscribeClosesChannel(t *testing.T) {
+	hub := &chatHub{subscribers: make(map[string]map[chan ChatMessage]bool)}
+	ch := hub.subscribe("alice")
+	hub.unsubscribe("alice", ch)
+	if _, open := <-ch; open {
+		t.Error("channel still open after unsubscribe")
+	}
+	if len(hub.subscribers) != 0 {
+		t.Errorf("subscribers not cleaned up: %v", hub.subscribers)
+	}
+	// Unsubscribing twice must not panic on a closed channel.
+	hub.unsubscribe("alice", ch)
+	hub.broadcast("alice", ChatMessage{Content: "nobody listening"})
+}
+
+func TestChatTypingEventReachesPeerWithoutPersisting(t *testing.T) {
+	requireEmulator(t, "PlayerMessage", "DirectMessage")
+
+	srv := httptest.NewServer(http.HandlerFunc(handleChatWebSocket))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/chat/ws/" + obfuscatePlayerID("p1")
+
+	sender, err := websocket.Dial(url, "", srv.URL)
+	if err != nil {
+		t.Fatalf("dialing sender: %v", err)
+	}
+	defer sender.Close()
+	peer, err := websocket.Dial(url, "", srv.URL)
+	if err != nil {
+		t.Fatalf("dialing peer: %v", err)
+	}
+	defer peer.Close()
+	// Both connections must be subscribed before the event is sent.
+	time.Sleep(100 * time.Millisecond)
+
+	if err := websocket.JSON.Send(sender, map[string]string{"type": chatEventTyping}); err != nil {
+		t.Fatalf("sending typing event: %v", err)
+	}
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var got ChatMessage
+	if err := websocket.JSON.Receive(peer, &got); err != nil {
+		t.Fatalf("peer did not receive typing event: %v", err)
+	}
+	if got.Type != chatEventTyping || got.From != "player" {
+		t.Errorf("got %+v, want a typing event from the player", got)
+	}
+
+	if n := countEntities(t, "PlayerMessage") + countEntities(t, "DirectMessage"); n != 0 {
+		t.Errorf("typing event stored %d messages, want 0", n)
+	}
+}
+
+// withLeadSessionKey sets a session signing key for the duration of a test.
+func withLeadSessionKey(t *testing.T) {
+	t.Helper()
+	old := leadSessionKey
+	leadSessionKey = []byte("test-session-key")
+	t.Cleanup(func() { leadSessionKey = old })
+}
+
+func TestLeadSessionRoundTrip(t *testing.T) {
+	withLeadSessionKey(t)
+
+	token := signLeadSession("ann|lead", "", time.Now().Add(time.Hour))
+	if got, err := verifyLeadSession(token, ""); err != nil || got != "ann|lead" {
+		t.Fatalf("verifyLeadSession: got %q, %v", got, err)
+	}
+
+	if _, err := verifyLeadSession(signLeadSession("ann", "", time.Now().Add(-time.Minute)), ""); err == nil {
+		t.Error("expired session verified")
+	}
+
+	leadSessionKey = []byte("another-key")
+	if _, err := verifyLeadSession(token, ""); err == nil {
+		t.Error("session signed with a different key verified")
+	}
+
+	leadSessionKey = nil
+	if _, err := verifyLeadSession(signLeadSession("ann", "", time.Now().Add(time.Hour)), ""); err == nil {
+		t.Error("session verified without a configured key")
+	}
+}
+
+func TestLeadSessionIsBoundToItsGame(t *testing.T) {
+	withLeadSessionKey(t)
+
+	token := signLeadSession("ann", "spring", time.Now().Add(time.Hour))
+	if got, err := verifyLeadSession(token, "spring"); err != nil || got != "ann" {
+		t.Fatalf("own game: got %q, %v", got, err)
+	}
+	for _, namespace := range []string{"", "autumn"} {
+		if _, err := verifyLeadSession(token, namespace); err == nil {
+			t.Errorf("session for spring verified in game %q", namespace)
+		}
+	}
+}
+
+func TestRequireLead(t *testing.T) {
+	withLeadSessionKey(t)
+	handler := requireLead(handleLeadMe)
+
+	tests := []struct {
+		name     string
+		cookie   string
+		wantCode int
+	}{
+		{"no cookie", "", http.StatusUnauthorized},
+		{"garbage", "not-a-session", http.StatusUnauthorized},
+		{"expired", signLeadSession("ann", "", time.Now().Add(-time.Minute)), http.StatusUnauthorized},
+		{"valid", signLeadSession("ann", "", time.Now().Add(time.Hour)), http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/leads/me", nil)
+		if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: leadSessionCookie, Value: tt.cookie})
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: got %d, want %d", tt.name, rec.Code, tt.wantCode)
+			continue
+		}
+		if tt.wantCode == http.StatusOK && !strings.Contains(rec.Body.String(), `"ann"`) {
+			t.Errorf("%s: body %q does not name the lead", tt.name, rec.Body.String())
+		}
+	}
+}
+
+func TestLeadEndpointsWithoutSessionKey(t *testing.T) {
+	old := leadSessionKey
+	leadSessionKey = nil
+	t.Cleanup(func() { leadSessionKey = old })
+
+	rec := httptest.NewRecorder()
+	handleLeadLogin(rec, httptest.NewRequest(http.MethodPost, "/api/leads/login", strings.NewReader(`{"username":"ann","password":"secret"}`)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("login: got %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/leads/me", nil)
+	req.AddCookie(&http.Cookie{Name: leadSessionCookie, Value: "anything"})
+	rec = httptest.NewRecorder()
+	requireLead(handleLeadMe)(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("lead endpoint: got %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	// Nobody can claim the first lead account before a key is configured.
+	if code := createLead(t, "ann", "password1", ""); code != http.StatusServiceUnavailable {
+		t.Errorf("bootstrap: got %d, want %d", code, http.StatusServiceUnavailable)
+	}
+}
+
+func createLead(t *testing.T, username, password, session string) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/leads", strings.NewReader(fmt.Sprintf(`{"username":%q,"password":%q}`, username, password)))
+	if session != "" {
+		req.AddCookie(&http.Cookie{Name: leadSessionCookie, Value: session})
+	}
+	rec := httptest.NewRecorder()
+	handleCreateLead(rec, req)
+	return rec.Code
+}
+
+func TestCreateLead(t *testing.T) {
+	requireEmulator(t, "Lead")
+	withLeadSessionKey(t)
+	session := signLeadSession("ann", "", time.Now().Add(time.Hour))
+
+	if code := createLead(t, "ann", "password1", ""); code != http.StatusCreated {
+		t.Fatalf("bootstrap: got %d, want %d", code, http.StatusCreated)
+	}
+	if code := createLead(t, "bob", "password2", ""); code != http.StatusUnauthorized {
+		t.Errorf("second lead without session: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := createLead(t, "ann", "password3", session); code != http.StatusConflict {
+		t.Errorf("duplicate username: got %d, want %d", code, http.StatusConflict)
+	}
+	if code := createLead(t, "bob", "short", session); code != http.StatusBadRequest {
+		t.Errorf("short password: got %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := createLead(t, "bob", "password2", session); code != http.StatusCreated {
+		t.Errorf("second lead with session: got %d, want %d", code, http.StatusCreated)
+	}
+	if n := countEntities(t, "Lead"); n != 2 {
+		t.Errorf("got %d leads, want 2", n)
+	}
+}
+
+func TestLeadLogin(t *testing.T) {
+	requireEmulator(t, "Lead")
+	withLeadSessionKey(t)
+	if code := createLead(t, "ann", "password1", ""); code != http.StatusCreated {
+		t.Fatalf("creating lead: got %d", code)
+	}
+
+	login := func(username, password string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleLeadLogin(rec, httptest.NewRequest(http.MethodPost, "/api/leads/login", strings.NewReader(fmt.Sprintf(`{"username":%q,"password":%q}`, username, password))))
+		return rec
+	}
+
+	for _, c := range [][2]string{{"ann", "wrong-password"}, {"nobody", "password1"}} {
+		rec := login(c[0], c[1])
+		if rec.Code != http.StatusUnauthorized || len(rec.Result().Cookies()) != 0 {
+			t.Errorf("login %s/%s: got %d with %d cookies, want 401 and none", c[0], c[1], rec.Code, len(rec.Result().Cookies()))
+		}
+	}
+
+	rec := login("ann", "password1")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: got %d, want %d", rec.Code, http.StatusOK)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != leadSessionCookie {
+		t.Fatalf("login cookies: %v", cookies)
+	}
+
+	// The issued cookie opens protected endpoints.
+	req := httptest.NewRequest(http.MethodGet, "/api/leads/me", nil)
+	req.AddCookie(cookies[0])
+	me := httptest.NewRecorder()
+	requireLead(handleLeadMe)(me, req)
+	if me.Code != http.StatusOK || !strings.Contains(me.Body.String(), `"ann"`) {
+		t.Errorf("me: got %d %q", me.Code, me.Body.String())
+	}
+}
+
+func TestDirectMessageAttribution(t *testing.T) {
+	requireEmulator(t, "PlayerMessage", "DirectMessage")
+	withLeadSessionKey(t)
+
+	// An old DM from before leads had accounts, and a new one sent through the API.
+	putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "p1", Content: "old", Timestamp: time.Now().Add(-time.Minute)})
+	req := httptest.NewRequest(http.MethodPost, "/api/dm/"+obfuscatePlayerID("p1"), strings.NewReader(`{"message":"new"}`))
+	req.AddCookie(&http.Cookie{Name: leadSessionCookie, Value: signLeadSession("ann", "", time.Now().Add(time.Hour))})
+	rec := httptest.NewRecorder()
+	requireLead(handleSendDirectMessage)(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("sending DM: got %d, want %d", rec.Code, http.StatusCreated)
+	}
+
+	history, _, err := loadChatHistory(context.Background(), "p1", time.Time{}, 0)
+	if err != nil {
+		t.Fatalf("loadChatHistory: %v", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("got %d messages, want 2", len(history))
+	}
+	if history[0].Sender != "lead" || history[1].Sender != "ann" {
+		t.Errorf("senders: got %q and %q, want \"lead\" and \"ann\"", history[0].Sender, history[1].Sender)
+	}
+}
+
+func TestChatHistoryRejectsBadParams(t *testing.T) {
+	base := "/api/chat/" + obfuscatePlayerID("p1")
+	for _, query := range []string{"?since=yesterday", "?since=2024-01-01", "?limit=0", "?limit=-1", "?limit=x", "?limit=1001"} {
+		rec := httptest.NewRecorder()
+		handleChatHistory(rec, httptest.NewRequest(http.MethodGet, base+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func chatHistory(t *testing.T, url string) []ChatMessage {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleChatHistory(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: got %d: %s", url, rec.Code, rec.Body.String())
+	}
+	var messages []ChatMessage
+	if err := json.NewDecoder(rec.Body).Decode(&messages); err != nil {
+		t.Fatalf("decoding %s: %v", url, err)
+	}
+	return messages
+}
+
+func TestChatHistorySinceAndLimit(t *testing.T) {
+	requireEmulator(t, "PlayerMessage", "DirectMessage")
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p1", Content: "one", Timestamp: base})
+	putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "p1", Content: "two", Timestamp: base.Add(time.Minute)})
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p1", Content: "three", Timestamp: base.Add(2 * time.Minute)})
+	putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "p1", Content: "four", Timestamp: base.Add(3 * time.Minute)})
+	putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "p2", Content: "other", Timestamp: base.Add(3 * time.Minute)})
+
+	contents := func(messages []ChatMessage) string {
+		var parts []string
+		for _, msg := range messages {
+			parts = append(parts, msg.Content)
+		}
+		return strings.Join(parts, ",")
+	}
+	url := "/api/chat/" + obfuscatePlayerID("p1")
+	for query, want := range map[string]string{
+		"": "one,two,three,four",
+		// A message sent exactly at since was already seen.
+		"?since=" + base.Add(time.Minute).Format(time.RFC3339):             "three,four",
+		"?since=" + base.Add(time.Minute-time.Second).Format(time.RFC3339): "two,three,four",
+		"?since=" + base.Add(3*time.Minute).Format(time.RFC3339):           "",
+		"?limit=3":  "two,three,four",
+		"?limit=1":  "four",
+		"?limit=10": "one,two,three,four",
+		"?limit=2&since=" + base.Add(-time.Second).Format(time.RFC3339):              "three,four",
+		"?limit=2&since=" + base.Add(2*time.Minute-time.Second).Format(time.RFC3339): "three,four",
+	} {
+		if got := contents(chatHistory(t, url+query)); got != want {
+			t.Errorf("%q: got %q, want %q", query, got, want)
+		}
+	}
+}
+
+// withMaxChatHistory lowers the chat history cap for the duration of a test.
+func withMaxChatHistory(t *testing.T, n int) {
+	t.Helper()
+	maxChatHistory = n
+	t.Cleanup(func() { maxChatHistory = defaultMaxChatHistory })
+}
+
+func TestTruncateChat(t *testing.T) {
+	withMaxChatHistory(t, 2)
+	messages := []ChatMessage{{Content: "one"}, {Content: "two"}}
+	if got, truncated := truncateChat(messages); truncated || len(got) != 2 {
+		t.Errorf("at the cap: got %+v, truncated %v", got, truncated)
+	}
+	messages = append(messages, ChatMessage{Content: "three"})
+	if got, truncated := truncateChat(messages); !truncated || len(got) != 2 || got[0].Content != "two" || got[1].Content != "three" {
+		t.Errorf("over the cap: got %+v, truncated %v, want the newest two", got, truncated)
+	}
+}
+
+func TestChatHistoryTruncatedToNewest(t *testing.T) {
+	requireEmulator(t, "PlayerMessage", "DirectMessage", "ReadCursor")
+	withMaxChatHistory(t, 3)
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < 5; i++ {
+		content := fmt.Sprintf("m%d", i)
+		at := base.Add(time.Duration(i) * time.Minute)
+		if i%2 == 0 {
+			putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p1", Content: content, Timestamp: at})
+		} else {
+			putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "p1", Content: content, Timestamp: at})
+		}
+	}
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p2", Content: "short", Timestamp: base})
+
+	contents := func(messages []ChatMessage) string {
+		var parts []string
+		for _, msg := range messages {
+			parts = append(parts, msg.Content)
+		}
+		return strings.Join(parts, ",")
+	}
+	url := "/api/chat/" + obfuscatePlayerID("p1")
+	rec := httptest.NewRecorder()
+	handleChatHistory(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	var messages []ChatMessage
+	if err := json.NewDecoder(rec.Body).Decode(&messages); err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	if got := contents(messages); got != "m2,m3,m4" {
+		t.Errorf("got %q, want the newest three", got)
+	}
+	if rec.Header().Get(chatTruncatedHeader) != "true" {
+		t.Errorf("%s header not set on a truncated history", chatTruncatedHeader)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, url+"?withCursor=true", nil)
+	req.AddCookie(&http.Cookie{Name: leadSessionCookie, Value: signLeadSession("ann", "", time.Now().Add(time.Hour))})
+	rec = httptest.NewRecorder()
+	handleChatHistory(rec, req)
+	var history ChatHistory
+	if err := json.NewDecoder(rec.Body).Decode(&history); err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	if !history.Truncated || contents(history.Messages) != "m2,m3,m4" {
+		t.Errorf("got %+v, want the newest three marked truncated", history)
+	}
+
+	// An explicit limit is what the client asked for, so it isn't flagged.
+	rec = httptest.NewRecorder()
+	handleChatHistory(rec, httptest.NewRequest(http.MethodGet, url+"?limit=2", nil))
+	if rec.Header().Get(chatTruncatedHeader) != "" {
+		t.Errorf("%s header set for ?limit=", chatTruncatedHeader)
+	}
+	rec = httptest.NewRecorder()
+	handleChatHistory(rec, httptest.NewRequest(http.MethodGet, url+"?limit=4", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("limit above the cap: got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	rec = chatBatch(fmt.Sprintf(`{"obfuscatedIDs":[%q,%q]}`, obfuscatePlayerID("p1"), obfuscatePlayerID("p2")))
+	var histories map[string][]ChatMessage
+	if err := json.NewDecoder(rec.Body).Decode(&histories); err != nil {
+		t.Fatalf("decoding batch: %v", err)
+	}
+	if got := contents(histories["p1"]); got != "m2,m3,m4" {
+		t.Errorf("batch p1: got %q, want the newest three", got)
+	}
+	if got := contents(histories["p2"]); got != "short" {
+		t.Errorf("batch p2: got %q", got)
+	}
+	if rec.Header().Get(chatTruncatedHeader) != "true" {
+		t.Errorf("%s header not set on a truncated batch", chatTruncatedHeader)
+	}
+}
+
+func chatBatch(body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handleChatBatch(rec, httptest.NewRequest(http.MethodPost, "/api/chat/batch", strings.NewReader(body)))
+	return rec
+}
+
+func TestChatBatch(t *testing.T) {
+	requireEmulator(t, "PlayerMessage", "DirectMessage", "Player")
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	putEntity(t, datastore.NameKey("Player", "p2", nil), &Player{DisplayName: "Agent Blue"})
+	putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "p1", Content: "two", Timestamp: base.Add(time.Minute)})
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p1", Content: "one", Timestamp: base})
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p1", Content: "three", Timestamp: base.Add(2 * time.Minute)})
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p2", Content: "hi", Timestamp: base})
+	putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "p2", SenderID: "ann", Content: "hello", Timestamp: base.Add(time.Minute)})
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p4", Content: "not asked for", Timestamp: base})
+
+	body := fmt.Sprintf(`{"obfuscatedIDs":[%q,%q,%q,%q]}`, obfuscatePlayerID("p1"), obfuscatePlayerID("p2"), obfuscatePlayerID("p3"), obfuscatePlayerID("p1"))
+	rec := chatBatch(body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var histories map[string][]ChatMessage
+	if err := json.NewDecoder(rec.Body).Decode(&histories); err != nil {
+		t.Fatalf("decoding histories: %v", err)
+	}
+
+	contents := func(messages []ChatMessage) string {
+		var parts []string
+		for _, msg := range messages {
+			parts = append(parts, msg.From+":"+msg.Content)
+		}
+		return strings.Join(parts, ",")
+	}
+	want := map[string]string{
+		"p1": "player:one,lead:two,player:three",
+		"p2": "player:hi,lead:hello",
+		"p3": "",
+	}
+	if len(histories) != len(want) {
+		t.Errorf("got histories for %d players, want %d: %v", len(histories), len(want), histories)
+	}
+	for playerID, wantContents := range want {
+		messages, ok := histories[playerID]
+		if !ok {
+			t.Errorf("%s: missing from response", playerID)
+			continue
+		}
+		if got := contents(messages); got != wantContents {
+			t.Errorf("%s: got %q, want %q", playerID, got, wantContents)
+		}
+	}
+
+	// Player messages are shown by display name, like in a single history.
+	if got := histories["p2"][0].DisplayName; got != "Agent Blue" {
+		t.Errorf("p2's message shown as %q, want their display name", got)
+	}
+	if got := histories["p1"][0].DisplayName; got != "p1" {
+		t.Errorf("p1's message shown as %q, want their ID", got)
+	}
+
+	// Long conversations are cut to the most recent messages.
+	old := maxChatHistory
+	t.Cleanup(func() { maxChatHistory = old })
+	maxChatHistory = 2
+	rec = chatBatch(fmt.Sprintf(`{"obfuscatedIDs":[%q]}`, obfuscatePlayerID("p1")))
+	histories = nil
+	if err := json.NewDecoder(rec.Body).Decode(&histories); err != nil {
+		t.Fatalf("decoding truncated histories: %v", err)
+	}
+	if got := contents(histories["p1"]); got != "lead:two,player:three" || rec.Header().Get(chatTruncatedHeader) != "true" {
+		t.Errorf("capped at 2: got %q, truncated header %q", got, rec.Header().Get(chatTruncatedHeader))
+	}
+
+	// A busy player filling the batch query doesn't crowd out the others.
+	for i := 0; i < 2*(maxChatHistory+1); i++ {
+		putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p1", Content: "busy", Timestamp: base.Add(time.Duration(10+i) * time.Minute)})
+	}
+	rec = chatBatch(fmt.Sprintf(`{"obfuscatedIDs":[%q,%q]}`, obfuscatePlayerID("p1"), obfuscatePlayerID("p2")))
+	histories = nil
+	if err := json.NewDecoder(rec.Body).Decode(&histories); err != nil {
+		t.Fatalf("decoding crowded histories: %v", err)
+	}
+	if got := contents(histories["p2"]); got != "player:hi,lead:hello" {
+		t.Errorf("p2 next to a busy player: got %q, want %q", got, "player:hi,lead:hello")
+	}
+	if got := contents(histories["p1"]); got != "player:busy,player:busy" {
+		t.Errorf("busy player: got %q, want their two latest messages", got)
+	}
+}
+
+func TestChatBatchRejectsBadRequests(t *testing.T) {
+	tooMany := make([]string, maxChatBatchPlayers+1)
+	for i := range tooMany {
+		tooMany[i] = obfuscatePlayerID(fmt.Sprintf("p%d", i))
+	}
+	tooManyBody, _ := json.Marshal(map[string][]string{"obfuscatedIDs": tooMany})
+
+	for name, body := range map[string]string{
+		"no IDs":       `{"obfuscatedIDs":[]}`,
+		"missing":      `{}`,
+		"invalid ID":   `{"obfuscatedIDs":["not-an-id"]}`,
+		"unknown key":  `{"playerIDs":["alice"]}`,
+		"too many IDs": string(tooManyBody),
+	} {
+		if rec := chatBatch(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", name, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func chatCursorRequest(method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.AddCookie(&http.Cookie{Name: leadSessionCookie, Value: signLeadSession("ann", "", time.Now().Add(time.Hour))})
+	rec := httptest.NewRecorder()
+	handleChatHistory(rec, req)
+	return rec
+}
+
+func TestFirstUnread(t *testing.T) {
+	base := time.Now().Truncate(time.Second)
+	messages := []ChatMessage{
+		{ID: 1, From: "player", Timestamp: base},
+		{ID: 2, From: "lead", Sender: "ann", Timestamp: base.Add(time.Minute)},
+		{ID: 3, From: "lead", Sender: "bob", Timestamp: base.Add(2 * time.Minute)},
+		{ID: 4, From: "player", Timestamp: base.Add(3 * time.Minute)},
+	}
+	tests := []struct {
+		readUpTo time.Time
+		leadID   string
+		want     int64
+	}{
+		{time.Time{}, "ann", 1},
+		{base, "ann", 3},
+		{base, "bob", 2},
+		{base.Add(2 * time.Minute), "ann", 4},
+		{base.Add(3 * time.Minute), "ann", 0},
+	}
+	for _, tt := range tests {
+		if got := firstUnread(messages, tt.readUpTo, tt.leadID); got != tt.want {
+			t.Errorf("read up to %v as %s: got %d, want %d", tt.readUpTo.Sub(base), tt.leadID, got, tt.want)
+		}
+	}
+}
+
+func TestChatCursor(t *testing.T) {
+	requireEmulator(t, "PlayerMessage", "DirectMessage", "ReadCursor")
+	withLeadSessionKey(t)
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p1", Content: "one", Timestamp: base})
+	putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "p1", SenderID: "ann", Content: "two", Timestamp: base.Add(time.Minute)})
+	three := putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p1", Content: "three", Timestamp: base.Add(2 * time.Minute)})
+	url := "/api/chat/" + obfuscatePlayerID("p1")
+
+	if rec := chatCursorRequest(http.MethodGet, url+"/cursor", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("cursor before setting one: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	body := fmt.Sprintf(`{"readUpTo":%q}`, base.Add(time.Minute).Format(time.RFC3339))
+	if rec := chatCursorRequest(http.MethodPut, url+"/cursor", body); rec.Code != http.StatusOK {
+		t.Fatalf("setting cursor: got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec := chatCursorRequest(http.MethodGet, url+"/cursor", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("getting cursor: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var cursor ReadCursor
+	if err := json.NewDecoder(rec.Body).Decode(&cursor); err != nil {
+		t.Fatalf("decoding cursor: %v", err)
+	}
+	if cursor.LeadID != "ann" || cursor.PlayerID != "p1" || !cursor.ReadUpTo.Equal(base.Add(time.Minute)) {
+		t.Errorf("got cursor %+v", cursor)
+	}
+
+	rec = chatCursorRequest(http.MethodGet, url+"?withCursor=true", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("getting history: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var history ChatHistory
+	if err := json.NewDecoder(rec.Body).Decode(&history); err != nil {
+		t.Fatalf("decoding history: %v", err)
+	}
+	if len(history.Messages) != 3 || history.UnreadFrom != three.ID {
+		t.Errorf("got %d messages unread from %d, want 3 unread from %d", len(history.Messages), history.UnreadFrom, three.ID)
+	}
+
+	// Another lead has a cursor of their own.
+	req := httptest.NewRequest(http.MethodGet, url+"/cursor", nil)
+	req.AddCookie(&http.Cookie{Name: leadSessionCookie, Value: signLeadSession("bob", "", time.Now().Add(time.Hour))})
+	rec = httptest.NewRecorder()
+	handleChatHistory(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("other lead's cursor: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestChatCursorBadRequests(t *testing.T) {
+	withLeadSessionKey(t)
+	url := "/api/chat/" + obfuscatePlayerID("p1")
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	for name, tt := range map[string]struct {
+		method, path, body string
+		want               int
+	}{
+		"missing readUpTo": {http.MethodPut, url + "/cursor", `{}`, http.StatusBadRequest},
+		"future readUpTo":  {http.MethodPut, url + "/cursor", fmt.Sprintf(`{"readUpTo":%q}`, future), http.StatusBadRequest},
+		"bad readUpTo":     {http.MethodPut, url + "/cursor", `{"readUpTo":"yesterday"}`, http.StatusBadRequest},
+		"invalid player":   {http.MethodGet, "/api/chat/not-an-id/cursor", "", http.StatusBadRequest},
+		"wrong method":     {http.MethodDelete, url + "/cursor", "", http.StatusMethodNotAllowed},
+	} {
+		if rec := chatCursorRequest(tt.method, tt.path, tt.body); rec.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", name, rec.Code, tt.want)
+		}
+	}
+
+	// Both the cursor and the unread marker need a lead session.
+	for _, path := range []string{url + "/cursor", url + "?withCursor=true"} {
+		rec := httptest.NewRecorder()
+		handleChatHistory(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s without session: got %d, want %d", path, rec.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func searchMessages(t *testing.T, url string) []ChatMessage {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleSearchMessages(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: got %d: %s", url, rec.Code, rec.Body.String())
+	}
+	var results []ChatMessage
+	if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+		t.Fatalf("decoding search results: %v", err)
+	}
+	return results
+}
+
+func TestSearchMessages(t *testing.T) {
+	requireEmulator(t, "PlayerMessage", "DirectMessage")
+	now := time.Now()
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p1", Content: "Found the BRIDGE", Timestamp: now.Add(-2 * time.Minute)})
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p2", Content: "lost", Timestamp: now.Add(-time.Minute)})
+	putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "p1", SenderID: "ann", Content: "head to the bridge", Timestamp: now})
+
+	results := searchMessages(t, "/api/messages/search?q=bridge")
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2: %+v", len(results), results)
+	}
+	// Newest first, from both kinds.
+	if results[0].From != "lead" || results[0].Sender != "ann" || results[1].From != "player" {
+		t.Errorf("unexpected results: %+v", results)
+	}
+
+	if results := searchMessages(t, "/api/messages/search?q=bridge&limit=1"); len(results) != 1 || results[0].From != "lead" {
+		t.Errorf("limit=1: got %+v", results)
+	}
+	if results := searchMessages(t, "/api/messages/search?q=nothing"); len(results) != 0 {
+		t.Errorf("no matches: got %+v", results)
+	}
+}
+
+func TestSearchMessagesRejectsBadParams(t *testing.T) {
+	for _, url := range []string{"/api/messages/search", "/api/messages/search?q=%20", "/api/messages/search?q=a&limit=0", "/api/messages/search?q=a&limit=501"} {
+		rec := httptest.NewRecorder()
+		handleSearchMessages(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: got %d, want %d", url, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func prefsRequest(t *testing.T, method, path, body string) (int, NotificationPrefs) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleNotificationPrefs(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	var prefs NotificationPrefs
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&prefs); err != nil {
+			t.Fatalf("decoding prefs: %v", err)
+		}
+	}
+	return rec.Code, prefs
+}
+
+func TestNotificationPrefsRejectsMissingPlayerID(t *testing.T) {
+	for _, path := range []string{"/api/prefs/", "/api/prefs/!!!"} {
+		if code, _ := prefsRequest(t, http.MethodGet, path, ""); code != http.StatusBadRequest {
+			t.Errorf("GET %s: got %d, want %d", path, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestNotificationPrefs(t *testing.T) {
+	requireEmulator(t, "NotificationPrefs")
+	path := "/api/prefs/" + obfuscatePlayerID("p1")
+
+	if code, prefs := prefsRequest(t, http.MethodGet, path, ""); code != http.StatusOK || !prefs.TargetAlerts || !prefs.DMAlerts {
+		t.Fatalf("defaults: got %d %+v, want both alerts on", code, prefs)
+	}
+
+	// Only the fields present in the body change.
+	if code, prefs := prefsRequest(t, http.MethodPut, path, `{"dmAlerts":false}`); code != http.StatusOK || !prefs.TargetAlerts || prefs.DMAlerts {
+		t.Fatalf("PUT: got %d %+v", code, prefs)
+	}
+	if code, prefs := prefsRequest(t, http.MethodGet, path, ""); code != http.StatusOK || !prefs.TargetAlerts || prefs.DMAlerts {
+		t.Errorf("after PUT: got %d %+v", code, prefs)
+	}
+
+	// Other players keep the defaults.
+	if _, prefs := prefsRequest(t, http.MethodGet, "/api/prefs/"+obfuscatePlayerID("p2"), ""); !prefs.DMAlerts {
+		t.Errorf("other player: got %+v", prefs)
+	}
+}
+
+func TestTestStatusPassed(t *testing.T) {
+	for status, want := range map[string]bool{
+		"OK": true, "Success": true, "Granted": true, "ok": true, "SUCCESS": true, "granted": true,
+		"Denied": false, "FAILED": false, "Failed": false, "Pending": false, "": false,
+	} {
+		if got := testStatusPassed(status); got != want {
+			t.Errorf("testStatusPassed(%q) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestTestResultsSummary(t *testing.T) {
+	requireEmulator(t, "TestResult", "Player", "TargetLocation")
+	now := time.Now()
+	// Players who joined or got a target after the roster was loaded are expected too.
+	putEntity(t, datastore.NameKey("Player", "7: Joris", nil), &Player{Updated: now})
+	putEntity(t, datastore.NameKey("TargetLocation", "8: Kato", nil), &TargetLocation{Lat: 51, Lng: 3.7, Timestamp: now})
+	putEntity(t, datastore.NameKey("Player", "1: Ben", nil), &Player{Updated: now})
+	putEntity(t, datastore.IncompleteKey("TestResult", nil), &TestResult{PlayerName: "1: Ben", LocationStatus: "Success", NotificationStatus: "Granted", ServerStatus: "Pending", Timestamp: now})
+	putEntity(t, datastore.IncompleteKey("TestResult", nil), &TestResult{PlayerName: "6: Ilse", LocationStatus: "Denied", NotificationStatus: "Granted", ServerStatus: "OK", Timestamp: now})
+	// Statuses are accepted in any case, so they're counted in any case too.
+	putEntity(t, datastore.IncompleteKey("TestResult", nil), &TestResult{PlayerName: "2: Cleo", LocationStatus: "SUCCESS", NotificationStatus: "granted", ServerStatus: "PENDING", Timestamp: now})
+
+	rec := httptest.NewRecorder()
+	handleTestResultsSummary(rec, httptest.NewRequest(http.MethodGet, "/api/test-results/summary", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var summary struct {
+		Passed   int      `json:"passed"`
+		Failed   int      `json:"failed"`
+		Untested []string `json:"untested"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&summary); err != nil {
+		t.Fatalf("decoding summary: %v", err)
+	}
+	if summary.Passed != 2 || summary.Failed != 1 {
+		t.Errorf("got %d passed, %d failed, want 2 and 1", summary.Passed, summary.Failed)
+	}
+	for _, name := range summary.Untested {
+		if name == "1: Ben" || name == "2: Cleo" || name == "6: Ilse" {
+			t.Errorf("tested player %q listed as untested", name)
+		}
+	}
+	untested := strings.Join(summary.Untested, ",")
+	for _, name := range []string{"2: Sjoekes", "7: Joris", "8: Kato"} {
+		if !strings.Contains(untested, name) {
+			t.Errorf("untested player %q missing: %v", name, summary.Untested)
+		}
+	}
+	if !sort.StringsAreSorted(summary.Untested) {
+		t.Errorf("untested players not sorted: %v", summary.Untested)
+	}
+}
+
+func TestEnvInt(t *testing.T) {
+	t.Setenv("DROPPYDROP_TEST_INT", "12")
+	if got := envInt("DROPPYDROP_TEST_INT", 5); got != 12 {
+		t.Errorf("set: got %d, want 12", got)
+	}
+	t.Setenv("DROPPYDROP_TEST_INT", "twelve")
+	if got := envInt("DROPPYDROP_TEST_INT", 5); got != 5 {
+		t.Errorf("invalid: got %d, want default 5", got)
+	}
+	if got := envInt("DROPPYDROP_TEST_UNSET", 5); got != 5 {
+		t.Errorf("unset: got %d, want default 5", got)
+	}
+}
+
+func TestMapConfig(t *testing.T) {
+	if config, err := loadMapConfig(); err != nil || config != (MapConfig{Lat: spawnLat, Lng: spawnLng, Zoom: defaultMapZoom}) {
+		t.Errorf("unset: got %+v, %v, want the spawn location", config, err)
+	}
+
+	t.Setenv("MAP_CENTER_LAT", "50.8503")
+	t.Setenv("MAP_CENTER_LNG", "4.3517")
+	t.Setenv("MAP_ZOOM", "13")
+	config, err := loadMapConfig()
+	if err != nil {
+		t.Fatalf("loading: %v", err)
+	}
+	old := mapConfig
+	mapConfig = config
+	t.Cleanup(func() { mapConfig = old })
+
+	rec := httptest.NewRecorder()
+	handleMapConfig(rec, httptest.NewRequest(http.MethodGet, "/api/map-config", nil))
+	var got MapConfig
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	if want := (MapConfig{Lat: 50.8503, Lng: 4.3517, Zoom: 13}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	for name, value := range map[string]string{"MAP_CENTER_LAT": "91", "MAP_ZOOM": "20"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := loadMapConfig(); err == nil {
+				t.Errorf("%s=%s: got no error", name, value)
+			}
+		})
+	}
+}
+
+// withFeatureDisabled switches a feature off for the duration of the test.
+func withFeatureDisabled(t *testing.T, feature string) {
+	t.Helper()
+	old := features
+	features = maps.Clone(old)
+	features[feature] = false
+	t.Cleanup(func() { features = old })
+}
+
+func TestFeatures(t *testing.T) {
+	t.Setenv("FEATURE_CHAT", "false")
+	t.Setenv("FEATURE_TARGETS", "nope")
+	if got, want := loadFeatures(), map[string]bool{featureChat: false, featureTargets: true, featureEmergency: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %v, want %v", got, want)
+	}
+
+	withFeatureDisabled(t, featureEmergency)
+	rec := httptest.NewRecorder()
+	handleFeatures(rec, httptest.NewRequest(http.MethodGet, "/api/features", nil))
+	var got map[string]bool
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	if want := map[string]bool{featureChat: true, featureTargets: true, featureEmergency: false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDisabledFeaturesAreRejected(t *testing.T) {
+	id := obfuscatePlayerID("alice")
+	tests := []struct {
+		feature string
+		handler http.HandlerFunc
+		method  string
+		url     string
+		body    string
+	}{
+		{featureChat, handlePlayerMessages, http.MethodPost, "/api/messages/" + id, `{"message": "hi"}`},
+		{featureChat, handleSendDirectMessage, http.MethodPost, "/api/dm/" + id, `{"message": "hi"}`},
+		{featureChat, handleSendDirectMessage, http.MethodPost, "/api/dm/" + id + "/resend", ``},
+		{featureChat, handleDMWithTarget, http.MethodPost, "/api/dm-with-target/" + id, `{"message": "go", "lat": 51, "lng": 4}`},
+		{featureChat, handleChatWebSocket, http.MethodGet, "/api/chat/ws/" + id, ``},
+		{featureTargets, handleDMWithTarget, http.MethodPost, "/api/dm-with-target/" + id, `{"message": "go", "lat": 51, "lng": 4}`},
+		{featureTargets, handleSetTargetLocation, http.MethodPost, "/api/target/" + id, `{"lat": 51, "lng": 4}`},
+		{featureTargets, handleSetTargetLocation, http.MethodDelete, "/api/target/" + id, ``},
+		{featureTargets, handleSetTargetLocation, http.MethodPost, "/api/target/" + id + "/recall", ``},
+		{featureTargets, handleTargetChain, http.MethodPost, "/api/targets/chain/" + id, `{"lat": 51, "lng": 4}`},
+		{featureTargets, handleTargetChain, http.MethodPost, "/api/targets/chain/" + id + "/reorder", `{"order": [1]}`},
+		{featureTargets, handleBatchSetTargets, http.MethodPost, "/api/targets/batch", `[{"playerID": "` + id + `", "lat": 51, "lng": 4}]`},
+		{featureTargets, handleLoadTargets, http.MethodPost, "/api/admin/load-targets", `[{"playerID": "alice", "lat": 51, "lng": 4}]`},
+		{featureTargets, handleLoadInitialTargets, http.MethodPost, "/api/admin/load-initial-targets", ``},
+		{featureEmergency, handlePanic, http.MethodPost, "/api/panic/" + id, ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.feature+" "+tt.method+" "+tt.url, func(t *testing.T) {
+			withFeatureDisabled(t, tt.feature)
+			// Without an emulator dsClient is nil, so reaching datastore would panic.
+			rec := httptest.NewRecorder()
+			tt.handler(rec, httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body)))
+			if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), tt.feature) {
+				t.Errorf("got %d %q, want %d naming the %s feature", rec.Code, rec.Body.String(), http.StatusForbidden, tt.feature)
+			}
+		})
+	}
+}
+
+func postTestResult(body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handleTestResult(rec, httptest.NewRequest(http.MethodPost, "/api/test-result", strings.NewReader(body)))
+	return rec
+}
+
+func TestValidateTestStatus(t *testing.T) {
+	for _, status := range []string{"", "OK", "FAIL", "DENIED", "PENDING", "Pending", "Success", "Failed", "Unavailable", "PERMISSION DENIED", "NOT SUPPORTED", "Granted", "Refused", "Skipped", "Unsupported", "Error", "ok"} {
+		if err := validateTestStatus("locationStatus", status); err != nil {
+			t.Errorf("%q: got %v, want it accepted", status, err)
+		}
+	}
+	for _, status := range []string{"Maybe", "OKAY", " OK", "<script>"} {
+		if err := validateTestStatus("locationStatus", status); err == nil {
+			t.Errorf("%q: accepted, want an error", status)
+		}
+	}
+}
+
+func TestTestResultRejectsBadRequests(t *testing.T) {
+	for body, field := range map[string]string{
+		`{"locationStatus": "Success"}`:                             "playerName",
+		`{"playerName": "1: Ben", "locationStatus": "Maybe"}`:       "locationStatus",
+		`{"playerName": "1: Ben", "notificationStatus": "Later"}`:   "notificationStatus",
+		`{"playerName": "1: Ben", "serverStatus": "Probably fine"}`: "serverStatus",
+	} {
+		rec := postTestResult(body)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"`+field+`"`) {
+			t.Errorf("%s: got %d %q, want %d naming %s", body, rec.Code, rec.Body.String(), http.StatusBadRequest, field)
+		}
+	}
+}
+
+func TestTestResultCooldown(t *testing.T) {
+	testResultCooldown = time.Minute
+	testResultCooldowns.def.last = nil
+	t.Cleanup(func() {
+		testResultCooldown = 0
+		testResultCooldowns.def.last = nil
+	})
+
+	// A submission moments ago, without needing the datastore to make it.
+	testResultCooldowns.def.take("1: Ben", time.Now().Add(-20*time.Second), testResultCooldown)
+	rec := postTestResult(`{"playerName": "1: Ben", "locationStatus": "Success"}`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "40" {
+		t.Errorf("Retry-After: got %q, want 40", got)
+	}
+}
+
+func TestTestResultSkipsUnchangedStatuses(t *testing.T) {
+	requireEmulator(t, "TestResult")
+	submission := `{"playerName": "1: Ben", "locationStatus": "Success", "notificationStatus": "Granted", "serverStatus": "OK"}`
+	if rec := postTestResult(submission); rec.Code != http.StatusCreated {
+		t.Fatalf("first submission: got %d: %s", rec.Code, rec.Body.String())
+	}
+	key := datastore.NameKey("TestResult", "1: Ben", nil)
+	var first TestResult
+	if err := dsClient.Get(context.Background(), key, &first); err != nil {
+		t.Fatalf("getting test result: %v", err)
+	}
+
+	rec := postTestResult(submission)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"unchanged":true`) {
+		t.Fatalf("duplicate submission: got %d %q, want unchanged", rec.Code, rec.Body.String())
+	}
+	var stored TestResult
+	if err := dsClient.Get(context.Background(), key, &stored); err != nil {
+		t.Fatalf("getting test result: %v", err)
+	}
+	if !stored.Timestamp.Equal(first.Timestamp) {
+		t.Errorf("duplicate submission was written: timestamp %v, was %v", stored.Timestamp, first.Timestamp)
+	}
+
+	if rec := postTestResult(`{"playerName": "1: Ben", "locationStatus": "Denied", "notificationStatus": "Granted", "serverStatus": "OK"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("changed submission: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if err := dsClient.Get(context.Background(), key, &stored); err != nil {
+		t.Fatalf("getting test result: %v", err)
+	}
+	if stored.LocationStatus != "Denied" || !stored.Timestamp.After(first.Timestamp) {
+		t.Errorf("changed submission: stored %+v", stored)
+	}
+}
+
+func TestTestResultRefreshesOldUnchangedResult(t *testing.T) {
+	requireEmulator(t, "TestResult")
+	key := datastore.NameKey("TestResult", "1: Ben", nil)
+	old := time.Now().Add(-2 * testResultRefreshInterval)
+	putEntity(t, key, &TestResult{PlayerName: "1: Ben", LocationStatus: "Success", NotificationStatus: "Granted", ServerStatus: "OK", Timestamp: old})
+
+	if rec := postTestResult(`{"playerName": "1: Ben", "locationStatus": "Success", "notificationStatus": "Granted", "serverStatus": "OK"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("got %d %q, want the result written again", rec.Code, rec.Body.String())
+	}
+	var stored TestResult
+	if err := dsClient.Get(context.Background(), key, &stored); err != nil {
+		t.Fatalf("getting test result: %v", err)
+	}
+	if !stored.Timestamp.After(old.Add(time.Minute)) {
+		t.Errorf("timestamp not refreshed: got %v", stored.Timestamp)
+	}
+}
+
+func TestCleanupTestResults(t *testing.T) {
+	requireEmulator(t, "TestResult")
+	now := time.Now()
+	putEntity(t, datastore.IncompleteKey("TestResult", nil), &TestResult{PlayerName: "old", Timestamp: now.Add(-48 * time.Hour)})
+	putEntity(t, datastore.IncompleteKey("TestResult", nil), &TestResult{PlayerName: "new", Timestamp: now.Add(-time.Hour)})
+
+	rec := httptest.NewRecorder()
+	handleCleanupTestResults(rec, httptest.NewRequest(http.MethodPost, "/api/admin/cleanup-test-results?olderThanHours=24", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"deleted":1`) {
+		t.Fatalf("got %d %q, want one deleted", rec.Code, rec.Body.String())
+	}
+
+	var left []TestResult
+	if _, err := dsClient.GetAll(context.Background(), datastore.NewQuery("TestResult"), &left); err != nil {
+		t.Fatalf("listing test results: %v", err)
+	}
+	if len(left) != 1 || left[0].PlayerName != "new" {
+		t.Errorf("remaining results: %+v, want only \"new\"", left)
+	}
+}
+
+func TestCleanupTestResultsRejectsBadParams(t *testing.T) {
+	for _, q := range []string{"", "?olderThanHours=-1", "?olderThanHours=abc"} {
+		rec := httptest.NewRecorder()
+		handleCleanupTestResults(rec, httptest.NewRequest(http.MethodPost, "/api/admin/cleanup-test-results"+q, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got %d, want %d", q, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestClearDatastoreSelectedKinds(t *testing.T) {
+	requireEmulator(t, "PlayerMessage", "DirectMessage", "TargetLocation")
+	now := time.Now()
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p1", Content: "hi", Timestamp: now})
+	putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "p1", Content: "hello", Timestamp: now})
+	putEntity(t, datastore.NameKey("TargetLocation", "p1", nil), &TargetLocation{Lat: 51, Lng: 3.9, Timestamp: now})
+
+	rec := httptest.NewRecorder()
+	handleClearDatastore(rec, httptest.NewRequest(http.MethodPost, "/api/admin/clear-datastore?confirm=true&kinds=PlayerMessage,%20DirectMessage", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if n := countEntities(t, "PlayerMessage") + countEntities(t, "DirectMessage"); n != 0 {
+		t.Errorf("%d messages left, want 0", n)
+	}
+	if n := countEntities(t, "TargetLocation"); n != 1 {
+		t.Errorf("got %d targets, want 1 to survive", n)
+	}
+}
+
+func TestClearDatastoreRejectsUnknownKinds(t *testing.T) {
+	for _, kinds := range []string{"Lead", "PlayerMessage,Nope", "PlayerMessage,"} {
+		rec := httptest.NewRecorder()
+		handleClearDatastore(rec, httptest.NewRequest(http.MethodPost, "/api/admin/clear-datastore?confirm=true&kinds="+kinds, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("kinds=%s: got %d, want %d", kinds, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func withDatastoreBatchSize(t *testing.T, n int) {
+	t.Helper()
+	datastoreBatchSize = n
+	t.Cleanup(func() { datastoreBatchSize = maxDatastoreBatchSize })
+}
+
+func TestForEachBatch(t *testing.T) {
+	withDatastoreBatchSize(t, 2)
+	var batches [][2]int
+	err := forEachBatch(5, func(start, end int) error {
+		batches = append(batches, [2]int{start, end})
+		return nil
+	})
+	if want := [][2]int{{0, 2}, {2, 4}, {4, 5}}; err != nil || !reflect.DeepEqual(batches, want) {
+		t.Errorf("got %v (err %v), want %v", batches, err, want)
+	}
+
+	calls := 0
+	failure := errors.New("boom")
+	err = forEachBatch(5, func(start, end int) error {
+		calls++
+		return failure
+	})
+	if !errors.Is(err, failure) || calls != 1 {
+		t.Errorf("got %v after %d calls, want the first error to stop the batches", err, calls)
+	}
+
+	if err := forEachBatch(0, func(start, end int) error { t.Error("called without items"); return nil }); err != nil {
+		t.Errorf("no items: got %v", err)
+	}
+}
+
+func TestBatchPutAndDelete(t *testing.T) {
+	requireEmulator(t, "TargetLocation", "PlayerMessage")
+	withDatastoreBatchSize(t, 2)
+	ctx := context.Background()
+	var keys []*datastore.Key
+	var targets []*TargetLocation
+	for i := 0; i < 5; i++ {
+		keys = append(keys, datastore.NameKey("TargetLocation", fmt.Sprintf("p%d", i), nil))
+		targets = append(targets, &TargetLocation{Lat: 51, Lng: 3.9, Timestamp: time.Now()})
+	}
+	if saved, err := batchPut(ctx, keys, targets); err != nil || saved != 5 {
+		t.Fatalf("saving: got %d, %v, want 5 saved", saved, err)
+	}
+	if n := countEntities(t, "TargetLocation"); n != 5 {
+		t.Errorf("got %d targets, want 5", n)
+	}
+	if deleted, err := batchDelete(ctx, keys[:3]); err != nil || deleted != 3 {
+		t.Fatalf("deleting: got %d, %v, want 3 deleted", deleted, err)
+	}
+	if n := countEntities(t, "TargetLocation"); n != 2 {
+		t.Errorf("got %d targets, want 2 left", n)
+	}
+
+	for i := 0; i < 5; i++ {
+		putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p1", Content: "hi", Timestamp: time.Now()})
+	}
+	rec := httptest.NewRecorder()
+	handleClearDatastore(rec, httptest.NewRequest(http.MethodPost, "/api/admin/clear-datastore?confirm=true&kinds=PlayerMessage,TargetLocation", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	if n := countEntities(t, "PlayerMessage") + countEntities(t, "TargetLocation"); n != 0 {
+		t.Errorf("%d entities left after clearing in batches of 2, want 0", n)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/metrics-test/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+	handler := metricsMiddleware(mux)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/metrics-test/abc", nil))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scrape: got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`droppydrop_http_requests_total{code="418",handler="/api/metrics-test/{id}",method="GET"} 1`,
+		`droppydrop_http_request_duration_seconds_bucket{handler="/api/metrics-test/{id}"`,
+		"droppydrop_datastore_errors_total",
+		"droppydrop_active_players",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("scrape is missing %q", want)
+		}
+	}
+}
+
+func TestCountDatastoreErrors(t *testing.T) {
+	before := testutil.ToFloat64(datastoreErrorsTotal)
+	ok := func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		return nil
+	}
+	fail := func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		return fmt.Errorf("unavailable")
+	}
+
+	countDatastoreErrors(context.Background(), "/Lookup", nil, nil, nil, ok)
+	if err := countDatastoreErrors(context.Background(), "/Lookup", nil, nil, nil, fail); err == nil {
+		t.Error("interceptor swallowed the error")
+	}
+	if got := testutil.ToFloat64(datastoreErrorsTotal) - before; got != 1 {
+		t.Errorf("counted %v errors, want 1", got)
+	}
+}
+
+// blockingDatastore points dsClient at a server that accepts connections but never
+// answers, so every datastore call blocks until its context is done.
+func blockingDatastore(t *testing.T) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	var conns []net.Conn
+	var mu sync.Mutex
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+
+	t.Setenv("DATASTORE_EMULATOR_HOST", ln.Addr().String())
+	client, err := datastore.NewClient(context.Background(), "blocking-test")
+	if err != nil {
+		t.Fatalf("creating blocking client: %v", err)
+	}
+	old := dsClient
+	dsClient = client
+	t.Cleanup(func() {
+		dsClient = old
+		client.Close()
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+}
+
+func TestTimeoutMiddlewareReturns503(t *testing.T) {
+	blockingDatastore(t)
+	handler := timeoutMiddleware(http.HandlerFunc(handleGetTargets), 100*time.Millisecond)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/targets", nil))
+		done <- rec
+	}()
+
+	select {
+	case rec := <-done:
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("got %d, want %d", rec.Code, http.StatusServiceUnavailable)
+		}
+		if !strings.Contains(rec.Body.String(), requestTimeoutMessage) {
+			t.Errorf("body %q does not explain the timeout", rec.Body.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request hung past its deadline")
+	}
+}
+
+func TestTimeoutMiddlewarePassesFastRequests(t *testing.T) {
+	handler := timeoutMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); !ok {
+			t.Error("request context has no deadline")
+		}
+		w.WriteHeader(http.StatusCreated)
+	}), time.Second)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/test-result", nil))
+	if rec.Code != http.StatusCreated {
+		t.Errorf("got %d, want %d", rec.Code, http.StatusCreated)
+	}
+}
+
+func TestBackupsAreExemptFromTheTimeout(t *testing.T) {
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(`{"kinds":{}}`))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/admin/export", slow)
+	mux.HandleFunc("/api/admin/import", slow)
+	mux.HandleFunc("/api/targets", slow)
+	server := httptest.NewServer(newHandler(mux, 20*time.Millisecond))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/api/admin/export", http.StatusOK},
+		{http.MethodPost, "/api/admin/import", http.StatusOK},
+		{http.MethodGet, "/api/targets", http.StatusServiceUnavailable},
+	} {
+		req, _ := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(`{"kinds":{}}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.method, tt.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s: got %d %q, want %d", tt.method, tt.path, resp.StatusCode, body, tt.want)
+		}
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		var locations map[string]PlayerLocation
+		locations["alice"] = PlayerLocation{}
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("still here"))
+	})
+	server := httptest.NewServer(recoverMiddleware(mux))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/panic")
+	if err != nil {
+		t.Fatalf("panicking request: %v", err)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Errorf("decoding the error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || body["error"] == "" {
+		t.Errorf("got %d %v, want a 500 with a JSON error", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+
+	resp, err = http.Get(server.URL + "/ok")
+	if err != nil {
+		t.Fatalf("request after the panic: %v", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(b) != "still here" {
+		t.Errorf("after the panic: got %d %q", resp.StatusCode, b)
+	}
+}
+
+func TestRequestIDUsesTraceHeader(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/targets", nil)
+	r.Header.Set("X-Cloud-Trace-Context", "105445aa7843bc8bf206b12000100000/1;o=1")
+	if id := requestID(r); id != "105445aa7843bc8bf206b12000100000" {
+		t.Errorf("got %q, want the trace ID", id)
+	}
+	r.Header.Del("X-Cloud-Trace-Context")
+	if id := requestID(r); len(id) != 16 {
+		t.Errorf("got %q, want a made-up 16 digit ID", id)
+	}
+}
+
+func TestHaversineMeters(t *testing.T) {
+	if d := haversineMeters(51.0, 3.9, 51.0, 3.9); d != 0 {
+		t.Errorf("same point: got %v, want 0", d)
+	}
+	// One degree of latitude is about 111.2km everywhere.
+	if d := haversineMeters(51.0, 3.9, 52.0, 3.9); math.Abs(d-111195) > 10 {
+		t.Errorf("one degree of latitude: got %v, want ~111195", d)
+	}
+	if a, b := haversineMeters(51.0, 3.9, 51.01, 3.95), haversineMeters(51.01, 3.95, 51.0, 3.9); math.Abs(a-b) > 1e-6 {
+		t.Errorf("distance not symmetric: %v vs %v", a, b)
+	}
+}
+
+// stubGeocoder answers reverse-geocoding requests with a numbered address and counts calls.
+type stubGeocoder struct {
+	calls int
+}
+
+func (s *stubGeocoder) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.calls++
+	body := fmt.Sprintf(`{"status":"OK","results":[{"formatted_address":"Address %d for %s"}]}`, s.calls, req.URL.Query().Get("latlng"))
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func withStubGeocoder(t *testing.T) *stubGeocoder {
+	t.Helper()
+	stub := &stubGeocoder{}
+	oldClient, oldKey := geocodeClient, geocodeAPIKey
+	geocodeClient = &http.Client{Transport: stub}
+	geocodeAPIKey = "test-key"
+	t.Cleanup(func() { geocodeClient, geocodeAPIKey = oldClient, oldKey })
+	return stub
+}
+
+func TestSetAddressCachesUntilPlayerMoves(t *testing.T) {
+	stub := withStubGeocoder(t)
+	ctx := context.Background()
+
+	loc := PlayerLocation{Lat: 51.0, Lng: 3.9}
+	if err := setAddress(ctx, &loc, PlayerLocation{}); err != nil {
+		t.Fatalf("first lookup: %v", err)
+	}
+	if stub.calls != 1 || !strings.HasPrefix(loc.Address, "Address 1") {
+		t.Fatalf("first lookup: %d calls, address %q", stub.calls, loc.Address)
+	}
+
+	// About 55m away: reuse the cached address.
+	near := PlayerLocation{Lat: 51.0005, Lng: 3.9}
+	if err := setAddress(ctx, &near, loc); err != nil {
+		t.Fatalf("nearby update: %v", err)
+	}
+	if stub.calls != 1 || near.Address != loc.Address || near.AddressLat != 51.0 {
+		t.Errorf("nearby update: %d calls, address %q from %v", stub.calls, near.Address, near.AddressLat)
+	}
+
+	// About 220m from where the address was looked up: refresh it.
+	far := PlayerLocation{Lat: 51.002, Lng: 3.9}
+	if err := setAddress(ctx, &far, near); err != nil {
+		t.Fatalf("far update: %v", err)
+	}
+	if stub.calls != 2 || !strings.HasPrefix(far.Address, "Address 2") || far.AddressLat != 51.002 {
+		t.Errorf("far update: %d calls, address %q from %v", stub.calls, far.Address, far.AddressLat)
+	}
+}
+
+func TestUpdateLocationSkipsGeocodingWithoutKey(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory")
+	stub := withStubGeocoder(t)
+	geocodeAPIKey = ""
+
+	rec := httptest.NewRecorder()
+	handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID("p1"), strings.NewReader(`{"lat":51.0,"lng":3.9,"status":"OK"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d", rec.Code)
+	}
+	if stub.calls != 0 {
+		t.Errorf("geocoder called %d times without a key", stub.calls)
+	}
+}
+
+func TestClusterLocations(t *testing.T) {
+	locations := map[string]PlayerLocation{
+		// Two players about 20m apart at the church, two about 30m apart at the station,
+		// one on their own a few km away, and one that never sent coordinates.
+		"alice": {Lat: 51.03500, Lng: 3.97370},
+		"bob":   {Lat: 51.03518, Lng: 3.97370},
+		"carol": {Lat: 51.04500, Lng: 3.98000},
+		"dave":  {Lat: 51.04500, Lng: 3.98043},
+		"erin":  {Lat: 51.04600, Lng: 3.98000},
+		"frank": {Lat: 51.07000, Lng: 4.02000},
+		"gina":  {Status: "DENIED"},
+	}
+
+	clusters := clusterLocations(locations, 50)
+	got := make(map[string][]string)
+	for _, c := range clusters {
+		if c.Count != len(c.PlayerIDs) {
+			t.Errorf("cluster %v: count %d does not match members", c.PlayerIDs, c.Count)
+		}
+		got[c.PlayerIDs[0]] = c.PlayerIDs
+	}
+	want := map[string][]string{
+		"alice": {"alice", "bob"},
+		"carol": {"carol", "dave"},
+		"erin":  {"erin"},
+		"frank": {"frank"},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("clusters: got %v, want %v", got, want)
+	}
+	if clusters[0].Count != 2 || clusters[len(clusters)-1].Count != 1 {
+		t.Errorf("clusters not ordered by size: %+v", clusters)
+	}
+
+	// The centroid sits between its members.
+	if c := clusters[0]; c.PlayerIDs[0] == "alice" && math.Abs(c.Lat-51.03509) > 1e-9 {
+		t.Errorf("centroid lat: got %v, want 51.03509", c.Lat)
+	}
+
+	// A larger radius pulls erin into the station group.
+	if clusters := clusterLocations(locations, 200); len(clusters) != 3 || clusters[0].Count != 3 {
+		t.Errorf("200m radius: got %+v", clusters)
+	}
+}
+
+func TestLocationClustersRejectsBadRadius(t *testing.T) {
+	for _, q := range []string{"?radius=abc", "?radius=0", "?radius=-5", "?radius=100000"} {
+		rec := httptest.NewRecorder()
+		handleGetLocationClusters(rec, httptest.NewRequest(http.MethodGet, "/api/locations/clusters"+q, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", q, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestNearbyPlayers(t *testing.T) {
+	// Checkpoint at the origin of a small grid; 0.001 degrees of latitude is about 111m.
+	locations := map[string]PlayerLocation{
+		"far":     {Lat: 51.010, Lng: 3.9},
+		"close":   {Lat: 51.001, Lng: 3.9},
+		"closer":  {Lat: 51.0005, Lng: 3.9},
+		"middle":  {Lat: 51.002, Lng: 3.9},
+		"nowhere": {Status: "DENIED"},
+	}
+
+	nearby := nearbyPlayers(locations, 51.0, 3.9, 300)
+	var ids []string
+	for _, p := range nearby {
+		ids = append(ids, p.PlayerID)
+	}
+	if fmt.Sprint(ids) != "[closer close middle]" {
+		t.Fatalf("got %v, want [closer close middle]", ids)
+	}
+	if d := nearby[1].DistanceMeters; math.Abs(d-111.2) > 0.5 {
+		t.Errorf("distance of close: got %v, want ~111.2", d)
+	}
+	if nearby[0].Lat != 51.0005 {
+		t.Errorf("location not included: %+v", nearby[0])
+	}
+}
+
+func TestNearbyPlayersRejectsBadParams(t *testing.T) {
+	for _, q := range []string{
+		"", "?lat=51&lng=3.9", "?lat=abc&lng=3.9&radius=100", "?lat=91&lng=3.9&radius=100",
+		"?lat=51&lng=-181&radius=100", "?lat=51&lng=3.9&radius=0", "?lat=51&lng=3.9&radius=x",
+	} {
+		rec := httptest.NewRecorder()
+		handleGetNearbyPlayers(rec, httptest.NewRequest(http.MethodGet, "/api/locations/near"+q, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got %d, want %d", q, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func withFastWebhookRetries(t *testing.T) {
+	t.Helper()
+	old := webhookBackoff
+	webhookBackoff = time.Millisecond
+	t.Cleanup(func() { webhookBackoff = old })
+}
+
+func TestDeliverWebhookSignsAndRetries(t *testing.T) {
+	withFastWebhookRetries(t)
+	hook := Webhook{Secret: "s3cret"}
+	payload := []byte(`{"event":"arrival"}`)
+
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		body, _ := io.ReadAll(r.Body)
+		if got, want := r.Header.Get("X-Signature"), signWebhookPayload(hook.Secret, body); got != want {
+			t.Errorf("signature: got %q, want %q", got, want)
+		}
+		if string(body) != string(payload) {
+			t.Errorf("body: got %q", body)
+		}
+		if attempts < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+	hook.URL = srv.URL
+
+	if err := deliverWebhook(hook, payload); err != nil {
+		t.Fatalf("deliverWebhook: %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+}
+
+func TestDeliverWebhookGivesUp(t *testing.T) {
+	withFastWebhookRetries(t)
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	if err := deliverWebhook(Webhook{URL: srv.URL, Secret: "s"}, []byte("{}")); err == nil {
+		t.Error("expected an error after exhausting retries")
+	}
+	if attempts != webhookMaxAttempts {
+		t.Errorf("got %d attempts, want %d", attempts, webhookMaxAttempts)
+	}
+}
+
+func TestRegisterWebhookRejectsBadInput(t *testing.T) {
+	for _, body := range []string{
+		`not json`,
+		`{"url":"ftp://example.com","events":["arrival"]}`,
+		`{"url":"/relative","events":["arrival"]}`,
+		`{"url":"https://example.com/hook","events":[]}`,
+		`{"url":"https://example.com/hook","events":["arrival","explosion"]}`,
+	} {
+		rec := httptest.NewRecorder()
+		handleRegisterWebhook(rec, httptest.NewRequest(http.MethodPost, "/api/admin/webhooks", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+var startWebhookWorker sync.Once
+
+func TestWebhookReceivesArrival(t *testing.T) {
+	requireEmulator(t, "Webhook", "TargetLocation", "PlayerLocation", "LocationHistory")
+	startWebhookWorker.Do(func() { go runWebhookWorker() })
+
+	received := make(chan webhookEvent, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev webhookEvent
+		json.NewDecoder(r.Body).Decode(&ev)
+		received <- ev
+	}))
+	defer srv.Close()
+
+	rec := httptest.NewRecorder()
+	handleRegisterWebhook(rec, httptest.NewRequest(http.MethodPost, "/api/admin/webhooks", strings.NewReader(`{"url":"`+srv.URL+`","events":["arrival"]}`)))
+	if rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"secret"`) {
+		t.Fatalf("registering: got %d %q", rec.Code, rec.Body.String())
+	}
+	putEntity(t, datastore.NameKey("TargetLocation", "p1", nil), &TargetLocation{Lat: 51.0, Lng: 3.9, IsReleased: true, Timestamp: time.Now()})
+
+	// Two updates at the target: only the first is an arrival.
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID("p1"), strings.NewReader(`{"lat":51.0001,"lng":3.9,"status":"OK"}`)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("update %d: got %d", i, rec.Code)
+		}
+	}
+
+	select {
+	case ev := <-received:
+		if ev.Event != webhookEventArrival {
+			t.Errorf("got %q event, want arrival", ev.Event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook never received the arrival")
+	}
+	select {
+	case ev := <-received:
+		t.Errorf("unexpected second delivery: %+v", ev)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestOpenAPISpecIsValid(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleOpenAPISpec(rec, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !json.Valid(rec.Body.Bytes()) {
+		t.Fatal("spec is not valid JSON")
+	}
+
+	doc, err := openapi3.NewLoader().LoadFromData(rec.Body.Bytes())
+	if err != nil {
+		t.Fatalf("loading spec: %v", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		t.Fatalf("invalid OpenAPI document: %v", err)
+	}
+}
+
+// registeredAPIRoutes returns the /api patterns registered in main.go.
+func registeredAPIRoutes(t *testing.T) []string {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), "main.go", nil, 0)
+	if err != nil {
+		t.Fatalf("parsing main.go: %v", err)
+	}
+	var routes []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) == 0 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || (sel.Sel.Name != "HandleFunc" && sel.Sel.Name != "Handle") {
+			return true
+		}
+		if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			if pattern, _ := strconv.Unquote(lit.Value); strings.HasPrefix(pattern, "/api/") {
+				routes = append(routes, pattern)
+			}
+		}
+		return true
+	})
+	return routes
+}
+
+func TestAdminRoutesRequireLead(t *testing.T) {
+	file, err := parser.ParseFile(token.NewFileSet(), "main.go", nil, 0)
+	if err != nil {
+		t.Fatalf("parsing main.go: %v", err)
+	}
+	checked := 0
+	ast.Inspect(file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) != 2 {
+			return true
+		}
+		if sel, ok := call.Fun.(*ast.SelectorExpr); !ok || sel.Sel.Name != "HandleFunc" {
+			return true
+		}
+		lit, ok := call.Args[0].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		if pattern, _ := strconv.Unquote(lit.Value); strings.HasPrefix(pattern, "/api/admin/") {
+			checked++
+			requiresLead := false
+			if wrapper, ok := call.Args[1].(*ast.CallExpr); ok {
+				fun, _ := wrapper.Fun.(*ast.Ident)
+				requiresLead = fun != nil && fun.Name == "requireLead"
+			}
+			if !requiresLead {
+				t.Errorf("route %s isn't wrapped in requireLead", pattern)
+			}
+		}
+		return true
+	})
+	if checked == 0 {
+		t.Fatal("found no admin routes in main.go")
+	}
+}
+
+func TestOpenAPISpecMatchesRoutes(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("decoding spec: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	routes := registeredAPIRoutes(t)
+	for _, route := range routes {
+		mux.HandleFunc(route, func(http.ResponseWriter, *http.Request) {})
+	}
+
+	// Every documented path is served by the route that would actually handle it.
+	documented := make(map[string]bool)
+	for path := range spec.Paths {
+		example := regexp.MustCompile(`\{[^}]+\}`).ReplaceAllString(path, "x")
+		_, pattern := mux.Handler(httptest.NewRequest(http.MethodGet, example, nil))
+		if pattern == "" {
+			t.Errorf("documented path %s is not routed", path)
+			continue
+		}
+		if strings.HasSuffix(pattern, "/") == (example == path) && pattern != path {
+			t.Errorf("documented path %s is handled by %s", path, pattern)
+		}
+		documented[pattern] = true
+	}
+
+	// Every registered route is documented.
+	for _, route := range routes {
+		if !documented[route] {
+			t.Errorf("route %s is missing from openapi.json", route)
+		}
+	}
+}
+
+func TestOpenAPISchemasMatchStructs(t *testing.T) {
+	var spec struct {
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("decoding spec: %v", err)
+	}
+
+	types := map[string]interface{}{
+		"PlayerLocation":        PlayerLocation{},
+		"LocationHistoryEntry":  LocationHistoryEntry{},
+		"PlayerMessage":         PlayerMessage{},
+		"DirectMessage":         DirectMessage{},
+		"TestResult":            TestResult{},
+		"TargetLocation":        TargetLocation{},
+		"TargetListEntry":       TargetListEntry{},
+		"ChatMessage":           ChatMessage{},
+		"ChatHistory":           ChatHistory{},
+		"ReadCursor":            ReadCursor{},
+		"NotificationPrefs":     NotificationPrefs{},
+		"ObfuscatedURLResponse": ObfuscatedURLResponse{},
+		"LocationCluster":       LocationCluster{},
+		"NearbyPlayer":          NearbyPlayer{},
+		"ArchivedMessage":       ArchivedMessage{},
+		"BatchTargetResult":     BatchTargetResult{},
+		"InitialTarget":         InitialTarget{},
+		"PlayerState":           PlayerState{},
+		"GameStats":             GameStats{},
+		"GameState":             GameState{},
+		"ArrivalEvent":          ArrivalEvent{},
+		"MapConfig":             MapConfig{},
+		"PlayerContact":         PlayerContact{},
+		"TargetHashMatch":       TargetHashMatch{},
+		"LeaderboardEntry":      LeaderboardEntry{},
+		"Arrival":               Arrival{},
+		"Player":                Player{},
+		"ActivityBucket":        ActivityBucket{},
+		"RenameSummary":         RenameSummary{},
+		"EmergencyAlert":        EmergencyAlert{},
+		"PlayerTarget":          PlayerTarget{},
+		"IdempotencyRecord":     IdempotencyRecord{},
+	}
+	for name, v := range types {
+		schema, ok := spec.Components.Schemas[name]
+		if !ok {
+			t.Errorf("schema %s is missing", name)
+			continue
+		}
+		var got []string
+		for prop := range schema.Properties {
+			got = append(got, prop)
+		}
+		sort.Strings(got)
+		want := jsonFieldNames(reflect.TypeOf(v))
+		sort.Strings(want)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("schema %s has properties %v, struct has %v", name, got, want)
+		}
+	}
+}
+
+// jsonFieldNames lists the JSON names of a struct's fields, flattening embedded structs.
+func jsonFieldNames(typ reflect.Type) []string {
+	var names []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if field.Anonymous && tag == "" {
+			names = append(names, jsonFieldNames(field.Type)...)
+			continue
+		}
+		if tag == "" {
+			tag = field.Name
+		}
+		names = append(names, tag)
+	}
+	return names
+}
+
+func TestPresenceState(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		ago  time.Duration
+		want string
+	}{
+		{0, presenceOnline},
+		{59 * time.Second, presenceOnline},
+		{60 * time.Second, presenceOnline},
+		{61 * time.Second, presenceIdle},
+		{5 * time.Minute, presenceIdle},
+		{5*time.Minute + time.Second, presenceOffline},
+		{24 * time.Hour, presenceOffline},
+	} {
+		if got := presenceState(now.Add(-tc.ago), now); got != tc.want {
+			t.Errorf("%v ago: got %q, want %q", tc.ago, got, tc.want)
+		}
+	}
+}
+
+func TestPresenceThresholdsAreConfigurable(t *testing.T) {
+	oldOnline, oldIdle := presenceOnlineWindow, presenceIdleWindow
+	t.Cleanup(func() { presenceOnlineWindow, presenceIdleWindow = oldOnline, oldIdle })
+	presenceOnlineWindow, presenceIdleWindow = 10*time.Second, 30*time.Second
+
+	now := time.Now()
+	lastSeen := now.Add(-20 * time.Second)
+	locations := map[string]PlayerLocation{"p1": {Timestamp: lastSeen}}
+	// The same player moves through every state as time passes.
+	for _, tc := range []struct {
+		now  time.Time
+		want string
+	}{
+		{lastSeen.Add(5 * time.Second), presenceOnline},
+		{now, presenceIdle},
+		{now.Add(time.Minute), presenceOffline},
+	} {
+		if got := playerPresence(locations, tc.now)["p1"]; got != tc.want {
+			t.Errorf("at %v: got %q, want %q", tc.now.Sub(lastSeen), got, tc.want)
+		}
+	}
+}
+
+// contactSummary renders contacts as "player:location/message/contact", with "-" for no age.
+func contactSummary(contacts []PlayerContact) []string {
+	age := func(seconds *int64) string {
+		if seconds == nil {
+			return "-"
+		}
+		return strconv.FormatInt(*seconds, 10)
+	}
+	var summary []string
+	for _, c := range contacts {
+		summary = append(summary, fmt.Sprintf("%s:%s/%s/%d", c.PlayerID, age(c.SecondsSinceLastLocation), age(c.SecondsSinceLastMessage), c.SecondsSinceLastContact))
+	}
+	return summary
+}
+
+func TestContactAges(t *testing.T) {
+	now := time.Now()
+	locations := map[string]PlayerLocation{
+		"alice": {Timestamp: now.Add(-90 * time.Second)},
+		"bob":   {Timestamp: now.Add(-10 * time.Minute)},
+		"carol": {Timestamp: now.Add(-90 * time.Second)},
+	}
+	lastMessages := map[string]time.Time{
+		"bob":  now.Add(-30*time.Second - 500*time.Millisecond),
+		"dave": now.Add(-time.Hour),
+	}
+	got := contactSummary(contactAges(locations, lastMessages, now))
+	// dave only wrote, long ago. bob's message is more recent than their location, and
+	// alice and carol tie, so they're sorted by ID.
+	want := []string{"dave:-/3600/3600", "alice:90/-/90", "carol:90/-/90", "bob:600/30/30"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if contacts := contactAges(nil, nil, now); contacts == nil || len(contacts) != 0 {
+		t.Errorf("no players: got %#v, want an empty list", contacts)
+	}
+}
+
+func TestGetContact(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "PlayerMessage")
+	now := time.Now()
+	putEntity(t, datastore.NameKey("PlayerLocation", "alice", nil), &PlayerLocation{Lat: 51, Lng: 3.9, Status: PlayerStatusOK, Timestamp: now.Add(-time.Minute)})
+	putEntity(t, datastore.NameKey("PlayerLocation", "bob", nil), &PlayerLocation{Lat: 51, Lng: 3.9, Status: PlayerStatusOK, Timestamp: now.Add(-time.Hour)})
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "bob", Content: "old", Timestamp: now.Add(-50 * time.Minute)})
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "bob", Content: "new", Timestamp: now.Add(-20 * time.Minute)})
+
+	rec := httptest.NewRecorder()
+	handleGetContact(rec, httptest.NewRequest(http.MethodGet, "/api/contact", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var contacts []PlayerContact
+	if err := json.NewDecoder(rec.Body).Decode(&contacts); err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	if len(contacts) != 2 || contacts[0].PlayerID != "bob" || contacts[1].PlayerID != "alice" {
+		t.Fatalf("got %v, want bob before alice", contactSummary(contacts))
+	}
+	if bob := contacts[0]; bob.SecondsSinceLastMessage == nil || *bob.SecondsSinceLastMessage < 20*60 || *bob.SecondsSinceLastMessage > 20*60+5 || bob.SecondsSinceLastContact != *bob.SecondsSinceLastMessage {
+		t.Errorf("bob: got %v, want their latest message 20 minutes ago", contactSummary(contacts[:1]))
+	}
+	if alice := contacts[1]; alice.SecondsSinceLastMessage != nil {
+		t.Errorf("alice never wrote, got %v", contactSummary(contacts[1:]))
+	}
+}
+
+func TestArchiveMessages(t *testing.T) {
+	requireEmulator(t, "PlayerMessage", "DirectMessage", "ArchivedMessage")
+	now := time.Now()
+	oldMsg := putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p1", Content: "old", Timestamp: now.Add(-48 * time.Hour), IsRead: true})
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "p1", Content: "new", Timestamp: now})
+	putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "p2", SenderID: "ann", Content: "old dm", Timestamp: now.Add(-30 * time.Hour),
+		DeliveredAt: now.Add(-29 * time.Hour), ReadAt: now.Add(-28 * time.Hour)})
+
+	rec := httptest.NewRecorder()
+	handleArchiveMessages(rec, httptest.NewRequest(http.MethodPost, "/api/admin/archive-messages?olderThanHours=24", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"archived":2`) {
+		t.Fatalf("got %d %q, want two archived", rec.Code, rec.Body.String())
+	}
+	if n := countEntities(t, "PlayerMessage"); n != 1 {
+		t.Errorf("got %d live player messages, want 1", n)
+	}
+	if n := countEntities(t, "DirectMessage"); n != 0 {
+		t.Errorf("got %d live DMs, want 0", n)
+	}
+
+	// Running again must not duplicate anything.
+	if n, err := archiveMessages(context.Background(), now.Add(-24*time.Hour)); err != nil || n != 0 {
+		t.Fatalf("second run: got %d, %v", n, err)
+	}
+
+	rec = httptest.NewRecorder()
+	handleGetArchivedMessages(rec, httptest.NewRequest(http.MethodGet, "/api/messages/archived", nil))
+	var all []ArchivedMessage
+	if err := json.NewDecoder(rec.Body).Decode(&all); err != nil {
+		t.Fatalf("decoding archive: %v", err)
+	}
+	if len(all) != 2 || all[0].Content != "old dm" || all[1].Content != "old" {
+		t.Fatalf("archive: %+v, want old dm then old", all)
+	}
+	if all[0].Kind != "DirectMessage" || all[0].SenderID != "ann" || !all[0].IsRead ||
+		!all[0].DeliveredAt.Equal(now.Add(-29*time.Hour).Truncate(time.Microsecond)) || !all[0].ReadAt.Equal(now.Add(-28*time.Hour).Truncate(time.Microsecond)) {
+		t.Errorf("DM not archived faithfully: %+v", all[0])
+	}
+	if all[1].Kind != "PlayerMessage" || all[1].ID != oldMsg.ID || !all[1].IsRead {
+		t.Errorf("player message not archived faithfully: %+v", all[1])
+	}
+
+	rec = httptest.NewRecorder()
+	handleGetArchivedMessages(rec, httptest.NewRequest(http.MethodGet, "/api/messages/archived?playerID="+obfuscatePlayerID("p2"), nil))
+	var filtered []ArchivedMessage
+	if err := json.NewDecoder(rec.Body).Decode(&filtered); err != nil {
+		t.Fatalf("decoding filtered archive: %v", err)
+	}
+	if len(filtered) != 1 || filtered[0].PlayerID != "p2" {
+		t.Errorf("filtered archive: %+v, want only p2", filtered)
+	}
+}
+
+func TestArchiveMessagesRejectsBadParams(t *testing.T) {
+	for _, q := range []string{"", "?olderThanHours=-1", "?olderThanHours=abc"} {
+		rec := httptest.NewRecorder()
+		handleArchiveMessages(rec, httptest.NewRequest(http.MethodPost, "/api/admin/archive-messages"+q, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got %d, want %d", q, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleGetArchivedMessages(rec, httptest.NewRequest(http.MethodGet, "/api/messages/archived?playerID=garbage", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("bad playerID: got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRoundCoordinate(t *testing.T) {
+	for _, tc := range []struct {
+		v      float64
+		places int
+		want   float64
+	}{
+		{51.0352807419, 5, 51.03528},
+		{3.9737665526, 5, 3.97377},
+		{3.9737665526, 4, 3.9738},
+		{-0.1234567, 3, -0.123},
+		{-73.98765, 0, -74},
+	} {
+		if got := roundCoordinate(tc.v, tc.places); got != tc.want {
+			t.Errorf("roundCoordinate(%v, %d) = %v, want %v", tc.v, tc.places, got, tc.want)
+		}
+		// Rounding again must not move the point.
+		if got := roundCoordinate(roundCoordinate(tc.v, tc.places), tc.places); got != tc.want {
+			t.Errorf("rounding %v twice gave %v", tc.v, got)
+		}
+	}
+}
+
+func TestGetLocationsRejectsExcessPrecision(t *testing.T) {
+	for _, value := range []string{"abc", "-1", strconv.Itoa(coordinatePrecision + 1)} {
+		rec := httptest.NewRecorder()
+		handleGetLocations(rec, httptest.NewRequest(http.MethodGet, "/api/locations?precision="+value, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("precision=%s: status %d, want %d", value, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestLocationPrecision(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory")
+	body := `{"lat": 51.035280741, "lng": 3.973766552, "status": "OK"}`
+	rec := httptest.NewRecorder()
+	handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID("alice"), strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update: got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var stored PlayerLocation
+	if err := dsClient.Get(context.Background(), datastore.NameKey("PlayerLocation", "alice", nil), &stored); err != nil {
+		t.Fatalf("getting stored location: %v", err)
+	}
+	if stored.Lat != 51.03528 || stored.Lng != 3.97377 {
+		t.Errorf("stored %v,%v, want 51.03528,3.97377", stored.Lat, stored.Lng)
+	}
+
+	loc := getLocations(t, "/api/locations?precision=3")["alice"]
+	if loc.Lat != 51.035 || loc.Lng != 3.974 {
+		t.Errorf("precision=3 returned %v,%v, want 51.035,3.974", loc.Lat, loc.Lng)
+	}
+}
+
+func TestSpectatorTokenRoundTrip(t *testing.T) {
+	withLeadSessionKey(t)
+
+	if err := verifySpectatorToken(signSpectatorToken("", time.Now().Add(time.Hour)), ""); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+	if err := verifySpectatorToken(signSpectatorToken("", time.Now().Add(-time.Minute)), ""); err == nil {
+		t.Error("expired token accepted")
+	}
+	if err := verifySpectatorToken(signSpectatorToken("spring", time.Now().Add(time.Hour)), "autumn"); err == nil {
+		t.Error("token of another game accepted")
+	}
+	// Neither kind of token may stand in for the other.
+	if err := verifySpectatorToken(signLeadSession("ann", "", time.Now().Add(time.Hour)), ""); err == nil {
+		t.Error("lead session accepted as spectator token")
+	}
+	if _, err := verifyLeadSession(signSpectatorToken("", time.Now().Add(time.Hour)), ""); err == nil {
+		t.Error("spectator token accepted as lead session")
+	}
+}
+
+// routeGuards maps each /api/ route registered in main.go to the function its handler
+// is wrapped in, e.g. "requireLead", or "" for routes anyone can call.
+func routeGuards(t *testing.T) map[string]string {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), "main.go", nil, 0)
+	if err != nil {
+		t.Fatalf("parsing main.go: %v", err)
+	}
+	guards := make(map[string]string)
+	ast.Inspect(file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) != 2 {
+			return true
+		}
+		if sel, ok := call.Fun.(*ast.SelectorExpr); !ok || sel.Sel.Name != "HandleFunc" {
+			return true
+		}
+		lit, ok := call.Args[0].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		pattern, _ := strconv.Unquote(lit.Value)
+		guards[pattern] = ""
+		if wrapped, ok := call.Args[1].(*ast.CallExpr); ok {
+			if ident, ok := wrapped.Fun.(*ast.Ident); ok {
+				guards[pattern] = ident.Name
+			}
+		}
+		return true
+	})
+	return guards
+}
+
+func TestPrivateRoutesRequireAuth(t *testing.T) {
+	guards := routeGuards(t)
+	for route, want := range map[string]string{
+		"/api/locations":            "requireLeadOrSpectator",
+		"/api/locations/bbox":       "requireLeadOrSpectator",
+		"/api/locations/near":       "requireLeadOrSpectator",
+		"/api/locations/clusters":   "requireLeadOrSpectator",
+		"/api/targets":              "requireLeadOrSpectator",
+		"/api/contact":              "requireLead",
+		"/api/presence":             "requireLead",
+		"/api/test-results/summary": "requireLead",
+	} {
+		if got, ok := guards[route]; !ok || got != want {
+			t.Errorf("%s: wrapped in %q (registered %v), want %s", route, got, ok, want)
+		}
+	}
+}
+
+// spectatorMux serves the real DM handler next to stubs for the read-only routes.
+func spectatorMux() http.Handler {
+	mux := http.NewServeMux()
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	mux.HandleFunc("/api/locations", requireLeadOrSpectator(ok))
+	mux.HandleFunc("/api/targets", requireLeadOrSpectator(ok))
+	mux.HandleFunc("/api/locations/bbox", requireLeadOrSpectator(handleGetLocationsInBox))
+	mux.HandleFunc("/api/locations/near", requireLeadOrSpectator(handleGetNearbyPlayers))
+	mux.HandleFunc("/api/locations/clusters", requireLeadOrSpectator(handleGetLocationClusters))
+	mux.HandleFunc("/api/dm/", requireLead(handleSendDirectMessage))
+	return spectatorMiddleware(mux)
+}
+
+func TestSpectatorMiddleware(t *testing.T) {
+	withLeadSessionKey(t)
+	handler := spectatorMux()
+	token := signSpectatorToken("", time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		bearer   string
+		lead     bool
+		wantCode int
+	}{
+		{"reads locations", http.MethodGet, "/api/locations?spectator=" + token, "", false, http.StatusOK},
+		{"reads targets with a bearer token", http.MethodGet, "/api/targets", token, false, http.StatusOK},
+		{"sends a DM", http.MethodPost, "/api/dm/" + obfuscatePlayerID("p1") + "?spectator=" + token, "", false, http.StatusForbidden},
+		{"writes locations", http.MethodPost, "/api/locations?spectator=" + token, "", false, http.StatusForbidden},
+		{"forged token", http.MethodGet, "/api/locations?spectator=forged", "", false, http.StatusUnauthorized},
+		{"expired token", http.MethodGet, "/api/locations", signSpectatorToken("", time.Now().Add(-time.Minute)), false, http.StatusUnauthorized},
+		{"no token", http.MethodGet, "/api/locations", "", false, http.StatusUnauthorized},
+		{"no token for targets", http.MethodGet, "/api/targets", "", false, http.StatusUnauthorized},
+		{"no token for a box", http.MethodGet, "/api/locations/bbox?minLat=-90&minLng=-180&maxLat=90&maxLng=180", "", false, http.StatusUnauthorized},
+		{"no token near a point", http.MethodGet, "/api/locations/near?lat=51&lng=3.7&radius=1000", "", false, http.StatusUnauthorized},
+		{"no token for clusters", http.MethodGet, "/api/locations/clusters", "", false, http.StatusUnauthorized},
+		{"box with a bad token", http.MethodGet, "/api/locations/bbox?minLat=-90&minLng=-180&maxLat=90&maxLng=180&spectator=forged", "", false, http.StatusUnauthorized},
+		{"lead cookie", http.MethodGet, "/api/targets", "", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(`{"message":"hi"}`))
+		if tt.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.bearer)
+		}
+		if tt.lead {
+			req.AddCookie(&http.Cookie{Name: leadSessionCookie, Value: signLeadSession("ann", "", time.Now().Add(time.Hour))})
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: got %d, want %d", tt.name, rec.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestSpectatorDeniedDMEvenWithLeadCookie(t *testing.T) {
+	withLeadSessionKey(t)
+	req := httptest.NewRequest(http.MethodPost, "/api/dm/"+obfuscatePlayerID("p1"), strings.NewReader(`{"message":"hi"}`))
+	req.Header.Set("Authorization", "Bearer "+signSpectatorToken("", time.Now().Add(time.Hour)))
+	req.AddCookie(&http.Cookie{Name: leadSessionCookie, Value: signLeadSession("ann", "", time.Now().Add(time.Hour))})
+	rec := httptest.NewRecorder()
+	spectatorMux().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestSpectatorReadsLocations(t *testing.T) {
+	requireEmulator(t, "PlayerLocation")
+	withLeadSessionKey(t)
+	putEntity(t, datastore.NameKey("PlayerLocation", "alice", nil), &PlayerLocation{Lat: 51, Lng: 4, Status: "OK", Timestamp: time.Now()})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/locations", requireLeadOrSpectator(handleGetLocations))
+	rec := httptest.NewRecorder()
+	spectatorMiddleware(mux).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/locations?spectator="+signSpectatorToken("", time.Now().Add(time.Hour)), nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"alice"`) {
+		t.Errorf("got %d %q, want alice's location", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCreateSpectatorToken(t *testing.T) {
+	withLeadSessionKey(t)
+	for _, q := range []string{"?ttlMinutes=0", "?ttlMinutes=abc", "?ttlMinutes=" + strconv.Itoa(maxSpectatorTokenMinutes+1)} {
+		rec := httptest.NewRecorder()
+		handleCreateSpectatorToken(rec, httptest.NewRequest(http.MethodPost, "/api/admin/spectator-token"+q, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got %d, want %d", q, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleCreateSpectatorToken(rec, httptest.NewRequest(http.MethodPost, "/api/admin/spectator-token?ttlMinutes=30", nil))
+	var resp struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if err := verifySpectatorToken(resp.Token, ""); err != nil {
+		t.Errorf("minted token rejected: %v", err)
+	}
+	if d := time.Until(resp.ExpiresAt); d < 29*time.Minute || d > 30*time.Minute {
+		t.Errorf("token expires in %v, want ~30m", d)
+	}
+}
+
+func TestTargetReleased(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name   string
+		target TargetLocation
+		want   bool
+	}{
+		{"released", TargetLocation{IsReleased: true}, true},
+		{"unreleased", TargetLocation{}, false},
+		{"scheduled", TargetLocation{ReleaseAt: now.Add(time.Minute)}, false},
+		{"schedule passed", TargetLocation{ReleaseAt: now.Add(-time.Minute)}, true},
+	} {
+		if got := tc.target.released(now); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBatchSetTargetsRejectsBadBody(t *testing.T) {
+	for _, body := range []string{"", "{}", "[]", `[{"playerID": 1}]`} {
+		rec := httptest.NewRecorder()
+		handleBatchSetTargets(rec, httptest.NewRequest(http.MethodPost, "/api/targets/batch", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestBatchSetTargets(t *testing.T) {
+	requireEmulator(t, "TargetLocation")
+	releaseAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	body := `[
+		{"playerID": "` + obfuscatePlayerID("alice") + `", "lat": 51.05, "lng": 3.72},
+		{"playerID": "` + obfuscatePlayerID("bob") + `", "lat": 51.06, "lng": 3.73, "releaseAt": "` + releaseAt + `"},
+		{"playerID": "not-a-player", "lat": 51, "lng": 3},
+		{"playerID": "` + obfuscatePlayerID("carol") + `", "lat": 91, "lng": 3},
+		{"playerID": "` + obfuscatePlayerID("alice") + `", "lat": 51, "lng": 3}
+	]`
+	rec := httptest.NewRecorder()
+	handleBatchSetTargets(rec, httptest.NewRequest(http.MethodPost, "/api/targets/batch", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Results []BatchTargetResult `json:"results"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	var oks []bool
+	for _, res := range resp.Results {
+		oks = append(oks, res.OK)
+	}
+	if fmt.Sprint(oks) != "[true true false false false]" {
+		t.Fatalf("results: %+v", resp.Results)
+	}
+
+	ctx := context.Background()
+	var alice, bob TargetLocation
+	if err := dsClient.Get(ctx, datastore.NameKey("TargetLocation", "alice", nil), &alice); err != nil {
+		t.Fatalf("getting alice's target: %v", err)
+	}
+	if alice.Lat != 51.05 || !alice.IsReleased || alice.FakeHash == "" {
+		t.Errorf("alice's target: %+v", alice)
+	}
+	if err := dsClient.Get(ctx, datastore.NameKey("TargetLocation", "bob", nil), &bob); err != nil {
+		t.Fatalf("getting bob's target: %v", err)
+	}
+	if bob.IsReleased || bob.ReleaseAt.IsZero() || bob.released(time.Now()) {
+		t.Errorf("bob's target should be scheduled: %+v", bob)
+	}
+	if n := countEntities(t, "TargetLocation"); n != 2 {
+		t.Errorf("got %d targets, want 2", n)
+	}
+}
+
+func TestReleaseScheduledTargets(t *testing.T) {
+	requireEmulator(t, "TargetLocation")
+	ctx := context.Background()
+	now := time.Now().UTC()
+	putEntity(t, datastore.NameKey("TargetLocation", "alice", nil), &TargetLocation{Lat: 51.05, Lng: 3.72, ReleaseAt: now.Add(-time.Minute)})
+	putEntity(t, datastore.NameKey("TargetLocation", "bob", nil), &TargetLocation{Lat: 51.06, Lng: 3.73, ReleaseAt: now.Add(time.Hour)})
+	putEntity(t, datastore.NameKey("TargetLocation", "carol", nil), &TargetLocation{Lat: 51.07, Lng: 3.74, ReleaseAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)})
+	putEntity(t, datastore.NameKey("TargetLocation", "dave", nil), &TargetLocation{Lat: 51.08, Lng: 3.75})
+	for len(webhookQueue) > 0 {
+		<-webhookQueue
+	}
+
+	released, err := releaseScheduledTargets(ctx, now)
+	if err != nil {
+		t.Fatalf("releasing: %v", err)
+	}
+	if released != 1 || len(webhookQueue) != 1 {
+		t.Fatalf("got %d released and %d events, want 1 and 1", released, len(webhookQueue))
+	}
+	ev := <-webhookQueue
+	if data, _ := ev.Data.(map[string]interface{}); ev.Event != webhookEventTargetReleased || data["playerID"] != "alice" {
+		t.Errorf("event: got %+v", ev)
+	}
+	var alice, dave TargetLocation
+	if err := dsClient.Get(ctx, datastore.NameKey("TargetLocation", "alice", nil), &alice); err != nil || !alice.IsReleased {
+		t.Errorf("alice's target: got %+v, %v, want released", alice, err)
+	}
+	if err := dsClient.Get(ctx, datastore.NameKey("TargetLocation", "dave", nil), &dave); err != nil || dave.IsReleased {
+		t.Errorf("dave's unscheduled target: got %+v, %v, want it left alone", dave, err)
+	}
+
+	// The event is sent once per target.
+	if released, err := releaseScheduledTargets(ctx, now); err != nil || released != 0 || len(webhookQueue) != 0 {
+		t.Errorf("second run: got %d released, %v, %d events, want nothing", released, err, len(webhookQueue))
+	}
+}
+
+func TestHandlersRejectBadPlayerIDs(t *testing.T) {
+	for _, tc := range []struct {
+		handler     http.HandlerFunc
+		method, url string
+		body        string
+	}{
+		{handleMarkDirectMessageRead, http.MethodPost, "/api/dm/read/garbage/5", ""},
+		{handleMarkDirectMessageRead, http.MethodPost, "/api/dm/read/5", ""},
+		{handleChatCursor, http.MethodGet, "/api/chat/garbage/cursor", ""},
+		{handleChatBatch, http.MethodPost, "/api/chat/batch", `{"obfuscatedIDs": ["garbage"]}`},
+		{handlePlayerState, http.MethodGet, "/api/player//state", ""},
+		{handleRecallTarget, http.MethodPost, "/api/target/garbage/recall", ""},
+		{handleRotateTargetHash, http.MethodPost, "/api/target/garbage/rotate-hash", ""},
+		{handleTargetChain, http.MethodGet, "/api/targets/chain/garbage", ""},
+		{handleNotificationPrefs, http.MethodGet, "/api/prefs/garbage", ""},
+		{handleGetArchivedMessages, http.MethodGet, "/api/messages/archived?playerID=garbage", ""},
+		{handlePlayerQRCode, http.MethodGet, "/api/qr/garbage", ""},
+	} {
+		rec := httptest.NewRecorder()
+		tc.handler(rec, httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body)))
+		if rec.Code != http.StatusBadRequest || !strings.HasPrefix(rec.Body.String(), invalidPlayerIDMessage) {
+			t.Errorf("%s %s: got %d %q, want %d %q", tc.method, tc.url, rec.Code, rec.Body.String(), http.StatusBadRequest, invalidPlayerIDMessage)
+		}
+	}
+}
+
+func TestRecallTargetRejectsBadRequests(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleSetTargetLocation(rec, httptest.NewRequest(http.MethodGet, "/api/target/"+obfuscatePlayerID("p1")+"/recall", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	rec = httptest.NewRecorder()
+	handleSetTargetLocation(rec, httptest.NewRequest(http.MethodPost, "/api/target/garbage/recall", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("bad player ID: got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+// playerSeesTarget reports whether the player's status poll includes a target.
+func playerSeesTarget(t *testing.T, playerID string) bool {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handlePlayerMessages(rec, httptest.NewRequest(http.MethodGet, "/api/messages/"+obfuscatePlayerID(playerID), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("player poll: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp map[string]json.RawMessage
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding player poll: %v", err)
+	}
+	_, ok := resp["target"]
+	return ok
+}
+
+func TestRecallTarget(t *testing.T) {
+	requireEmulator(t, "TargetLocation", "PlayerMessage", "DirectMessage")
+	targetURL := "/api/target/" + obfuscatePlayerID("alice")
+
+	rec := httptest.NewRecorder()
+	handleSetTargetLocation(rec, httptest.NewRequest(http.MethodPost, targetURL+"/recall", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("recall without a target: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	rec = httptest.NewRecorder()
+	handleSetTargetLocation(rec, httptest.NewRequest(http.MethodPost, targetURL, strings.NewReader(`{"lat": 51.05, "lng": 3.72}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("release: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !playerSeesTarget(t, "alice") {
+		t.Fatal("player doesn't see the released target")
+	}
+
+	rec = httptest.NewRecorder()
+	handleSetTargetLocation(rec, httptest.NewRequest(http.MethodPost, targetURL+"/recall", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("recall: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if playerSeesTarget(t, "alice") {
+		t.Error("player still sees the recalled target")
+	}
+}
+
+// withFakeHashMode switches how fake hashes are derived for the duration of a test.
+func withFakeHashMode(t *testing.T, mode string) {
+	t.Helper()
+	fakeHashMode = mode
+	t.Cleanup(func() { fakeHashMode = fakeHashTimestamped })
+}
+
+func TestTargetFakeHashTimestamped(t *testing.T) {
+	now := time.Now()
+	first := targetFakeHash(51.05, 3.72, now)
+	if len(first) != 8 || strings.ToUpper(first) != first {
+		t.Errorf("hash %q isn't 8 uppercase hex digits", first)
+	}
+	if again := targetFakeHash(51.05, 3.72, now); again != first {
+		t.Errorf("same coordinates and time: got %q and %q", first, again)
+	}
+	if later := targetFakeHash(51.05, 3.72, now.Add(time.Nanosecond)); later == first {
+		t.Errorf("setting the same target later kept hash %q", first)
+	}
+}
+
+func TestTargetFakeHashDeterministic(t *testing.T) {
+	withFakeHashMode(t, fakeHashDeterministic)
+	now := time.Now()
+	first := targetFakeHash(51.05, 3.72, now)
+	if later := targetFakeHash(51.05, 3.72, now.Add(time.Hour)); later != first {
+		t.Errorf("same coordinates later: got %q, want %q", later, first)
+	}
+	if other := targetFakeHash(51.06, 3.72, now); other == first {
+		t.Errorf("other coordinates got the same hash %q", first)
+	}
+
+	// Rotating would give the same hash again, so it's refused before touching datastore.
+	rec := httptest.NewRecorder()
+	handleSetTargetLocation(rec, httptest.NewRequest(http.MethodPost, "/api/target/"+obfuscatePlayerID("alice")+"/rotate-hash", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("rotate: got %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestTargetFakeHashPrecision(t *testing.T) {
+	withFakeHashMode(t, fakeHashDeterministic)
+	// The default keeps the hash input of earlier releases.
+	if got, want := targetFakeHash(51.05, 3.72, time.Time{}), targetFakeHash(51.0500004, 3.72, time.Time{}); got != want {
+		t.Errorf("default precision: %q and %q differ beyond the 6th decimal", got, want)
+	}
+
+	fakeHashPrecision = 4
+	t.Cleanup(func() { fakeHashPrecision = defaultFakeHashPrecision })
+	base := targetFakeHash(51.05001, 3.72, time.Time{})
+	if beyond := targetFakeHash(51.05004, 3.72, time.Time{}); beyond != base {
+		t.Errorf("coordinates differing beyond the precision: got %q and %q", base, beyond)
+	}
+	if within := targetFakeHash(51.0501, 3.72, time.Time{}); within == base {
+		t.Errorf("coordinates differing within the precision share hash %q", base)
+	}
+	if within := targetFakeHash(51.05001, 3.7201, time.Time{}); within == base {
+		t.Errorf("longitudes differing within the precision share hash %q", base)
+	}
+}
+
+func TestSetAndLoadTargetsHashAlike(t *testing.T) {
+	requireEmulator(t, "TargetLocation", "GameState")
+	withFakeHashMode(t, fakeHashDeterministic)
+
+	rec := httptest.NewRecorder()
+	handleSetTargetLocation(rec, httptest.NewRequest(http.MethodPost, "/api/target/"+obfuscatePlayerID("alice"), strings.NewReader(`{"lat": 51.05, "lng": 3.72}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("set target: got %d: %s", rec.Code, rec.Body.String())
+	}
+	withInitialTargetsFile(t, `[{"playerName": "bob", "target": {"lat": 51.05, "lng": 3.72}}]`)
+	rec = httptest.NewRecorder()
+	handleLoadInitialTargets(rec, httptest.NewRequest(http.MethodPost, "/api/admin/load-initial-targets", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("load initial targets: got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var alice, bob TargetLocation
+	if err := dsClient.Get(context.Background(), datastore.NameKey("TargetLocation", "alice", nil), &alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := dsClient.Get(context.Background(), datastore.NameKey("TargetLocation", "bob", nil), &bob); err != nil {
+		t.Fatal(err)
+	}
+	if alice.FakeHash != bob.FakeHash {
+		t.Errorf("same coordinates hashed %q when set and %q when loaded", alice.FakeHash, bob.FakeHash)
+	}
+}
+
+func TestRotateTargetHash(t *testing.T) {
+	requireEmulator(t, "TargetLocation")
+	targetURL := "/api/target/" + obfuscatePlayerID("alice")
+
+	rec := httptest.NewRecorder()
+	handleSetTargetLocation(rec, httptest.NewRequest(http.MethodPost, targetURL+"/rotate-hash", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("rotate without a target: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	original := TargetLocation{Lat: 51.05, Lng: 3.72, Timestamp: time.Now(), FakeHash: "ABCD1234", IsReleased: true}
+	key := putEntity(t, datastore.NameKey("TargetLocation", "alice", nil), &original)
+
+	rec = httptest.NewRecorder()
+	handleSetTargetLocation(rec, httptest.NewRequest(http.MethodPost, targetURL+"/rotate-hash", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rotate: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		FakeHash string `json:"fakeHash"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+
+	var stored TargetLocation
+	if err := dsClient.Get(context.Background(), key, &stored); err != nil {
+		t.Fatalf("getting target: %v", err)
+	}
+	if stored.FakeHash == original.FakeHash || stored.FakeHash != resp.FakeHash {
+		t.Errorf("hash: stored %q, returned %q, was %q", stored.FakeHash, resp.FakeHash, original.FakeHash)
+	}
+	if stored.Lat != original.Lat || stored.Lng != original.Lng || !stored.IsReleased {
+		t.Errorf("target changed beyond its hash: %+v", stored)
+	}
+}
+
+func postVerifyTargetHash(body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handleVerifyTargetHash(rec, httptest.NewRequest(http.MethodPost, "/api/target/verify", strings.NewReader(body)))
+	return rec
+}
+
+func TestVerifyTargetHashRejectsBadRequests(t *testing.T) {
+	for _, body := range []string{``, `{}`, `{"hash": "  "}`, `{"hash": 1234}`, `{"hash": "ABCD1234", "player": "alice"}`} {
+		if rec := postVerifyTargetHash(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestVerifyTargetHash(t *testing.T) {
+	requireEmulator(t, "TargetLocation", "GameState")
+	withFakeHashMode(t, fakeHashDeterministic)
+	rec := httptest.NewRecorder()
+	handleSetTargetLocation(rec, httptest.NewRequest(http.MethodPost, "/api/target/"+obfuscatePlayerID("alice"), strings.NewReader(`{"lat": 51.05, "lng": 3.72}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("set target: got %d: %s", rec.Code, rec.Body.String())
+	}
+	hash := targetFakeHash(51.05, 3.72, time.Time{})
+
+	rec = postVerifyTargetHash(`{"hash": "` + strings.ToLower(hash) + `"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("verify: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var match TargetHashMatch
+	if err := json.NewDecoder(rec.Body).Decode(&match); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if match.PlayerID != "alice" || match.Lat != 51.05 || match.Lng != 3.72 || !match.IsReleased || len(match.SharedWith) != 0 {
+		t.Errorf("got %+v, want alice's released target at 51.05,3.72", match)
+	}
+
+	// Same coordinates, same hash in deterministic mode. An expired target doesn't count.
+	putEntity(t, datastore.NameKey("TargetLocation", "bob", nil), &TargetLocation{Lat: 51.05, Lng: 3.72, FakeHash: hash, Timestamp: time.Now()})
+	putEntity(t, datastore.NameKey("TargetLocation", "carol", nil), &TargetLocation{Lat: 51.05, Lng: 3.72, FakeHash: hash, Timestamp: time.Now(), ExpiresAt: time.Now().Add(-time.Minute)})
+	rec = postVerifyTargetHash(`{"hash": "` + hash + `"}`)
+	match = TargetHashMatch{}
+	if err := json.NewDecoder(rec.Body).Decode(&match); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if match.PlayerID != "alice" || !reflect.DeepEqual(match.SharedWith, []string{"bob"}) {
+		t.Errorf("got %+v, want alice's target shared with bob", match)
+	}
+
+	if rec := postVerifyTargetHash(`{"hash": "00000000"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown hash: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestValidateTargetCoordinates(t *testing.T) {
+	for _, tc := range []struct {
+		lat, lng float64
+		valid    bool
+	}{
+		{51.05, 3.72, true},
+		{90, 180, true},
+		{-90, -180, true},
+		{0, 3.72, true},
+		{51.05, 0, true},
+		{0, 0, false},
+		{90.0001, 3.72, false},
+		{-91, 3.72, false},
+		{51.05, 180.5, false},
+		{51.05, -181, false},
+	} {
+		if err := validateTargetCoordinates(tc.lat, tc.lng); (err == nil) != tc.valid {
+			t.Errorf("(%v,%v): got error %v, want valid=%v", tc.lat, tc.lng, err, tc.valid)
+		}
+	}
+}
+
+func TestTargetReachedAtUsesItsOwnRadius(t *testing.T) {
+	// The player is about 56m north of each target.
+	playerLat, playerLng := 51.0005, 3.9
+	for _, tc := range []struct {
+		radius float64
+		want   bool
+	}{
+		{0, false}, // The global 25m
+		{100, true},
+		{50, false},
+		{60, true},
+	} {
+		target := TargetLocation{Lat: 51.0, Lng: 3.9, ArrivalRadiusMeters: tc.radius}
+		if got := target.reachedAt(playerLat, playerLng); got != tc.want {
+			t.Errorf("radius %v: got %v, want %v", tc.radius, got, tc.want)
+		}
+	}
+
+	// A tighter radius than the global one counts as well.
+	target := TargetLocation{Lat: 51.0, Lng: 3.9, ArrivalRadiusMeters: 10}
+	if target.reachedAt(51.0002, 3.9) {
+		t.Error("reached a 10m target from 22m away")
+	}
+	if target.ArrivalRadiusMeters = 0; !target.reachedAt(51.0002, 3.9) {
+		t.Error("missed a 25m target from 22m away")
+	}
+}
+
+func TestArrivalUsesPerTargetRadius(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory", "TargetLocation", "GameStats")
+	for _, player := range []string{"near", "far"} {
+		body := `{"lat": 51.0, "lng": 3.9}`
+		if player == "near" {
+			body = `{"lat": 51.0, "lng": 3.9, "arrivalRadiusMeters": 100}`
+		}
+		rec := httptest.NewRecorder()
+		handleSetTargetLocation(rec, httptest.NewRequest(http.MethodPost, "/api/target/"+obfuscatePlayerID(player), strings.NewReader(body)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("setting %s's target: got %d: %s", player, rec.Code, rec.Body.String())
+		}
+
+		// Both players report from 56m away.
+		rec = httptest.NewRecorder()
+		handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID(player), strings.NewReader(`{"lat":51.0005,"lng":3.9,"status":"OK"}`)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("updating %s: got %d", player, rec.Code)
+		}
+	}
+
+	for player, wantArrived := range map[string]bool{"near": true, "far": false} {
+		var target TargetLocation
+		if err := dsClient.Get(context.Background(), datastore.NameKey("TargetLocation", player, nil), &target); err != nil {
+			t.Fatalf("getting %s's target: %v", player, err)
+		}
+		if arrived := !target.ArrivedAt.IsZero(); arrived != wantArrived {
+			t.Errorf("%s: arrived = %v, want %v", player, arrived, wantArrived)
+		}
+	}
+}
+
+func TestSetTargetLocationRejectsBadCoordinates(t *testing.T) {
+	for _, body := range []string{
+		`{"lat": 0, "lng": 0}`, `{}`, `{"lat": 95, "lng": 3.72}`, `{"lat": 51, "lng": -190}`,
+		`{"lat": 51, "lng": 3.72, "arrivalRadiusMeters": -1}`, `{"lat": 51, "lng": 3.72, "arrivalRadiusMeters": 5001}`,
+	} {
+		rec := httptest.NewRecorder()
+		handleSetTargetLocation(rec, httptest.NewRequest(http.MethodPost, "/api/target/"+obfuscatePlayerID("p1"), strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleSetTargetLocation(rec, httptest.NewRequest(http.MethodPost, "/api/target/"+obfuscatePlayerID("p1"), strings.NewReader(`{"lat": 0, "lng": 0}`)))
+	if !strings.Contains(rec.Body.String(), "(0,0)") {
+		t.Errorf("error %q doesn't explain the (0,0) rejection", rec.Body.String())
+	}
+}
+
+func TestLoadTargetsRejectsBadBody(t *testing.T) {
+	for _, body := range []string{"", "{}", "[]", `[{"playerName": 5}]`} {
+		rec := httptest.NewRecorder()
+		handleLoadTargets(rec, httptest.NewRequest(http.MethodPost, "/api/admin/load-targets", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestLoadTargetsFromBody(t *testing.T) {
+	requireEmulator(t, "TargetLocation")
+	body := `[
+		{"playerName": "alice", "target": {"lat": 51.05, "lng": 3.72}},
+		{"playerName": "bob", "target": {"lat": 51.06, "lng": 3.73}},
+		{"playerName": "", "target": {"lat": 51.07, "lng": 3.74}},
+		{"playerName": "carol", "target": {"lat": 0, "lng": 0}}
+	]`
+	rec := httptest.NewRecorder()
+	handleLoadTargets(rec, httptest.NewRequest(http.MethodPost, "/api/admin/load-targets", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp rosterLoadResult
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if resp.Loaded != 2 || len(resp.Invalid) != 2 {
+		t.Errorf("got %+v, want 2 loaded and 2 invalid", resp)
+	}
+
+	var alice TargetLocation
+	if err := dsClient.Get(context.Background(), datastore.NameKey("TargetLocation", "alice", nil), &alice); err != nil {
+		t.Fatalf("getting alice's target: %v", err)
+	}
+	if alice.Lat != 51.05 || !alice.IsReleased || alice.FakeHash == "" {
+		t.Errorf("alice's target: %+v", alice)
+	}
+	if n := countEntities(t, "TargetLocation"); n != 2 {
+		t.Errorf("got %d targets, want 2", n)
+	}
+}
+
+func TestLoadTargetsSkipExisting(t *testing.T) {
+	requireEmulator(t, "TargetLocation")
+	custom := TargetLocation{Lat: 51.1, Lng: 3.8, Timestamp: time.Now(), FakeHash: "CUSTOM01", IsReleased: true}
+	key := putEntity(t, datastore.NameKey("TargetLocation", "alice", nil), &custom)
+
+	body := `[
+		{"playerName": "alice", "target": {"lat": 51.05, "lng": 3.72}},
+		{"playerName": "bob", "target": {"lat": 51.06, "lng": 3.73}}
+	]`
+	rec := httptest.NewRecorder()
+	handleLoadTargets(rec, httptest.NewRequest(http.MethodPost, "/api/admin/load-targets?skipExisting=true", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp rosterLoadResult
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if resp.Loaded != 1 || resp.Skipped != 1 {
+		t.Errorf("got %+v, want 1 loaded and 1 skipped", resp)
+	}
+
+	var alice TargetLocation
+	if err := dsClient.Get(context.Background(), key, &alice); err != nil {
+		t.Fatalf("getting alice's target: %v", err)
+	}
+	if alice.FakeHash != "CUSTOM01" || alice.Lat != 51.1 {
+		t.Errorf("custom target was overwritten: %+v", alice)
+	}
+	if n := countEntities(t, "TargetLocation"); n != 2 {
+		t.Errorf("got %d targets, want 2", n)
+	}
+
+	// Without the option, the roster wins.
+	rec = httptest.NewRecorder()
+	handleLoadTargets(rec, httptest.NewRequest(http.MethodPost, "/api/admin/load-targets", strings.NewReader(body)))
+	if err := dsClient.Get(context.Background(), key, &alice); err != nil {
+		t.Fatalf("getting alice's target: %v", err)
+	}
+	if alice.FakeHash == "CUSTOM01" {
+		t.Error("roster didn't overwrite the target without skipExisting")
+	}
+}
+
+// withMaxRosterEntries lowers the roster limit for the duration of a test.
+func withMaxRosterEntries(t *testing.T, n int) {
+	t.Helper()
+	prev := maxRosterEntries
+	maxRosterEntries = n
+	t.Cleanup(func() { maxRosterEntries = prev })
+}
+
+// withInitialTargetsFile points handleLoadInitialTargets at a temporary roster file.
+func withInitialTargetsFile(t *testing.T, contents string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "initial_targets.json")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("writing roster: %v", err)
+	}
+	prev := initialTargetsFile
+	initialTargetsFile = path
+	t.Cleanup(func() { initialTargetsFile = prev })
+}
+
+func TestLoadTargetsRejectsOversizedRoster(t *testing.T) {
+	withMaxRosterEntries(t, 2)
+	roster := `[
+		{"playerName": "alice", "target": {"lat": 51.05, "lng": 3.72}},
+		{"playerName": "bob", "target": {"lat": 51.06, "lng": 3.73}},
+		{"playerName": "carol", "target": {"lat": 51.07, "lng": 3.74}}
+	]`
+
+	rec := httptest.NewRecorder()
+	handleLoadTargets(rec, httptest.NewRequest(http.MethodPost, "/api/admin/load-targets", strings.NewReader(roster)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload: got %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	withInitialTargetsFile(t, roster)
+	rec = httptest.NewRecorder()
+	handleLoadInitialTargets(rec, httptest.NewRequest(http.MethodPost, "/api/admin/load-initial-targets", nil))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("file: got %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestLoadTargetsRejectsBadGzip(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/load-targets", strings.NewReader("[]"))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	gunzipMiddleware(http.HandlerFunc(handleLoadTargets)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestLoadTargetsFromGzipBody(t *testing.T) {
+	requireEmulator(t, "TargetLocation")
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write([]byte(`[{"playerName": "alice", "target": {"lat": 51.05, "lng": 3.72}}]`))
+	gz.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/load-targets", &body)
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	gunzipMiddleware(http.HandlerFunc(handleLoadTargets)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	if n := countEntities(t, "TargetLocation"); n != 1 {
+		t.Errorf("got %d targets, want 1", n)
+	}
+}
+
+func TestLoadInitialTargetsReportsInvalidEntries(t *testing.T) {
+	requireEmulator(t, "TargetLocation")
+	withInitialTargetsFile(t, `[
+		{"playerName": "alice", "target": {"lat": 51.05, "lng": 3.72}},
+		{"playerName": " ", "target": {"lat": 51.06, "lng": 3.73}},
+		{"playerName": "bob", "target": {"lat": 91, "lng": 3.73}},
+		{"playerName": "carol", "target": {"lat": 51.07, "lng": 3.74}}
+	]`)
+
+	rec := httptest.NewRecorder()
+	handleLoadInitialTargets(rec, httptest.NewRequest(http.MethodPost, "/api/admin/load-initial-targets", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Loaded  int      `json:"loaded"`
+		Invalid int      `json:"invalid"`
+		Errors  []string `json:"errors"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if resp.Loaded != 2 || resp.Invalid != 2 || len(resp.Errors) != 2 {
+		t.Fatalf("got %+v, want 2 loaded and 2 errors", resp)
+	}
+	if !strings.HasPrefix(resp.Errors[0], "entry 1:") || !strings.HasPrefix(resp.Errors[1], "entry 2 (bob):") {
+		t.Errorf("errors %q don't name the invalid entries", resp.Errors)
+	}
+	if n := countEntities(t, "TargetLocation"); n != 2 {
+		t.Errorf("got %d targets, want 2", n)
+	}
+}
+
+func TestPlayerQRCode(t *testing.T) {
+	obfuscatedID := obfuscatePlayerID("alice")
+	for _, url := range []string{"/api/qr/" + obfuscatedID + "?size=300", "/api/qr/?player=alice&size=300"} {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Host = "droppydrop.example.com"
+		rec := httptest.NewRecorder()
+		handlePlayerQRCode(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: got %d: %s", url, rec.Code, rec.Body.String())
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+			t.Errorf("%s: Content-Type = %q", url, ct)
+		}
+
+		img, err := png.Decode(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: response is not a PNG: %v", url, err)
+		}
+		if b := img.Bounds(); b.Dx() != 300 || b.Dy() != 300 {
+			t.Errorf("%s: image is %dx%d, want 300x300", url, b.Dx(), b.Dy())
+		}
+
+		// The encoder is deterministic, so matching bytes means matching content.
+		want, err := qrcode.Encode("https://droppydrop.example.com/player/"+obfuscatedID, qrcode.Medium, 300)
+		if err != nil {
+			t.Fatalf("encoding expected QR code: %v", err)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), want) {
+			t.Errorf("%s: QR code doesn't encode the player URL", url)
+		}
+	}
+}
+
+func TestPlayerQRCodeRejectsBadParams(t *testing.T) {
+	for _, url := range []string{
+		"/api/qr/", "/api/qr/not*base64", "/api/qr/?player=%20", "/api/qr/?player=a%07b",
+		"/api/qr/?player=" + strings.Repeat("x", maxPlayerIDLength+1),
+		"/api/qr/" + obfuscatePlayerID("alice") + "?size=10", "/api/qr/" + obfuscatePlayerID("alice") + "?size=big",
+	} {
+		rec := httptest.NewRecorder()
+		handlePlayerQRCode(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", url, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestObfuscateURLBatch(t *testing.T) {
+	players := []string{"alice", "bob", "Chloé D."}
+	body, _ := json.Marshal(map[string][]string{"playerIDs": players})
+	req := httptest.NewRequest(http.MethodPost, "/api/obfuscate-url/batch", bytes.NewReader(body))
+	req.Host = "droppydrop.example.com"
+	rec := httptest.NewRecorder()
+	handleObfuscateURLBatch(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var urls []ObfuscatedURLResponse
+	if err := json.NewDecoder(rec.Body).Decode(&urls); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(urls) != len(players) {
+		t.Fatalf("got %d URLs, want %d", len(urls), len(players))
+	}
+	for i, u := range urls {
+		obfuscatedID, ok := strings.CutPrefix(u.ObfuscatedURL, "https://droppydrop.example.com/player/")
+		if !ok {
+			t.Errorf("%s: unexpected URL %q", players[i], u.ObfuscatedURL)
+			continue
+		}
+		if got, err := deobfuscatePlayerID(obfuscatedID); err != nil || got != players[i] || u.PlayerID != players[i] {
+			t.Errorf("URL %d deobfuscates to %q (%v), want %q", i, got, err, players[i])
+		}
+	}
+}
+
+func TestObfuscateURLBatchRejectsBadBody(t *testing.T) {
+	for _, body := range []string{"", "[]", `{}`, `{"playerIDs": []}`, `{"playerIDs": ["alice", " "]}`} {
+		rec := httptest.NewRecorder()
+		handleObfuscateURLBatch(rec, httptest.NewRequest(http.MethodPost, "/api/obfuscate-url/batch", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func postObfuscateURL(t *testing.T, playerID string) int {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"playerID": playerID})
+	rec := httptest.NewRecorder()
+	handleObfuscateURL(rec, httptest.NewRequest(http.MethodPost, "/api/obfuscate-url", bytes.NewReader(body)))
+	return rec.Code
+}
+
+func TestObfuscateURLValidatesName(t *testing.T) {
+	tests := []struct {
+		name     string
+		playerID string
+		want     int
+	}{
+		{"valid", "Chloé D.", http.StatusOK},
+		{"longest", strings.Repeat("a", maxPlayerIDLength), http.StatusOK},
+		{"empty", "", http.StatusBadRequest},
+		{"blank", "   ", http.StatusBadRequest},
+		{"too long", strings.Repeat("a", maxPlayerIDLength+1), http.StatusBadRequest},
+		{"control chars", "alice\n", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if got := postObfuscateURL(t, tt.playerID); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	body := `{"playerIDs": ["alice", "` + strings.Repeat("a", maxPlayerIDLength+1) + `"]}`
+	rec := httptest.NewRecorder()
+	handleObfuscateURLBatch(rec, httptest.NewRequest(http.MethodPost, "/api/obfuscate-url/batch", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "playerIDs[1]") {
+		t.Errorf("batch with a too long name: got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestObfuscateURLAllowlist(t *testing.T) {
+	if got := parsePlayerAllowlist(" , "); got != nil {
+		t.Errorf("blank allowlist parsed as %v, want nil", got)
+	}
+	playerAllowlist = parsePlayerAllowlist("alice, bob ,")
+	t.Cleanup(func() { playerAllowlist = nil })
+
+	if got := postObfuscateURL(t, "bob"); got != http.StatusOK {
+		t.Errorf("listed player: got %d, want 200", got)
+	}
+	if got := postObfuscateURL(t, "mallory"); got != http.StatusBadRequest {
+		t.Errorf("unlisted player: got %d, want 400", got)
+	}
+	rec := httptest.NewRecorder()
+	handleObfuscateURLBatch(rec, httptest.NewRequest(http.MethodPost, "/api/obfuscate-url/batch", strings.NewReader(`{"playerIDs": ["alice", "mallory"]}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("batch with an unlisted player: got %d, want 400", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	handlePlayerQRCode(rec, httptest.NewRequest(http.MethodGet, "/api/qr/?player=mallory", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("QR code for an unlisted player: got %d, want 400", rec.Code)
+	}
+}
+
+func TestDeobfuscatePlayerIDVerifiesTag(t *testing.T) {
+	token := obfuscatePlayerID("alice")
+	if got, err := deobfuscatePlayerID(token); err != nil || got != "alice" {
+		t.Fatalf("valid token: got %q, %v", got, err)
+	}
+
+	decoded, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatalf("decoding token: %v", err)
+	}
+	truncated := base64.URLEncoding.EncodeToString(decoded[:len(decoded)-1])
+	flipped := append([]byte(nil), decoded...)
+	flipped[0] ^= 0x01
+
+	for name, bad := range map[string]string{
+		"truncated":        truncated,
+		"truncated string": token[:len(token)-4],
+		"bit-flipped":      base64.URLEncoding.EncodeToString(flipped),
+		"tag only":         base64.URLEncoding.EncodeToString(decoded[len(decoded)-idTagSize:]),
+		"untagged":         base64.URLEncoding.EncodeToString(decoded[:len(decoded)-idTagSize]),
+		"empty":            "",
+	} {
+		if got, err := deobfuscatePlayerID(bad); err == nil {
+			t.Errorf("%s token accepted as %q", name, got)
+		}
+	}
+}
+
+func TestLoadIDKeys(t *testing.T) {
+	if got := loadIDKeys(); !reflect.DeepEqual(got, []string{defaultIDKey}) {
+		t.Errorf("unset: got %q, want the built-in key", got)
+	}
+	t.Setenv("ID_KEY", "new-key")
+	t.Setenv("PREVIOUS_ID_KEYS", " old-key, ,older-key,new-key")
+	if got, want := loadIDKeys(), []string{"new-key", "old-key", "older-key"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPlayerIDTagNeedsTheMACKey(t *testing.T) {
+	// Anyone who knows a player's ID can recover the XOR key from their URL. A tag made
+	// with that key must not pass.
+	mac := hmac.New(sha256.New, []byte(idKeys[0]))
+	mac.Write([]byte("mallory"))
+	forged := base64.URLEncoding.EncodeToString(append(xorWithKey([]byte("mallory"), idKeys[0]), mac.Sum(nil)[:idTagSize]...))
+	if got, err := deobfuscatePlayerID(forged); err == nil {
+		t.Errorf("token tagged with the XOR key accepted as %q", got)
+	}
+
+	old := idMACKey
+	t.Cleanup(func() { idMACKey = old })
+	token := obfuscatePlayerID("alice")
+	idMACKey = "another-mac-key"
+	if got, err := deobfuscatePlayerID(token); err == nil {
+		t.Errorf("token signed with a different MAC key accepted as %q", got)
+	}
+}
+
+func TestPlayerIDsSurviveKeyRotation(t *testing.T) {
+	old := idKeys
+	t.Cleanup(func() { idKeys = old })
+	idKeys = []string{"old-key"}
+	oldToken := obfuscatePlayerID("alice")
+
+	// The old key is kept as a previous key, so its URLs still work.
+	idKeys = []string{"new-key", "old-key"}
+	newToken := obfuscatePlayerID("alice")
+	if newToken == oldToken {
+		t.Fatal("the new key made the same token as the old one")
+	}
+	for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+		if got, err := deobfuscatePlayerID(token); err != nil || got != "alice" {
+			t.Errorf("%s token: got %q, %v, want alice", name, got, err)
+		}
+	}
+
+	// Once the old key is dropped, its URLs stop working.
+	idKeys = []string{"new-key"}
+	if got, err := deobfuscatePlayerID(oldToken); err == nil {
+		t.Errorf("old token accepted as %q after dropping its key", got)
+	}
+}
+
+func TestTamperedPlayerIDRejectedBeforeWriting(t *testing.T) {
+	decoded, _ := base64.URLEncoding.DecodeString(obfuscatePlayerID("alice"))
+	decoded[0] ^= 0x01
+	tampered := base64.URLEncoding.EncodeToString(decoded)
+
+	// dsClient is unused on these paths, so a 400 here means nothing was written.
+	rec := httptest.NewRecorder()
+	handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+tampered, strings.NewReader(`{"lat": 51, "lng": 4, "status": "OK"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("location update: got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	rec = httptest.NewRecorder()
+	handlePlayerMessages(rec, httptest.NewRequest(http.MethodPost, "/api/messages/"+tampered, strings.NewReader(`{"message": "hi"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("player message: got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestResolvePlayerID(t *testing.T) {
+	for _, playerID := range []string{"alice", "Chloé D.", strings.Repeat("a", maxPlayerIDLength)} {
+		got, err := resolvePlayerID("/api/messages/"+obfuscatePlayerID(playerID)+"/", "/api/messages/")
+		if err != nil || got != playerID {
+			t.Errorf("%q: got %q, %v", playerID, got, err)
+		}
+	}
+
+	// These decode and carry a valid tag, but aren't player IDs anyone should have.
+	for name, garbage := range map[string]string{
+		"empty":         "",
+		"control chars": "\x00\x1b[2Jalice",
+		"invalid UTF-8": "\xff\xfe",
+		"too long":      strings.Repeat("a", maxPlayerIDLength+1),
+	} {
+		if got, err := resolvePlayerID("/api/messages/"+obfuscatePlayerID(garbage), "/api/messages/"); err == nil {
+			t.Errorf("%s: accepted as %q", name, got)
+		}
+	}
+	if _, err := resolvePlayerID("/api/chat/"+obfuscatePlayerID("alice"), "/api/messages/"); err == nil {
+		t.Error("path with another prefix accepted")
+	}
+}
+
+func TestResolvePlayerSubpath(t *testing.T) {
+	obfuscatedID := obfuscatePlayerID("alice")
+	if got, err := resolvePlayerSubpath("/api/messages/"+obfuscatedID+"/status", "/api/messages/", "/status"); err != nil || got != "alice" {
+		t.Errorf("got %q, %v, want alice", got, err)
+	}
+	for _, path := range []string{
+		"/api/messages/" + obfuscatedID + "/other",
+		"/api/chat/" + obfuscatedID + "/status",
+		"/api/messages/" + obfuscatePlayerID("\x00\x1b") + "/status",
+	} {
+		if got, err := resolvePlayerSubpath(path, "/api/messages/", "/status"); err == nil {
+			t.Errorf("%s: accepted as %q", path, got)
+		}
+	}
+}
+
+func TestGarbagePlayerIDRejectedBeforeWriting(t *testing.T) {
+	garbage := obfuscatePlayerID("\x00\x01\x02")
+
+	// dsClient is unused on these paths, so a 400 here means nothing was written.
+	rec := httptest.NewRecorder()
+	handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+garbage, strings.NewReader(`{"lat": 51, "lng": 4, "status": "OK"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("location update: got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	rec = httptest.NewRecorder()
+	handlePlayerMessages(rec, httptest.NewRequest(http.MethodPost, "/api/messages/"+garbage, strings.NewReader(`{"message": "hi"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("player message: got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSweepStaleLocations(t *testing.T) {
+	requireEmulator(t, "PlayerLocation")
+	now := time.Now()
+	putEntity(t, datastore.NameKey("PlayerLocation", "fresh", nil), &PlayerLocation{Lat: 51, Lng: 4, Status: "OK", Timestamp: now})
+	putEntity(t, datastore.NameKey("PlayerLocation", "gone", nil), &PlayerLocation{Lat: 51, Lng: 4, Status: "OK", Timestamp: now.Add(-2 * time.Hour)})
+	putEntity(t, datastore.NameKey("PlayerLocation", "denied", nil), &PlayerLocation{Status: "DENIED", Timestamp: now.Add(-time.Hour)})
+
+	rec := httptest.NewRecorder()
+	handleSweepStale(rec, httptest.NewRequest(http.MethodPost, "/api/admin/sweep-stale?olderThanMinutes=30", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"flagged":2`) {
+		t.Fatalf("got %d %q, want two flagged", rec.Code, rec.Body.String())
+	}
+
+	locations := getLocations(t, "/api/locations")
+	if len(locations) != 3 {
+		t.Fatalf("got %d locations, want all 3 kept", len(locations))
+	}
+	if locations["fresh"].Stale || !locations["gone"].Stale || !locations["denied"].Stale {
+		t.Errorf("stale flags: fresh=%v gone=%v denied=%v", locations["fresh"].Stale, locations["gone"].Stale, locations["denied"].Stale)
+	}
+	if locations["gone"].Lat != 51 {
+		t.Errorf("flagging lost the location: %+v", locations["gone"])
+	}
+	if locations := getLocations(t, "/api/locations?excludeStale=true"); len(locations) != 1 {
+		t.Errorf("excludeStale returned %d locations, want only fresh", len(locations))
+	}
+
+	// Already-flagged locations aren't counted again.
+	if n, err := sweepStaleLocations(context.Background(), now.Add(-30*time.Minute)); err != nil || n != 0 {
+		t.Errorf("second sweep: got %d, %v", n, err)
+	}
+}
+
+func TestSweepStaleRejectsBadParams(t *testing.T) {
+	for _, q := range []string{"", "?olderThanMinutes=0", "?olderThanMinutes=-5", "?olderThanMinutes=soon"} {
+		rec := httptest.NewRecorder()
+		handleSweepStale(rec, httptest.NewRequest(http.MethodPost, "/api/admin/sweep-stale"+q, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got %d, want %d", q, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestPlayerStatusValid(t *testing.T) {
+	for _, s := range []PlayerStatus{"OK", "UNAVAILABLE", "DENIED", "PAUSED", "FINISHED"} {
+		if !s.valid() {
+			t.Errorf("%q rejected", s)
+		}
+	}
+	for _, s := range []PlayerStatus{"", "ok", "PERMISSION DENIED", "ASLEEP"} {
+		if s.valid() {
+			t.Errorf("%q accepted", s)
+		}
+	}
+	for s, want := range map[PlayerStatus]bool{"OK": true, "UNAVAILABLE": true, "DENIED": true, "PAUSED": false, "FINISHED": false} {
+		if got := s.active(); got != want {
+			t.Errorf("%q active = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestUpdateLocationRejectsUnknownStatus(t *testing.T) {
+	for _, body := range []string{`{"status": "ASLEEP"}`, `{"status": "PERMISSION DENIED"}`, `{"lat": 51, "lng": 4}`} {
+		rec := httptest.NewRecorder()
+		handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID("alice"), strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestUpdateLocationAcceptsEveryStatus(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory")
+	for _, status := range playerStatuses {
+		body := fmt.Sprintf(`{"lat": 51, "lng": 4, "status": %q}`, status)
+		rec := httptest.NewRecorder()
+		handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID("alice"), strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: got %d: %s", status, rec.Code, rec.Body.String())
+		}
+		if got := getLocations(t, "/api/locations")["alice"].Status; got != status {
+			t.Errorf("stored status %q, want %q", got, status)
+		}
+	}
+}
+
+func patchLocation(playerID, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handleUpdateLocation(rec, httptest.NewRequest(http.MethodPatch, "/api/locations/"+obfuscatePlayerID(playerID), strings.NewReader(body)))
+	return rec
+}
+
+func TestPatchLocationRejectsBadRequests(t *testing.T) {
+	for _, body := range []string{`{}`, `{"clientTimestamp": "2025-06-01T12:00:00Z"}`, `{"lat": 51}`, `{"lng": 4, "status": "OK"}`, `{"status": "ASLEEP"}`, `{"heading": 90}`} {
+		if rec := patchLocation("alice", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+	rec := httptest.NewRecorder()
+	handleUpdateLocation(rec, httptest.NewRequest(http.MethodPut, "/api/locations/"+obfuscatePlayerID("alice"), strings.NewReader(`{"status": "OK"}`)))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT: got %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestPatchLocationStatusOnly(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory", "TargetLocation")
+	ctx := context.Background()
+	key := datastore.NameKey("PlayerLocation", "alice", nil)
+	putEntity(t, key, &PlayerLocation{Lat: 51.05, Lng: 3.72, Status: PlayerStatusOK, Address: "Korenmarkt, Gent", AddressLat: 51.05, AddressLng: 3.72, SpeedMps: 1.5, Timestamp: time.Now().Add(-time.Minute)})
+
+	rec := patchLocation("alice", `{"status": "DENIED"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var stored PlayerLocation
+	if err := dsClient.Get(ctx, key, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != PlayerStatusDenied || stored.Lat != 51.05 || stored.Lng != 3.72 || stored.Address != "Korenmarkt, Gent" {
+		t.Errorf("stored %+v, want DENIED at the same coordinates and address", stored)
+	}
+	if stored.SpeedMps != 0 || time.Since(stored.Timestamp) > time.Minute/2 {
+		t.Errorf("stored speed %v at %v, want a fresh update without motion", stored.SpeedMps, stored.Timestamp)
+	}
+	var returned PlayerLocation
+	if err := json.NewDecoder(rec.Body).Decode(&returned); err != nil || returned.Status != PlayerStatusDenied || returned.Lat != 51.05 {
+		t.Errorf("returned %+v, %v, want the merged location", returned, err)
+	}
+
+	if rec := patchLocation("bob", `{"status": "DENIED"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("player without a location: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestPatchLocationCoordinatesOnly(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory", "TargetLocation")
+	ctx := context.Background()
+	key := datastore.NameKey("PlayerLocation", "alice", nil)
+	putEntity(t, key, &PlayerLocation{Lat: 51.05, Lng: 3.72, Status: PlayerStatusUnavailable, Address: "Korenmarkt, Gent", AddressLat: 51.05, AddressLng: 3.72, Timestamp: time.Now().Add(-time.Minute)})
+
+	if rec := patchLocation("alice", `{"lat": 51.0500001, "lng": 3.7300001, "clientTimestamp": "2025-06-01T12:00:00Z"}`); rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var stored PlayerLocation
+	if err := dsClient.Get(ctx, key, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != PlayerStatusUnavailable || stored.Lat != 51.05 || stored.Lng != 3.73 {
+		t.Errorf("stored %+v, want the rounded new coordinates with the status unchanged", stored)
+	}
+	if stored.Address != "" || !stored.ClientTimestamp.Equal(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("stored %+v, want the address 700m away dropped and the client timestamp set", stored)
+	}
+
+	// The patch is part of the player's history, like any other update.
+	var history []LocationHistoryEntry
+	if _, err := dsClient.GetAll(ctx, datastore.NewQuery("LocationHistory").FilterField("PlayerID", "=", "alice"), &history); err != nil || len(history) != 1 || history[0].Lng != 3.73 {
+		t.Errorf("history %+v, %v, want the patched location", history, err)
+	}
+}
+
+func TestPlayerDefaultLocation(t *testing.T) {
+	if lat, lng := (Player{}).defaultLocation(); lat != spawnLat || lng != spawnLng {
+		t.Errorf("no default: got %v,%v, want the spawn point", lat, lng)
+	}
+	if lat, lng := (Player{DefaultLat: 50.85, DefaultLng: 4.35}).defaultLocation(); lat != 50.85 || lng != 4.35 {
+		t.Errorf("with a default: got %v,%v", lat, lng)
+	}
+}
+
+func TestDefaultLocationRejectsBadRequests(t *testing.T) {
+	url := "/api/admin/default-location/" + obfuscatePlayerID("alice")
+	for _, body := range []string{`{}`, `{"lat": 51}`, `{"lat": 91, "lng": 4}`, `{"lat": 51, "lng": -181}`, `{"lat": 0, "lng": 0}`} {
+		rec := httptest.NewRecorder()
+		handleDefaultLocation(rec, httptest.NewRequest(http.MethodPut, url, strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+	rec := httptest.NewRecorder()
+	handleDefaultLocation(rec, httptest.NewRequest(http.MethodPost, url, strings.NewReader(`{"lat": 51, "lng": 4}`)))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestDeniedPlayersFallBackToTheirOwnDefault(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory", "Player")
+	ctx := context.Background()
+	update := func(playerID, body string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID(playerID), strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s %s: got %d: %s", playerID, body, rec.Code, rec.Body.String())
+		}
+	}
+	stored := func(playerID string) PlayerLocation {
+		t.Helper()
+		var loc PlayerLocation
+		if err := dsClient.Get(ctx, datastore.NameKey("PlayerLocation", playerID, nil), &loc); err != nil {
+			t.Fatalf("getting %s's location: %v", playerID, err)
+		}
+		return loc
+	}
+
+	// alice's default is their first fix, which outlives their location being cleared.
+	update("alice", `{"lat": 51.05, "lng": 3.72, "status": "OK"}`)
+	update("alice", `{"lat": 51.06, "lng": 3.73, "status": "OK"}`)
+	if err := dsClient.Delete(ctx, datastore.NameKey("PlayerLocation", "alice", nil)); err != nil {
+		t.Fatal(err)
+	}
+	update("alice", `{"status": "DENIED"}`)
+
+	// bob never had a fix, but a lead gave them a default.
+	req := httptest.NewRequest(http.MethodPut, "/api/admin/default-location/"+obfuscatePlayerID("bob"), strings.NewReader(`{"lat": 50.85, "lng": 4.35}`))
+	req.AddCookie(&http.Cookie{Name: leadSessionCookie, Value: signLeadSession("ann", "", time.Now().Add(time.Hour))})
+	rec := httptest.NewRecorder()
+	requireLead(handleDefaultLocation)(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("setting bob's default: got %d: %s", rec.Code, rec.Body.String())
+	}
+	update("bob", `{"status": "DENIED"}`)
+	update("carol", `{"status": "DENIED"}`)
+
+	if loc := stored("alice"); loc.Lat != 51.05 || loc.Lng != 3.72 {
+		t.Errorf("alice at %v,%v, want their first fix", loc.Lat, loc.Lng)
+	}
+	if loc := stored("bob"); loc.Lat != 50.85 || loc.Lng != 4.35 {
+		t.Errorf("bob at %v,%v, want the default the lead set", loc.Lat, loc.Lng)
+	}
+	if loc := stored("carol"); loc.Lat != spawnLat || loc.Lng != spawnLng {
+		t.Errorf("carol at %v,%v, want the spawn point", loc.Lat, loc.Lng)
+	}
+
+	var player Player
+	if err := dsClient.Get(ctx, datastore.NameKey("Player", "bob", nil), &player); err != nil || player.DefaultSetBy != "ann" {
+		t.Errorf("bob's settings: %+v, %v", player, err)
+	}
+	rec = httptest.NewRecorder()
+	handleDefaultLocation(rec, httptest.NewRequest(http.MethodGet, "/api/admin/default-location/"+obfuscatePlayerID("carol"), nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("carol's default: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestValidateDisplayName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "Agent Orange", want: "Agent Orange"},
+		{name: "  Zoë  ", want: "Zoë"},
+		{name: "", want: ""},
+		{name: "   ", want: ""},
+		{name: strings.Repeat("a", maxDisplayNameLength), want: strings.Repeat("a", maxDisplayNameLength)},
+		{name: strings.Repeat("a", maxDisplayNameLength+1), wantErr: true},
+		{name: "<b>bold</b>", wantErr: true},
+		{name: "tab\there", wantErr: true},
+		{name: "bad\xffbyte", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := validateDisplayName(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("validateDisplayName(%q) = %q, %v, want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestDisplayNameRejectsBadRequests(t *testing.T) {
+	url := "/api/admin/display-name/" + obfuscatePlayerID("alice")
+	for _, body := range []string{`{}`, `{"displayName": "<script>"}`, `not json`} {
+		rec := httptest.NewRecorder()
+		handleDisplayName(rec, httptest.NewRequest(http.MethodPut, url, strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+	rec := httptest.NewRecorder()
+	handleDisplayName(rec, httptest.NewRequest(http.MethodPost, url, strings.NewReader(`{"displayName": "Al"}`)))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+
+	// Generating a player URL is public, so it can't name players.
+	body := strings.NewReader(`{"playerID": "alice", "displayName": "Al"}`)
+	rec = httptest.NewRecorder()
+	handleObfuscateURL(rec, httptest.NewRequest(http.MethodPost, "/api/obfuscate-url", body))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("naming through the URL generator: got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestDisplayNamesFlowToLocations(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory", "Player")
+	ctx := context.Background()
+	for _, playerID := range []string{"alice", "bob", "carol"} {
+		rec := httptest.NewRecorder()
+		handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID(playerID), strings.NewReader(`{"lat": 51, "lng": 4, "status": "OK"}`)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: got %d: %s", playerID, rec.Code, rec.Body.String())
+		}
+	}
+
+	// A lead names alice and bob.
+	rec := httptest.NewRecorder()
+	handleDisplayName(rec, httptest.NewRequest(http.MethodPut, "/api/admin/display-name/"+obfuscatePlayerID("alice"), strings.NewReader(`{"displayName": "Agent Orange"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("naming alice: got %d: %s", rec.Code, rec.Body.String())
+	}
+	req := httptest.NewRequest(http.MethodPut, "/api/admin/display-name/"+obfuscatePlayerID("bob"), strings.NewReader(`{"displayName": " Agent Blue "}`))
+	req.AddCookie(&http.Cookie{Name: leadSessionCookie, Value: signLeadSession("ann", "", time.Now().Add(time.Hour))})
+	rec = httptest.NewRecorder()
+	requireLead(handleDisplayName)(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"displayName":"Agent Blue"`) {
+		t.Fatalf("naming bob: got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Generating alice's URL again, or setting a default location, keeps the names.
+	rec = httptest.NewRecorder()
+	handleObfuscateURL(rec, httptest.NewRequest(http.MethodPost, "/api/obfuscate-url", strings.NewReader(`{"playerID": "alice"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("looking up alice: got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	handleDefaultLocation(rec, httptest.NewRequest(http.MethodPut, "/api/admin/default-location/"+obfuscatePlayerID("bob"), strings.NewReader(`{"lat": 50.85, "lng": 4.35}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("setting bob's default: got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	locations := getLocations(t, "/api/locations")
+	for playerID, want := range map[string]string{"alice": "Agent Orange", "bob": "Agent Blue", "carol": "carol"} {
+		if got := locations[playerID].DisplayName; got != want {
+			t.Errorf("%s shown as %q, want %q", playerID, got, want)
+		}
+	}
+
+	// An empty name goes back to the ID.
+	rec = httptest.NewRecorder()
+	handleDisplayName(rec, httptest.NewRequest(http.MethodPut, "/api/admin/display-name/"+obfuscatePlayerID("bob"), strings.NewReader(`{"displayName": ""}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("clearing bob's name: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := getLocations(t, "/api/locations")["bob"].DisplayName; got != "bob" {
+		t.Errorf("bob shown as %q after clearing their name, want their ID", got)
+	}
+	var player Player
+	if err := dsClient.Get(ctx, datastore.NameKey("Player", "bob", nil), &player); err != nil || player.DefaultLat != 50.85 || player.DisplayName != "" {
+		t.Errorf("bob's settings: %+v, %v", player, err)
+	}
+}
+
+func TestActivePlayersExcludesPausedAndFinished(t *testing.T) {
+	requireEmulator(t, "PlayerLocation")
+	now := time.Now()
+	for playerID, status := range map[string]PlayerStatus{"a": "OK", "b": "DENIED", "c": "PAUSED", "d": "FINISHED"} {
+		putEntity(t, datastore.NameKey("PlayerLocation", playerID, nil), &PlayerLocation{Status: status, Timestamp: now})
+	}
+	if got := countActivePlayers(); got != 2 {
+		t.Errorf("got %v active players, want 2", got)
+	}
+}
+
+func TestClockSkewSeconds(t *testing.T) {
+	server := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		client time.Time
+		want   int64
+	}{
+		{time.Time{}, 0},
+		{server, 0},
+		{server.Add(-4 * time.Minute), 0},
+		{server.Add(5 * time.Minute), 0},
+		{server.Add(-2 * time.Hour), 7200},
+		{server.Add(10 * time.Minute), -600},
+	} {
+		if got := clockSkewSeconds(server, tc.client); got != tc.want {
+			t.Errorf("client %v: got %d, want %d", tc.client, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateLocationFlagsClockSkew(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory")
+	now := time.Now()
+	for _, tc := range []struct {
+		name   string
+		client time.Time
+		want   int64 // Rounded to minutes, the request takes a moment
+	}{
+		{"in sync", now, 0},
+		{"far in the past", now.Add(-3 * time.Hour), 180},
+		{"far in the future", now.Add(time.Hour), -60},
+	} {
+		body := fmt.Sprintf(`{"lat": 51, "lng": 4, "status": "OK", "clientTimestamp": %q}`, tc.client.Format(time.RFC3339Nano))
+		rec := httptest.NewRecorder()
+		handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID("alice"), strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: update rejected with %d", tc.name, rec.Code)
+		}
+		loc := getLocations(t, "/api/locations")["alice"]
+		if got := int64(math.Round(float64(loc.ClockSkewSeconds) / 60)); got != tc.want {
+			t.Errorf("%s: skew %ds, want ~%d minutes", tc.name, loc.ClockSkewSeconds, tc.want)
+		}
+		if !loc.ClientTimestamp.Equal(tc.client) {
+			t.Errorf("%s: client timestamp changed to %v", tc.name, loc.ClientTimestamp)
+		}
+	}
+}
+
+func TestUnreadDMCount(t *testing.T) {
+	for _, tc := range []struct {
+		from []string
+		want int
+	}{
+		{nil, 0},
+		{[]string{"player"}, 0},
+		{[]string{"lead"}, 1},
+		{[]string{"lead", "player", "lead", "lead"}, 2},
+		{[]string{"lead", "lead", "player"}, 0},
+		{[]string{"lead", "read", "lead"}, 1},
+		{[]string{"read", "read"}, 0},
+	} {
+		var history []ChatMessage
+		readAt := time.Now()
+		for _, from := range tc.from {
+			if from == "read" {
+				history = append(history, ChatMessage{From: "lead", ReadAt: &readAt})
+				continue
+			}
+			history = append(history, ChatMessage{From: from})
+		}
+		if got := unreadDMCount(history); got != tc.want {
+			t.Errorf("%v: got %d, want %d", tc.from, got, tc.want)
+		}
+	}
+}
+
+func TestPlayerStateRejectsBadRequests(t *testing.T) {
+	obfuscatedID := obfuscatePlayerID("alice")
+	for url, want := range map[string]int{
+		"/api/player/garbage/state":                           http.StatusBadRequest,
+		"/api/player/" + obfuscatedID:                         http.StatusNotFound,
+		"/api/player/" + obfuscatedID + "/state?chatLimit=-1": http.StatusBadRequest,
+		"/api/player/" + obfuscatedID + "/state?chatLimit=x":  http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		handlePlayerState(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != want {
+			t.Errorf("%s: got %d, want %d", url, rec.Code, want)
+		}
+	}
+}
+
+func TestPlayerState(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "PlayerMessage", "DirectMessage", "TargetLocation", "NotificationPrefs")
+	now := time.Now()
+	putEntity(t, datastore.NameKey("PlayerLocation", "alice", nil), &PlayerLocation{Lat: 51, Lng: 4, Status: "OK", Timestamp: now})
+	putEntity(t, datastore.NameKey("TargetLocation", "alice", nil), &TargetLocation{Lat: 51.05, Lng: 3.72, FakeHash: "ABCD1234", IsReleased: true, Timestamp: now})
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "alice", Content: "where to?", Timestamp: now.Add(-3 * time.Minute)})
+	putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "alice", SenderID: "ann", Content: "north", Timestamp: now.Add(-2 * time.Minute)})
+	putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "alice", SenderID: "ann", Content: "hurry", Timestamp: now.Add(-time.Minute)})
+
+	rec := httptest.NewRecorder()
+	handlePlayerState(rec, httptest.NewRequest(http.MethodGet, "/api/player/"+obfuscatePlayerID("alice")+"/state?chatLimit=2", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &raw); err != nil {
+		t.Fatalf("decoding state: %v", err)
+	}
+	for _, field := range []string{"location", "unreadDMs", "chat", "target", "prefs"} {
+		if _, ok := raw[field]; !ok {
+			t.Errorf("state is missing %q", field)
+		}
+	}
+
+	var state PlayerState
+	if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+		t.Fatalf("decoding state: %v", err)
+	}
+	if state.Location == nil || state.Location.Lat != 51 {
+		t.Errorf("location: %+v", state.Location)
+	}
+	if state.UnreadDMs != 2 {
+		t.Errorf("unreadDMs = %d, want 2", state.UnreadDMs)
+	}
+	if len(state.Chat) != 2 || state.Chat[0].Content != "north" || state.Chat[1].Content != "hurry" {
+		t.Errorf("chat: %+v, want the last two messages", state.Chat)
+	}
+	if state.Target == nil || state.Target.FakeHash != "ABCD1234" {
+		t.Errorf("target: %+v", state.Target)
+	}
+	if !state.Prefs.TargetAlerts || !state.Prefs.DMAlerts {
+		t.Errorf("prefs: %+v, want the defaults", state.Prefs)
+	}
+
+	// A shorter window still counts the unread DMs it cuts off.
+	for limit, wantChat := range map[string]int{"1": 1, "0": 0} {
+		rec = httptest.NewRecorder()
+		handlePlayerState(rec, httptest.NewRequest(http.MethodGet, "/api/player/"+obfuscatePlayerID("alice")+"/state?chatLimit="+limit, nil))
+		state = PlayerState{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+			t.Fatalf("chatLimit=%s: decoding state: %v", limit, err)
+		}
+		if len(state.Chat) != wantChat || state.UnreadDMs != 2 {
+			t.Errorf("chatLimit=%s: %d messages and %d unread, want %d and 2", limit, len(state.Chat), state.UnreadDMs, wantChat)
+		}
+	}
+}
+
+func TestMarkDirectMessageReadRejectsBadRequests(t *testing.T) {
+	obfuscatedID := obfuscatePlayerID("alice")
+	for url, want := range map[string]int{
+		"/api/dm/read/" + obfuscatedID:          http.StatusBadRequest,
+		"/api/dm/read/garbage/12":               http.StatusBadRequest,
+		"/api/dm/read/" + obfuscatedID + "/x":   http.StatusBadRequest,
+		"/api/dm/read/" + obfuscatedID + "/-3":  http.StatusBadRequest,
+		"/api/dm/read/" + obfuscatedID + "/1/2": http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		handleMarkDirectMessageRead(rec, httptest.NewRequest(http.MethodPost, url, nil))
+		if rec.Code != want {
+			t.Errorf("%s: got %d, want %d", url, rec.Code, want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleMarkDirectMessageRead(rec, httptest.NewRequest(http.MethodGet, "/api/dm/read/"+obfuscatedID+"/12", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestMarkDirectMessageRead(t *testing.T) {
+	requireEmulator(t, "PlayerMessage", "DirectMessage")
+	key := putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "alice", SenderID: "ann", Content: "north", Timestamp: time.Now()})
+	readURL := fmt.Sprintf("/api/dm/read/%s/%d", obfuscatePlayerID("alice"), key.ID)
+
+	// Another player can't acknowledge alice's message.
+	rec := httptest.NewRecorder()
+	handleMarkDirectMessageRead(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/dm/read/%s/%d", obfuscatePlayerID("bob"), key.ID), nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("other player: got %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	rec = httptest.NewRecorder()
+	handleMarkDirectMessageRead(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/dm/read/%s/%d", obfuscatePlayerID("alice"), key.ID+1), nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown message: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	// Polling delivers the DM.
+	rec = httptest.NewRecorder()
+	handlePlayerMessages(rec, httptest.NewRequest(http.MethodGet, "/api/messages/"+obfuscatePlayerID("alice"), nil))
+	var status struct {
+		DM *DirectMessage `json:"dm"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || status.DM == nil || status.DM.ID != key.ID {
+		t.Fatalf("poll: %s (err %v), want DM %d", rec.Body.String(), err, key.ID)
+	}
+
+	rec = httptest.NewRecorder()
+	handleMarkDirectMessageRead(rec, httptest.NewRequest(http.MethodPost, readURL, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("mark read: got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handleChatHistory(rec, httptest.NewRequest(http.MethodGet, "/api/chat/"+obfuscatePlayerID("alice"), nil))
+	var chat []ChatMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &chat); err != nil {
+		t.Fatalf("decoding chat: %v", err)
+	}
+	if len(chat) != 1 || chat[0].ID != key.ID || chat[0].DeliveredAt == nil || chat[0].ReadAt == nil {
+		t.Fatalf("chat: %+v, want one DM with delivery and read receipts", chat)
+	}
+	if chat[0].ReadAt.Before(*chat[0].DeliveredAt) {
+		t.Errorf("read at %v before delivered at %v", chat[0].ReadAt, chat[0].DeliveredAt)
+	}
+	if unreadDMCount(chat) != 0 {
+		t.Errorf("unreadDMCount = %d, want 0", unreadDMCount(chat))
+	}
+}
+
+func TestMarkDMsDeliveredLegacy(t *testing.T) {
+	requireEmulator(t, "DirectMessage")
+	ctx := context.Background()
+	now := time.Now()
+	// A DM stored before DeliveredAt existed has no such property at all.
+	legacy := putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &datastore.PropertyList{
+		{Name: "PlayerID", Value: "alice"},
+		{Name: "SenderID", Value: "ann"},
+		{Name: "Content", Value: "old", NoIndex: true},
+		{Name: "Timestamp", Value: now.Add(-time.Hour)},
+	})
+	delivered := putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "alice", SenderID: "ann", Content: "seen", Timestamp: now, DeliveredAt: now.Add(-time.Minute)})
+
+	if n, err := backfillDMDelivery(ctx); err != nil || n != 1 {
+		t.Fatalf("backfill: got %d, %v, want 1", n, err)
+	}
+	if n, err := backfillDMDelivery(ctx); err != nil || n != 0 {
+		t.Errorf("second backfill: got %d, %v, want nothing left to do", n, err)
+	}
+	if err := markDMsDelivered(ctx, "alice"); err != nil {
+		t.Fatalf("marking delivered: %v", err)
+	}
+	var dm DirectMessage
+	if err := dsClient.Get(ctx, legacy, &dm); err != nil || dm.DeliveredAt.IsZero() {
+		t.Errorf("legacy DM: got %+v, %v, want it delivered", dm, err)
+	}
+	if err := dsClient.Get(ctx, delivered, &dm); err != nil || !dm.DeliveredAt.Equal(now.Add(-time.Minute).Truncate(time.Microsecond)) {
+		t.Errorf("delivered DM: got %+v, %v, want its DeliveredAt kept", dm, err)
+	}
+}
+
+// withLocationsCache enables the locations cache for the duration of a test.
+func withLocationsCache(t *testing.T) {
+	t.Helper()
+	locationCache.invalidate()
+	locationsCacheEnabled = true
+	// Display names are served from their own cache next to the locations, loaded
+	// empty so tests don't need datastore for them either.
+	names := displayNameCaches.def
+	names.invalidate()
+	_, generation, _ := names.get()
+	names.fill(map[string]string{}, generation)
+	t.Cleanup(func() {
+		locationsCacheEnabled = false
+		locationCache.invalidate()
+		names.invalidate()
+	})
+}
+
+func TestLocationsCacheServesWithoutDatastore(t *testing.T) {
+	withLocationsCache(t)
+	_, generation, _ := locationCache.get()
+	locationCache.fill(map[string]PlayerLocation{"alice": {Lat: 51, Lng: 4, Status: PlayerStatusOK, Timestamp: time.Now()}}, generation)
+	locationCache.put("bob", PlayerLocation{Lat: 50, Lng: 3, Status: PlayerStatusDenied, Timestamp: time.Now()})
+
+	// Without an emulator dsClient is nil, so a datastore query would panic.
+	rec := httptest.NewRecorder()
+	handleGetLocations(rec, httptest.NewRequest(http.MethodGet, "/api/locations?status=OK", nil))
+	var locations map[string]PlayerLocation
+	if err := json.NewDecoder(rec.Body).Decode(&locations); err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	if len(locations) != 1 || locations["alice"].Lat != 51 {
+		t.Errorf("got %+v, want only alice from the cache", locations)
+	}
+
+	// Filtering a response must not change the cache.
+	if cached, _, _ := locationCache.get(); len(cached) != 2 {
+		t.Errorf("cache holds %d locations after a filtered read, want 2", len(cached))
+	}
+}
+
+func TestLocationsIncludeDisplayNames(t *testing.T) {
+	withLocationsCache(t)
+	_, generation, _ := locationCache.get()
+	locationCache.fill(map[string]PlayerLocation{
+		"alice": {Lat: 51, Lng: 4, Status: PlayerStatusOK, Timestamp: time.Now()},
+		"bob":   {Lat: 50, Lng: 3, Status: PlayerStatusOK, Timestamp: time.Now()},
+	}, generation)
+	displayNameCaches.def.put("alice", "Agent Orange")
+
+	locations := getLocations(t, "/api/locations")
+	if got := locations["alice"].DisplayName; got != "Agent Orange" {
+		t.Errorf("alice shown as %q, want their display name", got)
+	}
+	if got := locations["bob"].DisplayName; got != "bob" {
+		t.Errorf("bob shown as %q, want their ID", got)
+	}
+
+	// Changing a name must change the ETag, or polling leads keep the old one.
+	rec := httptest.NewRecorder()
+	handleGetLocations(rec, httptest.NewRequest(http.MethodGet, "/api/locations", nil))
+	etag := rec.Header().Get("ETag")
+	displayNameCaches.def.put("bob", "Agent Blue")
+	req := httptest.NewRequest(http.MethodGet, "/api/locations", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handleGetLocations(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("after renaming bob: got %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestGetLocationsSince(t *testing.T) {
+	withLocationsCache(t)
+	now := time.Now()
+	_, generation, _ := locationCache.get()
+	locationCache.fill(map[string]PlayerLocation{
+		"alice": {Lat: 51, Lng: 4, Status: PlayerStatusOK, Timestamp: now.Add(-10 * time.Minute)},
+		"bob":   {Lat: 50, Lng: 3, Status: PlayerStatusOK, Timestamp: now.Add(-time.Minute)},
+	}, generation)
+
+	getSince := func(since string) (map[string]PlayerLocation, time.Time) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleGetLocations(rec, httptest.NewRequest(http.MethodGet, "/api/locations?since="+url.QueryEscape(since), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("since=%s: got %d: %s", since, rec.Code, rec.Body.String())
+		}
+		var resp struct {
+			Locations  map[string]PlayerLocation `json:"locations"`
+			ServerTime time.Time                 `json:"serverTime"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("decoding: %v", err)
+		}
+		return resp.Locations, resp.ServerTime
+	}
+
+	locations, serverTime := getSince(now.Add(-5 * time.Minute).Format(time.RFC3339))
+	if len(locations) != 1 || locations["bob"].Lat != 50 {
+		t.Errorf("got %+v, want only bob, who moved in the last five minutes", locations)
+	}
+	if serverTime.Before(now) {
+		t.Errorf("serverTime %v is before the request", serverTime)
+	}
+
+	// Echoing serverTime returns nothing until someone moves again.
+	if locations, _ := getSince(serverTime.Format(time.RFC3339Nano)); len(locations) != 0 {
+		t.Errorf("got %+v, want no changes", locations)
+	}
+	locationCache.put("alice", PlayerLocation{Lat: 52, Lng: 4, Status: PlayerStatusOK, Timestamp: time.Now()})
+	if locations, _ := getSince(serverTime.Format(time.RFC3339Nano)); len(locations) != 1 || locations["alice"].Lat != 52 {
+		t.Errorf("got %+v, want alice's new location", locations)
+	}
+
+	rec := httptest.NewRecorder()
+	handleGetLocations(rec, httptest.NewRequest(http.MethodGet, "/api/locations?since=yesterday", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("since=yesterday: got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestBoundingBoxContains(t *testing.T) {
+	ghent := boundingBox{minLat: 51.0, minLng: 3.6, maxLat: 51.1, maxLng: 3.8}
+	pacific := boundingBox{minLat: -20, minLng: 170, maxLat: -10, maxLng: -170}
+	tests := []struct {
+		name     string
+		box      boundingBox
+		lat, lng float64
+		want     bool
+	}{
+		{"inside", ghent, 51.05, 3.72, true},
+		{"on the edge", ghent, 51.1, 3.6, true},
+		{"north of it", ghent, 51.2, 3.72, false},
+		{"east of it", ghent, 51.05, 3.9, false},
+		{"east of the antimeridian", pacific, -17.7, 178.1, true},
+		{"west of the antimeridian", pacific, -13.8, -171.8, true},
+		{"on the antimeridian", pacific, -15, 180, true},
+		{"the other side of the world", pacific, -15, 0, false},
+		{"west of a crossing box", pacific, -15, 160, false},
+	}
+	for _, tt := range tests {
+		if got := tt.box.contains(tt.lat, tt.lng); got != tt.want {
+			t.Errorf("%s: contains(%v, %v) = %v, want %v", tt.name, tt.lat, tt.lng, got, tt.want)
+		}
+	}
+}
+
+func getLocationsInBox(t *testing.T, query string) map[string]PlayerLocation {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleGetLocationsInBox(rec, httptest.NewRequest(http.MethodGet, "/api/locations/bbox?"+query, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: got %d: %s", query, rec.Code, rec.Body.String())
+	}
+	var locations map[string]PlayerLocation
+	if err := json.NewDecoder(rec.Body).Decode(&locations); err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	return locations
+}
+
+func TestGetLocationsInBox(t *testing.T) {
+	withLocationsCache(t)
+	now := time.Now()
+	_, generation, _ := locationCache.get()
+	locationCache.fill(map[string]PlayerLocation{
+		"alice": {Lat: 51.05, Lng: 3.72, Status: PlayerStatusOK, Timestamp: now},
+		"bob":   {Lat: 50.85, Lng: 4.35, Status: PlayerStatusOK, Timestamp: now},
+		"carol": {Lat: -17.7, Lng: 178.1, Status: PlayerStatusOK, Timestamp: now},
+		"dave":  {Lat: -13.8, Lng: -171.8, Status: PlayerStatusOK, Timestamp: now},
+		"erin":  {Status: PlayerStatusDenied, Timestamp: now},
+	}, generation)
+
+	locations := getLocationsInBox(t, "minLat=51&minLng=3.6&maxLat=51.1&maxLng=3.8")
+	if len(locations) != 1 || locations["alice"].Lat != 51.05 {
+		t.Errorf("Ghent: got %+v, want only alice", locations)
+	}
+	locations = getLocationsInBox(t, "minLat=-20&minLng=170&maxLat=-10&maxLng=-170")
+	if _, ok := locations["carol"]; len(locations) != 2 || !ok {
+		t.Errorf("across the antimeridian: got %+v, want carol and dave", locations)
+	}
+	// Players without coordinates aren't at 0,0.
+	locations = getLocationsInBox(t, "minLat=-90&minLng=-180&maxLat=90&maxLng=180")
+	if _, ok := locations["erin"]; len(locations) != 4 || ok {
+		t.Errorf("whole world: got %+v, want everyone but erin", locations)
+	}
+
+	for _, query := range []string{
+		"minLng=3.6&maxLat=51.1&maxLng=3.8",
+		"minLat=x&minLng=3.6&maxLat=51.1&maxLng=3.8",
+		"minLat=51.1&minLng=3.6&maxLat=51&maxLng=3.8",
+		"minLat=-91&minLng=3.6&maxLat=51&maxLng=3.8",
+		"minLat=51&minLng=3.6&maxLat=51.1&maxLng=181",
+	} {
+		rec := httptest.NewRecorder()
+		handleGetLocationsInBox(rec, httptest.NewRequest(http.MethodGet, "/api/locations/bbox?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestSnapshotCacheLoadsOnce(t *testing.T) {
+	// The leaderboard caches don't depend on LOCATIONS_CACHE, which tests switch off.
+	var cache snapshotCache[float64]
+	var loads atomic.Int32
+	release := make(chan struct{})
+	loader := func() (map[string]float64, error) {
+		loads.Add(1)
+		<-release
+		return map[string]float64{"alice": 5}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := cache.load(time.Minute, loader); err != nil || got["alice"] != 5 {
+				t.Errorf("load: got %v, %v", got, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := loads.Load(); n != 1 {
+		t.Errorf("datastore read %d times, want once", n)
+	}
+
+	// Failed loads aren't cached.
+	cache.invalidate()
+	if _, err := cache.load(time.Minute, func() (map[string]float64, error) { return nil, errors.New("unavailable") }); err == nil {
+		t.Error("load error swallowed")
+	}
+	if _, _, ok := cache.get(); ok {
+		t.Error("failed load cached")
+	}
+}
+
+func TestLocationsCacheWritesAndInvalidation(t *testing.T) {
+	withLocationsCache(t)
+
+	// Writes before the cache is loaded are left for the load to pick up.
+	locationCache.put("alice", PlayerLocation{Lat: 51})
+	if _, _, ok := locationCache.get(); ok {
+		t.Fatal("put loaded the cache")
+	}
+
+	_, generation, _ := locationCache.get()
+	locationCache.fill(map[string]PlayerLocation{"alice": {Lat: 51}}, generation)
+	locationCache.put("alice", PlayerLocation{Lat: 52})
+	locationCache.put("bob", PlayerLocation{Lat: 50})
+	cached, _, ok := locationCache.get()
+	if !ok || cached["alice"].Lat != 52 || cached["bob"].Lat != 50 {
+		t.Errorf("got %+v, want the written locations", cached)
+	}
+
+	locationCache.invalidate()
+	if _, _, ok := locationCache.get(); ok {
+		t.Error("locations served after invalidation")
+	}
+
+	// A snapshot loaded before a write must not be stored after it.
+	_, generation, _ = locationCache.get()
+	locationCache.put("alice", PlayerLocation{Lat: 53})
+	locationCache.fill(map[string]PlayerLocation{"alice": {Lat: 52}}, generation)
+	if _, _, ok := locationCache.get(); ok {
+		t.Error("stale snapshot stored after a write")
+	}
+}
+
+func TestLocationsCacheExpires(t *testing.T) {
+	withLocationsCache(t)
+	old := locationsCacheTTL
+	locationsCacheTTL = 20 * time.Millisecond
+	t.Cleanup(func() { locationsCacheTTL = old })
+
+	// Another instance may have stored newer locations, so a snapshot is only trusted briefly.
+	_, generation, _ := locationCache.get()
+	locationCache.fill(map[string]PlayerLocation{"alice": {Lat: 51}}, generation)
+	if _, _, ok := locationCache.get(); !ok {
+		t.Fatal("fresh snapshot not served")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, _, ok := locationCache.get(); ok {
+		t.Error("snapshot served after it expired")
+	}
+}
+
+func TestLocationsCacheWriteThroughAndFreshBypass(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory")
+	withLocationsCache(t)
+
+	getLocations := func(url string) map[string]PlayerLocation {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleGetLocations(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		var locations map[string]PlayerLocation
+		if err := json.NewDecoder(rec.Body).Decode(&locations); err != nil {
+			t.Fatalf("GET %s: decoding: %v", url, err)
+		}
+		return locations
+	}
+
+	// The first read loads the cache.
+	if locations := getLocations("/api/locations"); len(locations) != 0 {
+		t.Fatalf("got %d locations, want none", len(locations))
+	}
+	rec := httptest.NewRecorder()
+	handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID("alice"), strings.NewReader(`{"lat":51.03,"lng":3.97,"status":"OK"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update: status %d: %s", rec.Code, rec.Body.String())
+	}
+	if locations := getLocations("/api/locations"); locations["alice"].Lat != 51.03 {
+		t.Errorf("cached locations %+v don't reflect the update", locations)
+	}
+
+	// A write that skips the cache only shows up with ?fresh=true.
+	putEntity(t, datastore.NameKey("PlayerLocation", "alice", nil), &PlayerLocation{Lat: 50.5, Lng: 4, Status: PlayerStatusOK, Timestamp: time.Now()})
+	if locations := getLocations("/api/locations"); locations["alice"].Lat != 51.03 {
+		t.Errorf("got %v, want the cached 51.03", locations["alice"].Lat)
+	}
+	if locations := getLocations("/api/locations?fresh=true"); locations["alice"].Lat != 50.5 {
+		t.Errorf("fresh read got %v, want 50.5 from datastore", locations["alice"].Lat)
+	}
+	// The fresh read refilled the cache.
+	if cached, _, ok := locationCache.get(); !ok || cached["alice"].Lat != 50.5 {
+		t.Errorf("cache holds %+v after a fresh read", cached["alice"])
+	}
+}
+
+// withTargetsCache enables the targets cache for the duration of a test.
+func withTargetsCache(t *testing.T, ttl time.Duration) {
+	t.Helper()
+	targetCache.invalidate()
+	targetsCacheTTL = ttl
+	t.Cleanup(func() {
+		targetsCacheTTL = 0
+		targetCache.invalidate()
+	})
+}
+
+func getTargets(t *testing.T) map[string]TargetLocation {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleGetTargets(rec, httptest.NewRequest(http.MethodGet, "/api/targets", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/targets: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var targets map[string]TargetLocation
+	if err := json.NewDecoder(rec.Body).Decode(&targets); err != nil {
+		t.Fatalf("decoding targets: %v", err)
+	}
+	return targets
+}
+
+func TestTargetsCacheServesWithoutDatastore(t *testing.T) {
+	withTargetsCache(t, time.Minute)
+	_, generation, _ := targetCache.get()
+	targetCache.fillFor(map[string]TargetLocation{"alice": {Lat: 51, Lng: 4, FakeHash: "CACHED"}}, generation, targetsCacheTTL)
+
+	// Without an emulator dsClient is nil, so a datastore query would panic.
+	if targets := getTargets(t); targets["alice"].FakeHash != "CACHED" {
+		t.Errorf("got %+v, want the cached snapshot", targets)
+	}
+}
+
+func TestTargetsCacheExpiryAndInvalidation(t *testing.T) {
+	withTargetsCache(t, 20*time.Millisecond)
+	snapshot := map[string]TargetLocation{"alice": {}}
+
+	_, generation, _ := targetCache.get()
+	targetCache.fillFor(snapshot, generation, targetsCacheTTL)
+	if _, _, ok := targetCache.get(); !ok {
+		t.Error("snapshot missing before the TTL")
+	}
+	time.Sleep(targetsCacheTTL)
+	if _, _, ok := targetCache.get(); ok {
+		t.Error("snapshot served after the TTL")
+	}
+
+	_, generation, _ = targetCache.get()
+	targetCache.fillFor(snapshot, generation, time.Minute)
+	targetCache.invalidate()
+	if _, _, ok := targetCache.get(); ok {
+		t.Error("snapshot served after invalidation")
+	}
+
+	// A snapshot loaded before a write must not be stored after it.
+	_, generation, _ = targetCache.get()
+	targetCache.invalidate()
+	targetCache.fillFor(snapshot, generation, time.Minute)
+	if _, _, ok := targetCache.get(); ok {
+		t.Error("stale snapshot stored after invalidation")
+	}
+
+	targetsCacheTTL = 0
+	_, generation, _ = targetCache.get()
+	targetCache.fillFor(snapshot, generation, targetsCacheTTL)
+	if _, _, ok := targetCache.get(); ok {
+		t.Error("snapshot stored with the cache disabled")
+	}
+}
+
+func TestGetTargetsReleasedFilterAndSort(t *testing.T) {
+	withTargetsCache(t, time.Minute)
+	now := time.Now()
+	_, generation, _ := targetCache.get()
+	targetCache.fillFor(map[string]TargetLocation{
+		"carol":   {Timestamp: now.Add(-3 * time.Minute), IsReleased: true},
+		"alice":   {Timestamp: now.Add(-time.Minute)},
+		"bob":     {Timestamp: now.Add(-2 * time.Minute), ReleaseAt: now.Add(-time.Second)},
+		"dave":    {Timestamp: now.Add(-time.Minute), ReleaseAt: now.Add(time.Hour)},
+		"expired": {Timestamp: now.Add(-4 * time.Minute), IsReleased: true, ExpiresAt: now.Add(-time.Second)},
+	}, generation, targetsCacheTTL)
+
+	getList := func(url string) []string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleGetTargets(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: got %d: %s", url, rec.Code, rec.Body.String())
+		}
+		var entries []TargetListEntry
+		if err := json.NewDecoder(rec.Body).Decode(&entries); err != nil {
+			t.Fatalf("GET %s: decoding: %v", url, err)
+		}
+		var players []string
+		for _, entry := range entries {
+			players = append(players, entry.PlayerID)
+		}
+		return players
+	}
+
+	// Sorted oldest first, with ties broken by player ID and the expired target left out.
+	if got, want := getList("/api/targets?sort=time"), []string{"carol", "bob", "alice", "dave"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sort=time: got %v, want %v", got, want)
+	}
+	if got, want := getList("/api/targets?sort=time&released=true"), []string{"carol", "bob"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("released=true: got %v, want %v", got, want)
+	}
+	if got, want := getList("/api/targets?sort=time&released=false"), []string{"alice", "dave"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("released=false: got %v, want %v", got, want)
+	}
+
+	// Without ?sort the response stays a map, and filtering doesn't touch the cache.
+	rec := httptest.NewRecorder()
+	handleGetTargets(rec, httptest.NewRequest(http.MethodGet, "/api/targets?released=true", nil))
+	var targets map[string]TargetLocation
+	if err := json.NewDecoder(rec.Body).Decode(&targets); err != nil {
+		t.Fatalf("decoding map: %v", err)
+	}
+	if len(targets) != 2 {
+		t.Errorf("released=true map has %d targets, want 2", len(targets))
+	}
+	if all := getTargets(t); len(all) != 4 {
+		t.Errorf("unfiltered map has %d targets, want 4", len(all))
+	}
+}
+
+func TestGetTargetsRejectsBadParams(t *testing.T) {
+	for _, url := range []string{"/api/targets?released=yes", "/api/targets?sort=name"} {
+		rec := httptest.NewRecorder()
+		handleGetTargets(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: got %d, want %d", url, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestTargetWriteInvalidatesCache(t *testing.T) {
+	requireEmulator(t, "TargetLocation")
+	withTargetsCache(t, time.Minute)
+	putEntity(t, datastore.NameKey("TargetLocation", "alice", nil), &TargetLocation{Lat: 51, Lng: 4, IsReleased: true, Timestamp: time.Now()})
+	if targets := getTargets(t); len(targets) != 1 {
+		t.Fatalf("got %d targets, want 1", len(targets))
+	}
+
+	// A write that bypasses the handlers isn't seen until the cache expires...
+	putEntity(t, datastore.NameKey("TargetLocation", "bob", nil), &TargetLocation{Lat: 51.1, Lng: 4.1, IsReleased: true, Timestamp: time.Now()})
+	if targets := getTargets(t); len(targets) != 1 {
+		t.Fatalf("got %d targets, want the cached 1", len(targets))
+	}
+
+	// ...but one through the API is.
+	rec := httptest.NewRecorder()
+	handleSetTargetLocation(rec, httptest.NewRequest(http.MethodPost, "/api/target/"+obfuscatePlayerID("carol"), strings.NewReader(`{"lat": 51.2, "lng": 4.2}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("setting target: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if targets := getTargets(t); len(targets) != 3 {
+		t.Errorf("got %d targets, want 3 after the write", len(targets))
+	}
+}
+
+func getStats(t *testing.T) GameStats {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleGetStats(rec, httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/stats: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var stats GameStats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("decoding stats: %v", err)
+	}
+	return stats
+}
+
+func TestArrivalsCounterConcurrentIncrements(t *testing.T) {
+	requireEmulator(t, "GameStats")
+	if stats := getStats(t); stats.Arrivals != 0 {
+		t.Fatalf("got %d arrivals before any, want 0", stats.Arrivals)
+	}
+
+	const increments = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, increments)
+	for i := 0; i < increments; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := dsClient.RunInTransaction(context.Background(), func(tx *datastore.Transaction) error {
+				return incrementArrivals(context.Background(), tx, time.Now())
+			}, datastore.MaxAttempts(gameStatsMaxAttempts))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("incrementing: %v", err)
+		}
+	}
+	if stats := getStats(t); stats.Arrivals != increments {
+		t.Errorf("got %d arrivals, want %d", stats.Arrivals, increments)
+	}
+}
+
+func TestArrivalIncrementsStats(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory", "TargetLocation", "GameStats", "Arrival")
+	putEntity(t, datastore.NameKey("TargetLocation", "p1", nil), &TargetLocation{Lat: 51.0, Lng: 3.9, IsReleased: true, Timestamp: time.Now()})
+
+	// Only the first update at the target counts.
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID("p1"), strings.NewReader(`{"lat":51.0001,"lng":3.9,"status":"OK"}`)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("update %d: got %d", i, rec.Code)
+		}
+	}
+	if stats := getStats(t); stats.Arrivals != 1 || stats.UpdatedAt.IsZero() {
+		t.Errorf("got %+v, want 1 arrival", stats)
+	}
+	if n := countEntities(t, "Arrival"); n != 1 {
+		t.Errorf("got %d Arrival records, want 1", n)
+	}
+}
+
+func TestActivityBuckets(t *testing.T) {
+	start := time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)
+	history := []LocationHistoryEntry{
+		{PlayerID: "alice", Timestamp: start.Add(2 * time.Minute)},
+		{PlayerID: "bob", Timestamp: start.Add(14 * time.Minute)},
+		{PlayerID: "alice", Timestamp: start.Add(15 * time.Minute)},
+		{PlayerID: "alice", Timestamp: start.Add(50 * time.Minute)},
+		{PlayerID: "bob", Timestamp: start.Add(3 * time.Minute)},
+	}
+	buckets := activityBuckets(history, 15*time.Minute, true)
+	want := []ActivityBucket{
+		{Start: start, Updates: 3, Players: map[string]int{"alice": 1, "bob": 2}},
+		{Start: start.Add(15 * time.Minute), Updates: 1, Players: map[string]int{"alice": 1}},
+		{Start: start.Add(30 * time.Minute), Updates: 0, Players: map[string]int{}},
+		{Start: start.Add(45 * time.Minute), Updates: 1, Players: map[string]int{"alice": 1}},
+	}
+	if !reflect.DeepEqual(buckets, want) {
+		t.Errorf("got %+v, want %+v", buckets, want)
+	}
+
+	if buckets := activityBuckets(history, time.Hour, false); len(buckets) != 1 || buckets[0].Updates != 5 || buckets[0].Players != nil {
+		t.Errorf("hourly without players: got %+v", buckets)
+	}
+	if buckets := activityBuckets(nil, time.Hour, false); buckets == nil || len(buckets) != 0 {
+		t.Errorf("no history: got %#v, want an empty list", buckets)
+	}
+}
+
+func TestActivityStats(t *testing.T) {
+	for _, query := range []string{"", "?bucketMinutes=0", "?bucketMinutes=x", "?bucketMinutes=1441"} {
+		rec := httptest.NewRecorder()
+		handleActivityStats(rec, httptest.NewRequest(http.MethodGet, "/api/stats/activity"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	requireEmulator(t, "LocationHistory")
+	start := time.Now().UTC().Truncate(time.Hour).Add(-2 * time.Hour)
+	for i, minutes := range []int{1, 5, 61, 62, 63} {
+		putEntity(t, datastore.IncompleteKey("LocationHistory", nil), &LocationHistoryEntry{PlayerID: fmt.Sprintf("p%d", i%2), Status: PlayerStatusOK, Timestamp: start.Add(time.Duration(minutes) * time.Minute)})
+	}
+	rec := httptest.NewRecorder()
+	handleActivityStats(rec, httptest.NewRequest(http.MethodGet, "/api/stats/activity?bucketMinutes=30&perPlayer=true", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var buckets []ActivityBucket
+	if err := json.NewDecoder(rec.Body).Decode(&buckets); err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	var counts []int
+	for _, bucket := range buckets {
+		counts = append(counts, bucket.Updates)
+	}
+	if !reflect.DeepEqual(counts, []int{2, 0, 3}) || !buckets[0].Start.Equal(start) {
+		t.Errorf("got %+v, want 2, 0 and 3 updates from %v", buckets, start)
+	}
+	if p := buckets[2].Players; p["p0"] != 2 || p["p1"] != 1 {
+		t.Errorf("last bucket per player: got %v, want p0 2 and p1 1", p)
+	}
+}
+
+func TestHistoryDistances(t *testing.T) {
+	start := time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)
+	history := []LocationHistoryEntry{
+		{PlayerID: "alice", Lat: 51.002, Lng: 3.9, Status: PlayerStatusOK, Timestamp: start.Add(2 * time.Minute)},
+		{PlayerID: "alice", Lat: 51.0, Lng: 3.9, Status: PlayerStatusOK, Timestamp: start},
+		{PlayerID: "alice", Lat: 51.001, Lng: 3.9, Status: PlayerStatusOK, Timestamp: start.Add(time.Minute)},
+		{PlayerID: "alice", Status: PlayerStatusDenied, Timestamp: start.Add(3 * time.Minute)},
+		{PlayerID: "alice", Lat: 52.0, Lng: 3.9, Status: PlayerStatusOK, Timestamp: start.Add(90 * time.Second), Suspicious: true},
+		{PlayerID: "bob", Lat: 51.0, Lng: 3.9, Status: PlayerStatusOK, Timestamp: start},
+		// carol's second fix is over 100km away a minute later, so only the last step counts.
+		{PlayerID: "carol", Lat: 51.0, Lng: 3.9, Status: PlayerStatusOK, Timestamp: start},
+		{PlayerID: "carol", Lat: 52.0, Lng: 3.9, Status: PlayerStatusOK, Timestamp: start.Add(time.Minute)},
+		{PlayerID: "carol", Lat: 52.001, Lng: 3.9, Status: PlayerStatusOK, Timestamp: start.Add(2 * time.Minute)},
+	}
+	distances := historyDistances(history)
+	if want := haversineMeters(51.0, 3.9, 51.002, 3.9); math.Abs(distances["alice"]-want) > 0.01 {
+		t.Errorf("alice: got %.2fm, want %.2fm", distances["alice"], want)
+	}
+	if d, ok := distances["bob"]; !ok || d != 0 {
+		t.Errorf("bob with a single fix: got %v (listed %v), want 0", d, ok)
+	}
+	if want := haversineMeters(52.0, 3.9, 52.001, 3.9); math.Abs(distances["carol"]-want) > 0.01 {
+		t.Errorf("carol: got %.2fm, want %.2fm", distances["carol"], want)
+	}
+}
+
+func TestRankLeaderboard(t *testing.T) {
+	start := time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)
+	arrivals := []Arrival{
+		{PlayerID: "alice", ArrivedAt: start},
+		{PlayerID: "alice", ArrivedAt: start.Add(20 * time.Minute)},
+		{PlayerID: "bob", ArrivedAt: start.Add(5 * time.Minute)},
+		{PlayerID: "bob", ArrivedAt: start.Add(10 * time.Minute)},
+		{PlayerID: "carol", ArrivedAt: start.Add(time.Minute)},
+	}
+	distances := map[string]float64{"alice": 500, "bob": 800, "carol": 800, "dave": 100, "erin": 100}
+
+	order := func(board []LeaderboardEntry) []string {
+		var ids []string
+		for i, entry := range board {
+			if entry.Rank != i+1 {
+				t.Errorf("%s: got rank %d, want %d", entry.PlayerID, entry.Rank, i+1)
+			}
+			ids = append(ids, entry.PlayerID)
+		}
+		return ids
+	}
+	// bob reached their second target before alice did; dave and erin tie on everything.
+	if got, want := order(rankLeaderboard(arrivals, distances, leaderboardByArrivals)), []string{"bob", "alice", "carol", "dave", "erin"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("by arrivals: got %v, want %v", got, want)
+	}
+	// bob and carol travelled as far, bob reached more targets.
+	board := rankLeaderboard(arrivals, distances, leaderboardByDistance)
+	if got, want := order(board), []string{"bob", "carol", "alice", "dave", "erin"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("by distance: got %v, want %v", got, want)
+	}
+	if bob := board[0]; bob.Arrivals != 2 || bob.DistanceMeters != 800 || !bob.LastArrivalAt.Equal(start.Add(10*time.Minute)) {
+		t.Errorf("bob: got %+v", bob)
+	}
+	if board := rankLeaderboard(nil, nil, leaderboardByArrivals); board == nil || len(board) != 0 {
+		t.Errorf("no players: got %#v, want an empty leaderboard", board)
+	}
+}
+
+func TestLeaderboard(t *testing.T) {
+	for _, query := range []string{"?by=speed", "?by=ARRIVALS"} {
+		rec := httptest.NewRecorder()
+		handleLeaderboard(rec, httptest.NewRequest(http.MethodGet, "/api/leaderboard"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	requireEmulator(t, "Arrival", "LocationHistory", "PlayerLocation")
+	invalidateLeaderboard(context.Background())
+	locationCache.invalidate()
+	start := time.Now().UTC().Add(-time.Hour)
+	putEntity(t, datastore.IncompleteKey("Arrival", nil), &Arrival{PlayerID: "alice", ArrivedAt: start})
+	// bob hasn't arrived anywhere, so the arrivals board finds them through their location.
+	putEntity(t, datastore.NameKey("PlayerLocation", "bob", nil), &PlayerLocation{Lat: 51.01, Lng: 3.9, Status: PlayerStatusOK, Timestamp: start.Add(time.Minute)})
+	for i, lat := range []float64{51.0, 51.01} {
+		putEntity(t, datastore.IncompleteKey("LocationHistory", nil), &LocationHistoryEntry{PlayerID: "bob", Lat: lat, Lng: 3.9, Status: PlayerStatusOK, Timestamp: start.Add(time.Duration(i) * time.Minute)})
+	}
+	for by, leader := range map[string]string{"": "alice", "?by=distance": "bob"} {
+		rec := httptest.NewRecorder()
+		handleLeaderboard(rec, httptest.NewRequest(http.MethodGet, "/api/leaderboard"+by, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%q: got %d: %s", by, rec.Code, rec.Body.String())
+		}
+		var board []LeaderboardEntry
+		if err := json.NewDecoder(rec.Body).Decode(&board); err != nil {
+			t.Fatalf("decoding: %v", err)
+		}
+		if len(board) != 2 || board[0].PlayerID != leader {
+			t.Errorf("%q: got %+v, want %s first of 2", by, board, leader)
+		}
+	}
+}
+
+func TestCurrentChainStep(t *testing.T) {
+	done := PlayerTarget{CompletedAt: time.Now()}
+	for _, tc := range []struct {
+		chain []PlayerTarget
+		want  int
+	}{
+		{nil, -1},
+		{[]PlayerTarget{{}}, 0},
+		{[]PlayerTarget{done, {}, {}}, 1},
+		{[]PlayerTarget{done, done}, -1},
+		{[]PlayerTarget{{}, done}, 0},
+	} {
+		if got := currentChainStep(tc.chain); got != tc.want {
+			t.Errorf("%+v: got %d, want %d", tc.chain, got, tc.want)
+		}
+	}
+}
+
+func TestTargetChainRejectsBadRequests(t *testing.T) {
+	base := "/api/targets/chain/" + obfuscatePlayerID("alice")
+	for _, tc := range []struct {
+		method, url, body string
+		want              int
+	}{
+		{http.MethodGet, "/api/targets/chain/garbage", "", http.StatusBadRequest},
+		{http.MethodDelete, base, "", http.StatusMethodNotAllowed},
+		{http.MethodGet, base + "/reorder", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, base, `{"lat": 0, "lng": 0}`, http.StatusBadRequest},
+		{http.MethodPost, base, `{"lat": 51, "lng": 3.7, "arrivalRadiusMeters": -5}`, http.StatusBadRequest},
+		{http.MethodPost, base, `nope`, http.StatusBadRequest},
+		{http.MethodPost, base + "/reorder", `{"order": []}`, http.StatusBadRequest},
+		{http.MethodPost, base + "/reorder", `{"order": [1, 1]}`, http.StatusBadRequest},
+		{http.MethodPost, base + "/reorder", `{"order": [0, 1]}`, http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		handleTargetChain(rec, httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body)))
+		if rec.Code != tc.want {
+			t.Errorf("%s %s %s: got %d, want %d", tc.method, tc.url, tc.body, rec.Code, tc.want)
+		}
+	}
+}
+
+// chainRequest calls handleTargetChain for alice and decodes the response into out.
+func chainRequest(t *testing.T, method, suffix, body string, wantCode int, out interface{}) {
+	t.Helper()
+	url := "/api/targets/chain/" + obfuscatePlayerID("alice") + suffix
+	rec := httptest.NewRecorder()
+	handleTargetChain(rec, httptest.NewRequest(method, url, strings.NewReader(body)))
+	if rec.Code != wantCode {
+		t.Fatalf("%s %s: got %d, want %d: %s", method, url, rec.Code, wantCode, rec.Body.String())
+	}
+	if out != nil {
+		if err := json.NewDecoder(rec.Body).Decode(out); err != nil {
+			t.Fatalf("decoding %s %s: %v", method, url, err)
+		}
+	}
+}
+
+// polledTarget returns the target the player app is shown for playerID, or nil.
+func polledTarget(t *testing.T, playerID string) *TargetLocation {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handlePlayerMessages(rec, httptest.NewRequest(http.MethodGet, "/api/messages/"+obfuscatePlayerID(playerID), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("player poll: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Target *TargetLocation `json:"target"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding player poll: %v", err)
+	}
+	return resp.Target
+}
+
+// arriveAt reports alice's location at lat/lng.
+func arriveAt(t *testing.T, lat, lng float64) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"lat":%v,"lng":%v,"status":"OK"}`, lat, lng)
+	handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID("alice"), strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("updating location: got %d", rec.Code)
+	}
+}
+
+func TestTargetChainProgression(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory", "TargetLocation", "GameStats", "PlayerTarget")
+	for _, lng := range []string{"3.71", "3.72", "3.73"} {
+		chainRequest(t, http.MethodPost, "", `{"lat": 51.05, "lng": `+lng+`}`, http.StatusCreated, nil)
+	}
+
+	var chain []PlayerTarget
+	chainRequest(t, http.MethodGet, "", "", http.StatusOK, &chain)
+	if len(chain) != 3 || chain[0].Seq != 1 || chain[2].Lng != 3.73 {
+		t.Fatalf("chain: %+v", chain)
+	}
+	// Only the first step is shown.
+	if target := polledTarget(t, "alice"); target == nil || target.FakeHash != chain[0].FakeHash {
+		t.Fatalf("player sees %+v, want step 1", target)
+	}
+
+	arriveAt(t, 51.05, 3.71)
+	if target := polledTarget(t, "alice"); target == nil || target.FakeHash != chain[1].FakeHash {
+		t.Fatalf("after step 1 the player sees %+v, want step 2", target)
+	}
+
+	// Swapping the remaining steps makes the old step 3 current.
+	chainRequest(t, http.MethodPost, "/reorder", `{"order": [1, 3, 2]}`, http.StatusOK, &chain)
+	if chain[0].CompletedAt.IsZero() || !chain[1].CompletedAt.IsZero() || chain[1].Lng != 3.73 || chain[1].Seq != 2 {
+		t.Fatalf("reordered chain: %+v", chain)
+	}
+	if target := polledTarget(t, "alice"); target == nil || target.FakeHash != chain[1].FakeHash {
+		t.Fatalf("after reordering the player sees %+v, want the new step 2", target)
+	}
+	chainRequest(t, http.MethodPost, "/reorder", `{"order": [1, 2]}`, http.StatusBadRequest, nil)
+
+	arriveAt(t, 51.05, 3.73)
+	arriveAt(t, 51.05, 3.72)
+	chainRequest(t, http.MethodGet, "", "", http.StatusOK, &chain)
+	if currentChainStep(chain) != -1 {
+		t.Errorf("chain not finished: %+v", chain)
+	}
+	if stats := getStats(t); stats.Arrivals != 3 {
+		t.Errorf("got %d arrivals, want 3", stats.Arrivals)
+	}
+	var target TargetLocation
+	if err := dsClient.Get(context.Background(), datastore.NameKey("TargetLocation", "alice", nil), &target); err != nil {
+		t.Fatalf("getting target: %v", err)
+	}
+	if target.Lng != 3.72 || target.ArrivedAt.IsZero() {
+		t.Errorf("final target: %+v, want the last step, arrived", target)
+	}
+}
+
+func TestWriteJSONPretty(t *testing.T) {
+	v := map[string]interface{}{"lat": 51.05, "tags": []string{"a"}}
+	for url, want := range map[string]string{
+		"/api/map-config":              `{"lat":51.05,"tags":["a"]}` + "\n",
+		"/api/map-config?pretty=false": `{"lat":51.05,"tags":["a"]}` + "\n",
+		"/api/map-config?pretty=true":  "{\n  \"lat\": 51.05,\n  \"tags\": [\n    \"a\"\n  ]\n}\n",
+	} {
+		rec := httptest.NewRecorder()
+		writeJSON(rec, httptest.NewRequest(http.MethodGet, url, nil), v)
+		if got := rec.Body.String(); got != want {
+			t.Errorf("%s: got %q, want %q", url, got, want)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: Content-Type %q, want application/json", url, ct)
+		}
+	}
+
+	// Handlers pass ?pretty= through.
+	rec := httptest.NewRecorder()
+	handleMapConfig(rec, httptest.NewRequest(http.MethodGet, "/api/map-config?pretty=true", nil))
+	if !strings.HasPrefix(rec.Body.String(), "{\n  \"") {
+		t.Errorf("map config with ?pretty=true: got %q, want indented JSON", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	writeJSON(rec, httptest.NewRequest(http.MethodGet, "/api/map-config", nil), map[string]interface{}{"bad": math.NaN()})
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("unencodable value: got %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestDecodeJSONBody(t *testing.T) {
+	for _, tc := range []struct {
+		body, wantErr string
+	}{
+		{`{"name": "alice", "count": 2}`, ""},
+		{`{"name": "alice", "colour": "red"}`, `unknown field "colour"`},
+		{`{"name": "alice", "count": "two"}`, `field "count" must be of type int`},
+		{``, "request body is empty"},
+		{`{"name": `, "invalid JSON body"},
+		{`{"name": "alice"} {"name": "bob"}`, "request body must be a single JSON value"},
+	} {
+		var dst struct {
+			Name  string `json:"name"`
+			Count int    `json:"count"`
+		}
+		err := decodeJSONBody(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body)), &dst)
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("%q: unexpected error %v", tc.body, err)
+		}
+		if tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+			t.Errorf("%q: got error %v, want %q", tc.body, err, tc.wantErr)
+		}
+	}
+}
+
+func TestHandlersRejectUnknownAndMissingFields(t *testing.T) {
+	withLeadSessionKey(t)
+	alice := obfuscatePlayerID("alice")
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		url     string
+		body    string
+		want    string // Expected in the error message
+	}{
+		{"message typo", handlePlayerMessages, http.MethodPost, "/api/messages/" + alice, `{"mesage": "hi"}`, `unknown field "mesage"`},
+		{"empty message", handlePlayerMessages, http.MethodPost, "/api/messages/" + alice, `{"message": ""}`, `field "message" is required`},
+		{"DM without message", handleSendDirectMessage, http.MethodPost, "/api/dm/" + alice, `{}`, `field "message" is required`},
+		{"DM extra field", handleSendDirectMessage, http.MethodPost, "/api/dm/" + alice, `{"message": "hi", "urgent": true}`, `unknown field "urgent"`},
+		{"location without status", handleUpdateLocation, http.MethodPost, "/api/locations/" + alice, `{"lat": 51, "lng": 4}`, `field "status" is required`},
+		{"OK without lng", handleUpdateLocation, http.MethodPost, "/api/locations/" + alice, `{"lat": 51, "status": "OK"}`, `field "lng" is required`},
+		{"location accuracy", handleUpdateLocation, http.MethodPost, "/api/locations/" + alice, `{"lat": 51, "lng": 4, "status": "OK", "accuracy": 5}`, `unknown field "accuracy"`},
+		{"target without lat", handleSetTargetLocation, http.MethodPost, "/api/target/" + alice, `{"lng": 4}`, `field "lat" is required`},
+		{"target lat as string", handleSetTargetLocation, http.MethodPost, "/api/target/" + alice, `{"lat": "51", "lng": 4}`, `field "lat" must be of type float64`},
+		{"chain step without lng", handleTargetChain, http.MethodPost, "/api/targets/chain/" + alice, `{"lat": 51}`, `field "lng" is required`},
+		{"reorder without order", handleTargetChain, http.MethodPost, "/api/targets/chain/" + alice + "/reorder", `{}`, `field "order" is required`},
+		{"batch entry typo", handleBatchSetTargets, http.MethodPost, "/api/targets/batch", `[{"player": "x", "lat": 51, "lng": 4}]`, `unknown field "player"`},
+		{"obfuscate without player", handleObfuscateURL, http.MethodPost, "/api/obfuscate-url", `{}`, `field "playerID" is required`},
+		{"obfuscate batch without players", handleObfuscateURLBatch, http.MethodPost, "/api/obfuscate-url/batch", `{}`, `field "playerIDs" is required`},
+		{"test result without player", handleTestResult, http.MethodPost, "/api/test-result", `{"serverStatus": "Success"}`, `field "playerName" is required`},
+		{"login without password", handleLeadLogin, http.MethodPost, "/api/leads/login", `{"username": "ann"}`, `field "password" is required`},
+		{"webhook without url", handleRegisterWebhook, http.MethodPost, "/api/admin/webhooks", `{"events": ["arrival"]}`, `field "url" is required`},
+		{"roster entry typo", handleLoadTargets, http.MethodPost, "/api/admin/load-targets", `[{"name": "alice"}]`, `entry 0: unknown field "name"`},
+	} {
+		rec := httptest.NewRecorder()
+		tc.handler(rec, httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body)))
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tc.want) {
+			t.Errorf("%s: got %d %q, want %d with %q", tc.name, rec.Code, strings.TrimSpace(rec.Body.String()), http.StatusBadRequest, tc.want)
+		}
+	}
+}
+
+func TestSanitizeMessage(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"  hello  ", "hello"},
+		{"line one\nline two\t!", "line one\nline two\t!"},
+		{"be\x00ll\x07 \x1b[31mred\u0085", "bell [31mred"},
+		{"\r\n meet at <b>5</b> & don't wait \r\n", "meet at <b>5</b> & don't wait"},
+		{`<img src=x onerror="alert(1)">`, `<img src=x onerror="alert(1)">`},
+	} {
+		got, err := sanitizeMessage(tc.in)
+		if err != nil || got != tc.want {
+			t.Errorf("%q: got %q, %v, want %q", tc.in, got, err, tc.want)
+		}
+	}
+
+	for _, blank := range []string{" ", "\n\t ", "\x00\x07"} {
+		if _, err := sanitizeMessage(blank); err == nil {
+			t.Errorf("%q: got no error for a blank message", blank)
+		}
+	}
+}
+
+func TestMessagesRejectWhitespaceOnlyContent(t *testing.T) {
+	alice := obfuscatePlayerID("alice")
+	for url, handler := range map[string]http.HandlerFunc{
+		"/api/messages/" + alice: handlePlayerMessages,
+		"/api/dm/" + alice:       handleSendDirectMessage,
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, url, strings.NewReader(`{"message": " \n\t \u0000 "}`)))
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "blank") {
+			t.Errorf("%s: got %d %q, want %d", url, rec.Code, rec.Body.String(), http.StatusBadRequest)
+		}
+	}
+}
+
+// withPlayerLimit sets maxPlayers and seeds the player registry with known players.
+// With known nil, the registry loads the players from the datastore instead.
+func withPlayerLimit(t *testing.T, limit int, known ...string) {
+	t.Helper()
+	oldMax, oldIDs, oldLoaded := maxPlayers, players.ids, players.loaded
+	maxPlayers = limit
+	players.ids, players.loaded = nil, time.Time{}
+	if known != nil {
+		players.ids = make(map[string]bool)
+		for _, id := range known {
+			players.ids[id] = true
+		}
+		players.loaded = time.Now()
+	}
+	t.Cleanup(func() { maxPlayers, players.ids, players.loaded = oldMax, oldIDs, oldLoaded })
+}
+
+func TestObfuscateURLEnforcesPlayerLimit(t *testing.T) {
+	withPlayerLimit(t, 2, "alice", "bob")
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		path    string
+		body    string
+		want    int
+	}{
+		{handleObfuscateURL, "/api/obfuscate-url", `{"playerID":"alice"}`, http.StatusOK},
+		{handleObfuscateURL, "/api/obfuscate-url", `{"playerID":"carol"}`, http.StatusForbidden},
+		{handleObfuscateURLBatch, "/api/obfuscate-url/batch", `{"playerIDs":["bob","alice"]}`, http.StatusOK},
+		{handleObfuscateURLBatch, "/api/obfuscate-url/batch", `{"playerIDs":["alice","carol"]}`, http.StatusForbidden},
+	} {
+		rec := httptest.NewRecorder()
+		tc.handler(rec, httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body)))
+		if rec.Code != tc.want {
+			t.Errorf("%s %s: got %d, want %d: %s", tc.path, tc.body, rec.Code, tc.want, rec.Body.String())
+		}
+	}
+}
+
+func TestUpdateLocationEnforcesPlayerLimit(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory")
+	withPlayerLimit(t, 2)
+	update := func(player string) int {
+		rec := httptest.NewRecorder()
+		handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID(player), strings.NewReader(`{"lat":51.0,"lng":3.9,"status":"OK"}`)))
+		return rec.Code
+	}
+
+	for _, player := range []string{"alice", "bob"} {
+		if code := update(player); code != http.StatusOK {
+			t.Fatalf("%s: got %d, want %d", player, code, http.StatusOK)
+		}
+	}
+	if code := update("carol"); code != http.StatusForbidden {
+		t.Errorf("third player: got %d, want %d", code, http.StatusForbidden)
+	}
+
+	// Forgetting the cached players makes the limit count what's in the datastore.
+	players.invalidate()
+	if code := update("alice"); code != http.StatusOK {
+		t.Errorf("existing player: got %d, want %d", code, http.StatusOK)
+	}
+	if code := update("carol"); code != http.StatusForbidden {
+		t.Errorf("third player after reload: got %d, want %d", code, http.StatusForbidden)
+	}
+}
+
+// flakyCall stands in for a datastore call that fails with err a number of times
+// before it succeeds.
+type flakyCall struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *flakyCall) call() error {
+	f.calls++
+	if f.calls <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+func TestWithRetry(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "datastore unavailable")
+	for _, tc := range []struct {
+		name      string
+		call      flakyCall
+		wantErr   bool
+		wantCalls int
+	}{
+		{"succeeds after two transient failures", flakyCall{failures: 2, err: unavailable}, false, 3},
+		{"deadline exceeded is retried", flakyCall{failures: 1, err: status.Error(codes.DeadlineExceeded, "slow")}, false, 2},
+		{"gives up after max attempts", flakyCall{failures: 5, err: unavailable}, true, 3},
+		{"other errors aren't retried", flakyCall{failures: 5, err: status.Error(codes.InvalidArgument, "bad key")}, true, 1},
+		{"no such entity isn't retried", flakyCall{failures: 5, err: datastore.ErrNoSuchEntity}, true, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := withRetry(context.Background(), tc.call.call)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("got error %v, want error: %v", err, tc.wantErr)
+			}
+			if tc.call.calls != tc.wantCalls {
+				t.Errorf("got %d calls, want %d", tc.call.calls, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWithRetryStopsWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	call := flakyCall{failures: 5, err: status.Error(codes.Unavailable, "datastore unavailable")}
+	if err := withRetry(ctx, call.call); err == nil {
+		t.Fatal("got no error, want the last datastore error")
+	}
+	if call.calls != 1 {
+		t.Errorf("got %d calls, want 1", call.calls)
+	}
+}
+
+func TestIndexWarning(t *testing.T) {
+	notFound := status.Error(codes.FailedPrecondition, "no matching index found. recommended index is:\n- kind: PlayerMessage")
+	for name, err := range map[string]error{
+		"missing index": notFound,
+		"wrapped":       fmt.Errorf("running query: %w", notFound),
+	} {
+		warning := indexWarning("PlayerMessage (PlayerID, -Timestamp)", err)
+		if !strings.Contains(warning, "Datastore index PlayerMessage (PlayerID, -Timestamp) is missing") || !strings.Contains(warning, "gcloud datastore indexes create index.yaml") {
+			t.Errorf("%s: got warning %q", name, warning)
+		}
+	}
+
+	for name, err := range map[string]error{
+		"nil":                nil,
+		"unavailable":        status.Error(codes.Unavailable, "datastore unavailable"),
+		"other precondition": status.Error(codes.FailedPrecondition, "transaction is no longer active"),
+		"not a gRPC error":   errors.New("no matching index found"),
+	} {
+		if warning := indexWarning("PlayerMessage (PlayerID, -Timestamp)", err); warning != "" {
+			t.Errorf("%s: got warning %q, want none", name, warning)
+		}
+	}
+}
+
+func TestIndexChecksCoverIndexYAML(t *testing.T) {
+	data, err := os.ReadFile("index.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexes := regexp.MustCompile(`(?m)^- kind: `).FindAll(data, -1)
+	if got := len(indexChecks()); got != len(indexes) {
+		t.Errorf("indexChecks has %d queries, index.yaml declares %d indexes", got, len(indexes))
+	}
+}
+
+func postRenamePlayer(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleRenamePlayer(rec, httptest.NewRequest(http.MethodPost, "/api/admin/rename-player", strings.NewReader(body)))
+	return rec
+}
+
+func TestRenamePlayerRejectsBadRequests(t *testing.T) {
+	for _, body := range []string{
+		`{}`,
+		`{"oldName": "alise"}`,
+		`{"newName": "alice"}`,
+		`{"oldName": "alice", "newName": "alice"}`,
+		`{"oldName": "alise", "newName": "` + strings.Repeat("a", maxPlayerIDLength+1) + `"}`,
+	} {
+		if rec := postRenamePlayer(t, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestRenamePlayer(t *testing.T) {
+	kinds := append(append([]string{"PlayerTarget", "ReadCursor"}, renameKeyedKinds...), renameFieldKinds...)
+	requireEmulator(t, kinds...)
+	ctx := context.Background()
+	now := time.Now()
+	putEntity(t, datastore.NameKey("PlayerLocation", "alise", nil), &PlayerLocation{Lat: 51.05, Lng: 3.72, Status: PlayerStatusOK, Timestamp: now})
+	putEntity(t, datastore.NameKey("TargetLocation", "alise", nil), &TargetLocation{Lat: 51.06, Lng: 3.73, FakeHash: "ABCD1234", IsReleased: true, Timestamp: now})
+	putEntity(t, datastore.NameKey("TestResult", "alise", nil), &TestResult{PlayerName: "alise", LocationStatus: "ok", Timestamp: now})
+	putEntity(t, datastore.NameKey("PlayerTarget", "", datastore.NameKey("TargetChain", "alise", nil)), &PlayerTarget{Lat: 51.07, Lng: 3.74})
+	for i := 0; i < 3; i++ {
+		putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "alise", Content: fmt.Sprintf("message %d", i), Timestamp: now})
+	}
+	putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "alise", Content: "go north", Timestamp: now})
+	putEntity(t, datastore.IncompleteKey("PlayerMessage", nil), &PlayerMessage{PlayerID: "bob", Content: "not alise's", Timestamp: now})
+	putEntity(t, datastore.NameKey("ReadCursor", "ann:alise", nil), &ReadCursor{LeadID: "ann", PlayerID: "alise", ReadUpTo: now, Updated: now})
+
+	rec := postRenamePlayer(t, `{"oldName": "alise", "newName": "alice"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rename: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var summary RenameSummary
+	if err := json.NewDecoder(rec.Body).Decode(&summary); err != nil {
+		t.Fatalf("decoding summary: %v", err)
+	}
+	want := map[string]int{"PlayerLocation": 1, "TargetLocation": 1, "TestResult": 1, "PlayerTarget": 1, "PlayerMessage": 3, "DirectMessage": 1, "ReadCursor": 1}
+	if !reflect.DeepEqual(summary.Moved, want) {
+		t.Errorf("moved %v, want %v", summary.Moved, want)
+	}
+
+	var target TargetLocation
+	if err := dsClient.Get(ctx, datastore.NameKey("TargetLocation", "alice", nil), &target); err != nil || target.FakeHash != "ABCD1234" {
+		t.Errorf("target under the new name: %+v, %v", target, err)
+	}
+	var result TestResult
+	if err := dsClient.Get(ctx, datastore.NameKey("TestResult", "alice", nil), &result); err != nil || result.PlayerName != "alice" || result.LocationStatus != "ok" {
+		t.Errorf("test result under the new name: %+v, %v", result, err)
+	}
+	for _, kind := range []string{"PlayerLocation", "TargetLocation", "TestResult"} {
+		if err := dsClient.Get(ctx, datastore.NameKey(kind, "alise", nil), &datastore.PropertyList{}); err != datastore.ErrNoSuchEntity {
+			t.Errorf("%s under the old name: got %v, want it deleted", kind, err)
+		}
+	}
+	steps, err := dsClient.GetAll(ctx, datastore.NewQuery("PlayerTarget").Ancestor(datastore.NameKey("TargetChain", "alice", nil)).KeysOnly(), nil)
+	if err != nil || len(steps) != 1 {
+		t.Errorf("chain steps under the new name: %d, %v", len(steps), err)
+	}
+	if n := countEntities(t, "PlayerTarget"); n != 1 {
+		t.Errorf("got %d chain steps in total, want 1", n)
+	}
+	var cursor ReadCursor
+	if err := dsClient.Get(ctx, datastore.NameKey("ReadCursor", "ann:alice", nil), &cursor); err != nil || cursor.PlayerID != "alice" || cursor.LeadID != "ann" {
+		t.Errorf("read cursor under the new name: %+v, %v", cursor, err)
+	}
+	if err := dsClient.Get(ctx, datastore.NameKey("ReadCursor", "ann:alise", nil), &datastore.PropertyList{}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("read cursor under the old name: got %v, want it deleted", err)
+	}
+
+	var messages []PlayerMessage
+	if _, err := dsClient.GetAll(ctx, datastore.NewQuery("PlayerMessage").FilterField("PlayerID", "=", "alice"), &messages); err != nil || len(messages) != 3 {
+		t.Errorf("messages of the new name: %d, %v", len(messages), err)
+	}
+	var dms []DirectMessage
+	if _, err := dsClient.GetAll(ctx, datastore.NewQuery("DirectMessage").FilterField("PlayerID", "=", "alice"), &dms); err != nil || len(dms) != 1 || dms[0].Content != "go north" {
+		t.Errorf("DMs of the new name: %+v, %v", dms, err)
+	}
+	if n, _ := dsClient.Count(ctx, datastore.NewQuery("PlayerMessage").FilterField("PlayerID", "=", "bob")); n != 1 {
+		t.Errorf("bob has %d messages, want his 1 left alone", n)
+	}
+
+	// Nothing is left under the old name, and the new name can't be overwritten.
+	if rec := postRenamePlayer(t, `{"oldName": "alise", "newName": "alicia"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("renaming again: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	putEntity(t, datastore.NameKey("PlayerLocation", "bob", nil), &PlayerLocation{Status: PlayerStatusOK, Timestamp: now})
+	if rec := postRenamePlayer(t, `{"oldName": "bob", "newName": "alice"}`); rec.Code != http.StatusConflict {
+		t.Errorf("renaming onto an existing player: got %d, want %d", rec.Code, http.StatusConflict)
+	}
+	// A name with only chain steps is taken too.
+	putEntity(t, datastore.IncompleteKey("PlayerTarget", datastore.NameKey("TargetChain", "carol", nil)), &PlayerTarget{Lat: 51.08, Lng: 3.75})
+	if rec := postRenamePlayer(t, `{"oldName": "bob", "newName": "carol"}`); rec.Code != http.StatusConflict {
+		t.Errorf("renaming onto an existing chain: got %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if err := dsClient.Get(ctx, datastore.NameKey("PlayerLocation", "bob", nil), &datastore.PropertyList{}); err != nil {
+		t.Errorf("bob's location after the refused rename: %v", err)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	requireEmulator(t, knownKinds...)
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Millisecond)
+	chainStep := datastore.IDKey("PlayerTarget", 1, datastore.NameKey("TargetChain", "alice", nil))
+	seed := map[*datastore.Key]interface{}{
+		datastore.NameKey("PlayerLocation", "alice", nil):            &PlayerLocation{Lat: 51.03, Lng: 3.97, Timestamp: now, Status: PlayerStatusOK},
+		datastore.NameKey("PlayerLocation", "bob", nil):              &PlayerLocation{Lat: 51.04, Lng: 3.98, Timestamp: now, Status: PlayerStatusOK},
+		datastore.IDKey("PlayerMessage", 7, nil):                     &PlayerMessage{PlayerID: "alice", Content: "hi", Timestamp: now},
+		datastore.IDKey("DirectMessage", 8, nil):                     &DirectMessage{PlayerID: "bob", SenderID: "lead", Content: "go north", Timestamp: now, DeliveredAt: now},
+		datastore.NameKey("TargetLocation", "alice", nil):            &TargetLocation{Lat: 51.05, Lng: 3.99, Timestamp: now, FakeHash: "abc", IsReleased: true},
+		datastore.NameKey("TestResult", "alice", nil):                &TestResult{PlayerName: "alice", LocationStatus: "ok", Timestamp: now},
+		datastore.IDKey("LocationHistory", 9, nil):                   &LocationHistoryEntry{PlayerID: "alice", Lat: 51.03, Lng: 3.97, Timestamp: now, Status: PlayerStatusOK},
+		datastore.NameKey("IdempotencyRecord", "alice:k1", nil):      &IdempotencyRecord{PlayerID: "alice", MessageID: 7, Timestamp: now},
+		datastore.NameKey("NotificationPrefs", "alice", nil):         &NotificationPrefs{TargetAlerts: true},
+		datastore.NameKey("ArchivedMessage", "PlayerMessage-3", nil): &ArchivedMessage{Kind: "PlayerMessage", ID: 3, PlayerID: "bob", Content: "old", Timestamp: now, ArchivedAt: now},
+		datastore.NameKey("GameStats", "global", nil):                &GameStats{Arrivals: 4, UpdatedAt: now},
+		chainStep: &PlayerTarget{Lat: 51.06, Lng: 4.0, FakeHash: "step1", Created: now},
+		datastore.IDKey("EmergencyAlert", 10, nil):        &EmergencyAlert{PlayerID: "bob", Raised: now},
+		datastore.NameKey("ReadCursor", "ann:alice", nil): &ReadCursor{LeadID: "ann", PlayerID: "alice", ReadUpTo: now, Updated: now},
+		datastore.NameKey("GameState", "global", nil):     &GameState{Paused: true, UpdatedAt: now},
+		datastore.NameKey("Player", "alice", nil):         &Player{DisplayName: "Agent Red", Updated: now},
+		datastore.IDKey("Arrival", 11, nil):               &Arrival{PlayerID: "alice", Lat: 51.05, Lng: 3.99, FakeHash: "abc", ArrivedAt: now},
+	}
+	for key, entity := range seed {
+		if _, err := dsClient.Put(ctx, key, entity); err != nil {
+			t.Fatalf("seeding %v: %v", key, err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleExport(rec, httptest.NewRequest(http.MethodGet, "/api/admin/export", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("export: got %d: %s", rec.Code, rec.Body.String())
+	}
+	backup := rec.Body.Bytes()
+	if !json.Valid(backup) {
+		t.Fatalf("export is not valid JSON: %s", backup)
+	}
+
+	clear := httptest.NewRecorder()
+	handleClearDatastore(clear, httptest.NewRequest(http.MethodPost, "/api/admin/clear-datastore?confirm=true", nil))
+	if clear.Code != http.StatusOK {
+		t.Fatalf("clear: got %d: %s", clear.Code, clear.Body.String())
+	}
+	// Load the display names while there are none, the import must not leave them cached.
+	withLocationsCache(t)
+	if names, err := playerDisplayNames(ctx); err != nil || len(names) != 0 {
+		t.Fatalf("display names after clearing: got %v, %v", names, err)
+	}
+
+	rec = httptest.NewRecorder()
+	handleImport(rec, httptest.NewRequest(http.MethodPost, "/api/admin/import", bytes.NewReader(backup)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("import: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Imported map[string]int `json:"imported"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding import response: %v", err)
+	}
+	want := make(map[string]int)
+	for key := range seed {
+		want[key.Kind]++
+	}
+	for _, kind := range knownKinds {
+		if want[kind] == 0 {
+			t.Errorf("round trip doesn't seed %s", kind)
+		}
+	}
+	if !reflect.DeepEqual(resp.Imported, want) {
+		t.Errorf("imported %v, want %v", resp.Imported, want)
+	}
+
+	for kind, n := range want {
+		count, err := dsClient.Count(ctx, datastore.NewQuery(kind))
+		if err != nil {
+			t.Fatalf("counting %s: %v", kind, err)
+		}
+		if count != n {
+			t.Errorf("%s: %d entities after import, want %d", kind, count, n)
+		}
+	}
+	var dm DirectMessage
+	if err := dsClient.Get(ctx, datastore.IDKey("DirectMessage", 8, nil), &dm); err != nil {
+		t.Fatalf("getting restored DM: %v", err)
+	}
+	if dm.Content != "go north" || !dm.Timestamp.Equal(now) || !dm.DeliveredAt.Equal(now) {
+		t.Errorf("restored DM %+v, want the exported one", dm)
+	}
+	var step PlayerTarget
+	if err := dsClient.Get(ctx, chainStep, &step); err != nil {
+		t.Fatalf("getting restored chain step under its parent: %v", err)
+	}
+	if step.FakeHash != "step1" {
+		t.Errorf("restored chain step %+v, want the exported one", step)
+	}
+	if names, err := playerDisplayNames(ctx); err != nil || names["alice"] != "Agent Red" {
+		t.Errorf("display names after import: got %v, %v, want alice's restored", names, err)
+	}
+}
+
+func TestImportRejectsBadBackup(t *testing.T) {
+	for _, body := range []string{
+		"",
+		"[]",
+		`{"kinds": []}`,
+		`{"kinds": {"Lead": []}}`,
+		`{"kinds": {"PlayerLocation": [{"entity": {}}]}}`,
+		`{"kinds": {"PlayerLocation": [{"name": "alice", "id": 3, "entity": {}}]}}`,
+		`{"kinds": {"PlayerLocation": [{"name": "alice", "entity": {"color": "red"}}]}}`,
+		`{"kinds": {"PlayerTarget": [{"id": 1, "parent": {"name": "alice"}, "entity": {}}]}}`,
+		`{"kinds": {"PlayerTarget": [{"id": 1, "parent": {"kind": "TargetChain"}, "entity": {}}]}}`,
+		`{"version": 2, "kinds": {}}`,
+		`{"kinds": {"PlayerLocation": [`,
+	} {
+		rec := httptest.NewRecorder()
+		handleImport(rec, httptest.NewRequest(http.MethodPost, "/api/admin/import", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: got %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestCounts(t *testing.T) {
+	requireEmulator(t, knownKinds...)
+	ctx := context.Background()
+	seed := map[string]int{"PlayerLocation": 3, "PlayerMessage": 2, "TestResult": 1}
+	for kind, n := range seed {
+		for i := 0; i < n; i++ {
+			key := datastore.NameKey(kind, fmt.Sprintf("p%d", i), nil)
+			var err error
+			switch kind {
+			case "PlayerLocation":
+				_, err = dsClient.Put(ctx, key, &PlayerLocation{Lat: 51, Lng: 3.9, Timestamp: time.Now(), Status: PlayerStatusOK})
+			case "PlayerMessage":
+				_, err = dsClient.Put(ctx, key, &PlayerMessage{PlayerID: "p0", Content: "hi", Timestamp: time.Now()})
+			case "TestResult":
+				_, err = dsClient.Put(ctx, key, &TestResult{PlayerName: "p0", Timestamp: time.Now()})
+			}
+			if err != nil {
+				t.Fatalf("seeding %v: %v", key, err)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleCounts(rec, httptest.NewRequest(http.MethodGet, "/api/admin/counts", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var counts map[string]int
+	if err := json.NewDecoder(rec.Body).Decode(&counts); err != nil {
+		t.Fatalf("decoding counts: %v", err)
+	}
+	if len(counts) != len(knownKinds) {
+		t.Errorf("got counts for %d kinds, want %d", len(counts), len(knownKinds))
+	}
+	for _, kind := range knownKinds {
+		if counts[kind] != seed[kind] {
+			t.Errorf("%s: got %d, want %d", kind, counts[kind], seed[kind])
+		}
+	}
+}
+
+func TestServeTemplateCachesParsedFile(t *testing.T) {
+	for _, reload := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reload=%v", reload), func(t *testing.T) {
+			old := devReloadTemplates
+			devReloadTemplates = reload
+			t.Cleanup(func() { devReloadTemplates = old })
+			t.Setenv("GAE_VERSION", "v42")
+
+			filename := filepath.Join(t.TempDir(), "page.html")
+			write := func(content string) {
+				if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+					t.Fatalf("writing template: %v", err)
+				}
+			}
+			serve := serveTemplate(filename)
+			get := func() string {
+				rec := httptest.NewRecorder()
+				serve(rec, httptest.NewRequest(http.MethodGet, "/page", nil))
+				return rec.Body.String()
+			}
+			write("first {{.AppVersion}}")
+
+			if got := get(); got != "first v42" {
+				t.Fatalf("first request: got %q", got)
+			}
+			write("second {{.AppVersion}}")
+			want := "first v42"
+			if reload {
+				want = "second v42"
+			}
+			if got := get(); got != want {
+				t.Errorf("after editing the file: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestStaticAssetETag(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleStatic(rec, httptest.NewRequest(http.MethodGet, "/static/css/style.css", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag header")
+	}
+	if cc := rec.Header().Get("Cache-Control"); !strings.Contains(cc, "max-age=") {
+		t.Errorf("Cache-Control is %q, want a max-age", cc)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/css") {
+		t.Errorf("Content-Type is %q, want text/css", ct)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/static/css/style.css", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handleStatic(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("matching If-None-Match: got %d, want %d", rec.Code, http.StatusNotModified)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/static/css/style.css", nil)
+	req.Header.Set("If-None-Match", `"stale"`)
+	rec = httptest.NewRecorder()
+	handleStatic(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("stale If-None-Match: got %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestStaticAssetsExcludeTemplatesAndTargets(t *testing.T) {
+	for _, path := range []string{"/static/player.html", "/static/index.html", "/static/initial_targets.json", "/static/", "/static/js/", "/static/../main.go", "/static/missing.js"} {
+		rec := httptest.NewRecorder()
+		handleStatic(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: got %d, want %d", path, rec.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestStaticAssetPrecompressed(t *testing.T) {
+	dir := t.TempDir()
+	old := staticDir
+	staticDir = dir
+	t.Cleanup(func() { staticDir = old })
+
+	content := strings.Repeat("console.log('hello');\n", 100)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(content))
+	gz.Close()
+	if err := os.WriteFile(filepath.Join(dir, "app.js"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "app.js.gz"), compressed.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/static/app.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handleStatic(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got %d with Content-Encoding %q, want the pre-compressed file", rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.Contains(ct, "javascript") {
+		t.Errorf("Content-Type is %q, want JavaScript", ct)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("reading gzip body: %v", err)
+	}
+	if body, _ := io.ReadAll(zr); string(body) != content {
+		t.Errorf("decompressed body doesn't match app.js")
+	}
+
+	rec = httptest.NewRecorder()
+	handleStatic(rec, httptest.NewRequest(http.MethodGet, "/static/app.js", nil))
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != content {
+		t.Errorf("client without gzip got Content-Encoding %q", rec.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestSecurityHeadersOnTemplates(t *testing.T) {
+	t.Setenv("GAE_VERSION", "v1")
+	handler := securityHeaders(serveTemplate("static/login.html"))
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	for header, want := range map[string]string{
+		"Content-Security-Policy": defaultContentSecurityPolicy,
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "DENY",
+		"Referrer-Policy":         "strict-origin-when-cross-origin",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("%s: got %q, want %q", header, got, want)
+		}
+	}
+
+	old := contentSecurityPolicy
+	contentSecurityPolicy = "default-src 'none'"
+	t.Cleanup(func() { contentSecurityPolicy = old })
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if got := rec.Header().Get("Content-Security-Policy"); got != "default-src 'none'" {
+		t.Errorf("overridden policy: got %q", got)
+	}
+}
+
+// alertsRequest calls an alerts endpoint as the lead "ann".
+func alertsRequest(t *testing.T, method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	handler := requireLead(handleGetAlerts)
+	if path != "/api/alerts" {
+		handler = requireLead(handleResolveAlert)
+	}
+	req := httptest.NewRequest(method, path, nil)
+	req.AddCookie(&http.Cookie{Name: leadSessionCookie, Value: signLeadSession("ann", "", time.Now().Add(time.Hour))})
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestRaiseAndResolveEmergencyAlert(t *testing.T) {
+	requireEmulator(t, "EmergencyAlert", "PlayerLocation")
+	withLeadSessionKey(t)
+	located := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	putEntity(t, datastore.NameKey("PlayerLocation", "alice", nil), &PlayerLocation{Lat: 51.03, Lng: 3.97, Timestamp: located, Status: PlayerStatusOK})
+
+	rec := httptest.NewRecorder()
+	handlePanic(rec, httptest.NewRequest(http.MethodPost, "/api/panic/"+obfuscatePlayerID("alice"), nil))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("panic: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var raised EmergencyAlert
+	if err := json.NewDecoder(rec.Body).Decode(&raised); err != nil {
+		t.Fatalf("decoding alert: %v", err)
+	}
+	if raised.ID == 0 || raised.PlayerID != "alice" || raised.Lat != 51.03 || raised.Lng != 3.97 || !raised.LocatedAt.Equal(located) {
+		t.Errorf("raised %+v, want alice's alert with her last location", raised)
+	}
+
+	// A player without a location can still raise an alert.
+	rec = httptest.NewRecorder()
+	handlePanic(rec, httptest.NewRequest(http.MethodPost, "/api/panic/"+obfuscatePlayerID("bob"), nil))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("panic without location: got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var alerts []EmergencyAlert
+	rec = alertsRequest(t, http.MethodGet, "/api/alerts")
+	if err := json.NewDecoder(rec.Body).Decode(&alerts); err != nil {
+		t.Fatalf("decoding alerts: %v", err)
+	}
+	if len(alerts) != 2 || alerts[0].PlayerID != "bob" || alerts[1].ID != raised.ID {
+		t.Fatalf("got alerts %+v, want bob's then alice's", alerts)
+	}
+
+	rec = alertsRequest(t, http.MethodPost, fmt.Sprintf("/api/alerts/%d/resolve", raised.ID))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("resolve: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resolved EmergencyAlert
+	if err := json.NewDecoder(rec.Body).Decode(&resolved); err != nil {
+		t.Fatalf("decoding resolved alert: %v", err)
+	}
+	if !resolved.Resolved || resolved.ResolvedBy != "ann" || resolved.ResolvedAt.IsZero() {
+		t.Errorf("resolved %+v, want it resolved by ann", resolved)
+	}
+
+	// Resolving again keeps the first resolution.
+	rec = alertsRequest(t, http.MethodPost, fmt.Sprintf("/api/alerts/%d/resolve", raised.ID))
+	var again EmergencyAlert
+	json.NewDecoder(rec.Body).Decode(&again)
+	if rec.Code != http.StatusOK || !again.ResolvedAt.Equal(resolved.ResolvedAt) {
+		t.Errorf("second resolve: got %d with %+v", rec.Code, again)
+	}
+
+	alerts = nil
+	rec = alertsRequest(t, http.MethodGet, "/api/alerts")
+	if err := json.NewDecoder(rec.Body).Decode(&alerts); err != nil {
+		t.Fatalf("decoding alerts: %v", err)
+	}
+	if len(alerts) != 1 || alerts[0].PlayerID != "bob" {
+		t.Errorf("after resolving: got %+v, want only bob's alert", alerts)
+	}
+
+	if rec := alertsRequest(t, http.MethodPost, "/api/alerts/999999/resolve"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown alert: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+// withPanicCooldown enables the panic cooldown for the duration of a test.
+func withPanicCooldown(t *testing.T, window time.Duration) {
+	t.Helper()
+	panicCooldown = window
+	panicCooldowns.def.last = nil
+	t.Cleanup(func() {
+		panicCooldown = 0
+		panicCooldowns.def.last = nil
+	})
+}
+
+func TestCooldowns(t *testing.T) {
+	var c cooldowns
+	now := time.Now()
+	if wait := c.take("alice", now, 30*time.Second); wait != 0 {
+		t.Fatalf("first take: wait %v, want none", wait)
+	}
+	if wait := c.take("alice", now.Add(10*time.Second), 30*time.Second); wait != 20*time.Second {
+		t.Errorf("during the cooldown: wait %v, want 20s", wait)
+	}
+	if wait := c.take("bob", now.Add(10*time.Second), 30*time.Second); wait != 0 {
+		t.Errorf("another player: wait %v, want none", wait)
+	}
+	if wait := c.take("alice", now.Add(30*time.Second), 30*time.Second); wait != 0 {
+		t.Errorf("after the cooldown: wait %v, want none", wait)
+	}
+	c.forget("alice")
+	if wait := c.take("alice", now.Add(31*time.Second), 30*time.Second); wait != 0 {
+		t.Errorf("after forget: wait %v, want none", wait)
+	}
+	// Ended cooldowns are dropped; bob's ended at 40s.
+	c.take("carol", now.Add(45*time.Second), 30*time.Second)
+	if _, ok := c.last["bob"]; ok {
+		t.Error("bob's ended cooldown is still remembered")
+	}
+}
+
+func TestPanicCooldown(t *testing.T) {
+	requireEmulator(t, "EmergencyAlert", "PlayerLocation")
+	withPanicCooldown(t, 30*time.Second)
+	press := func(playerID string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handlePanic(rec, httptest.NewRequest(http.MethodPost, "/api/panic/"+obfuscatePlayerID(playerID), nil))
+		return rec
+	}
+
+	if rec := press("alice"); rec.Code != http.StatusCreated {
+		t.Fatalf("first press: got %d: %s", rec.Code, rec.Body.String())
+	}
+	for i := 0; i < 3; i++ {
+		rec := press("alice")
+		if rec.Code != http.StatusTooManyRequests {
+			t.Errorf("press %d: got %d, want %d", i+2, rec.Code, http.StatusTooManyRequests)
+		}
+		if retry, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || retry < 1 || retry > 30 {
+			t.Errorf("press %d: Retry-After %q, want 1-30 seconds", i+2, rec.Header().Get("Retry-After"))
+		}
+	}
+	if rec := press("bob"); rec.Code != http.StatusCreated {
+		t.Errorf("another player: got %d, want %d", rec.Code, http.StatusCreated)
+	}
+
+	var alerts []EmergencyAlert
+	if _, err := dsClient.GetAll(context.Background(), datastore.NewQuery("EmergencyAlert").FilterField("PlayerID", "=", "alice"), &alerts); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 1 || alerts[0].Resolved {
+		t.Errorf("alice has alerts %+v, want just the first, unresolved", alerts)
+	}
+}
+
+func TestEmergencyAlertBadRequests(t *testing.T) {
+	withLeadSessionKey(t)
+	rec := httptest.NewRecorder()
+	handlePanic(rec, httptest.NewRequest(http.MethodPost, "/api/panic/not-a-player", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("bad player ID: got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	for path, want := range map[string]int{
+		"/api/alerts/abc/resolve": http.StatusBadRequest,
+		"/api/alerts/0/resolve":   http.StatusBadRequest,
+		"/api/alerts/12":          http.StatusNotFound,
+	} {
+		if rec := alertsRequest(t, http.MethodPost, path); rec.Code != want {
+			t.Errorf("%s: got %d, want %d", path, rec.Code, want)
+		}
+	}
+	if rec := alertsRequest(t, http.MethodGet, "/api/alerts/12/resolve"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET resolve: got %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	old := minMoveMeters
+	minMoveMeters = defaultMinMoveMeters
+	t.Cleanup(func() { minMoveMeters = old })
+
+	now := time.Now()
+	prev := PlayerLocation{Lat: 51.0, Lng: 3.9, Timestamp: now.Add(-10 * time.Second), Status: PlayerStatusOK}
+	update := func(lat float64, at time.Time) PlayerLocation {
+		return PlayerLocation{Lat: lat, Lng: 3.9, Timestamp: at, Status: PlayerStatusOK}
+	}
+	stale := prev
+	stale.Stale = true
+	paused := prev
+	paused.Status = PlayerStatusPaused
+
+	for _, tc := range []struct {
+		name string
+		prev PlayerLocation
+		loc  PlayerLocation
+		want bool
+	}{
+		{"below threshold", prev, update(51.00002, now), true}, // ~2m
+		{"above threshold", prev, update(51.0001, now), false}, // ~11m
+		{"no previous location", PlayerLocation{}, update(51.0, now), false},
+		{"status changed", paused, update(51.0, now), false},
+		{"stale previous location", stale, update(51.0, now), false},
+		{"due for a presence refresh", prev, update(51.0, prev.Timestamp.Add(locationRefreshInterval)), false},
+	} {
+		if got := jitter(tc.prev, tc.loc); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	minMoveMeters = 0
+	if jitter(prev, update(51.0, now)) {
+		t.Error("filtering disabled: update treated as jitter")
+	}
+}
+
+func TestUpdateLocationSkipsJitter(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory")
+	old := minMoveMeters
+	minMoveMeters = defaultMinMoveMeters
+	t.Cleanup(func() { minMoveMeters = old })
+
+	update := func(lat float64) map[string]interface{} {
+		rec := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"lat":%v,"lng":3.9,"status":"OK"}`, lat)
+		handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID("alice"), strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("update to %v: got %d: %s", lat, rec.Code, rec.Body.String())
+		}
+		var resp map[string]interface{}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return resp
+	}
+
+	if resp := update(51.0); resp["skipped"] == true {
+		t.Fatal("first update skipped")
+	}
+	if resp := update(51.00002); resp["skipped"] != true {
+		t.Errorf("2m move: got %v, want skipped", resp)
+	}
+	if resp := update(51.0001); resp["skipped"] == true {
+		t.Errorf("11m move: got %v, want stored", resp)
+	}
+
+	var stored PlayerLocation
+	if err := dsClient.Get(context.Background(), datastore.NameKey("PlayerLocation", "alice", nil), &stored); err != nil {
+		t.Fatalf("getting stored location: %v", err)
+	}
+	if stored.Lat != 51.0001 {
+		t.Errorf("stored lat %v, want 51.0001", stored.Lat)
+	}
+	count, err := dsClient.Count(context.Background(), datastore.NewQuery("LocationHistory").FilterField("PlayerID", "=", "alice"))
+	if err != nil {
+		t.Fatalf("counting history: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("got %d history entries, want 2", count)
+	}
+}
+
+func TestMotion(t *testing.T) {
+	start := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	prev := PlayerLocation{Lat: 51.0, Lng: 3.9, Timestamp: start, Status: PlayerStatusOK}
+	// 0.001 degrees of latitude is about 111.2m, so this is due north at ~11.1 m/s.
+	north := PlayerLocation{Lat: 51.001, Lng: 3.9, Timestamp: start.Add(10 * time.Second), Status: PlayerStatusOK}
+	speed, heading := motion(prev, north)
+	if math.Abs(speed-11.12) > 0.05 || math.Abs(heading) > 0.01 {
+		t.Errorf("due north: got %.2f m/s heading %.2f, want ~11.12 m/s heading 0", speed, heading)
+	}
+
+	// Moving east along a parallel bears almost exactly 90 degrees.
+	east := PlayerLocation{Lat: 51.0, Lng: 3.901, Timestamp: start.Add(7 * time.Second), Status: PlayerStatusOK}
+	speed, heading = motion(prev, east)
+	wantSpeed := haversineMeters(51.0, 3.9, 51.0, 3.901) / 7
+	if math.Abs(speed-wantSpeed) > 1e-9 || math.Abs(heading-90) > 0.01 {
+		t.Errorf("east: got %.2f m/s heading %.2f, want %.2f m/s heading 90", speed, heading, wantSpeed)
+	}
+	west := PlayerLocation{Lat: 51.0, Lng: 3.9, Timestamp: start.Add(14 * time.Second), Status: PlayerStatusOK}
+	if _, heading = motion(east, west); math.Abs(heading-270) > 0.01 {
+		t.Errorf("west: got heading %.2f, want 270", heading)
+	}
+
+	// Client timestamps win over the server's when both fixes have one.
+	prevClient, northClient := prev, north
+	prevClient.ClientTimestamp = start
+	northClient.ClientTimestamp = start.Add(20 * time.Second)
+	if speed, _ = motion(prevClient, northClient); math.Abs(speed-5.56) > 0.05 {
+		t.Errorf("client timestamps: got %.2f m/s, want ~5.56", speed)
+	}
+
+	sameTime := north
+	sameTime.Timestamp = start
+	for name, tc := range map[string][2]PlayerLocation{
+		"same timestamp":  {prev, sameTime},
+		"older timestamp": {north, prev},
+		"no previous fix": {{}, north},
+		"previous not OK": {{Lat: 51.0, Lng: 3.9, Timestamp: start, Status: PlayerStatusDenied}, north},
+		"didn't move":     {prev, {Lat: 51.0, Lng: 3.9, Timestamp: start.Add(time.Second), Status: PlayerStatusOK}},
+	} {
+		if speed, heading := motion(tc[0], tc[1]); speed != 0 || heading != 0 {
+			t.Errorf("%s: got %v m/s heading %v, want zeros", name, speed, heading)
+		}
+	}
+}
+
+func TestUpdateLocationStoresSpeedAndHeading(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory")
+	start := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	for i, lat := range []float64{51.0, 51.001} {
+		body := fmt.Sprintf(`{"lat":%v,"lng":3.9,"status":"OK","clientTimestamp":%q}`, lat, start.Add(time.Duration(i)*10*time.Second).Format(time.RFC3339))
+		rec := httptest.NewRecorder()
+		handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID("alice"), strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("update %d: got %d: %s", i, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleGetLocations(rec, httptest.NewRequest(http.MethodGet, "/api/locations", nil))
+	var locations map[string]PlayerLocation
+	if err := json.NewDecoder(rec.Body).Decode(&locations); err != nil {
+		t.Fatalf("decoding locations: %v", err)
+	}
+	alice := locations["alice"]
+	if math.Abs(alice.SpeedMps-11.12) > 0.05 || math.Abs(alice.HeadingDeg) > 0.01 {
+		t.Errorf("got %.2f m/s heading %.2f, want ~11.12 m/s heading 0", alice.SpeedMps, alice.HeadingDeg)
+	}
+}
+
+func TestFlagImplausibleJump(t *testing.T) {
+	start := time.Now()
+	prev := PlayerLocation{Lat: 51.0, Lng: 3.9, Timestamp: start, Status: PlayerStatusOK}
+	for _, tc := range []struct {
+		name string
+		lat  float64
+		want bool
+	}{
+		{"plausible run", 51.001, false},  // ~111m in 10s
+		{"implausible jump", 51.09, true}, // ~10km in 10s
+	} {
+		loc := PlayerLocation{Lat: tc.lat, Lng: 3.9, Timestamp: start.Add(10 * time.Second), Status: PlayerStatusOK}
+		loc.SpeedMps, loc.HeadingDeg = motion(prev, loc)
+		flagImplausibleJump("alice", prev, &loc)
+		if loc.Suspicious != tc.want {
+			t.Errorf("%s at %.0f m/s: got suspicious %v, want %v", tc.name, loc.SpeedMps, loc.Suspicious, tc.want)
+		}
+	}
+
+	old := maxPlausibleSpeedMps
+	maxPlausibleSpeedMps = 0
+	t.Cleanup(func() { maxPlausibleSpeedMps = old })
+	loc := PlayerLocation{Lat: 51.09, Lng: 3.9, Timestamp: start.Add(10 * time.Second), Status: PlayerStatusOK}
+	loc.SpeedMps, _ = motion(prev, loc)
+	if flagImplausibleJump("alice", prev, &loc); loc.Suspicious {
+		t.Error("check turned off: jump flagged")
+	}
+}
+
+func TestUpdateLocationFlagsImplausibleJump(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory")
+	start := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	update := func(i int, lat float64) {
+		body := fmt.Sprintf(`{"lat":%v,"lng":3.9,"status":"OK","clientTimestamp":%q}`, lat, start.Add(time.Duration(i)*10*time.Second).Format(time.RFC3339))
+		rec := httptest.NewRecorder()
+		handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID("alice"), strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("update %d: got %d: %s", i, rec.Code, rec.Body.String())
+		}
+	}
+	stored := func() PlayerLocation {
+		var loc PlayerLocation
+		if err := dsClient.Get(context.Background(), datastore.NameKey("PlayerLocation", "alice", nil), &loc); err != nil {
+			t.Fatalf("getting stored location: %v", err)
+		}
+		return loc
+	}
+
+	update(0, 51.0)
+	update(1, 51.001)
+	if stored().Suspicious {
+		t.Error("plausible move flagged as suspicious")
+	}
+	update(2, 51.091)
+	if loc := stored(); !loc.Suspicious || loc.Lat != 51.091 {
+		t.Errorf("implausible jump: got %+v, want it stored and flagged", loc)
+	}
+}
+
+func TestRequestNamespace(t *testing.T) {
+	old := namespaceDomain
+	t.Cleanup(func() { namespaceDomain = old })
+
+	tests := []struct {
+		domain, host, header string
+		want                 string
+		wantErr              bool
+	}{
+		{domain: "games.example.com", host: "example.com", want: ""},
+		{domain: "games.example.com", host: "games.example.com", want: ""},
+		{domain: "games.example.com", host: "spring.games.example.com", want: "spring"},
+		{domain: "games.example.com", host: "Spring.Games.Example.com:8080", want: "spring"},
+		// With a domain set, the header can't move a client into another game.
+		{domain: "games.example.com", host: "spring.games.example.com", header: "autumn", want: "spring"},
+		{domain: "games.example.com", host: "example.com", header: "autumn", want: ""},
+		{domain: "games.example.com", host: "__reserved.games.example.com", wantErr: true},
+		{host: "example.com", header: "autumn", want: "autumn"},
+		{host: "spring.games.example.com", want: ""},
+		{host: "example.com", header: "bad namespace", wantErr: true},
+		{host: "example.com", header: "__reserved", wantErr: true},
+	}
+	for _, tt := range tests {
+		namespaceDomain = tt.domain
+		r := httptest.NewRequest(http.MethodGet, "/api/locations", nil)
+		r.Host = tt.host
+		if tt.header != "" {
+			r.Header.Set(namespaceHeader, tt.header)
+		}
+		got, err := requestNamespace(r)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s %q: got %q, want error", tt.host, tt.header, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s %q: got %q, %v, want %q", tt.host, tt.header, got, err, tt.want)
+		}
+	}
+}
+
+// withGames makes the game registry know exactly namespaces until the test ends.
+func withGames(t *testing.T, namespaces ...string) {
+	t.Helper()
+	games.mu.Lock()
+	oldNames, oldLoaded := games.names, games.loaded
+	games.names = make(map[string]bool)
+	for _, namespace := range namespaces {
+		games.names[namespace] = true
+	}
+	games.loaded = time.Now()
+	games.mu.Unlock()
+	t.Cleanup(func() {
+		games.mu.Lock()
+		games.names, games.loaded = oldNames, oldLoaded
+		games.mu.Unlock()
+	})
+}
+
+func TestNamespaceMiddleware(t *testing.T) {
+	withGames(t, "spring")
+	var got string
+	handler := namespaceMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = gameNamespace(r.Context())
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/api/locations", nil)
+	r.Header.Set(namespaceHeader, "spring")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if got != "spring" {
+		t.Errorf("got namespace %q, want spring", got)
+	}
+
+	rec := httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/api/locations", nil)
+	r.Header.Set(namespaceHeader, "no/slashes")
+	handler.ServeHTTP(rec, r)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid namespace: got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	got = "unchanged"
+	rec = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/api/locations", nil)
+	r.Header.Set(namespaceHeader, "made-up")
+	handler.ServeHTTP(rec, r)
+	if rec.Code != http.StatusNotFound || got != "unchanged" {
+		t.Errorf("unknown game: got %d, want %d without reaching the handler", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestRequireLeadChecksGame(t *testing.T) {
+	withLeadSessionKey(t)
+	withGames(t, "spring", "autumn")
+	handler := namespaceMiddleware(requireLead(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tt := range []struct {
+		session, namespace string
+		wantCode           int
+	}{
+		{"spring", "spring", http.StatusOK},
+		{"spring", "autumn", http.StatusUnauthorized},
+		{"spring", "", http.StatusUnauthorized},
+		{"", "spring", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/contact", nil)
+		r.Header.Set(namespaceHeader, tt.namespace)
+		r.AddCookie(&http.Cookie{Name: leadSessionCookie, Value: signLeadSession("ann", tt.session, time.Now().Add(time.Hour))})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != tt.wantCode {
+			t.Errorf("session for %q in game %q: got %d, want %d", tt.session, tt.namespace, rec.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestCreateGameValidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		body      string
+		wantCode  int
+	}{
+		{"from another game", "spring", `{"namespace":"autumn","username":"bob","password":"longenough"}`, http.StatusForbidden},
+		{"missing namespace", "", `{"username":"bob","password":"longenough"}`, http.StatusBadRequest},
+		{"reserved namespace", "", `{"namespace":"__x","username":"bob","password":"longenough"}`, http.StatusBadRequest},
+		{"invalid namespace", "", `{"namespace":"a/b","username":"bob","password":"longenough"}`, http.StatusBadRequest},
+		{"missing username", "", `{"namespace":"autumn","password":"longenough"}`, http.StatusBadRequest},
+		{"short password", "", `{"namespace":"autumn","username":"bob","password":"short"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/admin/games", strings.NewReader(tt.body))
+		rec := httptest.NewRecorder()
+		handleCreateGame(rec, r.WithContext(withNamespace(r.Context(), tt.namespace)))
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: got %d, want %d", tt.name, rec.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestCreateGame(t *testing.T) {
+	requireEmulator(t, "Game", "Lead")
+	withLeadSessionKey(t)
+	withGames(t)
+	ctx := context.Background()
+	for _, key := range []*datastore.Key{gameKey("winter"), leadKey("winnie"), leadKey("winnie2")} {
+		if err := dsClient.Delete(ctx, key); err != nil {
+			t.Fatalf("clearing %v: %v", key, err)
+		}
+	}
+
+	create := func(body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/admin/games", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handleCreateGame(rec, r.WithContext(context.WithValue(r.Context(), leadIDContextKey, "ann")))
+		return rec.Code
+	}
+	if code := create(`{"namespace":"winter","username":"winnie","password":"longenough"}`); code != http.StatusCreated {
+		t.Fatalf("create: got %d, want %d", code, http.StatusCreated)
+	}
+	if code := create(`{"namespace":"winter","username":"winnie2","password":"longenough"}`); code != http.StatusConflict {
+		t.Errorf("existing game: got %d, want %d", code, http.StatusConflict)
+	}
+	if known, err := games.known(ctx, "winter"); err != nil || !known {
+		t.Errorf("created game not known: %v, %v", known, err)
+	}
+
+	// The new lead can only sign in to their own game.
+	login := func(namespace string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/leads/login", strings.NewReader(`{"username":"winnie","password":"longenough"}`))
+		rec := httptest.NewRecorder()
+		handleLeadLogin(rec, r.WithContext(withNamespace(r.Context(), namespace)))
+		return rec.Code
+	}
+	if code := login("winter"); code != http.StatusOK {
+		t.Errorf("login to own game: got %d, want %d", code, http.StatusOK)
+	}
+	if code := login(""); code != http.StatusUnauthorized {
+		t.Errorf("login to default game: got %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestGameKeysUseNamespace(t *testing.T) {
+	ctx := withNamespace(context.Background(), "spring")
+	parent := gameNameKey(ctx, "PlayerTargetChain", "alice", nil)
+	for _, key := range []*datastore.Key{
+		parent,
+		gameIDKey(ctx, "PlayerTarget", 1, parent),
+		gameIncompleteKey(ctx, "PlayerMessage", nil),
+		gameStatsKey(ctx),
+	} {
+		if key.Namespace != "spring" {
+			t.Errorf("%v: got namespace %q, want spring", key, key.Namespace)
+		}
+	}
+	if key := gameNameKey(context.Background(), "PlayerLocation", "alice", nil); key.Namespace != "" {
+		t.Errorf("default game key has namespace %q", key.Namespace)
+	}
+	if chatTopic(ctx, "alice") == chatTopic(context.Background(), "alice") {
+		t.Error("chat topics of different games collide")
+	}
+}
+
+func TestNamespacesAreIsolated(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory")
+	withGames(t, "spring", "autumn")
+	for _, namespace := range []string{"spring", "autumn"} {
+		ctx := withNamespace(context.Background(), namespace)
+		for _, kind := range []string{"PlayerLocation", "LocationHistory"} {
+			keys, err := dsClient.GetAll(ctx, gameQuery(ctx, kind).KeysOnly(), nil)
+			if err != nil {
+				t.Fatalf("listing %s in %s: %v", kind, namespace, err)
+			}
+			if err := dsClient.DeleteMulti(ctx, keys); err != nil {
+				t.Fatalf("clearing %s in %s: %v", kind, namespace, err)
+			}
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/locations/", handleUpdateLocation)
+	mux.HandleFunc("/api/locations", handleGetLocations)
+	handler := namespaceMiddleware(mux)
+	request := func(method, namespace, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if namespace != "" {
+			r.Header.Set(namespaceHeader, namespace)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	// The same player ID plays in both games, at different places.
+	for namespace, lat := range map[string]float64{"spring": 51.0, "autumn": 52.0} {
+		body := fmt.Sprintf(`{"lat":%v,"lng":3.9,"status":"OK"}`, lat)
+		if rec := request(http.MethodPost, namespace, "/api/locations/"+obfuscatePlayerID("alice"), body); rec.Code != http.StatusOK {
+			t.Fatalf("update in %s: got %d: %s", namespace, rec.Code, rec.Body.String())
+		}
+	}
+
+	for namespace, wantLat := range map[string]float64{"spring": 51.0, "autumn": 52.0} {
+		rec := request(http.MethodGet, namespace, "/api/locations", "")
+		var locations map[string]PlayerLocation
+		if err := json.NewDecoder(rec.Body).Decode(&locations); err != nil {
+			t.Fatalf("decoding %s locations: %v", namespace, err)
+		}
+		if len(locations) != 1 {
+			t.Fatalf("%s: got %d locations, want 1", namespace, len(locations))
+		}
+		for _, loc := range locations {
+			if loc.Lat != wantLat {
+				t.Errorf("%s: got lat %v, want %v", namespace, loc.Lat, wantLat)
+			}
+		}
+	}
+	if locations := getLocations(t, "/api/locations"); len(locations) != 0 {
+		t.Errorf("default game: got %d locations, want none", len(locations))
+	}
+}
+
+func gameStateRequest(method, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/game-state", strings.NewReader(body))
+	req.AddCookie(&http.Cookie{Name: leadSessionCookie, Value: signLeadSession("ann", "", time.Now().Add(time.Hour))})
+	rec := httptest.NewRecorder()
+	requireLead(handleGameState)(rec, req)
+	return rec
+}
+
+func TestGameStatePollInterval(t *testing.T) {
+	if got := (GameState{}).pollInterval(); got != activePollInterval {
+		t.Errorf("active game: got %v, want %v", got, activePollInterval)
+	}
+	if got := (GameState{Paused: true}).pollInterval(); got != pausedPollInterval {
+		t.Errorf("paused game: got %v, want %v", got, pausedPollInterval)
+	}
+}
+
+func TestPausingGameSlowsPlayerPolling(t *testing.T) {
+	requireEmulator(t, "GameState", "PlayerMessage", "DirectMessage", "TargetLocation", "NotificationPrefs")
+	withLeadSessionKey(t)
+
+	pollInterval := func() float64 {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handlePlayerMessages(rec, httptest.NewRequest(http.MethodGet, "/api/messages/"+obfuscatePlayerID("alice"), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("getting messages: got %d: %s", rec.Code, rec.Body.String())
+		}
+		var resp map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("decoding messages: %v", err)
+		}
+		seconds, _ := resp["pollIntervalSeconds"].(float64)
+		return seconds
+	}
+
+	if got := pollInterval(); got != activePollInterval.Seconds() {
+		t.Errorf("before pausing: got %vs, want %vs", got, activePollInterval.Seconds())
+	}
+
+	if rec := gameStateRequest(http.MethodPut, `{"paused":true}`); rec.Code != http.StatusOK {
+		t.Fatalf("pausing: got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec := gameStateRequest(http.MethodGet, "")
+	var state GameState
+	if err := json.NewDecoder(rec.Body).Decode(&state); err != nil {
+		t.Fatalf("decoding game state: %v", err)
+	}
+	if !state.Paused || state.UpdatedBy != "ann" {
+		t.Errorf("got state %+v, want paused by ann", state)
+	}
+	if got := pollInterval(); got != pausedPollInterval.Seconds() {
+		t.Errorf("while paused: got %vs, want %vs", got, pausedPollInterval.Seconds())
+	}
+
+	if rec := gameStateRequest(http.MethodPut, `{"paused":false}`); rec.Code != http.StatusOK {
+		t.Fatalf("resuming: got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := pollInterval(); got != activePollInterval.Seconds() {
+		t.Errorf("after resuming: got %vs, want %vs", got, activePollInterval.Seconds())
+	}
+}
+
+func TestGameStateRejectsBadRequests(t *testing.T) {
+	withLeadSessionKey(t)
+	for name, tt := range map[string]struct {
+		method, body string
+		want         int
+	}{
+		"missing paused": {http.MethodPut, `{}`, http.StatusBadRequest},
+		"wrong type":     {http.MethodPut, `{"paused":"yes"}`, http.StatusBadRequest},
+		"wrong method":   {http.MethodPost, `{"paused":true}`, http.StatusMethodNotAllowed},
+	} {
+		if rec := gameStateRequest(tt.method, tt.body); rec.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestPausedGameSuppressesTargets(t *testing.T) {
+	requireEmulator(t, "GameState", "TargetLocation", "PlayerLocation", "PlayerMessage", "DirectMessage", "NotificationPrefs")
+	withLeadSessionKey(t)
+	// Later tests set targets, so don't leave the game paused.
+	t.Cleanup(func() { dsClient.Delete(context.Background(), gameStateKey(context.Background())) })
+	putEntity(t, datastore.NameKey("TargetLocation", "alice", nil), &TargetLocation{Lat: 51, Lng: 3.9, IsReleased: true, Timestamp: time.Now()})
+
+	adminRequest := func(path string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.AddCookie(&http.Cookie{Name: leadSessionCookie, Value: signLeadSession("ann", "", time.Now().Add(time.Hour))})
+		rec := httptest.NewRecorder()
+		requireLead(handlePauseGame(path == "/api/admin/pause"))(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST %s: got %d: %s", path, rec.Code, rec.Body.String())
+		}
+	}
+	setTarget := func() int {
+		rec := httptest.NewRecorder()
+		handleSetTargetLocation(rec, httptest.NewRequest(http.MethodPost, "/api/target/"+obfuscatePlayerID("alice"), strings.NewReader(`{"lat": 51.05, "lng": 3.72}`)))
+		return rec.Code
+	}
+	setTargets := func() int {
+		rec := httptest.NewRecorder()
+		body := fmt.Sprintf(`[{"playerID":%q,"lat":51.05,"lng":3.72}]`, obfuscatePlayerID("bob"))
+		handleBatchSetTargets(rec, httptest.NewRequest(http.MethodPost, "/api/targets/batch", strings.NewReader(body)))
+		return rec.Code
+	}
+	// visible reports whether alice sees her target, through both player endpoints.
+	visible := func() (messages, state bool) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handlePlayerMessages(rec, httptest.NewRequest(http.MethodGet, "/api/messages/"+obfuscatePlayerID("alice"), nil))
+		var resp map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("decoding messages: %v", err)
+		}
+		if paused := resp["paused"] == true; paused == (resp["target"] != nil) {
+			t.Errorf("messages: paused %v but target %v", paused, resp["target"])
+		}
+
+		rec = httptest.NewRecorder()
+		handlePlayerState(rec, httptest.NewRequest(http.MethodGet, "/api/player/"+obfuscatePlayerID("alice")+"/state", nil))
+		var playerState PlayerState
+		if err := json.NewDecoder(rec.Body).Decode(&playerState); err != nil {
+			t.Fatalf("decoding player state: %v", err)
+		}
+		if playerState.Paused == (playerState.Target != nil) {
+			t.Errorf("state: paused %v but target %v", playerState.Paused, playerState.Target)
+		}
+		return resp["target"] != nil, playerState.Target != nil
+	}
+
+	adminRequest("/api/admin/pause")
+	if code := setTarget(); code != http.StatusConflict {
+		t.Errorf("setting a target while paused: got %d, want %d", code, http.StatusConflict)
+	}
+	if code := setTargets(); code != http.StatusConflict {
+		t.Errorf("setting targets in batch while paused: got %d, want %d", code, http.StatusConflict)
+	}
+	if messages, state := visible(); messages || state {
+		t.Errorf("while paused: target visible in messages %v, state %v", messages, state)
+	}
+
+	adminRequest("/api/admin/resume")
+	if code := setTarget(); code != http.StatusCreated {
+		t.Errorf("setting a target after resuming: got %d, want %d", code, http.StatusCreated)
+	}
+	if code := setTargets(); code != http.StatusOK {
+		t.Errorf("setting targets in batch after resuming: got %d, want %d", code, http.StatusOK)
+	}
+	if messages, state := visible(); !messages || !state {
+		t.Errorf("after resuming: target visible in messages %v, state %v", messages, state)
+	}
+}
+
+func TestPauseGameRequiresPost(t *testing.T) {
+	for _, paused := range []bool{true, false} {
+		rec := httptest.NewRecorder()
+		handlePauseGame(paused)(rec, httptest.NewRequest(http.MethodGet, "/api/admin/pause", nil))
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("paused=%t: got %d, want %d", paused, rec.Code, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func TestTargetExpiry(t *testing.T) {
+	now := time.Now()
+	targets := map[string]TargetLocation{
+		"forever": {},
+		"live":    {ExpiresAt: now.Add(time.Minute)},
+		"expired": {ExpiresAt: now},
+	}
+	for playerID, target := range targets {
+		if got, want := target.expired(now), playerID == "expired"; got != want {
+			t.Errorf("%s: got expired %v, want %v", playerID, got, want)
+		}
+	}
+
+	live := withoutExpired(targets, now)
+	if _, ok := live["expired"]; ok || len(live) != 2 {
+		t.Errorf("got %v, want only the live targets", live)
+	}
+	if len(targets) != 3 {
+		t.Error("withoutExpired changed the shared snapshot")
+	}
+}
+
+func TestExpiredTargetIsHidden(t *testing.T) {
+	requireEmulator(t, "TargetLocation", "GameState", "PlayerMessage", "DirectMessage", "NotificationPrefs")
+	key := datastore.NameKey("TargetLocation", "alice", nil)
+
+	surfaced := func() (toPlayer, toLeads bool) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handlePlayerMessages(rec, httptest.NewRequest(http.MethodGet, "/api/messages/"+obfuscatePlayerID("alice"), nil))
+		var resp map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("decoding messages: %v", err)
+		}
+
+		rec = httptest.NewRecorder()
+		handleGetTargets(rec, httptest.NewRequest(http.MethodGet, "/api/targets", nil))
+		var targets map[string]TargetLocation
+		if err := json.NewDecoder(rec.Body).Decode(&targets); err != nil {
+			t.Fatalf("decoding targets: %v", err)
+		}
+		_, toLeads = targets["alice"]
+		return resp["target"] != nil, toLeads
+	}
+
+	putEntity(t, key, &TargetLocation{Lat: 51, Lng: 3.9, IsReleased: true, Timestamp: time.Now(), ExpiresAt: time.Now().Add(time.Hour)})
+	if toPlayer, toLeads := surfaced(); !toPlayer || !toLeads {
+		t.Errorf("before expiry: surfaced to player %v, leads %v, want both", toPlayer, toLeads)
+	}
+
+	putEntity(t, key, &TargetLocation{Lat: 51, Lng: 3.9, IsReleased: true, Timestamp: time.Now().Add(-time.Hour), ExpiresAt: time.Now().Add(-time.Second)})
+	if toPlayer, toLeads := surfaced(); toPlayer || toLeads {
+		t.Errorf("after expiry: surfaced to player %v, leads %v, want neither", toPlayer, toLeads)
+	}
+}
+
+func TestSetTargetTTL(t *testing.T) {
+	for _, ttl := range []string{"-1", "10081"} {
+		rec := httptest.NewRecorder()
+		body := `{"lat": 51.05, "lng": 3.72, "ttlMinutes": ` + ttl + `}`
+		handleSetTargetLocation(rec, httptest.NewRequest(http.MethodPost, "/api/target/"+obfuscatePlayerID("alice"), strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("ttlMinutes %s: got %d, want %d", ttl, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	requireEmulator(t, "TargetLocation", "GameState")
+	old := targetTTL
+	targetTTL = time.Hour
+	t.Cleanup(func() { targetTTL = old })
+
+	for body, want := range map[string]time.Duration{
+		`{"lat": 51.05, "lng": 3.72}`:                   time.Hour,
+		`{"lat": 51.05, "lng": 3.72, "ttlMinutes": 30}`: 30 * time.Minute,
+		`{"lat": 51.05, "lng": 3.72, "ttlMinutes": 0}`:  0,
+	} {
+		rec := httptest.NewRecorder()
+		handleSetTargetLocation(rec, httptest.NewRequest(http.MethodPost, "/api/target/"+obfuscatePlayerID("alice"), strings.NewReader(body)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("%s: got %d: %s", body, rec.Code, rec.Body.String())
+		}
+		var target TargetLocation
+		if err := dsClient.Get(context.Background(), datastore.NameKey("TargetLocation", "alice", nil), &target); err != nil {
+			t.Fatalf("getting target: %v", err)
+		}
+		if want == 0 {
+			if !target.ExpiresAt.IsZero() {
+				t.Errorf("%s: got expiry %v, want none", body, target.ExpiresAt)
+			}
+			continue
+		}
+		if got := target.ExpiresAt.Sub(target.Timestamp); got != want {
+			t.Errorf("%s: expires %v after it was set, want %v", body, got, want)
+		}
+	}
+}
+
+func TestTargetTTLAppliesToEveryTarget(t *testing.T) {
+	old := targetTTL
+	targetTTL = time.Hour
+	t.Cleanup(func() { targetTTL = old })
+	now := time.Now()
+	if got := targetForStep(PlayerTarget{Lat: 51.05, Lng: 3.72}, now).ExpiresAt; !got.Equal(now.Add(time.Hour)) {
+		t.Errorf("chain step: got expiry %v, want an hour from now", got)
+	}
+
+	requireEmulator(t, "TargetLocation", "GameState")
+	ctx := context.Background()
+	releaseAt := now.Add(30 * time.Minute).Truncate(time.Second).UTC()
+	body := `[
+		{"playerID": "` + obfuscatePlayerID("alice") + `", "lat": 51.05, "lng": 3.72},
+		{"playerID": "` + obfuscatePlayerID("bob") + `", "lat": 51.06, "lng": 3.73, "releaseAt": "` + releaseAt.Format(time.RFC3339) + `"}
+	]`
+	rec := httptest.NewRecorder()
+	handleBatchSetTargets(rec, httptest.NewRequest(http.MethodPost, "/api/targets/batch", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("batch: got %d: %s", rec.Code, rec.Body.String())
+	}
+	var alice, bob TargetLocation
+	if err := dsClient.Get(ctx, datastore.NameKey("TargetLocation", "alice", nil), &alice); err != nil {
+		t.Fatalf("getting alice's target: %v", err)
+	}
+	if got := alice.ExpiresAt.Sub(alice.Timestamp); got != time.Hour {
+		t.Errorf("batch: alice's target expires %v after it was set, want an hour", got)
+	}
+	if err := dsClient.Get(ctx, datastore.NameKey("TargetLocation", "bob", nil), &bob); err != nil {
+		t.Fatalf("getting bob's target: %v", err)
+	}
+	// A scheduled target gets its full time once it's released.
+	if !bob.ExpiresAt.Equal(releaseAt.Add(time.Hour)) {
+		t.Errorf("batch: bob's target expires at %v, want an hour after %v", bob.ExpiresAt, releaseAt)
+	}
+
+	var roster InitialTarget
+	roster.PlayerName = "carol"
+	roster.Target.Lat, roster.Target.Lng = 51.07, 3.74
+	if _, err := saveInitialTargets(ctx, []InitialTarget{roster}, false); err != nil {
+		t.Fatalf("saving initial targets: %v", err)
+	}
+	var carol TargetLocation
+	if err := dsClient.Get(ctx, datastore.NameKey("TargetLocation", "carol", nil), &carol); err != nil {
+		t.Fatalf("getting carol's target: %v", err)
+	}
+	if got := carol.ExpiresAt.Sub(carol.Timestamp); got != time.Hour {
+		t.Errorf("initial target expires %v after it was set, want an hour", got)
+	}
+}
+
+func TestResendDMRejectsBadRequests(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleSendDirectMessage(rec, httptest.NewRequest(http.MethodGet, "/api/dm/"+obfuscatePlayerID("alice")+"/resend", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	rec = httptest.NewRecorder()
+	handleSendDirectMessage(rec, httptest.NewRequest(http.MethodPost, "/api/dm/not-an-id/resend", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("bad player ID: got %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestResendDM(t *testing.T) {
+	requireEmulator(t, "DirectMessage")
+	ctx := context.Background()
+	sent := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "alice", SenderID: "bob", Content: "older", Timestamp: sent.Add(-time.Minute)})
+	putEntity(t, datastore.IncompleteKey("DirectMessage", nil), &DirectMessage{PlayerID: "alice", SenderID: "bob", Content: "head north", Timestamp: sent, ReadAt: sent})
+
+	resend := func(playerID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/dm/"+obfuscatePlayerID(playerID)+"/resend", nil)
+		req.AddCookie(&http.Cookie{Name: leadSessionCookie, Value: signLeadSession("ann", "", time.Now().Add(time.Hour))})
+		rec := httptest.NewRecorder()
+		requireLead(handleSendDirectMessage)(rec, req)
+		return rec
+	}
+	rec := resend("alice")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var copied DirectMessage
+	if err := json.NewDecoder(rec.Body).Decode(&copied); err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	if copied.ID == 0 || copied.Content != "head north" || copied.SenderID != "ann" {
+		t.Errorf("got %+v, want a copy of the last DM sent by ann", copied)
+	}
+
+	var dms []DirectMessage
+	keys, err := dsClient.GetAll(ctx, datastore.NewQuery("DirectMessage").FilterField("PlayerID", "=", "alice").Order("-Timestamp"), &dms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dms) != 3 {
+		t.Fatalf("got %d DMs, want the two seeded plus the resent one", len(dms))
+	}
+	if keys[0].ID != copied.ID || dms[0].Content != "head north" || !dms[0].Timestamp.After(sent) || !dms[0].ReadAt.IsZero() {
+		t.Errorf("newest DM = %+v, want an unread copy newer than %v", dms[0], sent)
+	}
+	if dms[1].Content != "head north" || !dms[1].Timestamp.Equal(sent) {
+		t.Errorf("original DM = %+v, want it left as it was", dms[1])
+	}
+
+	if rec := resend("carol"); rec.Code != http.StatusNotFound {
+		t.Errorf("player without DMs: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestDMWithTargetRejectsBadRequests(t *testing.T) {
+	url := "/api/dm-with-target/" + obfuscatePlayerID("alice")
+	for _, body := range []string{
+		`{"lat": 51.05, "lng": 3.72}`,
+		`{"message": "go here"}`,
+		`{"message": "go here", "lat": 51.05}`,
+		`{"message": "go here", "lat": 51.05, "lng": 3.72, "ttlMinutes": -1}`,
+		`{"message": "   ", "lat": 51.05, "lng": 3.72}`,
+	} {
+		rec := httptest.NewRecorder()
+		handleDMWithTarget(rec, httptest.NewRequest(http.MethodPost, url, strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+	rec := httptest.NewRecorder()
+	handleDMWithTarget(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestDMWithTarget(t *testing.T) {
+	requireEmulator(t, "DirectMessage", "TargetLocation", "GameState")
+	rec := httptest.NewRecorder()
+	body := `{"message": "go here", "lat": 51.05, "lng": 3.72}`
+	handleDMWithTarget(rec, httptest.NewRequest(http.MethodPost, "/api/dm-with-target/"+obfuscatePlayerID("alice"), strings.NewReader(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var dms []DirectMessage
+	if _, err := dsClient.GetAll(context.Background(), datastore.NewQuery("DirectMessage"), &dms); err != nil {
+		t.Fatal(err)
+	}
+	if len(dms) != 1 || dms[0].PlayerID != "alice" || dms[0].Content != "go here" {
+		t.Errorf("DMs = %+v, want the one to alice", dms)
+	}
+	var target TargetLocation
+	if err := dsClient.Get(context.Background(), datastore.NameKey("TargetLocation", "alice", nil), &target); err != nil {
+		t.Fatalf("getting target: %v", err)
+	}
+	if target.Lat != 51.05 || !target.IsReleased {
+		t.Errorf("target = %+v, want a released target at 51.05", target)
+	}
+}
+
+func TestDMWithTargetIsAtomic(t *testing.T) {
+	requireEmulator(t, "DirectMessage", "TargetLocation")
+	ctx := context.Background()
+	dm := &DirectMessage{PlayerID: "alice", Content: "go here", Timestamp: time.Now()}
+	target := &TargetLocation{Lat: 51.05, Lng: 3.72, Timestamp: time.Now()}
+
+	// A key under an incomplete parent can't be written, so the target write fails.
+	badKey := datastore.NameKey("TargetLocation", "alice", datastore.IncompleteKey("Game", nil))
+	if _, err := saveDMWithTarget(ctx, datastore.IncompleteKey("DirectMessage", nil), dm, badKey, target); err == nil {
+		t.Fatal("saving with a failing target write succeeded")
+	}
+	if n := countEntities(t, "DirectMessage"); n != 0 {
+		t.Errorf("got %d DMs after the target write failed, want 0", n)
+	}
+	if n := countEntities(t, "TargetLocation"); n != 0 {
+		t.Errorf("got %d targets after the failed transaction, want 0", n)
+	}
+
+	key, err := saveDMWithTarget(ctx, datastore.IncompleteKey("DirectMessage", nil), dm, datastore.NameKey("TargetLocation", "alice", nil), target)
+	if err != nil || key.ID == 0 {
+		t.Fatalf("saving: key %v, %v", key, err)
+	}
+	if countEntities(t, "DirectMessage") != 1 || countEntities(t, "TargetLocation") != 1 {
+		t.Error("want both the DM and the target stored")
+	}
+}
+
+func TestArrivalStreamDeliversEvents(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(handleArrivalStream))
+	defer srv.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/arrivals/stream", "", srv.URL)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer ws.Close()
+	// The connection must be subscribed before anyone arrives.
+	time.Sleep(100 * time.Millisecond)
+
+	arrivedAt := time.Now().Truncate(time.Second)
+	arrivals.publish("other-game", ArrivalEvent{PlayerID: "bob", ArrivedAt: arrivedAt})
+	arrivals.publish("", ArrivalEvent{PlayerID: "alice", FakeHash: "ABCD1234", Lat: 51, Lng: 3.9, ArrivedAt: arrivedAt})
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var got ArrivalEvent
+	if err := websocket.JSON.Receive(ws, &got); err != nil {
+		t.Fatalf("receiving arrival: %v", err)
+	}
+	want := ArrivalEvent{PlayerID: "alice", FakeHash: "ABCD1234", Lat: 51, Lng: 3.9, ArrivedAt: arrivedAt}
+	if got.PlayerID != want.PlayerID || got.FakeHash != want.FakeHash || !got.ArrivedAt.Equal(want.ArrivedAt) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Disconnecting unsubscribes, even though no arrival follows.
+	ws.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		arrivals.mu.Lock()
+		left := len(arrivals.subscribers[""])
+		arrivals.mu.Unlock()
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers left after disconnecting", left)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestArrivalEventFiresOnce(t *testing.T) {
+	requireEmulator(t, "PlayerLocation", "LocationHistory", "TargetLocation", "GameStats")
+	target := &TargetLocation{Lat: 51.0, Lng: 3.9, IsReleased: true, Timestamp: time.Now(), FakeHash: "ABCD1234"}
+	putEntity(t, datastore.NameKey("TargetLocation", "p1", nil), target)
+
+	ch := arrivals.subscribe("")
+	defer arrivals.unsubscribe("", ch)
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handleUpdateLocation(rec, httptest.NewRequest(http.MethodPost, "/api/locations/"+obfuscatePlayerID("p1"), strings.NewReader(`{"lat":51.0001,"lng":3.9,"status":"OK"}`)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("update %d: got %d", i, rec.Code)
+		}
+	}
+
+	select {
+	case ev := <-ch:
+		if ev.PlayerID != "p1" || ev.FakeHash != "ABCD1234" || ev.ArrivedAt.IsZero() {
+			t.Errorf("got %+v, want p1 arriving at ABCD1234", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no arrival event")
+	}
+	select {
+	case ev := <-ch:
+		t.Errorf("got a second arrival event %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -1,7 +1,34 @@
-document.addEventListener("DOMContentLoaded", () => {
+document.addEventListener("DOMContentLoaded", async () => {
+  // The dashboard's API calls need a lead session; send the lead to log in first if there isn't one.
+  const sessionResponse = await fetch('/api/leads/me');
+  if (sessionResponse.status === 401) {
+    window.location.href = `/login?next=${encodeURIComponent(window.location.pathname)}`;
+    return;
+  }
+
   // Initialize the map and set its view to a default location
   const map = L.map('map').setView([50.8503, 4.3517], 9); // Centered on Brussels
 
+  // Organizers can re-center the map per event on the server.
+  fetch('/api/map-config')
+    .then(response => response.ok ? response.json() : Promise.reject(new Error(`Server error: ${response.status}`)))
+    .then(config => map.setView([config.lat, config.lng], config.zoom))
+    .catch(error => console.error('Failed to load map config:', error));
+
+  // Organizers can switch features off per event; hide the actions for those.
+  let features = {};
+  fetch('/api/features')
+    .then(response => response.ok ? response.json() : Promise.reject(new Error(`Server error: ${response.status}`)))
+    .then(loaded => { features = loaded; })
+    .catch(error => console.error('Failed to load features:', error));
+
+  function hideDisabledActions() {
+    const targetsOff = features.targets === false;
+    document.getElementById('send-location-btn').hidden = targetsOff;
+    document.getElementById('clear-target-btn').hidden = targetsOff;
+    document.getElementById('dm-form').hidden = features.chat === false;
+  }
+
   // Add an OpenStreetMap tile layer
   L.tileLayer('https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png', {
     maxZoom: 19,
@@ -154,6 +181,39 @@ document.addEventListener("DOMContentLoaded", () => {
     }
   });
 
+  // --- Pause / Resume ---
+  const pauseGameBtn = document.getElementById('pause-game-btn');
+  let gamePaused = false;
+
+  function showGameState(state) {
+    gamePaused = state.paused;
+    pauseGameBtn.textContent = gamePaused ? 'Resume Game' : 'Pause Game';
+  }
+
+  fetch('/api/game-state')
+    .then(response => response.ok ? response.json() : Promise.reject(new Error(`Server error: ${response.status}`)))
+    .then(showGameState)
+    .catch(error => console.error('Failed to load game state:', error));
+
+  pauseGameBtn.addEventListener('click', async () => {
+    const action = gamePaused ? 'resume' : 'pause';
+    if (!confirm(gamePaused ? 'Resume the game and show players their targets again?' : 'Pause the game? Players will no longer see their targets.')) {
+      return;
+    }
+
+    pauseGameBtn.disabled = true;
+    try {
+      const response = await fetch(`/api/admin/${action}`, { method: 'POST' });
+      if (!response.ok) throw new Error(await response.text());
+      showGameState(await response.json());
+    } catch (error) {
+      console.error(`Failed to ${action} the game:`, error);
+      alert(`Error: ${error.message}`);
+    } finally {
+      pauseGameBtn.disabled = false;
+    }
+  });
+
   // --- Waypoints Toggle ---
   const toggleWaypointsBtn = document.getElementById('toggle-waypoints-btn');
   let waypointsLayer = null;
@@ -247,6 +307,13 @@ document.addEventListener("DOMContentLoaded", () => {
     });
   }
 
+  // Escapes text (chat messages, display names) for use in innerHTML templates.
+  function escapeHTML(text) {
+    const el = document.createElement('div');
+    el.textContent = text;
+    return el.innerHTML;
+  }
+
   // Helper function to format time difference
   function formatTimeAgo(timestamp) {
     const now = new Date();
@@ -305,9 +372,10 @@ document.addEventListener("DOMContentLoaded", () => {
         if (!obfusResponse.ok) throw new Error('Could not obfuscate player ID.');
         const obfusData = await obfusResponse.json();
 
-        const response = await fetch(`/api/chat/${obfusData.obfuscatedID}`);
+        const response = await fetch(`/api/chat/${obfusData.obfuscatedID}?withCursor=true`);
         if (!response.ok) throw new Error('Failed to load chat history.');
-        const chatMessages = await response.json();
+        const history = await response.json();
+        const chatMessages = history.messages;
         const chatHistoryEl = document.getElementById('chat-history');
         
         if (!chatMessages || chatMessages.length === 0) {
@@ -315,20 +383,42 @@ document.addEventListener("DOMContentLoaded", () => {
         } else {
           chatHistoryEl.innerHTML = ''; // Clear "Loading..."
           chatMessages.forEach(msg => {
+            // Mark where the messages we haven't read yet start.
+            if (history.unreadFrom && msg.id === history.unreadFrom) {
+              const dividerEl = document.createElement('div');
+              dividerEl.className = 'unread-divider';
+              dividerEl.textContent = 'New messages';
+              chatHistoryEl.appendChild(dividerEl);
+            }
             const msgEl = document.createElement('div');
             msgEl.className = 'chat-message';
             const timestamp = new Date(msg.timestamp).toLocaleTimeString([], { hour12: false });
-            const from = msg.from === 'player' ? selectedPlayerID : 'Game Lead';
+            const from = msg.from === 'player' ? (msg.displayName || selectedPlayerID) : 'Game Lead';
             const fromColor = msg.from === 'player' ? playerColor : 'black';
 
+            let receipt = '';
+            if (msg.readAt) {
+              receipt = ` &middot; Read ${new Date(msg.readAt).toLocaleTimeString([], { hour12: false })}`;
+            } else if (msg.deliveredAt) {
+              receipt = ' &middot; Delivered';
+            }
+
             msgEl.innerHTML = `
-              <div class="chat-header">From: <strong style="color: ${fromColor};">${from}</strong> at ${timestamp}</div>
-              <div class="message-content">${msg.content}</div>
+              <div class="chat-header">From: <strong style="color: ${fromColor};">${escapeHTML(from)}</strong> at ${timestamp}${receipt}</div>
+              <div class="message-content">${escapeHTML(msg.content)}</div>
             `;
             chatHistoryEl.appendChild(msgEl);
           });
           // Scroll to the bottom
           chatHistoryEl.scrollTop = chatHistoryEl.scrollHeight;
+
+          // Everything shown has now been read.
+          const lastMessage = chatMessages[chatMessages.length - 1];
+          fetch(`/api/chat/${obfusData.obfuscatedID}/cursor`, {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ readUpTo: lastMessage.timestamp }),
+          }).catch(error => console.error('Failed to save read cursor:', error));
         }
       } catch (error) {
         document.getElementById('chat-history').innerHTML = `<p style="color: red;">${error.message}</p>`;
@@ -361,6 +451,8 @@ document.addEventListener("DOMContentLoaded", () => {
       wireUpClearTargetButton();
     }
 
+    hideDisabledActions();
+
     // Wire up the send button
     document.getElementById('send-dm-button').addEventListener('click', async () => {
       const input = document.getElementById('dm-input');
@@ -537,12 +629,12 @@ document.addEventListener("DOMContentLoaded", () => {
           const color = getColorForPlayer(playerID);
 
           // Determine if the icon should have the 'stale' class
-          const iconClass = loc.status !== 'OK' ? 'stale-location' : '';
+          const iconClass = loc.status !== 'OK' || loc.stale ? 'stale-location' : '';
 
           // Create or update the marker
           const icon = createColoredIcon(color, iconClass);
           const marker = L.marker(latLng, { icon, type: 'player' }) // Add type option
-            .bindPopup(`<b>${playerID}</b><br>Status: <span style="color: ${loc.status === 'OK' ? 'green' : 'red'}; font-weight: bold;">${loc.status}</span><br>Updated: ${serverTimestamp.toLocaleTimeString([], { hour12: false })}`)
+            .bindPopup(`<b>${loc.displayName || playerID}</b><br>Status: <span style="color: ${loc.status === 'OK' ? 'green' : 'red'}; font-weight: bold;">${loc.status}</span><br>Updated: ${serverTimestamp.toLocaleTimeString([], { hour12: false })}${loc.address ? `<br>Near: ${loc.address}` : ''}${loc.speedMps ? `<br>Moving: ${(loc.speedMps * 3.6).toFixed(1)} km/h, heading ${Math.round(loc.headingDeg)}°` : ''}${loc.suspicious ? '<br><span style="color: red; font-weight: bold;">Suspicious jump: possibly a spoofed GPS</span>' : ''}`)
             .on('click', (e) => handlePlayerSelection(playerID, e.originalEvent));
 
           // Store marker and add to the cluster group
@@ -551,7 +643,8 @@ document.addEventListener("DOMContentLoaded", () => {
         }
 
         // Construct the new legend string
-        const legendText = `${playerID} <small>(C ${lastPoll} L ${lastLocationOrStatus})</small>`;
+        const suspiciousMark = loc.suspicious ? ' <span style="color: red;" title="Implausible jump: possibly a spoofed GPS">⚠</span>' : '';
+        const legendText = `${loc.displayName || playerID}${suspiciousMark} <small>(C ${lastPoll} L ${lastLocationOrStatus})</small>`;
 
         const color = getColorForPlayer(playerID);
 
@@ -658,7 +751,7 @@ document.addEventListener("DOMContentLoaded", () => {
           <div class="message-header">
             From: <strong style="color: ${playerColor};">${msg.playerID}</strong> at ${sentTime}
           </div>
-          <div class="message-content">${msg.content}</div>
+          <div class="message-content">${escapeHTML(msg.content)}</div>
           ${readButtonHtml}
         `;
         messageFeedEl.appendChild(msgEl);
@@ -680,6 +773,82 @@ document.addEventListener("DOMContentLoaded", () => {
     }
   });
 
+  const alertsEl = document.getElementById('alerts');
+
+  async function fetchAndDrawAlerts() {
+    try {
+      const response = await fetch('/api/alerts');
+      if (!response.ok) {
+        throw new Error(`Network response was not ok: ${response.statusText}`);
+      }
+      const alerts = await response.json();
+      alertsEl.hidden = alerts.length === 0;
+      alertsEl.innerHTML = '';
+
+      alerts.forEach(emergency => {
+        const alertEl = document.createElement('div');
+        alertEl.className = 'alert-item';
+        const raisedTime = new Date(emergency.raised).toLocaleTimeString([], { hour12: false });
+        const location = emergency.locatedAt
+          ? `last seen at ${emergency.lat.toFixed(5)}, ${emergency.lng.toFixed(5)} (${formatTimeAgo(emergency.locatedAt)})`
+          : 'location unknown';
+
+        const textEl = document.createElement('span');
+        textEl.textContent = `EMERGENCY: ${emergency.playerID} needs help (raised at ${raisedTime}, ${location})`;
+        alertEl.appendChild(textEl);
+
+        if (emergency.locatedAt) {
+          const showBtn = document.createElement('button');
+          showBtn.textContent = 'Show on Map';
+          showBtn.addEventListener('click', () => map.setView([emergency.lat, emergency.lng], 17));
+          alertEl.appendChild(showBtn);
+        }
+
+        const resolveBtn = document.createElement('button');
+        resolveBtn.textContent = 'Resolve';
+        resolveBtn.addEventListener('click', async () => {
+          if (!confirm(`Mark the alert of ${emergency.playerID} as resolved?`)) {
+            return;
+          }
+          resolveBtn.disabled = true;
+          await fetch(`/api/alerts/${emergency.id}/resolve`, { method: 'POST' });
+          await fetchAndDrawAlerts();
+        });
+        alertEl.appendChild(resolveBtn);
+        alertsEl.appendChild(alertEl);
+      });
+    } catch (error) {
+      console.error("Failed to fetch alerts:", error);
+    }
+  }
+
+  // --- Arrival Popups ---
+  // The server pushes every arrival over a WebSocket the moment it happens.
+  const arrivalsEl = document.getElementById('arrivals');
+
+  function showArrival(arrival) {
+    const arrivalEl = document.createElement('div');
+    arrivalEl.className = 'arrival-item';
+    const time = new Date(arrival.arrivedAt).toLocaleTimeString([], { hour12: false });
+    arrivalEl.textContent = `🏁 ${arrival.playerID} reached target ${arrival.fakeHash} at ${time}`;
+    arrivalsEl.appendChild(arrivalEl);
+    // Popups disappear on their own after 10 seconds.
+    setTimeout(() => arrivalEl.remove(), 10000);
+  }
+
+  function connectArrivalStream() {
+    const protocol = location.protocol === 'https:' ? 'wss' : 'ws';
+    const socket = new WebSocket(`${protocol}://${location.host}/api/arrivals/stream`);
+    socket.addEventListener('message', event => showArrival(JSON.parse(event.data)));
+    // Reconnect after a short pause if the connection drops.
+    socket.addEventListener('close', () => setTimeout(connectArrivalStream, 5000));
+  }
+  connectArrivalStream();
+
+  // Fetch alerts immediately and then every 5 seconds
+  fetchAndDrawAlerts();
+  setInterval(fetchAndDrawAlerts, 5000); // 5 seconds
+
   // Fetch locations immediately and then every 5 seconds
   updateMapData();
   setInterval(updateMapData, 5000); // 5 seconds
@@ -20,20 +20,14 @@ document.addEventListener("DOMContentLoaded", () => {
       generateBtn.textContent = 'Generating...';
 
       try {
-        // Create an array of promises, one for each API call
-        const obfusPromises = playerNames.map(playerName =>
-          fetch('/api/obfuscate-url', {
-            method: 'POST',
-            headers: { 'Content-Type': 'application/json' },
-            body: JSON.stringify({ playerID: playerName }),
-          }).then(res => {
-            if (!res.ok) throw new Error(`Failed for player ${playerName}`);
-            return res.json();
-          })
-        );
-
-        // Wait for all API calls to complete
-        const obfusDataArray = await Promise.all(obfusPromises);
+        // Generate all URLs in a single round trip
+        const response = await fetch('/api/obfuscate-url/batch', {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ playerIDs: playerNames }),
+        });
+        if (!response.ok) throw new Error(await response.text());
+        const obfusDataArray = await response.json();
 
         // Map the results to the desired JSON structure
         const targetJson = obfusDataArray.map(data => ({
@@ -1,5 +1,11 @@
 document.addEventListener("DOMContentLoaded", () => {
     const map = L.map('map').setView([50.8503, 4.3517], 9);
+
+    // Organizers can re-center the map per event on the server.
+    fetch('/api/map-config')
+        .then(response => response.ok ? response.json() : Promise.reject(new Error(`Server error: ${response.status}`)))
+        .then(config => map.setView([config.lat, config.lng], config.zoom))
+        .catch(error => console.error('Failed to load map config:', error));
     
     const standardLayer = L.tileLayer('https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png', {
         maxZoom: 19,
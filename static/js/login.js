@@ -0,0 +1,37 @@
+document.addEventListener("DOMContentLoaded", () => {
+    const loginForm = document.getElementById('login-form');
+    const usernameInput = document.getElementById('username-input');
+    const passwordInput = document.getElementById('password-input');
+    const loginBtn = document.getElementById('login-btn');
+    const loginErrorEl = document.getElementById('login-error');
+
+    loginForm.addEventListener('submit', async (event) => {
+      event.preventDefault();
+      loginErrorEl.textContent = '';
+      loginBtn.disabled = true;
+      loginBtn.textContent = 'Logging in...';
+
+      try {
+        const response = await fetch('/api/leads/login', {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ username: usernameInput.value.trim(), password: passwordInput.value }),
+        });
+        if (!response.ok) throw new Error(await response.text());
+
+        // Go back to wherever the lead was sent from, defaulting to the dashboard.
+        // Only same-origin targets are allowed, so "//evil.example" can't redirect off-site.
+        const next = new URLSearchParams(window.location.search).get('next');
+        const target = next ? new URL(next, window.location.origin) : null;
+        window.location.href = target && target.origin === window.location.origin
+          ? target.pathname + target.search + target.hash
+          : '/gamelead';
+      } catch (error) {
+        console.error('Login failed:', error);
+        loginErrorEl.textContent = error.message;
+      } finally {
+        loginBtn.disabled = false;
+        loginBtn.textContent = 'Log In';
+      }
+    });
+  });
@@ -15,6 +15,17 @@ function getGeolocation() {
   });
 }
 
+/**
+ * Escapes text, such as chat messages, for use in innerHTML templates.
+ * @param {string} text The text to escape.
+ * @returns {string} The escaped HTML.
+ */
+function escapeHTML(text) {
+  const el = document.createElement('div');
+  el.textContent = text;
+  return el.innerHTML;
+}
+
 async function runPlayerPage() {
   const statusEl = document.getElementById("status");
   const messageInputEl = document.getElementById("message-input");
@@ -22,6 +33,8 @@ async function runPlayerPage() {
   const messageStatusEl = document.getElementById("message-status");
   const dmStatusEl = document.getElementById("dm-status");
   const targetStatusEl = document.getElementById("target-status");
+  const panicBtn = document.getElementById("panic-button");
+  const panicStatusEl = document.getElementById("panic-status");
 
   // Extract player ID from the URL path: /player/{id}
   const pathParts = window.location.pathname.split('/');
@@ -118,10 +131,11 @@ async function runPlayerPage() {
 
     } catch (error) {
       let status = "UNAVAILABLE";
-      if (error.code === error.PERMISSION_DENIED) status = "PERMISSION DENIED";
-      if (error.code === 0) status = "NOT SUPPORTED"; // Custom code from our helper
+      if (error.code === error.PERMISSION_DENIED) status = "DENIED";
+      // Custom code from our helper, the server only knows UNAVAILABLE for this.
+      const statusLabel = error.code === 0 ? "NOT SUPPORTED" : status;
 
-      const statusText = `Player ID: ${playerID}\nStatus: Location ${status}\nLast Connected: ${new Date().toLocaleTimeString([], { hour12: false })}`;
+      const statusText = `Player ID: ${playerID}\nStatus: Location ${statusLabel}\nLast Connected: ${new Date().toLocaleTimeString([], { hour12: false })}`;
       statusEl.textContent = statusText;
       console.error("Geolocation error:", error);
       postStatusUpdate({ status });
@@ -175,10 +189,16 @@ async function runPlayerPage() {
     const distanceStr = distance < 1 ? `${(distance * 1000).toFixed(0)} m` : `${distance.toFixed(2)} km`;
     const cardinal = getCardinalDirection(bearing);
 
-    targetStatusEl.textContent =
-      `Target Code: ${target.fakeHash}\nDistance: ${distanceStr}\nBearing: ${bearing.toFixed(0)}° (${cardinal})`;
+    let text = `Target Code: ${target.fakeHash}\nDistance: ${distanceStr}\nBearing: ${bearing.toFixed(0)}° (${cardinal})`;
+    if (target.expiresAt) {
+      text += `\nReach it before: ${new Date(target.expiresAt).toLocaleTimeString([], { hour12: false })}`;
+    }
+    targetStatusEl.textContent = text;
   }
 
+  // How long to wait between message checks, as advised by the server.
+  let messagePollSeconds = 15;
+
   // Function to check the status of the last sent message
   async function checkMessageStatus() {
     let data;
@@ -192,6 +212,10 @@ async function runPlayerPage() {
         throw new Error(`Server error: ${response.status}`);
       }
       data = await response.json();
+      // The server slows us down while the game is paused.
+      if (data.pollIntervalSeconds > 0) {
+        messagePollSeconds = data.pollIntervalSeconds;
+      }
     } catch (error) {
       console.error("Error fetching message status:", error);
       messageStatusEl.textContent = "Could not retrieve message status.";
@@ -201,7 +225,7 @@ async function runPlayerPage() {
     // Handle player's sent message status
     try {
       if (data.playerMessage) {
-        let statusText = `<strong>Last Message Sent:</strong> "${data.playerMessage.content}"<br>`;
+        let statusText = `<strong>Last Message Sent:</strong> "${escapeHTML(data.playerMessage.content)}"<br>`;
         if (data.playerMessage.isRead) {
           statusText += `<strong>Status:</strong> Read by game lead ✅`;
         } else {
@@ -219,11 +243,19 @@ async function runPlayerPage() {
     try {
       if (data.dm) {
         const dmTimestamp = new Date(data.dm.timestamp);
-        dmStatusEl.innerHTML = `<strong>${dmTimestamp.toLocaleTimeString([], { hour12: false })}:</strong> ${data.dm.content}`;
+        dmStatusEl.innerHTML = `<strong>${dmTimestamp.toLocaleTimeString([], { hour12: false })}:</strong> ${escapeHTML(data.dm.content)}`;
+
+        // Let the game lead know the message was seen
+        if (data.dm.id && !data.dm.readAt) {
+          fetch(`/api/dm/read/${playerID}/${data.dm.id}`, { method: 'POST' })
+            .catch(err => console.error("Error sending read receipt:", err));
+        }
         
         // If this is a new message, show a notification
         if (dmTimestamp.toISOString() !== lastNotifiedDmTimestamp) {
-          showNotification("New Message from Game Lead", { body: data.dm.content });
+          if (!data.prefs || data.prefs.dmAlerts) {
+            showNotification("New Message from Game Lead", { body: data.dm.content });
+          }
           lastNotifiedDmTimestamp = dmTimestamp.toISOString();
           
           // Only blink if the message is recent (less than 1 minute old)
@@ -240,14 +272,20 @@ async function runPlayerPage() {
       console.error("Error handling DM update:", e);
     }
 
-    // Handle target location
+    // Handle target location. Targets are hidden while the game is paused.
     try {
+      if (data.paused) {
+        targetStatusEl.textContent = "The game is paused.\nHold on, the game leads will resume it shortly.";
+        return;
+      }
       updateTargetDisplay(data.target);
       if (data.target) {
         const targetTimestamp = new Date(data.target.timestamp);
         // If this is a new or updated target, show a notification
         if (targetTimestamp.toISOString() !== lastNotifiedTargetTimestamp) {
-          showNotification("New Target Assigned!", { body: `Target Code: ${data.target.fakeHash}` });
+          if (!data.prefs || data.prefs.targetAlerts) {
+            showNotification("New Target Assigned!", { body: `Target Code: ${data.target.fakeHash}` });
+          }
           lastNotifiedTargetTimestamp = targetTimestamp.toISOString();
 
           // Only blink if the target is recent (less than 1 minute old)
@@ -299,7 +337,42 @@ async function runPlayerPage() {
     }
   });
 
+  // Raise an emergency alert, after a confirmation so it isn't sent by accident
+  panicBtn.addEventListener("click", async () => {
+    if (!confirm("Alert the game leads that you need help?")) {
+      return;
+    }
+
+    panicBtn.disabled = true;
+    panicStatusEl.textContent = "Sending alert...";
+    try {
+      // Don't wait for a new position fix: the alert carries the last reported location.
+      const response = await fetch(`/api/panic/${playerID}`, { method: 'POST' });
+      if (!response.ok) {
+        throw new Error(`Server error: ${response.status}`);
+      }
+      panicStatusEl.textContent = `Alert sent at ${new Date().toLocaleTimeString([], { hour12: false })}. The game leads have been notified and will contact you.`;
+    } catch (error) {
+      console.error("Error raising alert:", error);
+      panicStatusEl.textContent = "Error: Could not send the alert. Try again, or call a game lead directly.";
+    } finally {
+      // Re-enable after a while, so a second alert can be sent if needed
+      setTimeout(() => { panicBtn.disabled = false; }, 30000);
+    }
+  });
+
   // --- INITIALIZATION ---
+  // Organizers can switch features off per event; hide those so the player can't use them.
+  fetch('/api/features')
+    .then(response => response.ok ? response.json() : Promise.reject(new Error(`Server error: ${response.status}`)))
+    .then(features => {
+      for (const [feature, enabled] of Object.entries(features)) {
+        const section = document.getElementById(`${feature}-section`);
+        if (section) section.hidden = !enabled;
+      }
+    })
+    .catch(error => console.error('Failed to load features:', error));
+
   // First, ask for permission and wait for the user's response.
   await requestNotificationPermission();
 
@@ -307,8 +380,12 @@ async function runPlayerPage() {
   updateLocation();
   setInterval(updateLocation, 10000); // 10 seconds
 
-  checkMessageStatus();
-  setInterval(checkMessageStatus, 15000); // Check every 15 seconds
+  // Poll as often as the server advises, 15 seconds until it says otherwise.
+  const pollMessages = async () => {
+    await checkMessageStatus();
+    setTimeout(pollMessages, messagePollSeconds * 1000);
+  };
+  pollMessages();
 
   // Also, add a keypress listener for the message input for convenience
   messageInputEl.addEventListener('keypress', (e) => { if (e.key === 'Enter' && !e.shiftKey) { e.preventDefault(); sendMessageBtn.click(); } });